@@ -11,16 +11,26 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/wmik/picolm-server/pkg/auth"
 	"github.com/wmik/picolm-server/pkg/config"
 	"github.com/wmik/picolm-server/pkg/handlers"
+	"github.com/wmik/picolm-server/pkg/metrics"
 	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/ratelimit"
 	"github.com/wmik/picolm-server/pkg/server"
+	"github.com/wmik/picolm-server/pkg/store"
 )
 
 func main() {
 	configPath := flag.String("config", "config.yaml", "path to config file")
+	hashKey := flag.String("hash-key", "", "print the hash of an API key for the keys section of the config and exit")
 	flag.Parse()
 
+	if *hashKey != "" {
+		fmt.Println(auth.Hash(*hashKey))
+		return
+	}
+
 	cfg, err := config.Load(*configPath)
 	if err != nil {
 		log.Fatalf("failed to load config: %v", err)
@@ -34,14 +44,75 @@ func main() {
 	}
 	log.Printf("PicoLM configuration valid")
 
-	h := handlers.NewHandler(client, cfg.Server.APIKey)
+	st, err := store.Open(cfg.Server.DataDir)
+	if err != nil {
+		log.Fatalf("failed to open data directory: %v", err)
+	}
+
+	keys, err := auth.NewKeyring(cfg.Server.APIKey, cfg.Server.Keys)
+	if err != nil {
+		log.Fatalf("invalid api keys: %v", err)
+	}
+
+	h := handlers.NewHandler(client, cfg.Server.APIKey,
+		handlers.WithKeyring(keys),
+		handlers.WithLimiter(ratelimit.New(st, cfg.Server.UserLimits)),
+		handlers.WithStore(st),
+		handlers.WithBatchWorkers(cfg.PicoLM.BatchWorkers),
+		handlers.WithJobWorkers(cfg.PicoLM.JobWorkers),
+		handlers.WithWebhook(cfg.Server.WebhookURL, cfg.Server.WebhookSecret),
+	)
+
+	background, stopBackground := context.WithCancel(context.Background())
+	h.Start(background)
 
 	mux := http.NewServeMux()
 
-	mux.HandleFunc("/v1/chat/completions", h.HandleChatCompletions)
-	mux.HandleFunc("/v1/models", h.HandleModels)
-	mux.HandleFunc("/v1/models/", h.HandleModelInfo)
-	mux.HandleFunc("/health", h.HandleHealth)
+	route := func(pattern, name string, handler http.HandlerFunc) {
+		mux.Handle(pattern, metrics.Instrument(name, handler))
+	}
+
+	route("/v1/chat/completions", "/v1/chat/completions", h.HandleChatCompletions)
+	route("/v1/chat/completions/", "/v1/chat/completions/{completion_id}", h.HandleChatCompletion)
+	route("/v1/completions", "/v1/completions", h.HandleCompletions)
+	route("/v1/messages", "/v1/messages", h.HandleMessages)
+	route("/v1/responses", "/v1/responses", h.HandleResponses)
+	route("/v1/responses/", "/v1/responses/{response_id}", h.HandleResponse)
+	route("/v1/files", "/v1/files", h.HandleFiles)
+	route("/v1/files/", "/v1/files/{file_id}", h.HandleFile)
+	route("/v1/batches", "/v1/batches", h.HandleBatches)
+	route("/v1/batches/", "/v1/batches/{batch_id}", h.HandleBatch)
+	route("/v1/jobs/", "/v1/jobs/{job_id}", h.HandleJob)
+	route("/v1/models", "/v1/models", h.HandleModels)
+	route("/v1/models/", "/v1/models/{model_id}", h.HandleModelInfo)
+	route("/health", "/health", h.HandleHealth)
+	route("/api/chat", "/api/chat", h.HandleOllamaChat)
+	route("/api/generate", "/api/generate", h.HandleOllamaGenerate)
+	route("/api/tags", "/api/tags", h.HandleOllamaTags)
+	route("/api/show", "/api/show", h.HandleOllamaShow)
+	route("/api/version", "/api/version", h.HandleOllamaVersion)
+
+	metrics.Default.NewGaugeFunc("picolm_inference_active", "picolm processes currently running.", func() float64 {
+		active, _ := client.Stats()
+		return float64(active)
+	})
+	metrics.Default.NewGaugeFunc("picolm_queue_depth", "Requests waiting for a picolm worker.", func() float64 {
+		_, queued := client.Stats()
+		return float64(queued)
+	})
+
+	var metricsServer *http.Server
+	if cfg.Server.MetricsAddress == "" {
+		mux.Handle("/metrics", h.RequireAdmin(metrics.Handler()))
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", metrics.Handler())
+		metricsServer = &http.Server{
+			Addr:              cfg.Server.MetricsAddress,
+			Handler:           metricsMux,
+			ReadHeaderTimeout: 5 * time.Second,
+		}
+	}
 
 	var srv http.Handler = mux
 
@@ -58,6 +129,9 @@ func main() {
 	log.Printf("  GET  /v1/models")
 	log.Printf("  GET  /v1/models/{model_id}")
 	log.Printf("  GET  /health")
+	if metricsServer == nil {
+		log.Printf("  GET  /metrics")
+	}
 
 	httpServer := &http.Server{
 		Addr:              addr,
@@ -71,11 +145,24 @@ func main() {
 		}
 	}()
 
+	if metricsServer != nil {
+		log.Printf("Serving metrics on %s/metrics", metricsServer.Addr)
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatalf("metrics server error: %v", err)
+			}
+		}()
+	}
+
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Printf("Shutting down...")
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	httpServer.Shutdown(ctx)
+	if metricsServer != nil {
+		metricsServer.Shutdown(ctx)
+	}
 }
@@ -0,0 +1,173 @@
+// Package auth identifies API keys and what they may use.
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+)
+
+var (
+	// ErrInvalidKey is returned for a key that is not configured.
+	ErrInvalidKey = errors.New("invalid api key")
+	// ErrExpiredKey is returned for a key past its expiry.
+	ErrExpiredKey = errors.New("api key has expired")
+)
+
+// DefaultKeyName names the key set by server.api_key.
+const DefaultKeyName = "default"
+
+// Key is an API key a request was authenticated with.
+type Key struct {
+	Name      string
+	Models    []string
+	Endpoints []string
+	ExpiresAt time.Time
+	Limits    config.Limits
+
+	hash [sha256.Size]byte
+}
+
+// AllowsEndpoint reports whether the key may use an endpoint group. A nil
+// key, for a server without authentication, may use everything.
+func (k *Key) AllowsEndpoint(endpoint string) bool {
+	return k == nil || len(k.Endpoints) == 0 || slices.Contains(k.Endpoints, endpoint)
+}
+
+// AllowsModel reports whether the key may use a model.
+func (k *Key) AllowsModel(model string) bool {
+	return k == nil || len(k.Models) == 0 || slices.Contains(k.Models, model)
+}
+
+// Keyring holds the configured API keys.
+type Keyring struct {
+	keys []*Key
+}
+
+// NewKeyring returns the keys of a server config. apiKey, when set, is a
+// plain text key named DefaultKeyName that may use everything.
+func NewKeyring(apiKey string, keys []config.APIKeyConfig) (*Keyring, error) {
+	kr := &Keyring{}
+	if apiKey != "" {
+		kr.keys = append(kr.keys, &Key{Name: DefaultKeyName, hash: sha256.Sum256([]byte(apiKey))})
+	}
+	for _, kc := range keys {
+		if slices.ContainsFunc(kr.keys, func(k *Key) bool { return k.Name == kc.Name }) {
+			return nil, fmt.Errorf("key name %q is used more than once", kc.Name)
+		}
+		digest, err := hex.DecodeString(strings.TrimPrefix(kc.Hash, config.KeyHashPrefix))
+		if err != nil || !strings.HasPrefix(kc.Hash, config.KeyHashPrefix) || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid hash for key %q", kc.Name)
+		}
+		key := &Key{
+			Name:      kc.Name,
+			Models:    kc.Models,
+			Endpoints: kc.Endpoints,
+			ExpiresAt: kc.ExpiresAt,
+			Limits:    kc.Limits,
+		}
+		copy(key.hash[:], digest)
+		kr.keys = append(kr.keys, key)
+	}
+	return kr, nil
+}
+
+// Enabled reports whether requests must present a key.
+func (kr *Keyring) Enabled() bool {
+	return kr != nil && len(kr.keys) > 0
+}
+
+// Authenticate returns the key matching token. Every key is compared, so
+// the time taken does not depend on which one matched.
+func (kr *Keyring) Authenticate(token string, now time.Time) (*Key, error) {
+	sum := sha256.Sum256([]byte(token))
+	var found *Key
+	for _, key := range kr.keys {
+		if subtle.ConstantTimeCompare(sum[:], key.hash[:]) == 1 {
+			found = key
+		}
+	}
+	switch {
+	case found == nil:
+		return nil, ErrInvalidKey
+	case found.expired(now):
+		return nil, ErrExpiredKey
+	}
+	return found, nil
+}
+
+// Lookup returns the key with the given name, for work that outlives the
+// request that started it, such as batches and jobs. A key that has since
+// been removed from the config is ErrInvalidKey and one that has expired is
+// ErrExpiredKey. Without keys, the empty name stands for unauthenticated
+// requests and a nil key is returned for it.
+func (kr *Keyring) Lookup(name string, now time.Time) (*Key, error) {
+	if !kr.Enabled() {
+		if name == "" {
+			return nil, nil
+		}
+		return nil, ErrInvalidKey
+	}
+	for _, key := range kr.keys {
+		if key.Name != name {
+			continue
+		}
+		if key.expired(now) {
+			return nil, ErrExpiredKey
+		}
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+func (k *Key) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// Hash returns the form a key is stored in the config.
+func Hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return config.KeyHashPrefix + hex.EncodeToString(sum[:])
+}
+
+type contextKey struct{}
+
+// slot holds the key of a request. Middleware that runs before
+// authentication installs an empty one with Track to read the key after
+// the handler returns.
+type slot struct {
+	key *Key
+}
+
+// Track returns ctx with room for the key the request is authenticated
+// with further down the handler chain.
+func Track(ctx context.Context) context.Context {
+	return context.WithValue(ctx, contextKey{}, &slot{})
+}
+
+// WithKey returns ctx carrying key, also filling the slot installed by
+// Track, if any.
+func WithKey(ctx context.Context, key *Key) context.Context {
+	if s, ok := ctx.Value(contextKey{}).(*slot); ok {
+		s.key = key
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, &slot{key: key})
+}
+
+// FromContext returns the key of a request, or nil when it was not
+// authenticated.
+func FromContext(ctx context.Context) *Key {
+	if s, ok := ctx.Value(contextKey{}).(*slot); ok {
+		return s.key
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+)
+
+func TestKeyring_Authenticate(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	kr, err := NewKeyring("plain-key", []config.APIKeyConfig{
+		{Name: "team-a", Hash: Hash("sk-team-a"), Models: []string{"tinyllama"}, Endpoints: []string{config.EndpointChat}},
+		{Name: "old", Hash: Hash("sk-old"), ExpiresAt: now.Add(-time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	if !kr.Enabled() {
+		t.Fatal("keyring with keys should be enabled")
+	}
+
+	tests := []struct {
+		token    string
+		wantName string
+		wantErr  error
+	}{
+		{token: "plain-key", wantName: DefaultKeyName},
+		{token: "sk-team-a", wantName: "team-a"},
+		{token: "sk-old", wantErr: ErrExpiredKey},
+		{token: "sk-unknown", wantErr: ErrInvalidKey},
+		{token: Hash("sk-team-a"), wantErr: ErrInvalidKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			key, err := kr.Authenticate(tt.token, now)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && key.Name != tt.wantName {
+				t.Errorf("Authenticate() key = %q, want %q", key.Name, tt.wantName)
+			}
+		})
+	}
+}
+
+func TestKeyring_Lookup(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	kr, err := NewKeyring("", []config.APIKeyConfig{
+		{Name: "team-a", Hash: Hash("sk-team-a")},
+		{Name: "old", Hash: Hash("sk-old"), ExpiresAt: now.Add(time.Hour)},
+	})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+
+	if key, err := kr.Lookup("team-a", now); err != nil || key.Name != "team-a" {
+		t.Errorf("Lookup(team-a) = %v, %v", key, err)
+	}
+	if _, err := kr.Lookup("old", now); err != nil {
+		t.Errorf("Lookup(old) before expiry error = %v", err)
+	}
+	if _, err := kr.Lookup("old", now.Add(time.Hour)); !errors.Is(err, ErrExpiredKey) {
+		t.Errorf("Lookup(old) after expiry error = %v, want %v", err, ErrExpiredKey)
+	}
+	for _, name := range []string{"removed", ""} {
+		if _, err := kr.Lookup(name, now); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Lookup(%q) error = %v, want %v", name, err, ErrInvalidKey)
+		}
+	}
+}
+
+func TestKeyring_Disabled(t *testing.T) {
+	kr, err := NewKeyring("", nil)
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	if kr.Enabled() {
+		t.Error("keyring without keys should be disabled")
+	}
+	if key, err := kr.Lookup("", time.Now()); key != nil || err != nil {
+		t.Errorf("Lookup(\"\") = %v, %v, want no key", key, err)
+	}
+	if _, err := kr.Lookup("team-a", time.Now()); !errors.Is(err, ErrInvalidKey) {
+		t.Errorf("Lookup(team-a) error = %v, want %v", err, ErrInvalidKey)
+	}
+}
+
+func TestNewKeyring_Invalid(t *testing.T) {
+	if _, err := NewKeyring("", []config.APIKeyConfig{{Name: "a", Hash: "sk-plain"}}); err == nil {
+		t.Error("expected an error for a plain text key")
+	}
+	if _, err := NewKeyring("plain", []config.APIKeyConfig{{Name: DefaultKeyName, Hash: Hash("x")}}); err == nil {
+		t.Error("expected an error for a key named like server.api_key")
+	}
+}
+
+func TestKey_Allows(t *testing.T) {
+	key := &Key{Name: "a", Models: []string{"tinyllama"}, Endpoints: []string{config.EndpointChat}}
+	if !key.AllowsModel("tinyllama") || key.AllowsModel("phi") {
+		t.Error("AllowsModel should only allow listed models")
+	}
+	if !key.AllowsEndpoint(config.EndpointChat) || key.AllowsEndpoint(config.EndpointAdmin) {
+		t.Error("AllowsEndpoint should only allow listed endpoints")
+	}
+
+	unrestricted := &Key{Name: "b"}
+	if !unrestricted.AllowsModel("phi") || !unrestricted.AllowsEndpoint(config.EndpointAdmin) {
+		t.Error("a key without lists should allow everything")
+	}
+
+	var none *Key
+	if !none.AllowsModel("phi") || !none.AllowsEndpoint(config.EndpointAdmin) {
+		t.Error("a nil key should allow everything")
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != nil {
+		t.Error("expected no key in an empty context")
+	}
+
+	key := &Key{Name: "a"}
+	if got := FromContext(WithKey(context.Background(), key)); got != key {
+		t.Errorf("FromContext() = %v, want %v", got, key)
+	}
+
+	// A key set below a tracked context is visible from it.
+	tracked := Track(context.Background())
+	WithKey(context.WithValue(tracked, struct{}{}, 1), key)
+	if got := FromContext(tracked); got != key {
+		t.Errorf("FromContext(tracked) = %v, want %v", got, key)
+	}
+}
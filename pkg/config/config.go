@@ -1,9 +1,12 @@
 package config
 
 import (
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -15,9 +18,63 @@ type Config struct {
 }
 
 type ServerConfig struct {
-	Host   string `yaml:"host"`
-	Port   int    `yaml:"port"`
-	APIKey string `yaml:"api_key"`
+	Host           string `yaml:"host"`
+	Port           int    `yaml:"port"`
+	APIKey         string `yaml:"api_key"`
+	MetricsAddress string `yaml:"metrics_address"`
+	DataDir        string `yaml:"data_dir"`
+	WebhookURL     string `yaml:"webhook_url"`
+	WebhookSecret  string `yaml:"webhook_secret"`
+
+	Keys []APIKeyConfig `yaml:"keys"`
+	// UserLimits apply to each value of the user field of requests, per key.
+	UserLimits Limits `yaml:"user_limits"`
+}
+
+// Limits are the rate limits and token quotas of an API key or user. Zero
+// leaves a limit unset.
+type Limits struct {
+	RequestsPerMinute int `yaml:"requests_per_minute"`
+	TokensPerMinute   int `yaml:"tokens_per_minute"`
+	DailyTokens       int `yaml:"daily_tokens"`
+	MonthlyTokens     int `yaml:"monthly_tokens"`
+}
+
+func (l Limits) validate() error {
+	if l.RequestsPerMinute < 0 || l.TokensPerMinute < 0 || l.DailyTokens < 0 || l.MonthlyTokens < 0 {
+		return fmt.Errorf("requests_per_minute, tokens_per_minute, daily_tokens and monthly_tokens must not be negative")
+	}
+	return nil
+}
+
+// APIKeyConfig is one API key. Only the SHA-256 hash of the key is kept in
+// the config, as "sha256:" followed by the hex digest. Empty Models or
+// Endpoints allow every model or endpoint.
+type APIKeyConfig struct {
+	Name      string    `yaml:"name"`
+	Hash      string    `yaml:"hash"`
+	Models    []string  `yaml:"models"`
+	Endpoints []string  `yaml:"endpoints"`
+	ExpiresAt time.Time `yaml:"expires_at"`
+	Limits    `yaml:",inline"`
+}
+
+// Endpoint groups an API key can be allowed to use.
+const (
+	EndpointChat   = "chat"
+	EndpointModels = "models"
+	EndpointAdmin  = "admin"
+)
+
+// KeyHashPrefix starts every hashed API key.
+const KeyHashPrefix = "sha256:"
+
+func ValidEndpoint(endpoint string) bool {
+	switch endpoint {
+	case EndpointChat, EndpointModels, EndpointAdmin:
+		return true
+	}
+	return false
 }
 
 type LoggingConfig struct {
@@ -38,6 +95,53 @@ type PicoLMConfig struct {
 	TopP           float64           `yaml:"top_p"`
 	ContextLength  int               `yaml:"context_length"`
 	CacheDir       string            `yaml:"cache_dir"`
+	Workers        int               `yaml:"workers"`
+	QueueSize      *int              `yaml:"queue_size"`
+	MaxChoices     int               `yaml:"max_choices"`
+	BatchWorkers   int               `yaml:"batch_workers"`
+	JobWorkers     int               `yaml:"job_workers"`
+
+	StreamFlushMs    int `yaml:"stream_flush_ms"`
+	StreamFlushBytes int `yaml:"stream_flush_bytes"`
+
+	ToolCallRetries       int  `yaml:"tool_call_retries"`
+	ResponseFormatRetries *int `yaml:"response_format_retries"`
+
+	ModelOptions map[string]ModelOptions `yaml:"model_options"`
+}
+
+type ModelOptions struct {
+	Slots            int    `yaml:"slots"`
+	Template         string `yaml:"template"`
+	ContextLength    int    `yaml:"context_length"`
+	Truncation       string `yaml:"truncation"`
+	ReserveMaxTokens bool   `yaml:"reserve_max_tokens"`
+}
+
+// Truncation strategies applied when a prompt does not fit the context window.
+const (
+	TruncationError      = "error"
+	TruncationDropOldest = "drop_oldest"
+	TruncationMiddleOut  = "middle_out"
+)
+
+func ValidTruncation(strategy string) bool {
+	switch strategy {
+	case "", TruncationError, TruncationDropOldest, TruncationMiddleOut:
+		return true
+	}
+	return false
+}
+
+// Defaults for settings where an explicit 0 is meaningful, so they are
+// pointers and only defaulted when left out of the config.
+const (
+	defaultQueueSize             = 16
+	defaultResponseFormatRetries = 2
+)
+
+func intPtr(v int) *int {
+	return &v
 }
 
 func (p *PicoLMConfig) SetDefaults() {
@@ -56,9 +160,45 @@ func (p *PicoLMConfig) SetDefaults() {
 	if p.TopP == 0 {
 		p.TopP = 0.9
 	}
-	if p.ContextLength == 0 {
-		p.ContextLength = 2048
+	if p.Workers == 0 {
+		p.Workers = 1
+	}
+	if p.QueueSize == nil {
+		p.QueueSize = intPtr(defaultQueueSize)
+	}
+	if p.MaxChoices == 0 {
+		p.MaxChoices = 4
 	}
+	if p.BatchWorkers == 0 {
+		p.BatchWorkers = 1
+	}
+	if p.JobWorkers == 0 {
+		p.JobWorkers = 1
+	}
+	if p.ResponseFormatRetries == nil {
+		p.ResponseFormatRetries = intPtr(defaultResponseFormatRetries)
+	}
+	if p.ModelOptions == nil {
+		p.ModelOptions = make(map[string]ModelOptions)
+	}
+}
+
+// GetQueueSize returns how many requests may wait for a worker. 0 rejects a
+// request as soon as every worker is busy.
+func (p *PicoLMConfig) GetQueueSize() int {
+	if p.QueueSize == nil {
+		return defaultQueueSize
+	}
+	return *p.QueueSize
+}
+
+// GetResponseFormatRetries returns how many times output that does not match
+// response_format is re-prompted. 0 fails on the first mismatch.
+func (p *PicoLMConfig) GetResponseFormatRetries() int {
+	if p.ResponseFormatRetries == nil {
+		return defaultResponseFormatRetries
+	}
+	return *p.ResponseFormatRetries
 }
 
 func (p *PicoLMConfig) GetModelPath(modelName string) (string, error) {
@@ -79,6 +219,10 @@ func (p *PicoLMConfig) GetDefaultModel() (string, error) {
 	return "", fmt.Errorf("no models configured")
 }
 
+func (p *PicoLMConfig) GetModelOptions(modelName string) ModelOptions {
+	return p.ModelOptions[modelName]
+}
+
 func (p *PicoLMConfig) GetModelInfo(modelName string) (string, int64, error) {
 	path, ok := p.Models[modelName]
 	if !ok {
@@ -106,9 +250,50 @@ func (p *PicoLMConfig) Validate() error {
 	if p.Threads <= 0 {
 		return fmt.Errorf("threads must be positive, got %d", p.Threads)
 	}
+	if p.ContextLength < 0 {
+		return fmt.Errorf("context_length must not be negative, got %d", p.ContextLength)
+	}
 	if len(p.Models) == 0 {
 		return fmt.Errorf("at least one model must be configured")
 	}
+	if p.Workers < 0 {
+		return fmt.Errorf("workers must not be negative, got %d", p.Workers)
+	}
+	if p.GetQueueSize() < 0 {
+		return fmt.Errorf("queue_size must not be negative, got %d", p.GetQueueSize())
+	}
+	if p.MaxChoices < 0 {
+		return fmt.Errorf("max_choices must not be negative, got %d", p.MaxChoices)
+	}
+	if p.BatchWorkers < 0 {
+		return fmt.Errorf("batch_workers must not be negative, got %d", p.BatchWorkers)
+	}
+	if p.JobWorkers < 0 {
+		return fmt.Errorf("job_workers must not be negative, got %d", p.JobWorkers)
+	}
+	if p.StreamFlushMs < 0 || p.StreamFlushBytes < 0 {
+		return fmt.Errorf("stream_flush_ms and stream_flush_bytes must not be negative")
+	}
+	if p.ToolCallRetries < 0 {
+		return fmt.Errorf("tool_call_retries must not be negative, got %d", p.ToolCallRetries)
+	}
+	if p.GetResponseFormatRetries() < 0 {
+		return fmt.Errorf("response_format_retries must not be negative, got %d", p.GetResponseFormatRetries())
+	}
+	for name, opts := range p.ModelOptions {
+		if _, ok := p.Models[name]; !ok {
+			return fmt.Errorf("model_options references unknown model %q", name)
+		}
+		if opts.Slots < 0 {
+			return fmt.Errorf("slots for model %q must not be negative, got %d", name, opts.Slots)
+		}
+		if opts.ContextLength < 0 {
+			return fmt.Errorf("context_length for model %q must not be negative, got %d", name, opts.ContextLength)
+		}
+		if !ValidTruncation(opts.Truncation) {
+			return fmt.Errorf("truncation for model %q must be one of %s, %s or %s, got %q", name, TruncationError, TruncationDropOldest, TruncationMiddleOut, opts.Truncation)
+		}
+	}
 	return nil
 }
 
@@ -119,6 +304,45 @@ func (s *ServerConfig) SetDefaults() {
 	if s.Port == 0 {
 		s.Port = 8080
 	}
+	if s.DataDir == "" {
+		s.DataDir = "data"
+	}
+}
+
+// Validate checks the API keys against the configured models.
+func (s *ServerConfig) Validate(models map[string]string) error {
+	if err := s.UserLimits.validate(); err != nil {
+		return fmt.Errorf("user_limits: %w", err)
+	}
+	names := make(map[string]bool)
+	for i, key := range s.Keys {
+		if key.Name == "" {
+			return fmt.Errorf("keys[%d] must have a name", i)
+		}
+		if names[key.Name] {
+			return fmt.Errorf("key name %q is used more than once", key.Name)
+		}
+		names[key.Name] = true
+
+		digest, ok := strings.CutPrefix(key.Hash, KeyHashPrefix)
+		if b, err := hex.DecodeString(digest); !ok || err != nil || len(b) != 32 {
+			return fmt.Errorf("hash for key %q must be %q followed by a hex SHA-256 digest", key.Name, KeyHashPrefix)
+		}
+		for _, model := range key.Models {
+			if _, ok := models[model]; !ok {
+				return fmt.Errorf("key %q allows unknown model %q", key.Name, model)
+			}
+		}
+		for _, endpoint := range key.Endpoints {
+			if !ValidEndpoint(endpoint) {
+				return fmt.Errorf("endpoints for key %q must be %s, %s or %s, got %q", key.Name, EndpointChat, EndpointModels, EndpointAdmin, endpoint)
+			}
+		}
+		if err := key.Limits.validate(); err != nil {
+			return fmt.Errorf("limits for key %q: %w", key.Name, err)
+		}
+	}
+	return nil
 }
 
 func (l *LoggingConfig) SetDefaults() {
@@ -159,12 +383,16 @@ func Load(path string) (*Config, error) {
 	if err := cfg.PicoLM.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid picolm config: %w", err)
 	}
+	if err := cfg.Server.Validate(cfg.PicoLM.Models); err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
 
 	cfg.PicoLM.Binary = expandHome(cfg.PicoLM.Binary)
 	for name, path := range cfg.PicoLM.Models {
 		cfg.PicoLM.Models[name] = expandHome(path)
 	}
 	cfg.PicoLM.CacheDir = expandHome(cfg.PicoLM.CacheDir)
+	cfg.Server.DataDir = expandHome(cfg.Server.DataDir)
 
 	return &cfg, nil
 }
@@ -187,4 +415,7 @@ func (c *Config) applyEnvOverrides() {
 	if v := os.Getenv("PICOLM_SERVER_API_KEY"); v != "" {
 		c.Server.APIKey = v
 	}
+	if v := os.Getenv("PICOLM_SERVER_WEBHOOK_SECRET"); v != "" {
+		c.Server.WebhookSecret = v
+	}
 }
@@ -3,7 +3,9 @@ package config
 import (
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestPicoLMConfig_SetDefaults(t *testing.T) {
@@ -23,8 +25,26 @@ func TestPicoLMConfig_SetDefaults(t *testing.T) {
 	if cfg.TopP != 0.9 {
 		t.Errorf("TopP = %f, want 0.9", cfg.TopP)
 	}
-	if cfg.ContextLength != 2048 {
-		t.Errorf("ContextLength = %d, want 2048", cfg.ContextLength)
+	if cfg.ContextLength != 0 {
+		t.Errorf("ContextLength = %d, want 0 (use the model's native context length)", cfg.ContextLength)
+	}
+	if cfg.Workers != 1 {
+		t.Errorf("Workers = %d, want 1", cfg.Workers)
+	}
+	if cfg.GetQueueSize() != 16 {
+		t.Errorf("QueueSize = %d, want 16", cfg.GetQueueSize())
+	}
+	if cfg.MaxChoices != 4 {
+		t.Errorf("MaxChoices = %d, want 4", cfg.MaxChoices)
+	}
+	if cfg.BatchWorkers != 1 {
+		t.Errorf("BatchWorkers = %d, want 1", cfg.BatchWorkers)
+	}
+	if cfg.JobWorkers != 1 {
+		t.Errorf("JobWorkers = %d, want 1", cfg.JobWorkers)
+	}
+	if cfg.GetResponseFormatRetries() != 2 {
+		t.Errorf("ResponseFormatRetries = %d, want 2", cfg.GetResponseFormatRetries())
 	}
 	if cfg.Models == nil {
 		t.Error("Models should not be nil after SetDefaults")
@@ -155,6 +175,92 @@ func TestPicoLMConfig_Validate(t *testing.T) {
 			},
 			wantErr: "top_p must be between 0 and 1",
 		},
+		{
+			name: "model options for unknown model",
+			cfg: PicoLMConfig{
+				MaxTokens:     256,
+				Threads:       4,
+				Temperature:   0.7,
+				TopP:          0.9,
+				ContextLength: 2048,
+				Models:        map[string]string{"test": "/path/model.gguf"},
+				ModelOptions:  map[string]ModelOptions{"other": {Slots: 1}},
+			},
+			wantErr: "model_options references unknown model",
+		},
+		{
+			name: "invalid truncation strategy",
+			cfg: PicoLMConfig{
+				MaxTokens:     256,
+				Threads:       4,
+				Temperature:   0.7,
+				TopP:          0.9,
+				ContextLength: 2048,
+				Models:        map[string]string{"test": "/path/model.gguf"},
+				ModelOptions:  map[string]ModelOptions{"test": {Truncation: "newest_first"}},
+			},
+			wantErr: "truncation for model",
+		},
+		{
+			name: "negative tool call retries",
+			cfg: PicoLMConfig{
+				MaxTokens:       256,
+				Threads:         4,
+				Temperature:     0.7,
+				TopP:            0.9,
+				ToolCallRetries: -1,
+				Models:          map[string]string{"test": "/path/model.gguf"},
+			},
+			wantErr: "tool_call_retries must not be negative",
+		},
+		{
+			name: "negative response format retries",
+			cfg: PicoLMConfig{
+				MaxTokens:             256,
+				Threads:               4,
+				Temperature:           0.7,
+				TopP:                  0.9,
+				ResponseFormatRetries: intPtr(-1),
+				Models:                map[string]string{"test": "/path/model.gguf"},
+			},
+			wantErr: "response_format_retries must not be negative",
+		},
+		{
+			name: "negative max choices",
+			cfg: PicoLMConfig{
+				MaxTokens:   256,
+				Threads:     4,
+				Temperature: 0.7,
+				TopP:        0.9,
+				MaxChoices:  -1,
+				Models:      map[string]string{"test": "/path/model.gguf"},
+			},
+			wantErr: "max_choices must not be negative",
+		},
+		{
+			name: "negative batch workers",
+			cfg: PicoLMConfig{
+				MaxTokens:    256,
+				Threads:      4,
+				Temperature:  0.7,
+				TopP:         0.9,
+				BatchWorkers: -1,
+				Models:       map[string]string{"test": "/path/model.gguf"},
+			},
+			wantErr: "batch_workers must not be negative",
+		},
+		{
+			name: "negative job workers",
+			cfg: PicoLMConfig{
+				MaxTokens:   256,
+				Threads:     4,
+				Temperature: 0.7,
+				TopP:        0.9,
+				JobWorkers:  -1,
+				Models:      map[string]string{"test": "/path/model.gguf"},
+			},
+			wantErr: "job_workers must not be negative",
+		},
 		{
 			name: "no models",
 			cfg: PicoLMConfig{
@@ -198,6 +304,9 @@ func TestServerConfig_SetDefaults(t *testing.T) {
 	if cfg.Port != 8080 {
 		t.Errorf("Port = %d, want 8080", cfg.Port)
 	}
+	if cfg.DataDir != "data" {
+		t.Errorf("DataDir = %q, want 'data'", cfg.DataDir)
+	}
 }
 
 func TestLoggingConfig_SetDefaults(t *testing.T) {
@@ -364,3 +473,143 @@ logging:
 		t.Errorf("Logging.FilePath = %q, want '/tmp/test.log'", cfg.Logging.FilePath)
 	}
 }
+
+func TestLoad_ExplicitZero(t *testing.T) {
+	content := `
+picolm:
+  models:
+    test: "/tmp/model.gguf"
+  queue_size: 0
+  response_format_retries: 0
+`
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.PicoLM.GetQueueSize() != 0 {
+		t.Errorf("QueueSize = %d, want explicit 0 kept", cfg.PicoLM.GetQueueSize())
+	}
+	if cfg.PicoLM.GetResponseFormatRetries() != 0 {
+		t.Errorf("ResponseFormatRetries = %d, want explicit 0 kept", cfg.PicoLM.GetResponseFormatRetries())
+	}
+}
+
+func TestServerConfig_Validate(t *testing.T) {
+	models := map[string]string{"test": "/path/model.gguf"}
+	hash := KeyHashPrefix + "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+
+	tests := []struct {
+		name    string
+		keys    []APIKeyConfig
+		wantErr string
+	}{
+		{
+			name: "valid keys",
+			keys: []APIKeyConfig{
+				{Name: "team-a", Hash: hash, Models: []string{"test"}, Endpoints: []string{EndpointChat, EndpointModels}},
+				{Name: "ops", Hash: hash, Endpoints: []string{EndpointAdmin}},
+			},
+		},
+		{
+			name:    "missing name",
+			keys:    []APIKeyConfig{{Hash: hash}},
+			wantErr: "keys[0] must have a name",
+		},
+		{
+			name:    "duplicate name",
+			keys:    []APIKeyConfig{{Name: "a", Hash: hash}, {Name: "a", Hash: hash}},
+			wantErr: `key name "a" is used more than once`,
+		},
+		{
+			name:    "plain text key",
+			keys:    []APIKeyConfig{{Name: "a", Hash: "sk-secret"}},
+			wantErr: `hash for key "a" must be`,
+		},
+		{
+			name:    "unknown model",
+			keys:    []APIKeyConfig{{Name: "a", Hash: hash, Models: []string{"other"}}},
+			wantErr: `key "a" allows unknown model "other"`,
+		},
+		{
+			name:    "unknown endpoint",
+			keys:    []APIKeyConfig{{Name: "a", Hash: hash, Endpoints: []string{"files"}}},
+			wantErr: `endpoints for key "a" must be`,
+		},
+		{
+			name:    "negative limit",
+			keys:    []APIKeyConfig{{Name: "a", Hash: hash, Limits: Limits{TokensPerMinute: -1}}},
+			wantErr: `limits for key "a"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ServerConfig{Keys: tt.keys}
+			err := cfg.Validate(models)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Validate() error = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad_Keys(t *testing.T) {
+	content := `
+server:
+  keys:
+    - name: team-a
+      hash: "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+      models: [test]
+      endpoints: [chat]
+      expires_at: 2027-01-01T00:00:00Z
+      requests_per_minute: 60
+      daily_tokens: 100000
+  user_limits:
+    tokens_per_minute: 2000
+
+picolm:
+  binary: "/usr/bin/picolm"
+  models:
+    test: "/tmp/model.gguf"
+`
+
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatalf("failed to write temp config: %v", err)
+	}
+
+	cfg, err := Load(configPath)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if len(cfg.Server.Keys) != 1 {
+		t.Fatalf("Server.Keys = %+v, want one key", cfg.Server.Keys)
+	}
+	key := cfg.Server.Keys[0]
+	if key.Name != "team-a" || len(key.Models) != 1 || key.Endpoints[0] != EndpointChat {
+		t.Errorf("key = %+v", key)
+	}
+	if want := time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC); !key.ExpiresAt.Equal(want) {
+		t.Errorf("ExpiresAt = %v, want %v", key.ExpiresAt, want)
+	}
+	if want := (Limits{RequestsPerMinute: 60, DailyTokens: 100000}); key.Limits != want {
+		t.Errorf("Limits = %+v, want %+v", key.Limits, want)
+	}
+	if cfg.Server.UserLimits.TokensPerMinute != 2000 {
+		t.Errorf("UserLimits = %+v, want 2000 tokens per minute", cfg.Server.UserLimits)
+	}
+}
@@ -0,0 +1,380 @@
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Magic is "GGUF" read as a little-endian uint32.
+const Magic = 0x46554747
+
+var ErrNotGGUF = errors.New("not a GGUF file")
+
+const (
+	maxStringLen  = 64 << 20
+	maxArrayLen   = 16 << 20
+	maxTensorDims = 8
+)
+
+type ValueType uint32
+
+const (
+	TypeUint8 ValueType = iota
+	TypeInt8
+	TypeUint16
+	TypeInt16
+	TypeUint32
+	TypeInt32
+	TypeFloat32
+	TypeBool
+	TypeString
+	TypeArray
+	TypeUint64
+	TypeInt64
+	TypeFloat64
+)
+
+type TensorInfo struct {
+	Name   string
+	Dims   []uint64
+	Type   uint32
+	Offset uint64
+}
+
+// Elements returns the number of values stored in the tensor.
+func (t TensorInfo) Elements() uint64 {
+	n := uint64(1)
+	for _, d := range t.Dims {
+		n *= d
+	}
+	return n
+}
+
+// File holds the header, key/value metadata and tensor descriptors of a GGUF
+// file. Tensor data is not read.
+type File struct {
+	Version  uint32
+	Metadata map[string]any
+	Tensors  []TensorInfo
+}
+
+func Open(path string) (*File, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	file, err := Read(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return file, nil
+}
+
+// CheckFile reports ErrNotGGUF if the file at path does not start with the
+// GGUF magic number.
+func CheckFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var magic uint32
+	if err := binary.Read(f, binary.LittleEndian, &magic); err != nil || magic != Magic {
+		return ErrNotGGUF
+	}
+	return nil
+}
+
+func Read(r io.Reader) (*File, error) {
+	d := &decoder{r: bufio.NewReaderSize(r, 64<<10)}
+
+	magic, err := d.uint32()
+	if err != nil || magic != Magic {
+		return nil, ErrNotGGUF
+	}
+
+	version, err := d.uint32()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read version: %w", err)
+	}
+	if version < 1 || version > 3 {
+		return nil, fmt.Errorf("unsupported GGUF version %d", version)
+	}
+	d.version = version
+
+	tensorCount, err := d.count()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tensor count: %w", err)
+	}
+	kvCount, err := d.count()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata count: %w", err)
+	}
+
+	file := &File{
+		Version:  version,
+		Metadata: make(map[string]any, kvCount),
+	}
+
+	for i := uint64(0); i < kvCount; i++ {
+		key, err := d.string()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata key: %w", err)
+		}
+		typ, err := d.uint32()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read type of %q: %w", key, err)
+		}
+		value, err := d.value(ValueType(typ))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read value of %q: %w", key, err)
+		}
+		file.Metadata[key] = value
+	}
+
+	if tensorCount > maxArrayLen {
+		return nil, fmt.Errorf("tensor count %d exceeds limit", tensorCount)
+	}
+	file.Tensors = make([]TensorInfo, 0, tensorCount)
+	for i := uint64(0); i < tensorCount; i++ {
+		t, err := d.tensorInfo()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read tensor info: %w", err)
+		}
+		file.Tensors = append(file.Tensors, t)
+	}
+
+	return file, nil
+}
+
+// String returns the string value stored under key.
+func (f *File) String(key string) (string, bool) {
+	v, ok := f.Metadata[key].(string)
+	return v, ok
+}
+
+// Uint returns the integer value stored under key, whatever its width.
+func (f *File) Uint(key string) (uint64, bool) {
+	switch v := f.Metadata[key].(type) {
+	case uint8:
+		return uint64(v), true
+	case uint16:
+		return uint64(v), true
+	case uint32:
+		return uint64(v), true
+	case uint64:
+		return v, true
+	case int8:
+		return uint64(v), v >= 0
+	case int16:
+		return uint64(v), v >= 0
+	case int32:
+		return uint64(v), v >= 0
+	case int64:
+		return uint64(v), v >= 0
+	}
+	return 0, false
+}
+
+// Strings returns the string array stored under key.
+func (f *File) Strings(key string) ([]string, bool) {
+	v, ok := f.Metadata[key].([]string)
+	return v, ok
+}
+
+type decoder struct {
+	r       *bufio.Reader
+	version uint32
+	buf     [8]byte
+}
+
+func (d *decoder) read(n int) ([]byte, error) {
+	if _, err := io.ReadFull(d.r, d.buf[:n]); err != nil {
+		return nil, err
+	}
+	return d.buf[:n], nil
+}
+
+func (d *decoder) uint8() (uint8, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *decoder) uint16() (uint16, error) {
+	b, err := d.read(2)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint16(b), nil
+}
+
+func (d *decoder) uint32() (uint32, error) {
+	b, err := d.read(4)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b), nil
+}
+
+func (d *decoder) uint64() (uint64, error) {
+	b, err := d.read(8)
+	if err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(b), nil
+}
+
+// count reads a length or count field, which is 32 bits wide in version 1
+// files and 64 bits wide afterwards.
+func (d *decoder) count() (uint64, error) {
+	if d.version == 1 {
+		n, err := d.uint32()
+		return uint64(n), err
+	}
+	return d.uint64()
+}
+
+func (d *decoder) string() (string, error) {
+	n, err := d.count()
+	if err != nil {
+		return "", err
+	}
+	if n > maxStringLen {
+		return "", fmt.Errorf("string length %d exceeds limit", n)
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) value(typ ValueType) (any, error) {
+	switch typ {
+	case TypeUint8:
+		return d.uint8()
+	case TypeInt8:
+		v, err := d.uint8()
+		return int8(v), err
+	case TypeUint16:
+		return d.uint16()
+	case TypeInt16:
+		v, err := d.uint16()
+		return int16(v), err
+	case TypeUint32:
+		return d.uint32()
+	case TypeInt32:
+		v, err := d.uint32()
+		return int32(v), err
+	case TypeFloat32:
+		v, err := d.uint32()
+		return math.Float32frombits(v), err
+	case TypeBool:
+		v, err := d.uint8()
+		return v != 0, err
+	case TypeString:
+		return d.string()
+	case TypeArray:
+		return d.array()
+	case TypeUint64:
+		return d.uint64()
+	case TypeInt64:
+		v, err := d.uint64()
+		return int64(v), err
+	case TypeFloat64:
+		v, err := d.uint64()
+		return math.Float64frombits(v), err
+	}
+	return nil, fmt.Errorf("unknown value type %d", typ)
+}
+
+func (d *decoder) array() (any, error) {
+	typ, err := d.uint32()
+	if err != nil {
+		return nil, err
+	}
+	n, err := d.count()
+	if err != nil {
+		return nil, err
+	}
+	if n > maxArrayLen {
+		return nil, fmt.Errorf("array length %d exceeds limit", n)
+	}
+
+	switch ValueType(typ) {
+	case TypeString:
+		return readArray(d, n, (*decoder).string)
+	case TypeFloat32:
+		return readArray(d, n, func(d *decoder) (float32, error) {
+			v, err := d.uint32()
+			return math.Float32frombits(v), err
+		})
+	case TypeInt32:
+		return readArray(d, n, func(d *decoder) (int32, error) {
+			v, err := d.uint32()
+			return int32(v), err
+		})
+	case TypeUint32:
+		return readArray(d, n, (*decoder).uint32)
+	case TypeUint8:
+		return readArray(d, n, (*decoder).uint8)
+	}
+	return readArray(d, n, func(d *decoder) (any, error) {
+		return d.value(ValueType(typ))
+	})
+}
+
+func readArray[T any](d *decoder, n uint64, read func(*decoder) (T, error)) ([]T, error) {
+	values := make([]T, 0, n)
+	for i := uint64(0); i < n; i++ {
+		v, err := read(d)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func (d *decoder) tensorInfo() (TensorInfo, error) {
+	var t TensorInfo
+
+	name, err := d.string()
+	if err != nil {
+		return t, err
+	}
+	t.Name = name
+
+	nDims, err := d.uint32()
+	if err != nil {
+		return t, err
+	}
+	if nDims > maxTensorDims {
+		return t, fmt.Errorf("tensor %q has %d dimensions", name, nDims)
+	}
+	t.Dims = make([]uint64, nDims)
+	for i := range t.Dims {
+		if t.Dims[i], err = d.count(); err != nil {
+			return t, err
+		}
+	}
+
+	if t.Type, err = d.uint32(); err != nil {
+		return t, err
+	}
+	if t.Offset, err = d.uint64(); err != nil {
+		return t, err
+	}
+	return t, nil
+}
@@ -0,0 +1,120 @@
+package gguf
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func testFile() *File {
+	return &File{
+		Metadata: map[string]any{
+			"general.architecture":         "llama",
+			"general.name":                 "TinyLlama",
+			"general.file_type":            uint32(15),
+			"llama.context_length":         uint32(4096),
+			"llama.rope.freq_base":         float32(10000),
+			"tokenizer.ggml.model":         "llama",
+			"tokenizer.ggml.tokens":        []string{"<unk>", "<s>", "</s>", "▁hi"},
+			"tokenizer.ggml.scores":        []float32{0, 0, 0, -1},
+			"tokenizer.ggml.token_type":    []int32{2, 3, 3, 1},
+			"tokenizer.ggml.bos_token_id":  uint32(1),
+			"tokenizer.ggml.eos_token_id":  uint32(2),
+			"tokenizer.chat_template":      "{% for m in messages %}<|user|>{% endfor %}",
+			"tokenizer.ggml.add_bos_token": true,
+		},
+		Tensors: []TensorInfo{
+			{Name: "token_embd.weight", Dims: []uint64{64, 4}, Type: 12},
+			{Name: "output_norm.weight", Dims: []uint64{64}, Type: 0},
+		},
+	}
+}
+
+func TestReadWriteRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testFile()); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	f, err := Read(&buf)
+	if err != nil {
+		t.Fatalf("Read() error = %v", err)
+	}
+
+	if f.Version != 3 {
+		t.Errorf("Version = %d, want 3", f.Version)
+	}
+	if !reflect.DeepEqual(f.Metadata, testFile().Metadata) {
+		t.Errorf("Metadata = %#v, want %#v", f.Metadata, testFile().Metadata)
+	}
+	if len(f.Tensors) != 2 || f.Tensors[0].Name != "token_embd.weight" || f.Tensors[0].Elements() != 256 {
+		t.Errorf("unexpected tensors: %+v", f.Tensors)
+	}
+}
+
+func TestModelInfo(t *testing.T) {
+	info := testFile().ModelInfo()
+
+	want := ModelInfo{
+		Architecture:   "llama",
+		Name:           "TinyLlama",
+		ParameterCount: 64*4 + 64,
+		Quantization:   "Q4_K_M",
+		ContextLength:  4096,
+		BOSToken:       "<s>",
+		EOSToken:       "</s>",
+		ChatTemplate:   "{% for m in messages %}<|user|>{% endfor %}",
+	}
+	if info != want {
+		t.Errorf("ModelInfo() = %+v, want %+v", info, want)
+	}
+}
+
+func TestModelInfo_QuantizationFromTensors(t *testing.T) {
+	f := testFile()
+	delete(f.Metadata, "general.file_type")
+
+	if q := f.ModelInfo().Quantization; q != "Q4_K" {
+		t.Errorf("Quantization = %q, want Q4_K", q)
+	}
+}
+
+func TestRead_NotGGUF(t *testing.T) {
+	_, err := Read(bytes.NewReader([]byte("not a model file")))
+	if !errors.Is(err, ErrNotGGUF) {
+		t.Errorf("Read() error = %v, want ErrNotGGUF", err)
+	}
+}
+
+func TestRead_Truncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testFile()); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	if _, err := Read(bytes.NewReader(buf.Bytes()[:buf.Len()/2])); err == nil {
+		t.Error("expected error for truncated file")
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	dir := t.TempDir()
+
+	good := filepath.Join(dir, "model.gguf")
+	var buf bytes.Buffer
+	Write(&buf, testFile())
+	os.WriteFile(good, buf.Bytes(), 0644)
+
+	bad := filepath.Join(dir, "model.bin")
+	os.WriteFile(bad, []byte("PK\x03\x04"), 0644)
+
+	if err := CheckFile(good); err != nil {
+		t.Errorf("CheckFile(good) error = %v", err)
+	}
+	if err := CheckFile(bad); !errors.Is(err, ErrNotGGUF) {
+		t.Errorf("CheckFile(bad) error = %v, want ErrNotGGUF", err)
+	}
+}
@@ -0,0 +1,101 @@
+package gguf
+
+import "fmt"
+
+// ModelInfo summarises the metadata most useful for serving a model.
+type ModelInfo struct {
+	Architecture   string
+	Name           string
+	ParameterCount uint64
+	Quantization   string
+	ContextLength  int
+	BOSToken       string
+	EOSToken       string
+	ChatTemplate   string
+}
+
+func (f *File) ModelInfo() ModelInfo {
+	info := ModelInfo{}
+
+	info.Architecture, _ = f.String("general.architecture")
+	info.Name, _ = f.String("general.name")
+	info.ChatTemplate, _ = f.String("tokenizer.chat_template")
+
+	if n, ok := f.Uint(info.Architecture + ".context_length"); ok {
+		info.ContextLength = int(n)
+	}
+
+	if n, ok := f.Uint("general.parameter_count"); ok {
+		info.ParameterCount = n
+	} else {
+		for _, t := range f.Tensors {
+			info.ParameterCount += t.Elements()
+		}
+	}
+
+	if ft, ok := f.Uint("general.file_type"); ok {
+		info.Quantization = fileTypeName(ft)
+	} else {
+		info.Quantization = f.dominantTensorType()
+	}
+
+	tokens, _ := f.Strings("tokenizer.ggml.tokens")
+	if id, ok := f.Uint("tokenizer.ggml.bos_token_id"); ok && id < uint64(len(tokens)) {
+		info.BOSToken = tokens[id]
+	}
+	if id, ok := f.Uint("tokenizer.ggml.eos_token_id"); ok && id < uint64(len(tokens)) {
+		info.EOSToken = tokens[id]
+	}
+
+	return info
+}
+
+// dominantTensorType returns the name of the most common type among the
+// file's matrices, which is what the quantization label describes.
+func (f *File) dominantTensorType() string {
+	counts := make(map[uint32]int)
+	best, bestCount := uint32(0), 0
+	for _, t := range f.Tensors {
+		if len(t.Dims) < 2 {
+			continue
+		}
+		counts[t.Type]++
+		if counts[t.Type] > bestCount {
+			best, bestCount = t.Type, counts[t.Type]
+		}
+	}
+	if bestCount == 0 {
+		return ""
+	}
+	return TensorTypeName(best)
+}
+
+var fileTypes = map[uint64]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 7: "Q8_0", 8: "Q5_0", 9: "Q5_1",
+	10: "Q2_K", 11: "Q3_K_S", 12: "Q3_K_M", 13: "Q3_K_L", 14: "Q4_K_S", 15: "Q4_K_M",
+	16: "Q5_K_S", 17: "Q5_K_M", 18: "Q6_K", 19: "IQ2_XXS", 20: "IQ2_XS", 21: "Q2_K_S",
+	22: "IQ3_XS", 23: "IQ3_XXS", 24: "IQ1_S", 25: "IQ4_NL", 26: "IQ3_S", 27: "IQ3_M",
+	28: "IQ2_S", 29: "IQ2_M", 30: "IQ4_XS", 31: "IQ1_M", 32: "BF16",
+}
+
+var tensorTypes = map[uint32]string{
+	0: "F32", 1: "F16", 2: "Q4_0", 3: "Q4_1", 6: "Q5_0", 7: "Q5_1", 8: "Q8_0", 9: "Q8_1",
+	10: "Q2_K", 11: "Q3_K", 12: "Q4_K", 13: "Q5_K", 14: "Q6_K", 15: "Q8_K",
+	16: "IQ2_XXS", 17: "IQ2_XS", 18: "IQ3_XXS", 19: "IQ1_S", 20: "IQ4_NL", 21: "IQ3_S",
+	22: "IQ2_S", 23: "IQ4_XS", 24: "I8", 25: "I16", 26: "I32", 27: "I64", 28: "F64",
+	29: "IQ1_M", 30: "BF16",
+}
+
+func fileTypeName(ft uint64) string {
+	if name, ok := fileTypes[ft]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", ft)
+}
+
+func TensorTypeName(t uint32) string {
+	if name, ok := tensorTypes[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
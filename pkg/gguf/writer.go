@@ -0,0 +1,144 @@
+package gguf
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// Write encodes the header, metadata and tensor descriptors of f in GGUF
+// version 3 format. Metadata keys are written in sorted order.
+func Write(w io.Writer, f *File) error {
+	e := &encoder{w: bufio.NewWriter(w)}
+
+	e.uint32(Magic)
+	e.uint32(3)
+	e.uint64(uint64(len(f.Tensors)))
+	e.uint64(uint64(len(f.Metadata)))
+
+	keys := make([]string, 0, len(f.Metadata))
+	for k := range f.Metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		e.string(k)
+		if err := e.value(f.Metadata[k], true); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	for _, t := range f.Tensors {
+		e.string(t.Name)
+		e.uint32(uint32(len(t.Dims)))
+		for _, d := range t.Dims {
+			e.uint64(d)
+		}
+		e.uint32(t.Type)
+		e.uint64(t.Offset)
+	}
+
+	if e.err != nil {
+		return e.err
+	}
+	return e.w.Flush()
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (e *encoder) write(v any) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, v)
+	}
+}
+
+func (e *encoder) uint32(v uint32) { e.write(v) }
+func (e *encoder) uint64(v uint64) { e.write(v) }
+
+func (e *encoder) string(s string) {
+	e.uint64(uint64(len(s)))
+	if e.err == nil {
+		_, e.err = e.w.WriteString(s)
+	}
+}
+
+func (e *encoder) value(v any, tagged bool) error {
+	tag := func(t ValueType) {
+		if tagged {
+			e.uint32(uint32(t))
+		}
+	}
+
+	switch v := v.(type) {
+	case uint8:
+		tag(TypeUint8)
+		e.write(v)
+	case int8:
+		tag(TypeInt8)
+		e.write(v)
+	case uint16:
+		tag(TypeUint16)
+		e.write(v)
+	case int16:
+		tag(TypeInt16)
+		e.write(v)
+	case uint32:
+		tag(TypeUint32)
+		e.write(v)
+	case int32:
+		tag(TypeInt32)
+		e.write(v)
+	case float32:
+		tag(TypeFloat32)
+		e.write(math.Float32bits(v))
+	case bool:
+		tag(TypeBool)
+		e.write(v)
+	case string:
+		tag(TypeString)
+		e.string(v)
+	case uint64:
+		tag(TypeUint64)
+		e.write(v)
+	case int64:
+		tag(TypeInt64)
+		e.write(v)
+	case float64:
+		tag(TypeFloat64)
+		e.write(math.Float64bits(v))
+	case []string:
+		return writeArray(e, tagged, TypeString, v)
+	case []float32:
+		return writeArray(e, tagged, TypeFloat32, v)
+	case []int32:
+		return writeArray(e, tagged, TypeInt32, v)
+	case []uint32:
+		return writeArray(e, tagged, TypeUint32, v)
+	case []uint8:
+		return writeArray(e, tagged, TypeUint8, v)
+	default:
+		return fmt.Errorf("unsupported metadata type %T", v)
+	}
+	return nil
+}
+
+func writeArray[T any](e *encoder, tagged bool, typ ValueType, values []T) error {
+	if tagged {
+		e.uint32(uint32(TypeArray))
+	}
+	e.uint32(uint32(typ))
+	e.uint64(uint64(len(values)))
+	for _, v := range values {
+		if err := e.value(v, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,825 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/auth"
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/ratelimit"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+const (
+	batchesCollection = "batches"
+	batchEndpoint     = "/v1/chat/completions"
+	batchWindow       = 24 * time.Hour
+)
+
+// storedBatch is a batch and the files its results are appended to while
+// it runs. The files are only listed once the batch has finished. Key names
+// the API key that created it, which its tokens are charged to and its files
+// belong to.
+type storedBatch struct {
+	Batch      types.Batch `json:"batch"`
+	OutputFile string      `json:"output_file"`
+	ErrorFile  string      `json:"error_file"`
+	Key        string      `json:"key,omitempty"`
+}
+
+// batchRunner processes stored batches one at a time in the background.
+// mu serializes updates to batch records between the runner and cancel
+// requests.
+type batchRunner struct {
+	workers int
+	wake    chan struct{}
+
+	mu      sync.Mutex
+	running map[string]context.CancelFunc
+}
+
+func batchFinished(status string) bool {
+	switch status {
+	case "completed", "failed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+// HandleBatches creates a batch with POST /v1/batches and lists batches with
+// GET /v1/batches.
+func (h *Handler) HandleBatches(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok || !h.requireStore(w) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		h.createBatch(w, r)
+	case http.MethodGet:
+		h.listBatches(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createBatch validates the input file and queues the batch. A file with
+// invalid requests still creates a batch, which fails with one error per
+// line.
+func (h *Handler) createBatch(w http.ResponseWriter, r *http.Request) {
+	var req types.BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	invalid := func(param, message string) {
+		h.writeErrorDetail(w, types.ErrorDetail{Message: message, Type: "invalid_request_error", Param: param}, http.StatusBadRequest)
+	}
+	switch {
+	case req.Endpoint != batchEndpoint:
+		invalid("endpoint", fmt.Sprintf("endpoint must be %q", batchEndpoint))
+		return
+	case req.CompletionWindow != "24h":
+		invalid("completion_window", `completion_window must be "24h"`)
+		return
+	case req.InputFileID == "":
+		invalid("input_file_id", "input_file_id is required")
+		return
+	}
+
+	r, err := h.checkLimits(w, r, "")
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+
+	file, err := h.loadFile(r, req.InputFileID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			h.writeFileNotFound(w, req.InputFileID, err)
+			return
+		}
+		invalid("input_file_id", fmt.Sprintf("No such File object: %s", req.InputFileID))
+		return
+	}
+	if file.Purpose != "batch" {
+		invalid("input_file_id", `input file must have purpose "batch"`)
+		return
+	}
+
+	lines, lineErrors, err := h.readBatchInput(req.InputFileID, auth.FromContext(r.Context()))
+	if err != nil {
+		log.Printf("failed to read batch input %s: %v", req.InputFileID, err)
+		h.writeError(w, "failed to read input file", "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now()
+	sb := storedBatch{
+		Batch: types.Batch{
+			ID:               "batch_" + generateID(),
+			Object:           "batch",
+			Endpoint:         req.Endpoint,
+			InputFileID:      req.InputFileID,
+			CompletionWindow: req.CompletionWindow,
+			Status:           "validating",
+			CreatedAt:        now.Unix(),
+			ExpiresAt:        now.Add(batchWindow).Unix(),
+			RequestCounts:    types.BatchRequestCounts{Total: len(lines)},
+			Metadata:         req.Metadata,
+		},
+		OutputFile: "file-" + generateID(),
+		ErrorFile:  "file-" + generateID(),
+		Key:        keyName(r),
+	}
+	if len(lines) == 0 && len(lineErrors) == 0 {
+		lineErrors = []types.BatchError{{Code: "empty_file", Message: "The input file contains no requests."}}
+	}
+	if len(lineErrors) > 0 {
+		sb.Batch.Status = "failed"
+		sb.Batch.FailedAt = timestamp(now)
+		sb.Batch.Errors = &types.BatchErrors{Object: "list", Data: lineErrors}
+	}
+
+	if err := h.store.Put(batchesCollection, sb.Batch.ID, sb); err != nil {
+		log.Printf("failed to store batch %s: %v", sb.Batch.ID, err)
+		h.writeError(w, "failed to store batch", "internal_error", http.StatusInternalServerError)
+		return
+	}
+	h.wakeBatches()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sb.Batch)
+}
+
+// readBatchInput parses a batch input file, returning its requests and an
+// error for each invalid line. Requests for models key may not use are
+// invalid.
+func (h *Handler) readBatchInput(fileID string, key *auth.Key) ([]types.BatchInputLine, []types.BatchError, error) {
+	f, err := h.store.OpenBlob(filesCollection, fileID)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var lines []types.BatchInputLine
+	var lineErrors []types.BatchError
+	seen := map[string]bool{}
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFileSize)
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		lineError := func(code, param, message string) {
+			lineErrors = append(lineErrors, types.BatchError{Code: code, Message: message, Param: param, Line: n})
+		}
+
+		var line types.BatchInputLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			lineError("invalid_json_line", "", "This line is not parseable as valid JSON.")
+			continue
+		}
+		var req types.ChatCompletionRequest
+		switch {
+		case line.CustomID == "":
+			lineError("missing_required_parameter", "custom_id", "custom_id is required.")
+		case seen[line.CustomID]:
+			lineError("duplicate_custom_id", "custom_id", fmt.Sprintf("The custom_id %q is used more than once.", line.CustomID))
+		case line.Method != http.MethodPost:
+			lineError("invalid_method", "method", "method must be POST.")
+		case line.URL != batchEndpoint:
+			lineError("invalid_url", "url", fmt.Sprintf("url must be %q, the endpoint of the batch.", batchEndpoint))
+		case json.Unmarshal(line.Body, &req) != nil:
+			lineError("invalid_request", "body", "body is not a valid chat completion request.")
+		case req.Stream:
+			lineError("invalid_request", "body.stream", "Streaming is not supported in batches.")
+		default:
+			if err := h.client.CheckChoices(req.N); err != nil {
+				lineError("invalid_request", "body.n", err.Error())
+				continue
+			}
+			model := req.Model
+			if model == "" {
+				model = h.client.GetDefaultModel()
+			}
+			if !key.AllowsModel(model) {
+				lineError("model_not_found", "body.model", fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", model))
+				continue
+			}
+			seen[line.CustomID] = true
+			lines = append(lines, line)
+		}
+	}
+	return lines, lineErrors, scanner.Err()
+}
+
+func (h *Handler) listBatches(w http.ResponseWriter, r *http.Request) {
+	stored, err := store.List[storedBatch](h.store, batchesCollection)
+	if err != nil {
+		log.Printf("failed to list batches: %v", err)
+		h.writeError(w, "failed to list batches", "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	var batches []types.Batch
+	for _, sb := range stored {
+		if ownedBy(r, sb.Key) {
+			batches = append(batches, sb.Batch)
+		}
+	}
+	sortBatches(batches)
+
+	page, err := paginate(r.URL.Query(), batches, func(b types.Batch) string { return b.ID })
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func sortBatches(batches []types.Batch) {
+	slices.SortStableFunc(batches, func(a, b types.Batch) int {
+		if c := cmp.Compare(a.CreatedAt, b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
+
+// HandleBatch serves a batch at /v1/batches/{id} and cancels it with
+// POST /v1/batches/{id}/cancel.
+func (h *Handler) HandleBatch(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok || !h.requireStore(w) {
+		return
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/batches/"), "/")
+
+	switch {
+	case sub == "cancel" && r.Method == http.MethodPost:
+		h.cancelBatch(w, r, id)
+
+	case sub != "":
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodGet:
+		var sb storedBatch
+		err := h.store.Get(batchesCollection, id, &sb)
+		if err == nil && !ownedBy(r, sb.Key) {
+			err = store.ErrNotFound
+		}
+		if err != nil {
+			h.writeBatchNotFound(w, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(sb.Batch)
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// cancelBatch stops a running batch after its in-flight requests, or
+// cancels a queued batch straight away. Results written so far are kept.
+func (h *Handler) cancelBatch(w http.ResponseWriter, r *http.Request, id string) {
+	var running bool
+	sb, err := h.updateBatch(id, func(sb *storedBatch) error {
+		if !ownedBy(r, sb.Key) {
+			return store.ErrNotFound
+		}
+		if batchFinished(sb.Batch.Status) {
+			return &picolm.InvalidRequestError{
+				Message: fmt.Sprintf("Cannot cancel a batch with status %q.", sb.Batch.Status),
+			}
+		}
+		if sb.Batch.Status != "cancelling" {
+			sb.Batch.Status = "cancelling"
+			sb.Batch.CancellingAt = timestamp(time.Now())
+		}
+		var cancel context.CancelFunc
+		cancel, running = h.batches.running[id]
+		if running {
+			cancel()
+		}
+		return nil
+	})
+	switch {
+	case errors.As(err, new(*picolm.InvalidRequestError)):
+		h.writeInferenceError(w, err)
+		return
+	case err != nil:
+		h.writeBatchNotFound(w, id, err)
+		return
+	}
+
+	if !running {
+		if err := h.finishBatch(id, "cancelled", nil); err != nil {
+			log.Printf("failed to cancel batch %s: %v", id, err)
+		}
+		h.store.Get(batchesCollection, id, sb)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sb.Batch)
+}
+
+func (h *Handler) writeBatchNotFound(w http.ResponseWriter, id string, err error) {
+	if !errors.Is(err, store.ErrNotFound) {
+		log.Printf("failed to load batch %s: %v", id, err)
+		h.writeError(w, "failed to load batch", "internal_error", http.StatusInternalServerError)
+		return
+	}
+	h.writeErrorDetail(w, types.ErrorDetail{
+		Message: fmt.Sprintf("No such Batch object: %s", id),
+		Type:    "invalid_request_error",
+	}, http.StatusNotFound)
+}
+
+// updateBatch applies update to a stored batch and saves it. If update
+// returns an error the batch is left unchanged.
+func (h *Handler) updateBatch(id string, update func(sb *storedBatch) error) (*storedBatch, error) {
+	h.batches.mu.Lock()
+	defer h.batches.mu.Unlock()
+
+	var sb storedBatch
+	if err := h.store.Get(batchesCollection, id, &sb); err != nil {
+		return nil, err
+	}
+	if err := update(&sb); err != nil {
+		return nil, err
+	}
+	return &sb, h.store.Put(batchesCollection, id, sb)
+}
+
+// Start runs batches and jobs in the background until ctx is done, starting
+// with any that were interrupted by a restart. It must be called before the
+// handler serves requests.
+func (h *Handler) Start(ctx context.Context) {
+	h.background = ctx
+	if h.store == nil {
+		return
+	}
+	h.resumeJobs(ctx)
+	go h.runBatches(ctx)
+}
+
+func (h *Handler) wakeBatches() {
+	select {
+	case h.batches.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *Handler) runBatches(ctx context.Context) {
+	for ctx.Err() == nil {
+		id, err := h.nextBatch()
+		if err == nil && id != "" {
+			err = h.processBatch(ctx, id)
+		}
+		if err != nil {
+			log.Printf("batch error: %v", err)
+			// Back off so that a failing store does not spin the loop.
+			select {
+			case <-time.After(time.Minute):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		if id == "" {
+			select {
+			case <-h.batches.wake:
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// nextBatch returns the ID of the oldest unfinished batch, if any.
+func (h *Handler) nextBatch() (string, error) {
+	stored, err := store.List[storedBatch](h.store, batchesCollection)
+	if err != nil {
+		return "", err
+	}
+	var pending []types.Batch
+	for _, sb := range stored {
+		if !batchFinished(sb.Batch.Status) {
+			pending = append(pending, sb.Batch)
+		}
+	}
+	if len(pending) == 0 {
+		return "", nil
+	}
+	sortBatches(pending)
+	return pending[0].ID, nil
+}
+
+// processBatch runs the requests of a batch that have no result yet. When
+// ctx is done the batch is left in progress, to be resumed on the next
+// start.
+func (h *Handler) processBatch(parent context.Context, id string) error {
+	var sb storedBatch
+	if err := h.store.Get(batchesCollection, id, &sb); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithDeadline(parent, time.Unix(sb.Batch.ExpiresAt, 0))
+	defer cancel()
+
+	status := ""
+	_, err := h.updateBatch(id, func(sb *storedBatch) error {
+		status = sb.Batch.Status
+		switch status {
+		case "validating":
+			sb.Batch.Status = "in_progress"
+			sb.Batch.InProgressAt = timestamp(time.Now())
+		case "in_progress":
+		default:
+			return nil
+		}
+		h.batches.running[id] = cancel
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		h.batches.mu.Lock()
+		delete(h.batches.running, id)
+		h.batches.mu.Unlock()
+	}()
+
+	switch status {
+	case "cancelling":
+		return h.finishBatch(id, "cancelled", nil)
+	case "finalizing":
+		return h.finishBatch(id, "completed", nil)
+	case "validating", "in_progress":
+	default:
+		return nil
+	}
+
+	// A batch whose key was removed or has expired does not run at all.
+	if _, err := h.keys.Lookup(sb.Key, time.Now()); err != nil {
+		return h.failBatch(id, types.BatchError{
+			Code:    "invalid_api_key",
+			Message: fmt.Sprintf("The API key of the batch can no longer be used: %v", err),
+		})
+	}
+
+	lines, _, err := h.readBatchInput(sb.Batch.InputFileID, nil)
+	if err != nil {
+		return h.failBatch(id, types.BatchError{
+			Code:    "invalid_file",
+			Message: fmt.Sprintf("The input file could not be read: %v", err),
+			Param:   "input_file_id",
+		})
+	}
+
+	done, err := h.batchProgress(&sb)
+	if err != nil {
+		return err
+	}
+
+	sem := make(chan struct{}, max(h.batches.workers, 1))
+	var wg sync.WaitGroup
+	for _, line := range lines {
+		if done[line.CustomID] {
+			continue
+		}
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func(line types.BatchInputLine) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := h.runBatchRequest(ctx, &sb, line); err != nil {
+				log.Printf("failed to record result %s of batch %s: %v", line.CustomID, id, err)
+			}
+		}(line)
+	}
+	wg.Wait()
+
+	switch {
+	case parent.Err() != nil:
+		return nil
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		done, err := h.batchProgress(&sb)
+		if err != nil {
+			return err
+		}
+		expired := slices.DeleteFunc(lines, func(line types.BatchInputLine) bool { return done[line.CustomID] })
+		return h.finishBatch(id, "expired", expired)
+	case ctx.Err() != nil:
+		return h.finishBatch(id, "cancelled", nil)
+	}
+	return h.finishBatch(id, "completed", nil)
+}
+
+// runBatchRequest runs one request of a batch as if the batch's key had sent
+// it to the endpoint at low priority, and appends the response to the batch's
+// output file, or to its error file if the request failed. A key that
+// expires or is removed while the batch runs fails its remaining requests
+// with 401. Requests interrupted by cancellation or shutdown are not
+// recorded.
+func (h *Handler) runBatchRequest(ctx context.Context, sb *storedBatch, line types.BatchInputLine) error {
+	var req types.ChatCompletionRequest
+	if err := json.Unmarshal(line.Body, &req); err != nil {
+		return err
+	}
+
+	keyCtx, keyErr := h.keyContext(picolm.WithLowPriority(ctx), sb.Key, req.User)
+	r := (&http.Request{
+		Method: http.MethodPost,
+		URL:    &url.URL{Path: line.URL},
+		Header: http.Header{},
+	}).WithContext(keyCtx)
+	resp := &responseBuffer{}
+	if keyErr != nil {
+		h.writeKeyError(resp, keyErr)
+	} else if err := h.waitForLimits(ctx, ratelimit.SubjectsFrom(r.Context())); err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		h.writeInferenceError(resp, err)
+	} else {
+		h.createChatCompletion(resp, r, &req)
+	}
+
+	status := resp.Status()
+	if ctx.Err() != nil && status != http.StatusOK {
+		return nil
+	}
+
+	body := bytes.TrimSpace(resp.body.Bytes())
+	if !json.Valid(body) {
+		body, _ = json.Marshal(string(body))
+	}
+	return h.recordBatchResult(sb, types.BatchOutputLine{
+		ID:       "batch_req_" + generateID(),
+		CustomID: line.CustomID,
+		Response: &types.BatchResponse{StatusCode: status, RequestID: "req_" + generateID(), Body: body},
+	})
+}
+
+// waitForLimits admits a batch request against the limits of subjects,
+// waiting for the per-minute limits to allow it rather than failing it.
+// Exceeded quotas are returned, so that the request and every one after it
+// fail with the quota error until the quota resets.
+func (h *Handler) waitForLimits(ctx context.Context, subjects []ratelimit.Subject) error {
+	if len(subjects) == 0 {
+		return nil
+	}
+	for {
+		_, err := h.limits.Allow(subjects)
+		var lerr *ratelimit.Error
+		if !errors.As(err, &lerr) || lerr.Code != "rate_limit_exceeded" {
+			return err
+		}
+		timer := time.NewTimer(lerr.RetryAfter)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+func (h *Handler) recordBatchResult(sb *storedBatch, result types.BatchOutputLine) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	_, err = h.updateBatch(sb.Batch.ID, func(stored *storedBatch) error {
+		file := stored.OutputFile
+		if result.Response == nil || result.Response.StatusCode != http.StatusOK {
+			file = stored.ErrorFile
+			stored.Batch.RequestCounts.Failed++
+		} else {
+			stored.Batch.RequestCounts.Completed++
+		}
+		return h.store.AppendBlob(filesCollection, file, data)
+	})
+	return err
+}
+
+// batchProgress returns the custom IDs of the requests that already have a
+// result. It drops a partly written last line left by a crash and brings
+// the request counts in line with the files.
+func (h *Handler) batchProgress(sb *storedBatch) (map[string]bool, error) {
+	done := map[string]bool{}
+	_, err := h.updateBatch(sb.Batch.ID, func(stored *storedBatch) error {
+		completed, err := h.readBatchResults(stored.OutputFile, done)
+		if err != nil {
+			return err
+		}
+		failed, err := h.readBatchResults(stored.ErrorFile, done)
+		if err != nil {
+			return err
+		}
+		stored.Batch.RequestCounts.Completed = completed
+		stored.Batch.RequestCounts.Failed = failed
+		return nil
+	})
+	return done, err
+}
+
+func (h *Handler) readBatchResults(fileID string, done map[string]bool) (int, error) {
+	f, err := h.store.OpenBlob(filesCollection, fileID)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var valid bytes.Buffer
+	count, torn := 0, false
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxFileSize)
+	for scanner.Scan() {
+		var result types.BatchOutputLine
+		if err := json.Unmarshal(scanner.Bytes(), &result); err != nil {
+			torn = true
+			continue
+		}
+		done[result.CustomID] = true
+		count++
+		valid.Write(scanner.Bytes())
+		valid.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	if torn {
+		if _, err := h.store.PutBlob(filesCollection, fileID, &valid); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+// finishBatch moves a batch to a final status and lists its output and
+// error files. Requests that expired are added to the error file.
+func (h *Handler) finishBatch(id, status string, expired []types.BatchInputLine) error {
+	_, err := h.updateBatch(id, func(sb *storedBatch) error {
+		if batchFinished(sb.Batch.Status) {
+			return nil
+		}
+
+		now := time.Now()
+		if status == "completed" && sb.Batch.FinalizingAt == nil {
+			sb.Batch.Status = "finalizing"
+			sb.Batch.FinalizingAt = timestamp(now)
+			if err := h.store.Put(batchesCollection, id, sb); err != nil {
+				return err
+			}
+		}
+
+		for _, line := range expired {
+			data, _ := json.Marshal(types.BatchOutputLine{
+				ID:       "batch_req_" + generateID(),
+				CustomID: line.CustomID,
+				Error: &types.BatchError{
+					Code:    "batch_expired",
+					Message: "This request could not be executed before the completion window expired.",
+				},
+			})
+			if err := h.store.AppendBlob(filesCollection, sb.ErrorFile, append(data, '\n')); err != nil {
+				return err
+			}
+		}
+
+		var err error
+		if sb.Batch.OutputFileID, err = h.registerBatchFile(sb, sb.OutputFile, "output"); err != nil {
+			return err
+		}
+		if sb.Batch.ErrorFileID, err = h.registerBatchFile(sb, sb.ErrorFile, "error"); err != nil {
+			return err
+		}
+
+		sb.Batch.Status = status
+		switch status {
+		case "completed":
+			sb.Batch.CompletedAt = timestamp(now)
+		case "cancelled":
+			sb.Batch.CancelledAt = timestamp(now)
+		case "expired":
+			sb.Batch.ExpiredAt = timestamp(now)
+		}
+		return nil
+	})
+	return err
+}
+
+// registerBatchFile lists a file the batch wrote results to. Batches that
+// wrote nothing to it get no file.
+func (h *Handler) registerBatchFile(sb *storedBatch, fileID, kind string) (*string, error) {
+	f, err := h.store.OpenBlob(filesCollection, fileID)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	file := storedFile{
+		File: types.File{
+			ID:        fileID,
+			Object:    "file",
+			Bytes:     info.Size(),
+			CreatedAt: time.Now().Unix(),
+			Filename:  fmt.Sprintf("%s_%s.jsonl", sb.Batch.ID, kind),
+			Purpose:   "batch_output",
+		},
+		Key: sb.Key,
+	}
+	if err := h.store.Put(filesCollection, fileID, file); err != nil {
+		return nil, err
+	}
+	return &fileID, nil
+}
+
+func (h *Handler) failBatch(id string, batchErr types.BatchError) error {
+	_, err := h.updateBatch(id, func(sb *storedBatch) error {
+		sb.Batch.Status = "failed"
+		sb.Batch.FailedAt = timestamp(time.Now())
+		sb.Batch.Errors = &types.BatchErrors{Object: "list", Data: []types.BatchError{batchErr}}
+		return nil
+	})
+	return err
+}
+
+func timestamp(t time.Time) *int64 {
+	unix := t.Unix()
+	return &unix
+}
+
+// responseBuffer captures the response of a handler run outside an HTTP
+// request.
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *responseBuffer) Header() http.Header {
+	if b.header == nil {
+		b.header = http.Header{}
+	}
+	return b.header
+}
+
+func (b *responseBuffer) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *responseBuffer) Write(p []byte) (int, error) {
+	b.WriteHeader(http.StatusOK)
+	return b.body.Write(p)
+}
+
+func (b *responseBuffer) Status() int {
+	if b.status == 0 {
+		return http.StatusOK
+	}
+	return b.status
+}
+
+var _ http.ResponseWriter = (*responseBuffer)(nil)
@@ -0,0 +1,300 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// chatFuncClient answers Chat with a function of the request.
+type chatFuncClient struct {
+	*mockPicoLMClient
+	chat func(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error)
+}
+
+func (c *chatFuncClient) Chat(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error) {
+	c.record(req)
+	return c.chat(ctx, req)
+}
+
+func uploadBatchFile(t *testing.T, handler *Handler, content string) types.File {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("purpose", "batch")
+	fw, _ := mw.CreateFormFile("file", "requests.jsonl")
+	io.WriteString(fw, content)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/files", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	handler.HandleFiles(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var file types.File
+	json.Unmarshal(w.Body.Bytes(), &file)
+	return file
+}
+
+func createBatch(t *testing.T, handler *Handler, fileID string) types.Batch {
+	t.Helper()
+	body := `{"input_file_id":"` + fileID + `","endpoint":"/v1/chat/completions","completion_window":"24h"}`
+	w := httptest.NewRecorder()
+	handler.HandleBatches(w, httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("create batch: expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var batch types.Batch
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	return batch
+}
+
+func getBatch(t *testing.T, handler *Handler, id string) types.Batch {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler.HandleBatch(w, httptest.NewRequest(http.MethodGet, "/v1/batches/"+id, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("get batch: expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var batch types.Batch
+	json.Unmarshal(w.Body.Bytes(), &batch)
+	return batch
+}
+
+func waitBatch(t *testing.T, handler *Handler, id string, done func(types.Batch) bool) types.Batch {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		batch := getBatch(t, handler, id)
+		if done(batch) {
+			return batch
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for batch, last state %+v", batch)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func fileLines(t *testing.T, handler *Handler, id *string) []types.BatchOutputLine {
+	t.Helper()
+	if id == nil {
+		t.Fatal("file ID is nil")
+	}
+	w := httptest.NewRecorder()
+	handler.HandleFile(w, httptest.NewRequest(http.MethodGet, "/v1/files/"+*id+"/content", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("file content: expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var lines []types.BatchOutputLine
+	for _, raw := range strings.Split(strings.TrimSpace(w.Body.String()), "\n") {
+		var line types.BatchOutputLine
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("failed to unmarshal %q: %v", raw, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func batchLine(customID, content string) string {
+	return `{"custom_id":"` + customID + `","method":"POST","url":"/v1/chat/completions","body":{"messages":[{"role":"user","content":"` + content + `"}]}}` + "\n"
+}
+
+func TestBatch_Completed(t *testing.T) {
+	client := &chatFuncClient{
+		mockPicoLMClient: &mockPicoLMClient{},
+		chat: func(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error) {
+			if !picolm.IsLowPriority(ctx) {
+				t.Error("batch request was not low priority")
+			}
+			if req.Messages[0].Content.Text == "too long" {
+				return nil, &picolm.ContextLengthError{}
+			}
+			return &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}, nil
+		},
+	}
+	handler := newStoreHandler(t, client)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler.Start(ctx)
+
+	file := uploadBatchFile(t, handler, batchLine("req-1", "Hello")+"\n"+batchLine("req-2", "too long"))
+	if file.Purpose != "batch" || file.Filename != "requests.jsonl" || file.Bytes == 0 {
+		t.Errorf("file = %+v", file)
+	}
+
+	created := createBatch(t, handler, file.ID)
+	if created.Status != "validating" || created.RequestCounts.Total != 2 {
+		t.Errorf("created batch = %+v", created)
+	}
+
+	batch := waitBatch(t, handler, created.ID, func(b types.Batch) bool { return b.Status == "completed" })
+	if batch.RequestCounts.Completed != 1 || batch.RequestCounts.Failed != 1 || batch.CompletedAt == nil {
+		t.Errorf("completed batch = %+v", batch)
+	}
+
+	output := fileLines(t, handler, batch.OutputFileID)
+	if len(output) != 1 || output[0].CustomID != "req-1" || output[0].Response.StatusCode != http.StatusOK {
+		t.Fatalf("output = %+v", output)
+	}
+	var completion types.ChatCompletionResponse
+	json.Unmarshal(output[0].Response.Body, &completion)
+	if completion.Choices[0].Message.Content.Text != "Hi" {
+		t.Errorf("completion = %s", output[0].Response.Body)
+	}
+
+	errs := fileLines(t, handler, batch.ErrorFileID)
+	if len(errs) != 1 || errs[0].CustomID != "req-2" || errs[0].Response.StatusCode != http.StatusBadRequest {
+		t.Errorf("errors = %+v", errs)
+	}
+}
+
+func TestBatch_InvalidInput(t *testing.T) {
+	handler := newStoreHandler(t, &mockPicoLMClient{})
+
+	input := batchLine("a", "x") + batchLine("a", "y") + "not json\n" +
+		`{"custom_id":"b","method":"POST","url":"/v1/chat/completions","body":{"stream":true,"messages":[]}}` + "\n" +
+		`{"custom_id":"c","method":"POST","url":"/v1/chat/completions","body":{"n":1000000000,"messages":[]}}` + "\n"
+	file := uploadBatchFile(t, handler, input)
+	batch := createBatch(t, handler, file.ID)
+
+	if batch.Status != "failed" || batch.Errors == nil {
+		t.Fatalf("batch = %+v", batch)
+	}
+	var codes []string
+	for _, e := range batch.Errors.Data {
+		codes = append(codes, e.Code)
+	}
+	if got := strings.Join(codes, ","); got != "duplicate_custom_id,invalid_json_line,invalid_request,invalid_request" {
+		t.Errorf("error codes = %s", got)
+	}
+	if batch.Errors.Data[0].Line != 2 {
+		t.Errorf("duplicate reported on line %d, want 2", batch.Errors.Data[0].Line)
+	}
+
+	w := httptest.NewRecorder()
+	body := `{"input_file_id":"` + file.ID + `","endpoint":"/v1/embeddings","completion_window":"24h"}`
+	handler.HandleBatches(w, httptest.NewRequest(http.MethodPost, "/v1/batches", strings.NewReader(body)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"endpoint"`) {
+		t.Errorf("expected 400 for unsupported endpoint, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestBatch_Cancel(t *testing.T) {
+	client := &chatFuncClient{
+		mockPicoLMClient: &mockPicoLMClient{},
+		chat: func(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	handler := newStoreHandler(t, client)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler.Start(ctx)
+
+	file := uploadBatchFile(t, handler, batchLine("a", "x")+batchLine("b", "y"))
+	created := createBatch(t, handler, file.ID)
+	waitBatch(t, handler, created.ID, func(b types.Batch) bool { return client.lastRequest() != nil })
+
+	w := httptest.NewRecorder()
+	handler.HandleBatch(w, httptest.NewRequest(http.MethodPost, "/v1/batches/"+created.ID+"/cancel", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("cancel: expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	batch := waitBatch(t, handler, created.ID, func(b types.Batch) bool { return b.Status == "cancelled" })
+	if batch.CancellingAt == nil || batch.CancelledAt == nil || batch.OutputFileID != nil {
+		t.Errorf("cancelled batch = %+v", batch)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleBatch(w, httptest.NewRequest(http.MethodPost, "/v1/batches/"+created.ID+"/cancel", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 cancelling a finished batch, got %d", w.Code)
+	}
+}
+
+func TestBatch_ResumeAfterRestart(t *testing.T) {
+	client := &chatFuncClient{
+		mockPicoLMClient: &mockPicoLMClient{},
+		chat: func(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error) {
+			return &picolm.ChatResult{Content: "ok", FinishReason: "stop"}, nil
+		},
+	}
+	first := newStoreHandler(t, client)
+
+	file := uploadBatchFile(t, first, batchLine("a", "x")+batchLine("b", "y"))
+	created := createBatch(t, first, file.ID)
+
+	// The server stopped after recording the result of a and while writing
+	// another line.
+	var sb storedBatch
+	first.store.Get(batchesCollection, created.ID, &sb)
+	sb.Batch.Status = "in_progress"
+	first.store.Put(batchesCollection, created.ID, sb)
+	first.store.AppendBlob(filesCollection, sb.OutputFile, []byte(`{"id":"batch_req_1","custom_id":"a","response":{"status_code":200,"request_id":"r","body":{}}}`+"\n"+`{"id":"batch_`))
+
+	restarted := NewHandler(client, "", WithStore(first.store))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	restarted.Start(ctx)
+
+	batch := waitBatch(t, restarted, created.ID, func(b types.Batch) bool { return b.Status == "completed" })
+	if batch.RequestCounts.Completed != 2 || batch.ErrorFileID != nil {
+		t.Errorf("resumed batch = %+v", batch)
+	}
+	client.mu.Lock()
+	requests := len(client.requests)
+	client.mu.Unlock()
+	if requests != 1 || client.lastRequest().Messages[0].Content.Text != "y" {
+		t.Errorf("expected only b to run after the restart, got %d requests", requests)
+	}
+
+	output := fileLines(t, restarted, batch.OutputFileID)
+	if len(output) != 2 || output[0].CustomID != "a" || output[1].CustomID != "b" {
+		t.Errorf("output = %+v", output)
+	}
+}
+
+func TestFiles_ListAndDelete(t *testing.T) {
+	handler := newStoreHandler(t, &mockPicoLMClient{})
+	file := uploadBatchFile(t, handler, batchLine("a", "x"))
+
+	w := httptest.NewRecorder()
+	handler.HandleFiles(w, httptest.NewRequest(http.MethodGet, "/v1/files?purpose=batch", nil))
+	var list types.CursorList[types.File]
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].ID != file.ID {
+		t.Errorf("list = %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleFile(w, httptest.NewRequest(http.MethodDelete, "/v1/files/"+file.ID, nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deleted":true`) {
+		t.Errorf("delete = %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleFile(w, httptest.NewRequest(http.MethodGet, "/v1/files/"+file.ID+"/content", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after delete, got %d", w.Code)
+	}
+}
@@ -1,60 +1,254 @@
 package handlers
 
 import (
+	"context"
 	"crypto/rand"
-	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/wmik/picolm-server/pkg/auth"
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/metrics"
 	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/ratelimit"
+	"github.com/wmik/picolm-server/pkg/store"
 	"github.com/wmik/picolm-server/pkg/types"
 )
 
 type Handler struct {
-	client picolm.Provider
-	apiKey string
+	client  picolm.Provider
+	keys    *auth.Keyring
+	limits  *ratelimit.Limiter
+	store   *store.Store
+	batches batchRunner
+	jobs    jobRunner
+	webhook webhook
+
+	// completions indexes the stored chat completions for listing.
+	completions completionIndex
+
+	// background is the context of batches and jobs, done on shutdown.
+	background context.Context
 }
 
-func NewHandler(client picolm.Provider, apiKey string) *Handler {
-	return &Handler{
-		client: client,
-		apiKey: apiKey,
+// Option configures optional Handler features.
+type Option func(*Handler)
+
+// WithStore persists responses and other server state in s. Without a
+// store, nothing is kept after a request completes.
+func WithStore(s *store.Store) Option {
+	return func(h *Handler) {
+		h.store = s
 	}
 }
 
-func (h *Handler) requireAuth(w http.ResponseWriter, r *http.Request) bool {
-	if h.apiKey == "" {
-		return true
+// WithKeyring authenticates requests with the keys of kr instead of the
+// single key given to NewHandler.
+func WithKeyring(kr *auth.Keyring) Option {
+	return func(h *Handler) {
+		h.keys = kr
+	}
+}
+
+// WithLimiter enforces the rate limits and token quotas of API keys and
+// users with l.
+func WithLimiter(l *ratelimit.Limiter) Option {
+	return func(h *Handler) {
+		h.limits = l
+	}
+}
+
+// WithJobWorkers sets how many background jobs run at once. Like batch
+// requests, jobs only take worker slots no interactive request is waiting
+// for.
+func WithJobWorkers(n int) Option {
+	return func(h *Handler) {
+		if n > 0 {
+			h.jobs.workers = n
+		}
+	}
+}
+
+// WithBatchWorkers sets how many requests of a batch run at once. Batch
+// requests only take worker slots no interactive request is waiting for.
+func WithBatchWorkers(n int) Option {
+	return func(h *Handler) {
+		if n > 0 {
+			h.batches.workers = n
+		}
+	}
+}
+
+func NewHandler(client picolm.Provider, apiKey string, opts ...Option) *Handler {
+	// A plain key always makes a valid keyring.
+	keys, _ := auth.NewKeyring(apiKey, nil)
+	h := &Handler{
+		client:     client,
+		keys:       keys,
+		background: context.Background(),
+		batches: batchRunner{
+			workers: 1,
+			wake:    make(chan struct{}, 1),
+			running: make(map[string]context.CancelFunc),
+		},
+		jobs: jobRunner{
+			workers: 1,
+			queue:   make(chan storedJob, maxQueuedJobs),
+			slots:   make(chan struct{}, maxQueuedJobs),
+		},
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// requireAuth authenticates the request and checks that its key may use
+// the endpoint group. The returned request carries the key in its context.
+func (h *Handler) requireAuth(w http.ResponseWriter, r *http.Request, endpoint string) (*http.Request, bool) {
+	if !h.keys.Enabled() {
+		return r, true
 	}
 
-	auth := r.Header.Get("Authorization")
-	if auth == "" {
+	// Anthropic clients send the key in x-api-key instead of a bearer token.
+	header := r.Header.Get("Authorization")
+	token := r.Header.Get("X-Api-Key")
+	switch {
+	case header != "":
+		if !strings.HasPrefix(header, "Bearer ") {
+			http.Error(w, "invalid authorization header", http.StatusUnauthorized)
+			return r, false
+		}
+		token = strings.TrimPrefix(header, "Bearer ")
+	case token == "":
 		http.Error(w, "missing authorization header", http.StatusUnauthorized)
-		return false
+		return r, false
 	}
 
-	if !strings.HasPrefix(auth, "Bearer ") {
-		http.Error(w, "invalid authorization header", http.StatusUnauthorized)
-		return false
+	key, err := h.keys.Authenticate(token, time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return r, false
 	}
+	metrics.SetKey(r.Context(), key.Name)
+	r = r.WithContext(auth.WithKey(r.Context(), key))
 
-	token := strings.TrimPrefix(auth, "Bearer ")
-	if subtle.ConstantTimeCompare([]byte(token), []byte(h.apiKey)) != 1 {
-		http.Error(w, "invalid api key", http.StatusUnauthorized)
-		return false
+	if !key.AllowsEndpoint(endpoint) {
+		h.writeErrorCode(w, fmt.Sprintf("API key %q is not allowed to use %s endpoints.", key.Name, endpoint),
+			"permission_error", "insufficient_permissions", http.StatusForbidden)
+		return r, false
 	}
+	return r, true
+}
 
-	return true
+// RequireAdmin serves next only to keys allowed to use admin endpoints.
+func (h *Handler) RequireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r, ok := h.requireAuth(w, r, config.EndpointAdmin); ok {
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// checkLimits admits a request of user against the limits of its key and
+// user, setting the x-ratelimit-* headers. The returned request carries the
+// subjects its tokens are charged to.
+func (h *Handler) checkLimits(w http.ResponseWriter, r *http.Request, user string) (*http.Request, error) {
+	subjects := h.limits.Subjects(auth.FromContext(r.Context()), user)
+	if len(subjects) == 0 {
+		return r, nil
+	}
+	status, err := h.limits.Allow(subjects)
+	status.SetHeaders(w.Header())
+	if err != nil {
+		return r, err
+	}
+	return r.WithContext(ratelimit.WithSubjects(r.Context(), subjects)), nil
+}
+
+// keyContext returns ctx for background work of the key with the given name
+// on behalf of user: records it stores belong to the key, and its tokens are
+// charged to the key and user. It fails once the key was removed or has
+// expired, so that work it queued earlier no longer runs.
+func (h *Handler) keyContext(ctx context.Context, key, user string) (context.Context, error) {
+	k, err := h.keys.Lookup(key, time.Now())
+	if err != nil {
+		return ctx, err
+	}
+	ctx = auth.WithKey(ctx, k)
+	subjects := h.limits.Subjects(k, user)
+	if len(subjects) == 0 {
+		return ctx, nil
+	}
+	return ratelimit.WithSubjects(ctx, subjects), nil
+}
+
+// writeKeyError reports background work whose key was removed or expired.
+func (h *Handler) writeKeyError(w http.ResponseWriter, err error) {
+	h.writeErrorCode(w, err.Error(), "invalid_request_error", "invalid_api_key", http.StatusUnauthorized)
+}
+
+// keyName returns the name of the key a request was authenticated with.
+func keyName(r *http.Request) string {
+	if key := auth.FromContext(r.Context()); key != nil {
+		return key.Name
+	}
+	return ""
+}
+
+// ownedBy reports whether the request may see a stored record of key.
+// Records are only visible to the key that created them; on a server without
+// keys every record has the empty key.
+func ownedBy(r *http.Request, key string) bool {
+	return keyName(r) == key
+}
+
+// allowModel reports whether the request's key may use model.
+func allowModel(r *http.Request, model string) bool {
+	return auth.FromContext(r.Context()).AllowsModel(model)
+}
+
+// availableModel reports whether model is configured and the request's key
+// may use it.
+func (h *Handler) availableModel(r *http.Request, model string) bool {
+	return slices.Contains(h.client.GetModelIDs(), model) && allowModel(r, model)
+}
+
+// requireModel reports whether model is available to the request, answering
+// as OpenAI does for a model that does not exist when it is not. Only an
+// available model is recorded in the metrics, so that clients cannot create
+// a series per made-up name; rejected requests keep the empty model label.
+func (h *Handler) requireModel(w http.ResponseWriter, r *http.Request, model string) bool {
+	if h.availableModel(r, model) {
+		metrics.SetModel(r.Context(), model)
+		return true
+	}
+	h.writeErrorDetail(w, types.ErrorDetail{
+		Message: fmt.Sprintf("The model `%s` does not exist or you do not have access to it.", model),
+		Type:    "invalid_request_error",
+		Param:   "model",
+		Code:    "model_not_found",
+	}, http.StatusNotFound)
+	return false
 }
 
 func (h *Handler) HandleChatCompletions(w http.ResponseWriter, r *http.Request) {
-	if !h.requireAuth(w, r) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		h.listChatCompletions(w, r)
 		return
 	}
 
@@ -65,31 +259,64 @@ func (h *Handler) HandleChatCompletions(w http.ResponseWriter, r *http.Request)
 
 	var req types.ChatCompletionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		h.writeError(w, "invalid request body", "invalid_request_error", http.StatusBadRequest)
+		h.writeDecodeError(w, err)
 		return
 	}
 
 	if req.Model == "" {
 		req.Model = h.client.GetDefaultModel()
 	}
+	if !h.requireModel(w, r, req.Model) {
+		return
+	}
+	if err := h.client.CheckChoices(req.N); err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+	r, err := h.checkLimits(w, r, req.User)
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
 
-	if req.Stream {
-		h.handleStreamingChat(w, r, &req)
+	if req.Background || preferAsync(r) {
+		h.createJob(w, keyName(r), &req)
 		return
 	}
 
-	result, err := h.client.Chat(r.Context(), &req)
-	if err != nil {
-		log.Printf("picolm error: %v", err)
+	h.createChatCompletion(w, r, &req)
+}
 
-		errStr := err.Error()
-		httpStatus := http.StatusInternalServerError
+// createChatCompletion generates and writes the completion for a decoded
+// request. Batches call it directly for each request of their input file.
+func (h *Handler) createChatCompletion(w http.ResponseWriter, r *http.Request, req *types.ChatCompletionRequest) {
+	if req.Model == "" {
+		req.Model = h.client.GetDefaultModel()
+	}
 
-		if strings.Contains(errStr, "timeout") || strings.Contains(errStr, "cancelled") || strings.Contains(errStr, "disconnected") {
-			httpStatus = http.StatusGatewayTimeout
-		}
+	// n is checked before a result or goroutine is allocated per choice.
+	if err := h.client.CheckChoices(req.N); err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
 
-		h.writeError(w, errStr, "internal_error", httpStatus)
+	if req.Stream {
+		h.handleStreamingChat(w, r, req)
+		return
+	}
+
+	n := max(req.N, 1)
+	results := make([]*picolm.ChatResult, n)
+
+	var mu sync.Mutex
+	err := h.runChoices(h.observe(w, r, &mu), req.Model, n, func(ctx context.Context, index int) error {
+		result, err := h.client.Chat(ctx, req)
+		results[index] = result
+		return err
+	})
+	if err != nil {
+		log.Printf("picolm error: %v", err)
+		h.writeInferenceError(w, err)
 		return
 	}
 
@@ -98,19 +325,23 @@ func (h *Handler) HandleChatCompletions(w http.ResponseWriter, r *http.Request)
 		Object:  "chat.completion",
 		Created: time.Now().Unix(),
 		Model:   req.Model,
-		Choices: []types.Choice{
-			{
-				Index: 0,
-				Message: types.ChatMessage{
-					Role:      "assistant",
-					Content:   result.Content,
-					ToolCalls: result.ToolCalls,
-				},
-				FinishReason: result.FinishReason,
+		Choices: make([]types.Choice, n),
+	}
+	for i, result := range results {
+		response.Choices[i] = types.Choice{
+			Index: i,
+			Message: types.ChatMessage{
+				Role:      "assistant",
+				Content:   types.TextContent(result.Content),
+				ToolCalls: result.ToolCalls,
 			},
-		},
-		Usage: result.Usage,
+			FinishReason: result.FinishReason,
+		}
+		response.Usage.PromptTokens += result.Usage.PromptTokens
+		response.Usage.CompletionTokens += result.Usage.CompletionTokens
+		response.Usage.TotalTokens += result.Usage.TotalTokens
 	}
+	h.saveCompletion(keyName(r), req, response)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
@@ -133,25 +364,23 @@ func (h *Handler) handleStreamingChat(w http.ResponseWriter, r *http.Request, re
 	created := time.Now().Unix()
 	model := req.Model
 
-	streamContent := func(content, finishReason string) error {
-		choice := map[string]interface{}{
-			"index": 0,
-			"delta": map[string]interface{}{
-				"content": content,
-			},
-			"finish_reason": finishReason,
-		}
-
-		if finishReason != "" {
-			choice["delta"] = map[string]interface{}{}
-		}
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
 
+	// Choices are generated concurrently; mu serializes their writes and the
+	// header updates made while they are admitted.
+	var mu sync.Mutex
+	started := false
+	writeChunk := func(choices []interface{}, usage *types.Usage) error {
+		started = true
 		resp := map[string]interface{}{
 			"id":      compID,
 			"object":  "chat.completion.chunk",
 			"created": created,
 			"model":   model,
-			"choices": []interface{}{choice},
+			"choices": choices,
+		}
+		if includeUsage {
+			resp["usage"] = usage
 		}
 
 		data, err := json.Marshal(resp)
@@ -164,27 +393,82 @@ func (h *Handler) handleStreamingChat(w http.ResponseWriter, r *http.Request, re
 		return nil
 	}
 
-	err := h.client.StreamChat(r.Context(), req, streamContent)
-	if err != nil {
-		log.Printf("picolm streaming error: %v", err)
+	var usage *types.Usage
+	var streamed streamedChoices
+	streamContent := func(index int, chunk picolm.StreamChunk) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if req.Store {
+			streamed.add(index, chunk)
+		}
 
-		errData, _ := json.Marshal(map[string]interface{}{
-			"error": map[string]string{
-				"message": err.Error(),
-				"type":    "internal_error",
+		choice := map[string]interface{}{
+			"index": index,
+			"delta": map[string]interface{}{
+				"content": chunk.Content,
 			},
+			"finish_reason": chunk.FinishReason,
+		}
+
+		if len(chunk.ToolCalls) > 0 {
+			choice["delta"] = map[string]interface{}{
+				"tool_calls": chunk.ToolCalls,
+			}
+		}
+
+		if chunk.FinishReason != "" {
+			choice["delta"] = map[string]interface{}{}
+			if chunk.Usage != nil {
+				if usage == nil {
+					usage = &types.Usage{}
+				}
+				usage.PromptTokens += chunk.Usage.PromptTokens
+				usage.CompletionTokens += chunk.Usage.CompletionTokens
+				usage.TotalTokens += chunk.Usage.TotalTokens
+			}
+		}
+
+		return writeChunk([]interface{}{choice}, nil)
+	}
+
+	n := max(req.N, 1)
+	err := h.runChoices(h.observe(w, r, &mu), model, n, func(ctx context.Context, index int) error {
+		return h.client.StreamChat(ctx, req, func(chunk picolm.StreamChunk) error {
+			return streamContent(index, chunk)
 		})
-		fmt.Fprintf(w, "data: %s\n\n", errData)
-		flusher.Flush()
+	})
+	if err != nil {
+		log.Printf("picolm streaming error: %v", err)
+		h.writeStreamError(w, flusher, err, started)
 		return
 	}
 
+	if includeUsage && usage != nil {
+		writeChunk([]interface{}{}, usage)
+	}
+
+	if req.Store {
+		response := types.ChatCompletionResponse{
+			ID:      compID,
+			Object:  "chat.completion",
+			Created: created,
+			Model:   model,
+			Choices: streamed.result(n),
+		}
+		if usage != nil {
+			response.Usage = *usage
+		}
+		h.saveCompletion(keyName(r), req, response)
+	}
+
 	fmt.Fprintf(w, "data: [DONE]\n\n")
 	flusher.Flush()
 }
 
 func (h *Handler) HandleModels(w http.ResponseWriter, r *http.Request) {
-	if !h.requireAuth(w, r) {
+	r, ok := h.requireAuth(w, r, config.EndpointModels)
+	if !ok {
 		return
 	}
 
@@ -194,18 +478,21 @@ func (h *Handler) HandleModels(w http.ResponseWriter, r *http.Request) {
 	}
 
 	modelIDs := h.client.GetModelIDs()
-	models := make([]types.Model, len(modelIDs))
-	for i, id := range modelIDs {
+	models := make([]types.Model, 0, len(modelIDs))
+	for _, id := range modelIDs {
+		if !allowModel(r, id) {
+			continue
+		}
 		_, created, err := h.client.GetModelInfo(id)
 		if err != nil {
 			created = 1704067200
 		}
-		models[i] = types.Model{
+		models = append(models, types.Model{
 			ID:      id,
 			Object:  "model",
 			Created: int(created),
 			OwnedBy: "picolm",
-		}
+		})
 	}
 
 	response := types.ModelList{
@@ -218,7 +505,8 @@ func (h *Handler) HandleModels(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *Handler) HandleModelInfo(w http.ResponseWriter, r *http.Request) {
-	if !h.requireAuth(w, r) {
+	r, ok := h.requireAuth(w, r, config.EndpointModels)
+	if !ok {
 		return
 	}
 
@@ -233,11 +521,13 @@ func (h *Handler) HandleModelInfo(w http.ResponseWriter, r *http.Request) {
 	modelIDs := h.client.GetModelIDs()
 	found := slices.Contains(modelIDs, modelID)
 
-	if !found {
+	if !found || !allowModel(r, modelID) {
 		http.Error(w, "model not found", http.StatusNotFound)
 		return
 	}
 
+	metrics.SetModel(r.Context(), modelID)
+
 	_, created, err := h.client.GetModelInfo(modelID)
 	if err != nil {
 		created = 1704067200
@@ -250,6 +540,12 @@ func (h *Handler) HandleModelInfo(w http.ResponseWriter, r *http.Request) {
 		OwnedBy: "picolm",
 	}
 
+	if meta, err := h.client.GetModelMetadata(modelID); err == nil {
+		response.Metadata = meta
+	} else {
+		log.Printf("model metadata unavailable for %s: %v", modelID, err)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
@@ -261,13 +557,190 @@ func (h *Handler) HandleHealth(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-func (h *Handler) writeError(w http.ResponseWriter, message, code string, status int) {
-	response := types.ErrorResponse{
-		Error: types.ErrorDetail{
-			Message: message,
-			Type:    code,
+// observe returns the request context with an observer that reports queue
+// admission through response headers. The headers are set while holding mu,
+// which callers also hold while writing the response.
+func (h *Handler) observe(w http.ResponseWriter, r *http.Request, mu *sync.Mutex) context.Context {
+	return picolm.WithObserver(r.Context(), &picolm.Observer{
+		OnAdmit: func(info picolm.QueueInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("X-Queue-Position", strconv.Itoa(info.Position))
+			w.Header().Set("X-Queue-Wait-Ms", strconv.FormatInt(info.Wait.Milliseconds(), 10))
 		},
+		OnTruncate: func(t picolm.Truncation) {
+			mu.Lock()
+			defer mu.Unlock()
+			w.Header().Set("X-Truncation-Strategy", t.Strategy)
+			w.Header().Set("X-Truncation-Dropped-Messages", strconv.Itoa(t.DroppedMessages))
+		},
+		OnUsage: func(u types.Usage) {
+			if subjects := ratelimit.SubjectsFrom(r.Context()); len(subjects) > 0 {
+				h.limits.Charge(subjects, u.PromptTokens+u.CompletionTokens)
+			}
+		},
+	})
+}
+
+// writeInferenceError reports a failed generation as an HTTP error.
+func (h *Handler) writeInferenceError(w http.ResponseWriter, err error) {
+	if h.writeQueueFull(w, err) || h.writeLimitError(w, err) || h.writeRequestError(w, err) || h.writeFormatError(w, err) {
+		return
 	}
+
+	errStr := err.Error()
+	httpStatus := http.StatusInternalServerError
+
+	if strings.Contains(errStr, "timeout") || strings.Contains(errStr, "cancelled") || strings.Contains(errStr, "disconnected") {
+		httpStatus = http.StatusGatewayTimeout
+	}
+
+	h.writeError(w, errStr, "internal_error", httpStatus)
+}
+
+// inferenceStatus returns the HTTP status for a failed generation, for
+// handlers that report errors in another API's format. It sets Retry-After
+// when the model's queue is full.
+func inferenceStatus(w http.ResponseWriter, err error) int {
+	var qerr *picolm.QueueFullError
+	var lerr *ratelimit.Error
+	switch {
+	case errors.As(err, &qerr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(qerr.RetryAfter.Seconds())))
+		return http.StatusTooManyRequests
+	case errors.As(err, &lerr):
+		w.Header().Set("Retry-After", lerr.RetryAfterSeconds())
+		return http.StatusTooManyRequests
+	case errors.As(err, new(*picolm.ContextLengthError)), errors.As(err, new(*picolm.InvalidRequestError)):
+		return http.StatusBadRequest
+	}
+
+	errStr := err.Error()
+	if strings.Contains(errStr, "timeout") || strings.Contains(errStr, "cancelled") || strings.Contains(errStr, "disconnected") {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// writeStreamError reports a failed streaming generation. Errors that occur
+// before the first event are still sent with their HTTP status; later ones
+// are sent as an error event.
+func (h *Handler) writeStreamError(w http.ResponseWriter, flusher http.Flusher, err error, started bool) {
+	if !started && (h.writeQueueFull(w, err) || h.writeLimitError(w, err) || h.writeRequestError(w, err) || h.writeFormatError(w, err)) {
+		return
+	}
+
+	errData, _ := json.Marshal(map[string]interface{}{
+		"error": map[string]string{
+			"message": err.Error(),
+			"type":    "internal_error",
+		},
+	})
+	fmt.Fprintf(w, "data: %s\n\n", errData)
+	flusher.Flush()
+}
+
+func (h *Handler) writeQueueFull(w http.ResponseWriter, err error) bool {
+	var qerr *picolm.QueueFullError
+	if !errors.As(err, &qerr) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(qerr.RetryAfter.Seconds())))
+	w.Header().Set("X-Queue-Position", strconv.Itoa(qerr.Queued+1))
+	h.writeErrorCode(w, qerr.Error(), "rate_limit_error", "queue_full", http.StatusTooManyRequests)
+	return true
+}
+
+// writeLimitError reports a request rejected by the rate limits or token
+// quotas of its key or user.
+func (h *Handler) writeLimitError(w http.ResponseWriter, err error) bool {
+	var lerr *ratelimit.Error
+	if !errors.As(err, &lerr) {
+		return false
+	}
+	w.Header().Set("Retry-After", lerr.RetryAfterSeconds())
+	h.writeErrorCode(w, lerr.Message, lerr.Type, lerr.Code, http.StatusTooManyRequests)
+	return true
+}
+
+// writeRequestError reports requests that were rejected before inference,
+// such as prompts that overflow the context window.
+func (h *Handler) writeRequestError(w http.ResponseWriter, err error) bool {
+	var cerr *picolm.ContextLengthError
+	if errors.As(err, &cerr) {
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: cerr.Error(),
+			Type:    "invalid_request_error",
+			Param:   "messages",
+			Code:    "context_length_exceeded",
+		}, http.StatusBadRequest)
+		return true
+	}
+
+	var rerr *picolm.InvalidRequestError
+	if errors.As(err, &rerr) {
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: rerr.Message,
+			Type:    "invalid_request_error",
+			Param:   rerr.Param,
+		}, http.StatusBadRequest)
+		return true
+	}
+
+	return false
+}
+
+// writeFormatError reports a model that never produced output matching the
+// requested response_format, or the tool call tool_choice requires.
+func (h *Handler) writeFormatError(w http.ResponseWriter, err error) bool {
+	var ferr *picolm.ResponseFormatError
+	var terr *picolm.ToolChoiceError
+	switch {
+	case errors.As(err, &ferr):
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: ferr.Error(),
+			Type:    "internal_error",
+			Param:   "response_format",
+			Code:    "response_format_failed",
+		}, http.StatusInternalServerError)
+	case errors.As(err, &terr):
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: terr.Error(),
+			Type:    "internal_error",
+			Param:   "tool_choice",
+			Code:    "tool_choice_failed",
+		}, http.StatusInternalServerError)
+	default:
+		return false
+	}
+	return true
+}
+
+// writeDecodeError reports a request body that could not be decoded, naming
+// the offending content part when that is the cause.
+func (h *Handler) writeDecodeError(w http.ResponseWriter, err error) {
+	var cerr *types.UnsupportedContentError
+	if errors.As(err, &cerr) {
+		h.writeErrorCode(w, cerr.Error(), "invalid_request_error", "unsupported_content_type", http.StatusBadRequest)
+		return
+	}
+	h.writeError(w, "invalid request body", "invalid_request_error", http.StatusBadRequest)
+}
+
+func (h *Handler) writeError(w http.ResponseWriter, message, code string, status int) {
+	h.writeErrorCode(w, message, code, "", status)
+}
+
+func (h *Handler) writeErrorCode(w http.ResponseWriter, message, errType, code string, status int) {
+	h.writeErrorDetail(w, types.ErrorDetail{
+		Message: message,
+		Type:    errType,
+		Code:    code,
+	}, status)
+}
+
+func (h *Handler) writeErrorDetail(w http.ResponseWriter, detail types.ErrorDetail, status int) {
+	response := types.ErrorResponse{Error: detail}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	json.NewEncoder(w).Encode(response)
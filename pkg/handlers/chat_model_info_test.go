@@ -43,6 +43,34 @@ func TestHandleModelInfo_Success(t *testing.T) {
 	}
 }
 
+func TestHandleModelInfo_Metadata(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		modelMetadata: &types.ModelMetadata{
+			Architecture:  "llama",
+			Quantization:  "Q4_K_M",
+			ContextLength: 2048,
+		},
+	}
+	handler := NewHandler(mockClient, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/models/picolm-local", nil)
+
+	w := httptest.NewRecorder()
+	handler.HandleModelInfo(w, req)
+
+	var resp types.Model
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+
+	if resp.Metadata == nil {
+		t.Fatal("expected metadata in response")
+	}
+	if resp.Metadata.Architecture != "llama" || resp.Metadata.ContextLength != 2048 {
+		t.Errorf("unexpected metadata: %+v", resp.Metadata)
+	}
+}
+
 func TestHandleModelInfo_NotFound(t *testing.T) {
 	mockClient := &mockPicoLMClient{}
 	handler := NewHandler(mockClient, "")
@@ -10,6 +10,7 @@ import (
 	"testing"
 
 	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
 )
 
 type flusherRecorder struct {
@@ -175,3 +176,213 @@ func TestHandleStreamingChat_NonFlusher(t *testing.T) {
 		t.Error("expected streaming not supported error")
 	}
 }
+
+func TestHandleStreamingChat_IncludeUsage(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Hello"},
+		streamUsage:  &types.Usage{PromptTokens: 12, CompletionTokens: 1, TotalTokens: 13},
+	}
+
+	handler := NewHandler(mockClient, "")
+
+	body := `{"stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	rec := httptest.NewRecorder()
+	w := &flusherRecorder{rec: rec}
+	handler.HandleChatCompletions(w, req)
+
+	var events []map[string]json.RawMessage
+	for _, line := range strings.Split(w.Body().String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var event map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			t.Fatalf("failed to unmarshal event %q: %v", data, err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want 3", len(events))
+	}
+	for _, event := range events[:2] {
+		if string(event["usage"]) != "null" {
+			t.Errorf("usage = %s, want null on content chunks", event["usage"])
+		}
+	}
+
+	last := events[2]
+	if string(last["choices"]) != "[]" {
+		t.Errorf("choices = %s, want []", last["choices"])
+	}
+	var usage types.Usage
+	if err := json.Unmarshal(last["usage"], &usage); err != nil {
+		t.Fatalf("failed to unmarshal usage: %v", err)
+	}
+	if usage != *mockClient.streamUsage {
+		t.Errorf("usage = %+v, want %+v", usage, *mockClient.streamUsage)
+	}
+}
+
+func TestHandleStreamingChat_NoUsageByDefault(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Hello"},
+		streamUsage:  &types.Usage{PromptTokens: 12, CompletionTokens: 1, TotalTokens: 13},
+	}
+
+	handler := NewHandler(mockClient, "")
+
+	body := `{"stream":true,"messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	rec := httptest.NewRecorder()
+	w := &flusherRecorder{rec: rec}
+	handler.HandleChatCompletions(w, req)
+
+	if strings.Contains(w.Body().String(), "usage") {
+		t.Errorf("stream should not include usage unless requested: %s", w.Body().String())
+	}
+}
+
+func TestHandleStreamingChat_FinishReasonLength(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Once upon"},
+		streamFinish: "length",
+	}
+
+	handler := NewHandler(mockClient, "")
+
+	body := `{"stream":true,"max_tokens":2,"messages":[{"role":"user","content":"Tell a story"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	rec := httptest.NewRecorder()
+	w := &flusherRecorder{rec: rec}
+	handler.HandleChatCompletions(w, req)
+
+	if !strings.Contains(w.Body().String(), `"finish_reason":"length"`) {
+		t.Errorf("final chunk should report finish_reason length: %s", w.Body().String())
+	}
+}
+
+func TestHandleStreamingChat_ToolCalls(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamToolCalls: [][]types.ToolCallDelta{
+			{{Index: 0, ID: "call_1", Type: "function", Function: types.CallFunctionDelta{Name: "get_weather"}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `{"city":`}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `"Nairobi"}`}}},
+		},
+		streamFinish: "tool_calls",
+	}
+
+	handler := NewHandler(mockClient, "")
+
+	body := `{"stream":true,"messages":[{"role":"user","content":"Weather?"}],"tools":[{"type":"function","function":{"name":"get_weather"}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	rec := httptest.NewRecorder()
+	w := &flusherRecorder{rec: rec}
+	handler.HandleChatCompletions(w, req)
+
+	type chunk struct {
+		Choices []struct {
+			Delta struct {
+				Content   *string               `json:"content"`
+				ToolCalls []types.ToolCallDelta `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+
+	var deltas []types.ToolCallDelta
+	var finishReason string
+	for _, line := range strings.Split(w.Body().String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var c chunk
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			t.Fatalf("failed to unmarshal chunk %q: %v", data, err)
+		}
+		for _, choice := range c.Choices {
+			if choice.Delta.Content != nil {
+				t.Errorf("unexpected content delta %q", *choice.Delta.Content)
+			}
+			deltas = append(deltas, choice.Delta.ToolCalls...)
+			if choice.FinishReason != "" {
+				finishReason = choice.FinishReason
+			}
+		}
+	}
+
+	if len(deltas) != 3 || deltas[0].ID != "call_1" || deltas[0].Function.Name != "get_weather" {
+		t.Fatalf("tool call deltas = %+v", deltas)
+	}
+	if args := deltas[1].Function.Arguments + deltas[2].Function.Arguments; args != `{"city":"Nairobi"}` {
+		t.Errorf("arguments = %q", args)
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("finish_reason = %q, want tool_calls", finishReason)
+	}
+}
+
+func TestHandleStreamingChat_MultipleChoices(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Hello", " world"},
+		streamUsage:  &types.Usage{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7},
+		available:    2,
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"messages":[{"role":"user","content":"Hi"}],"stream":true,"n":2,"stream_options":{"include_usage":true}}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	w := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleChatCompletions(w, req)
+
+	content := make(map[int]string)
+	finished := make(map[int]string)
+	var usage *types.Usage
+
+	for _, line := range strings.Split(w.Body().String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok || data == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Index        int               `json:"index"`
+				Delta        map[string]string `json:"delta"`
+				FinishReason string            `json:"finish_reason"`
+			} `json:"choices"`
+			Usage *types.Usage `json:"usage"`
+		}
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		for _, choice := range chunk.Choices {
+			content[choice.Index] += choice.Delta["content"]
+			if choice.FinishReason != "" {
+				finished[choice.Index] = choice.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if content[i] != "Hello world" || finished[i] != "stop" {
+			t.Errorf("choice %d: content %q, finish_reason %q", i, content[i], finished[i])
+		}
+	}
+	if len(content) != 2 {
+		t.Errorf("got choices %v, want indexes 0 and 1", content)
+	}
+	if usage == nil || *usage != (types.Usage{PromptTokens: 10, CompletionTokens: 4, TotalTokens: 14}) {
+		t.Errorf("usage = %+v, want summed usage", usage)
+	}
+}
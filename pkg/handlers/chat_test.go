@@ -7,8 +7,13 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/wmik/picolm-server/pkg/config"
 	"github.com/wmik/picolm-server/pkg/picolm"
 	"github.com/wmik/picolm-server/pkg/types"
 )
@@ -19,12 +24,39 @@ type mockPicoLMClient struct {
 	streamTokens     []string
 	streamErr        error
 	streamHandler    picolm.StreamHandler
+	streamUsage      *types.Usage
+	streamFinish     string
+	streamStop       string
+	streamToolCalls  [][]types.ToolCallDelta
 	modelInfoPath    string
 	modelInfoCreated int64
 	modelInfoErr     error
+	modelMetadata    *types.ModelMetadata
+	available        int
+	chatCalls        atomic.Int32
+
+	mu       sync.Mutex
+	requests []*types.ChatCompletionRequest
+}
+
+func (m *mockPicoLMClient) record(req *types.ChatCompletionRequest) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, req)
+}
+
+func (m *mockPicoLMClient) lastRequest() *types.ChatCompletionRequest {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.requests) == 0 {
+		return nil
+	}
+	return m.requests[len(m.requests)-1]
 }
 
 func (m *mockPicoLMClient) Chat(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error) {
+	m.chatCalls.Add(1)
+	m.record(req)
 	if m.err != nil {
 		return nil, m.err
 	}
@@ -32,18 +64,55 @@ func (m *mockPicoLMClient) Chat(ctx context.Context, req *types.ChatCompletionRe
 }
 
 func (m *mockPicoLMClient) StreamChat(ctx context.Context, req *types.ChatCompletionRequest, handler picolm.StreamHandler) error {
+	m.record(req)
 	if m.streamErr != nil {
 		return m.streamErr
 	}
 	if m.streamHandler != nil {
-		return m.streamHandler("", "")
+		return m.streamHandler(picolm.StreamChunk{})
+	}
+	for _, token := range m.streamTokens {
+		if err := handler(picolm.StreamChunk{Content: token}); err != nil {
+			return err
+		}
+	}
+	for _, delta := range m.streamToolCalls {
+		if err := handler(picolm.StreamChunk{ToolCalls: delta}); err != nil {
+			return err
+		}
+	}
+	finishReason := m.streamFinish
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	return handler(picolm.StreamChunk{FinishReason: finishReason, StopSequence: m.streamStop, Usage: m.streamUsage})
+}
+
+func (m *mockPicoLMClient) Complete(ctx context.Context, req *types.CompletionRequest, prompt string) (*picolm.CompletionResult, error) {
+	if m.err != nil {
+		return nil, m.err
+	}
+	return &picolm.CompletionResult{
+		Text:         m.response.Content,
+		FinishReason: m.response.FinishReason,
+		Usage:        m.response.Usage,
+	}, nil
+}
+
+func (m *mockPicoLMClient) StreamComplete(ctx context.Context, req *types.CompletionRequest, prompt string, handler picolm.StreamHandler) error {
+	if m.streamErr != nil {
+		return m.streamErr
 	}
 	for _, token := range m.streamTokens {
-		if err := handler(token, ""); err != nil {
+		if err := handler(picolm.StreamChunk{Content: token}); err != nil {
 			return err
 		}
 	}
-	return handler("", "stop")
+	finishReason := m.streamFinish
+	if finishReason == "" {
+		finishReason = "stop"
+	}
+	return handler(picolm.StreamChunk{FinishReason: finishReason, StopSequence: m.streamStop, Usage: m.streamUsage})
 }
 
 func (m *mockPicoLMClient) GetDefaultModel() string {
@@ -69,6 +138,24 @@ func (m *mockPicoLMClient) GetModelInfo(modelName string) (string, int64, error)
 	return path, created, nil
 }
 
+func (m *mockPicoLMClient) GetModelMetadata(modelName string) (*types.ModelMetadata, error) {
+	if m.modelMetadata == nil {
+		return nil, fmt.Errorf("no metadata")
+	}
+	return m.modelMetadata, nil
+}
+
+func (m *mockPicoLMClient) CheckChoices(n int) error {
+	if n < 0 || n > 4 {
+		return &picolm.InvalidRequestError{Param: "n", Message: fmt.Sprintf("n must be between 1 and 4, got %d", n)}
+	}
+	return nil
+}
+
+func (m *mockPicoLMClient) Available(modelName string) int {
+	return m.available
+}
+
 func (m *mockPicoLMClient) Validate() error {
 	return nil
 }
@@ -111,7 +198,7 @@ func TestHandleChatCompletions_Success(t *testing.T) {
 		t.Fatalf("failed to unmarshal response: %v", err)
 	}
 
-	if resp.Choices[0].Message.Content != "Hello! How can I help you?" {
+	if resp.Choices[0].Message.Content.String() != "Hello! How can I help you?" {
 		t.Errorf("unexpected content: %s", resp.Choices[0].Message.Content)
 	}
 
@@ -204,7 +291,7 @@ func TestRequireAuth_NoAPIKey(t *testing.T) {
 	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
 	w := httptest.NewRecorder()
 
-	result := handler.requireAuth(w, req)
+	_, result := handler.requireAuth(w, req, config.EndpointModels)
 	if !result {
 		t.Error("expected auth to pass when no API key configured")
 	}
@@ -254,7 +341,7 @@ func TestRequireAuth_WithAPIKey(t *testing.T) {
 			}
 			w := httptest.NewRecorder()
 
-			result := handler.requireAuth(w, req)
+			_, result := handler.requireAuth(w, req, config.EndpointModels)
 
 			if result != tt.wantAuth {
 				t.Errorf("requireAuth() = %v, want %v", result, tt.wantAuth)
@@ -265,3 +352,198 @@ func TestRequireAuth_WithAPIKey(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleChatCompletions_QueueFull(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		err: &picolm.QueueFullError{Model: "picolm-local", Queued: 16, Capacity: 16, RetryAfter: 30 * time.Second},
+	}
+
+	handler := NewHandler(mockClient, "")
+
+	body := map[string]interface{}{
+		"messages": []map[string]string{
+			{"role": "user", "content": "Hi"},
+		},
+	}
+	jsonBody, _ := json.Marshal(body)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader(jsonBody))
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want %q", got, "30")
+	}
+
+	var resp types.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Error.Code != "queue_full" {
+		t.Errorf("error code = %q, want %q", resp.Error.Code, "queue_full")
+	}
+}
+
+func TestHandleChatCompletions_ContentParts(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "Hi there", FinishReason: "stop"},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"messages":[{"role":"user","content":[{"type":"text","text":"Hi"}]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader([]byte(body)))
+
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+}
+
+func TestHandleChatCompletions_UnsupportedContentPart(t *testing.T) {
+	handler := NewHandler(&mockPicoLMClient{}, "")
+
+	body := `{"messages":[{"role":"user","content":[{"type":"text","text":"What is this?"},{"type":"image_url","image_url":{"url":"https://example.com/cat.png"}}]}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", bytes.NewReader([]byte(body)))
+
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+
+	var resp types.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Error.Type != "invalid_request_error" {
+		t.Errorf("error type = %q, want invalid_request_error", resp.Error.Type)
+	}
+	if !strings.Contains(resp.Error.Message, `"image_url"`) {
+		t.Errorf("error message %q should name the unsupported part type", resp.Error.Message)
+	}
+}
+
+func TestHandleChatCompletions_ContextLengthExceeded(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		err: &picolm.ContextLengthError{Model: "picolm-local", ContextLength: 2048, PromptTokens: 3000},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", w.Code)
+	}
+
+	var resp types.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Error.Code != "context_length_exceeded" {
+		t.Errorf("error code = %q, want context_length_exceeded", resp.Error.Code)
+	}
+	if resp.Error.Param != "messages" {
+		t.Errorf("error param = %q, want messages", resp.Error.Param)
+	}
+}
+
+func TestHandleChatCompletions_ResponseFormatFailed(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		err: &picolm.ResponseFormatError{Format: "json_schema", Attempts: 3, Err: fmt.Errorf("output is not valid JSON")},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"messages":[{"role":"user","content":"Hi"}],"response_format":{"type":"json_schema","json_schema":{"name":"answer","schema":{"type":"object"}}}}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+
+	var resp types.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Error.Code != "response_format_failed" || resp.Error.Param != "response_format" {
+		t.Errorf("error = %+v", resp.Error)
+	}
+	if !strings.Contains(resp.Error.Message, "after 3 attempts") {
+		t.Errorf("error message = %q", resp.Error.Message)
+	}
+}
+
+func TestHandleChatCompletions_ToolChoiceFailed(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		err: &picolm.ToolChoiceError{Mode: "required", Attempts: 2, Err: fmt.Errorf("no tool call")},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"messages":[{"role":"user","content":"Hi"}],"tools":[{"type":"function","function":{"name":"get_time"}}],"tool_choice":"required"}`
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", w.Code)
+	}
+	var resp types.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Error.Code != "tool_choice_failed" || resp.Error.Param != "tool_choice" {
+		t.Errorf("error = %+v", resp.Error)
+	}
+}
+
+func TestHandleChatCompletions_MultipleChoices(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content:      "Hello",
+			FinishReason: "stop",
+			Usage:        types.Usage{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7},
+		},
+		available: 2,
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"messages":[{"role":"user","content":"Hi"}],"n":3}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp types.ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if len(resp.Choices) != 3 {
+		t.Fatalf("expected 3 choices, got %d", len(resp.Choices))
+	}
+	for i, choice := range resp.Choices {
+		if choice.Index != i || choice.FinishReason != "stop" || choice.Message.Content.String() != "Hello" {
+			t.Errorf("choice %d = %+v", i, choice)
+		}
+	}
+	if want := (types.Usage{PromptTokens: 15, CompletionTokens: 6, TotalTokens: 21}); resp.Usage != want {
+		t.Errorf("usage = %+v, want %+v", resp.Usage, want)
+	}
+	if calls := mockClient.chatCalls.Load(); calls != 3 {
+		t.Errorf("Chat called %d times, want 3", calls)
+	}
+}
@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+// runChoices calls generate for each of n choices. Choices run concurrently
+// up to the number of free worker slots for the model, and one at a time when
+// there are none. The first error cancels the remaining choices.
+func (h *Handler) runChoices(ctx context.Context, model string, n int, generate func(ctx context.Context, index int) error) error {
+	if n <= 1 {
+		return generate(ctx, 0)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	width := min(n, max(h.client.Available(model), 1))
+	sem := make(chan struct{}, width)
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				fail(ctx.Err())
+				return
+			}
+			defer func() { <-sem }()
+
+			if err := generate(ctx, index); err != nil {
+				fail(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	return firstErr
+}
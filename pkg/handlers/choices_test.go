@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestRunChoices_Concurrency(t *testing.T) {
+	tests := []struct {
+		name      string
+		available int
+		wantMax   int
+	}{
+		{name: "no free slots runs sequentially", available: 0, wantMax: 1},
+		{name: "limited by free slots", available: 2, wantMax: 2},
+		{name: "limited by n", available: 8, wantMax: 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHandler(&mockPicoLMClient{available: tt.available}, "")
+
+			var mu sync.Mutex
+			running, peak := 0, 0
+			seen := make(map[int]bool)
+
+			err := h.runChoices(context.Background(), "picolm-local", 4, func(ctx context.Context, index int) error {
+				mu.Lock()
+				running++
+				peak = max(peak, running)
+				seen[index] = true
+				mu.Unlock()
+
+				time.Sleep(20 * time.Millisecond)
+
+				mu.Lock()
+				running--
+				mu.Unlock()
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("runChoices() error = %v", err)
+			}
+			if peak != tt.wantMax {
+				t.Errorf("peak concurrency = %d, want %d", peak, tt.wantMax)
+			}
+			if len(seen) != 4 {
+				t.Errorf("generated choices %v, want 0-3", seen)
+			}
+		})
+	}
+}
+
+func TestRunChoices_ErrorCancels(t *testing.T) {
+	h := NewHandler(&mockPicoLMClient{available: 3}, "")
+	boom := errors.New("boom")
+
+	err := h.runChoices(context.Background(), "picolm-local", 3, func(ctx context.Context, index int) error {
+		if index == 0 {
+			return boom
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+			return errors.New("choice was not cancelled")
+		}
+	})
+	if !errors.Is(err, boom) {
+		t.Errorf("runChoices() error = %v, want %v", err, boom)
+	}
+}
+
+func TestChatCompletions_TooManyChoices(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		client := &mockPicoLMClient{}
+		handler := NewHandler(client, "")
+
+		body := fmt.Sprintf(`{"messages":[{"role":"user","content":"Hi"}],"n":1000000000,"stream":%v}`, stream)
+		w := httptest.NewRecorder()
+		handler.HandleChatCompletions(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("stream=%v: expected status 400, got %d: %s", stream, w.Code, w.Body.String())
+		}
+		var resp types.ErrorResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Error.Type != "invalid_request_error" || resp.Error.Param != "n" {
+			t.Errorf("stream=%v: error = %+v, want invalid_request_error for n", stream, resp.Error)
+		}
+		if client.lastRequest() != nil {
+			t.Errorf("stream=%v: client should not be called", stream)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// maxPrompts is the largest number of prompts accepted in one request.
+const maxPrompts = 64
+
+// HandleCompletions serves the legacy text completion API. Prompts are sent
+// to picolm as they are, without a chat template. Each prompt gets n
+// choices, indexed prompt by prompt.
+func (h *Handler) HandleCompletions(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.CompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	if req.Model == "" {
+		req.Model = h.client.GetDefaultModel()
+	}
+	if !h.requireModel(w, r, req.Model) {
+		return
+	}
+	if len(req.Prompt) == 0 {
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: "prompt is required",
+			Type:    "invalid_request_error",
+			Param:   "prompt",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	// Every prompt gets n choices, so both are bounded before anything is
+	// allocated for them.
+	if err := h.client.CheckChoices(req.N); err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+	if len(req.Prompt) > maxPrompts {
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: fmt.Sprintf("prompt must have at most %d entries, got %d", maxPrompts, len(req.Prompt)),
+			Type:    "invalid_request_error",
+			Param:   "prompt",
+		}, http.StatusBadRequest)
+		return
+	}
+	r, err := h.checkLimits(w, r, req.User)
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+
+	if req.Stream {
+		h.handleStreamingCompletion(w, r, &req)
+		return
+	}
+
+	n := max(req.N, 1)
+	results := make([]*picolm.CompletionResult, len(req.Prompt)*n)
+
+	var mu sync.Mutex
+	err = h.runChoices(h.observe(w, r, &mu), req.Model, len(results), func(ctx context.Context, index int) error {
+		result, err := h.client.Complete(ctx, &req, req.Prompt[index/n])
+		results[index] = result
+		return err
+	})
+	if err != nil {
+		log.Printf("picolm error: %v", err)
+		h.writeInferenceError(w, err)
+		return
+	}
+
+	response := types.CompletionResponse{
+		ID:      "cmpl-" + generateID(),
+		Object:  "text_completion",
+		Created: time.Now().Unix(),
+		Model:   req.Model,
+		Choices: make([]types.CompletionChoice, len(results)),
+		Usage:   &types.Usage{},
+	}
+	for i, result := range results {
+		text := result.Text
+		if req.Echo {
+			text = req.Prompt[i/n] + text
+		}
+		finishReason := result.FinishReason
+		response.Choices[i] = types.CompletionChoice{
+			Text:         text,
+			Index:        i,
+			FinishReason: &finishReason,
+		}
+		response.Usage.PromptTokens += result.Usage.PromptTokens
+		response.Usage.CompletionTokens += result.Usage.CompletionTokens
+		response.Usage.TotalTokens += result.Usage.TotalTokens
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Handler) handleStreamingCompletion(w http.ResponseWriter, r *http.Request, req *types.CompletionRequest) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	cmplID := "cmpl-" + generateID()
+	created := time.Now().Unix()
+
+	includeUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+
+	var mu sync.Mutex
+	started := false
+	writeChunk := func(choices []types.CompletionChoice, usage *types.Usage) {
+		started = true
+		data, _ := json.Marshal(types.CompletionResponse{
+			ID:      cmplID,
+			Object:  "text_completion",
+			Created: created,
+			Model:   req.Model,
+			Choices: choices,
+			Usage:   usage,
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		flusher.Flush()
+	}
+
+	var usage types.Usage
+	n := max(req.N, 1)
+
+	err := h.runChoices(h.observe(w, r, &mu), req.Model, len(req.Prompt)*n, func(ctx context.Context, index int) error {
+		prompt := req.Prompt[index/n]
+		echoed := !req.Echo
+
+		return h.client.StreamComplete(ctx, req, prompt, func(chunk picolm.StreamChunk) error {
+			mu.Lock()
+			defer mu.Unlock()
+
+			choice := types.CompletionChoice{Text: chunk.Content, Index: index}
+			if !echoed {
+				choice.Text = prompt + choice.Text
+				echoed = true
+			}
+			if chunk.FinishReason != "" {
+				finishReason := chunk.FinishReason
+				choice.FinishReason = &finishReason
+				if chunk.Usage != nil {
+					usage.PromptTokens += chunk.Usage.PromptTokens
+					usage.CompletionTokens += chunk.Usage.CompletionTokens
+					usage.TotalTokens += chunk.Usage.TotalTokens
+				}
+			}
+
+			writeChunk([]types.CompletionChoice{choice}, nil)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("picolm streaming error: %v", err)
+		h.writeStreamError(w, flusher, err, started)
+		return
+	}
+
+	if includeUsage {
+		writeChunk([]types.CompletionChoice{}, &usage)
+	}
+
+	fmt.Fprintf(w, "data: [DONE]\n\n")
+	flusher.Flush()
+}
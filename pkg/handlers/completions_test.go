@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/metrics"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestHandleCompletions_Success(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content:      " world",
+			FinishReason: "length",
+			Usage:        types.Usage{PromptTokens: 2, CompletionTokens: 1, TotalTokens: 3},
+		},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"model":"picolm-local","prompt":["Hello","Goodbye"],"n":2,"echo":true,"max_tokens":1}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler.HandleCompletions(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp types.CompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Object != "text_completion" || !strings.HasPrefix(resp.ID, "cmpl-") {
+		t.Errorf("unexpected response envelope: %+v", resp)
+	}
+
+	want := []string{"Hello world", "Hello world", "Goodbye world", "Goodbye world"}
+	if len(resp.Choices) != len(want) {
+		t.Fatalf("expected %d choices, got %d", len(want), len(resp.Choices))
+	}
+	for i, choice := range resp.Choices {
+		if choice.Index != i || choice.Text != want[i] || choice.FinishReason == nil || *choice.FinishReason != "length" {
+			t.Errorf("choice %d = %+v", i, choice)
+		}
+	}
+	if resp.Usage == nil || resp.Usage.TotalTokens != 12 {
+		t.Errorf("usage = %+v, want summed usage", resp.Usage)
+	}
+}
+
+func TestHandleCompletions_InvalidPrompt(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "missing prompt", body: `{"model":"picolm-local"}`},
+		{name: "token array", body: `{"model":"picolm-local","prompt":[1,2,3]}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewHandler(&mockPicoLMClient{}, "")
+			req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(tt.body))
+
+			w := httptest.NewRecorder()
+			handler.HandleCompletions(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("expected status 400, got %d", w.Code)
+			}
+		})
+	}
+}
+
+func TestHandleCompletions_ContextLengthExceeded(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		err: &picolm.ContextLengthError{Model: "picolm-local", ContextLength: 2048, PromptTokens: 3000},
+	}
+	handler := NewHandler(mockClient, "")
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(`{"prompt":"Hi"}`))
+	w := httptest.NewRecorder()
+	handler.HandleCompletions(w, req)
+
+	var resp types.ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusBadRequest || resp.Error.Code != "context_length_exceeded" {
+		t.Errorf("got %d %+v", w.Code, resp.Error)
+	}
+}
+
+func TestHandleCompletions_Streaming(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{" upon", " a time"},
+		streamUsage:  &types.Usage{PromptTokens: 1, CompletionTokens: 3, TotalTokens: 4},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"prompt":"Once","stream":true,"echo":true,"stream_options":{"include_usage":true}}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body))
+
+	w := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleCompletions(w, req)
+
+	var text strings.Builder
+	var finishReason string
+	var usage *types.Usage
+	done := false
+
+	for _, line := range strings.Split(w.Body().String(), "\n") {
+		data, ok := strings.CutPrefix(line, "data: ")
+		if !ok {
+			continue
+		}
+		if data == "[DONE]" {
+			done = true
+			continue
+		}
+		var chunk types.CompletionResponse
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			t.Fatalf("invalid chunk %q: %v", data, err)
+		}
+		if chunk.Object != "text_completion" {
+			t.Errorf("chunk object = %q", chunk.Object)
+		}
+		for _, choice := range chunk.Choices {
+			text.WriteString(choice.Text)
+			if choice.FinishReason != nil {
+				finishReason = *choice.FinishReason
+			}
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+	}
+
+	if text.String() != "Once upon a time" {
+		t.Errorf("streamed text = %q", text.String())
+	}
+	if finishReason != "stop" || !done {
+		t.Errorf("finish_reason = %q, done = %v", finishReason, done)
+	}
+	if usage == nil || usage.TotalTokens != 4 {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestHandleCompletions_Bounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		wantParam string
+	}{
+		{name: "too many choices", body: `{"prompt":"Hi","n":1000000000}`, wantParam: "n"},
+		{name: "too many prompts", body: `{"prompt":[` + strings.TrimSuffix(strings.Repeat(`"Hi",`, maxPrompts+1), ",") + `]}`, wantParam: "prompt"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewHandler(&mockPicoLMClient{}, "")
+			w := httptest.NewRecorder()
+			handler.HandleCompletions(w, httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(tt.body)))
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", w.Code, w.Body.String())
+			}
+			var resp types.ErrorResponse
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Error.Param != tt.wantParam {
+				t.Errorf("param = %q, want %q", resp.Error.Param, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestHandleCompletions_ModelLabel(t *testing.T) {
+	client := &mockPicoLMClient{response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}}
+	handler := metrics.Instrument("/test/completions/model", http.HandlerFunc(NewHandler(client, "").HandleCompletions))
+
+	for _, model := range []string{"made-up-model", "picolm-local"} {
+		body := `{"model":"` + model + `","prompt":"Hi"}`
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/v1/completions", strings.NewReader(body)))
+	}
+
+	var sb strings.Builder
+	metrics.Default.Write(&sb)
+	out := sb.String()
+
+	for _, want := range []string{
+		`picolm_http_requests_total{path="/test/completions/model",status="404",model=""} 1`,
+		`picolm_http_requests_total{path="/test/completions/model",status="200",model="picolm-local"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+	if strings.Contains(out, "made-up-model") {
+		t.Error("an unknown model should not become a label value")
+	}
+}
@@ -0,0 +1,263 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// Files are kept as a record with their metadata and a blob with their
+// content, both under the file's ID.
+const filesCollection = "files"
+
+const maxFileSize = 200 << 20
+
+// storedFile is the record of a file. Key names the API key that created
+// it; the file itself is what clients see.
+type storedFile struct {
+	types.File
+	Key string `json:"key,omitempty"`
+}
+
+// loadFile returns the record of a file of the request's key. Files of other
+// keys are not found.
+func (h *Handler) loadFile(r *http.Request, id string) (*storedFile, error) {
+	var file storedFile
+	if err := h.store.Get(filesCollection, id, &file); err != nil {
+		return nil, err
+	}
+	if !ownedBy(r, file.Key) {
+		return nil, store.ErrNotFound
+	}
+	return &file, nil
+}
+
+// HandleFiles uploads a file with POST /v1/files and lists files with
+// GET /v1/files.
+func (h *Handler) HandleFiles(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok || !h.requireStore(w) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		h.uploadFile(w, r)
+	case http.MethodGet:
+		h.listFiles(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadFile stores the file part of a multipart upload. Only batch input
+// files are accepted, since nothing else reads uploaded files.
+func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize+1<<20)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		h.writeError(w, "request body must be multipart/form-data", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+
+	var purpose string
+	var file *types.File
+	fail := func(status int, detail types.ErrorDetail) {
+		if file != nil {
+			h.store.DeleteBlob(filesCollection, file.ID)
+		}
+		h.writeErrorDetail(w, detail, status)
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(uploadStatus(err, http.StatusBadRequest), types.ErrorDetail{Message: "failed to read upload: " + err.Error(), Type: "invalid_request_error"})
+			return
+		}
+
+		switch part.FormName() {
+		case "purpose":
+			data, _ := io.ReadAll(io.LimitReader(part, 64))
+			purpose = string(data)
+		case "file":
+			if file != nil {
+				fail(http.StatusBadRequest, types.ErrorDetail{Message: "only one file may be uploaded", Type: "invalid_request_error", Param: "file"})
+				return
+			}
+			file = &types.File{
+				ID:        "file-" + generateID(),
+				Object:    "file",
+				CreatedAt: time.Now().Unix(),
+				Filename:  part.FileName(),
+			}
+			file.Bytes, err = h.store.PutBlob(filesCollection, file.ID, part)
+			if err != nil {
+				if status := uploadStatus(err, http.StatusInternalServerError); status == http.StatusRequestEntityTooLarge {
+					fail(status, types.ErrorDetail{Message: err.Error(), Type: "invalid_request_error", Param: "file"})
+					return
+				}
+				log.Printf("failed to store file %s: %v", file.ID, err)
+				fail(http.StatusInternalServerError, types.ErrorDetail{Message: "failed to store file", Type: "internal_error"})
+				return
+			}
+			if file.Bytes > maxFileSize {
+				fail(http.StatusRequestEntityTooLarge, types.ErrorDetail{
+					Message: fmt.Sprintf("file exceeds the maximum size of %d bytes", maxFileSize),
+					Type:    "invalid_request_error",
+					Param:   "file",
+				})
+				return
+			}
+		}
+		part.Close()
+	}
+
+	switch {
+	case file == nil:
+		fail(http.StatusBadRequest, types.ErrorDetail{Message: "file is required", Type: "invalid_request_error", Param: "file"})
+		return
+	case purpose != "batch":
+		fail(http.StatusBadRequest, types.ErrorDetail{Message: `purpose must be "batch"`, Type: "invalid_request_error", Param: "purpose"})
+		return
+	}
+
+	file.Purpose = purpose
+	if err := h.store.Put(filesCollection, file.ID, storedFile{File: *file, Key: keyName(r)}); err != nil {
+		log.Printf("failed to store file %s: %v", file.ID, err)
+		fail(http.StatusInternalServerError, types.ErrorDetail{Message: "failed to store file", Type: "internal_error"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(file)
+}
+
+// uploadStatus returns the HTTP status for a failed upload: 413 when the
+// body was too large and fallback otherwise.
+func uploadStatus(err error, fallback int) int {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return fallback
+}
+
+func (h *Handler) listFiles(w http.ResponseWriter, r *http.Request) {
+	stored, err := store.List[storedFile](h.store, filesCollection)
+	if err != nil {
+		log.Printf("failed to list files: %v", err)
+		h.writeError(w, "failed to list files", "internal_error", http.StatusInternalServerError)
+		return
+	}
+
+	query := r.URL.Query()
+	purpose := query.Get("purpose")
+	var files []types.File
+	for _, f := range stored {
+		if ownedBy(r, f.Key) && (purpose == "" || f.Purpose == purpose) {
+			files = append(files, f.File)
+		}
+	}
+	slices.SortStableFunc(files, func(a, b types.File) int {
+		if c := cmp.Compare(a.CreatedAt, b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+
+	page, err := paginate(query, files, func(f types.File) string { return f.ID })
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// HandleFile serves a file's metadata at /v1/files/{id} and its content at
+// /v1/files/{id}/content.
+func (h *Handler) HandleFile(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok || !h.requireStore(w) {
+		return
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/files/"), "/")
+
+	file, err := h.loadFile(r, id)
+	if err != nil {
+		h.writeFileNotFound(w, id, err)
+		return
+	}
+
+	switch {
+	case sub == "content" && r.Method == http.MethodGet:
+		content, err := h.store.OpenBlob(filesCollection, id)
+		if err != nil {
+			h.writeFileNotFound(w, id, err)
+			return
+		}
+		defer content.Close()
+		w.Header().Set("Content-Type", "application/jsonl")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file.Filename))
+		io.Copy(w, content)
+
+	case sub != "":
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(file.File)
+
+	case r.Method == http.MethodDelete:
+		if err := h.store.Delete(filesCollection, id); err != nil {
+			h.writeFileNotFound(w, id, err)
+			return
+		}
+		if err := h.store.DeleteBlob(filesCollection, id); err != nil && !errors.Is(err, store.ErrNotFound) {
+			log.Printf("failed to delete content of file %s: %v", id, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.DeletedObject{ID: id, Object: "file", Deleted: true})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) writeFileNotFound(w http.ResponseWriter, id string, err error) {
+	if !errors.Is(err, store.ErrNotFound) {
+		log.Printf("failed to load file %s: %v", id, err)
+		h.writeError(w, "failed to load file", "internal_error", http.StatusInternalServerError)
+		return
+	}
+	h.writeErrorDetail(w, types.ErrorDetail{
+		Message: fmt.Sprintf("No such File object: %s", id),
+		Type:    "invalid_request_error",
+	}, http.StatusNotFound)
+}
+
+// requireStore rejects requests for features that keep state when the
+// handler has no store.
+func (h *Handler) requireStore(w http.ResponseWriter) bool {
+	if h.store != nil {
+		return true
+	}
+	h.writeError(w, "this endpoint requires a data directory", "internal_error", http.StatusNotImplemented)
+	return false
+}
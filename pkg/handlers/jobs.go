@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+const jobsCollection = "jobs"
+
+// maxQueuedJobs bounds the jobs waiting for a job worker. Jobs beyond it
+// are refused with 429 rather than accepted and left to wait.
+const maxQueuedJobs = 64
+
+// jobRetryAfter is suggested to clients whose job was refused.
+const jobRetryAfter = 10 * time.Second
+
+// jobRunner runs jobs on a fixed number of workers at low priority, so that
+// jobs only take inference slots no interactive request is waiting for.
+// slots holds a token for every job accepted but not yet started.
+type jobRunner struct {
+	workers int
+	queue   chan storedJob
+	slots   chan struct{}
+	start   sync.Once
+}
+
+// storedJob is a job and the request it runs, so that jobs interrupted by a
+// restart can run again. Key names the API key that created it, which its
+// tokens are charged to.
+type storedJob struct {
+	Job     types.Job                   `json:"job"`
+	Request types.ChatCompletionRequest `json:"request"`
+	Key     string                      `json:"key,omitempty"`
+}
+
+// webhook receives finished jobs. Deliveries are signed as described by the
+// Standard Webhooks specification.
+type webhook struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// WithWebhook POSTs every finished job to url, signed with secret.
+func WithWebhook(url, secret string) Option {
+	return func(h *Handler) {
+		h.webhook = webhook{url: url, secret: secret, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+}
+
+// preferAsync reports whether the request carries Prefer: respond-async.
+func preferAsync(r *http.Request) bool {
+	for _, value := range r.Header.Values("Prefer") {
+		for _, pref := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(pref, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "respond-async") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// createJob queues a chat completion of key to run in the background and
+// responds with 202 and the job.
+func (h *Handler) createJob(w http.ResponseWriter, key string, req *types.ChatCompletionRequest) {
+	if !h.requireStore(w) {
+		return
+	}
+	if req.Stream {
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: "stream cannot be used with background requests",
+			Type:    "invalid_request_error",
+			Param:   "stream",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	if !h.reserveJob() {
+		h.writeQueueFull(w, &picolm.QueueFullError{
+			Model:      req.Model,
+			Queued:     cap(h.jobs.slots),
+			Capacity:   cap(h.jobs.slots),
+			RetryAfter: jobRetryAfter,
+		})
+		return
+	}
+
+	req.Background = false
+	sj := storedJob{
+		Job: types.Job{
+			ID:        "job_" + generateID(),
+			Object:    "job",
+			Status:    "queued",
+			CreatedAt: time.Now().Unix(),
+		},
+		Request: *req,
+		Key:     key,
+	}
+	if err := h.store.Put(jobsCollection, sj.Job.ID, sj); err != nil {
+		<-h.jobs.slots
+		log.Printf("failed to store job %s: %v", sj.Job.ID, err)
+		h.writeError(w, "failed to store job", "internal_error", http.StatusInternalServerError)
+		return
+	}
+	h.jobs.queue <- sj
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/v1/jobs/"+sj.Job.ID)
+	w.Header().Set("Preference-Applied", "respond-async")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(sj.Job)
+}
+
+// HandleJob serves a job at /v1/jobs/{id}.
+func (h *Handler) HandleJob(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok || !h.requireStore(w) {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/jobs/")
+	var sj storedJob
+	err := h.store.Get(jobsCollection, id, &sj)
+	if err == nil && !ownedBy(r, sj.Key) {
+		err = store.ErrNotFound
+	}
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			log.Printf("failed to load job %s: %v", id, err)
+			h.writeError(w, "failed to load job", "internal_error", http.StatusInternalServerError)
+			return
+		}
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: fmt.Sprintf("Job with id '%s' not found.", id),
+			Type:    "invalid_request_error",
+		}, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sj.Job)
+}
+
+// startJobs starts the job workers the first time it is called.
+func (h *Handler) startJobs() {
+	h.jobs.start.Do(func() {
+		for i := 0; i < max(h.jobs.workers, 1); i++ {
+			go h.runJobs(h.background)
+		}
+	})
+}
+
+// reserveJob takes a place in the job queue. It reports false when the
+// queue is full.
+func (h *Handler) reserveJob() bool {
+	h.startJobs()
+	select {
+	case h.jobs.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// runJobs runs queued jobs one at a time until ctx is done.
+func (h *Handler) runJobs(ctx context.Context) {
+	for {
+		select {
+		case sj := <-h.jobs.queue:
+			<-h.jobs.slots
+			h.runJob(ctx, sj)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// resumeJobs queues again the jobs that had not finished when the server
+// stopped. They wait for a place in the queue rather than being refused.
+func (h *Handler) resumeJobs(ctx context.Context) {
+	jobs, err := store.List[storedJob](h.store, jobsCollection)
+	if err != nil {
+		log.Printf("failed to list jobs: %v", err)
+		return
+	}
+	jobs = slices.DeleteFunc(jobs, func(sj storedJob) bool {
+		return sj.Job.Status != "queued" && sj.Job.Status != "in_progress"
+	})
+	if len(jobs) == 0 {
+		return
+	}
+
+	h.startJobs()
+	go func() {
+		for _, sj := range jobs {
+			select {
+			case h.jobs.slots <- struct{}{}:
+				h.jobs.queue <- sj
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// runJob runs a job's request at low priority as if it had been sent to
+// /v1/chat/completions, saves the outcome and delivers it to the webhook. A
+// job whose key was removed or has expired fails without running. A job
+// interrupted by shutdown is left to be resumed on the next start.
+func (h *Handler) runJob(ctx context.Context, sj storedJob) {
+	ctx, keyErr := h.keyContext(picolm.WithLowPriority(ctx), sj.Key, sj.Request.User)
+
+	sj.Job.Status = "in_progress"
+	sj.Job.StartedAt = timestamp(time.Now())
+	if err := h.store.Put(jobsCollection, sj.Job.ID, sj); err != nil {
+		log.Printf("failed to update job %s: %v", sj.Job.ID, err)
+	}
+
+	resp := &responseBuffer{}
+	if keyErr != nil {
+		h.writeKeyError(resp, keyErr)
+	} else {
+		r := (&http.Request{
+			Method: http.MethodPost,
+			URL:    &url.URL{Path: "/v1/chat/completions"},
+			Header: http.Header{},
+		}).WithContext(ctx)
+		h.createChatCompletion(resp, r, &sj.Request)
+	}
+
+	status := resp.Status()
+	if ctx.Err() != nil && status != http.StatusOK {
+		return
+	}
+
+	sj.Job.StatusCode = status
+	sj.Job.CompletedAt = timestamp(time.Now())
+	if status == http.StatusOK {
+		sj.Job.Status = "completed"
+		sj.Job.Result = bytes.TrimSpace(resp.body.Bytes())
+	} else {
+		sj.Job.Status = "failed"
+		var errResp types.ErrorResponse
+		if err := json.Unmarshal(resp.body.Bytes(), &errResp); err != nil {
+			errResp.Error = types.ErrorDetail{Message: strings.TrimSpace(resp.body.String()), Type: "internal_error"}
+		}
+		sj.Job.Error = &errResp.Error
+	}
+	if err := h.store.Put(jobsCollection, sj.Job.ID, sj); err != nil {
+		log.Printf("failed to store result of job %s: %v", sj.Job.ID, err)
+	}
+
+	h.deliverJob(ctx, &sj.Job)
+}
+
+// deliverJob POSTs a finished job to the webhook, retrying failed
+// deliveries a few times.
+func (h *Handler) deliverJob(ctx context.Context, job *types.Job) {
+	if h.webhook.url == "" {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"type": "job." + job.Status,
+		"data": job,
+	})
+	if err != nil {
+		log.Printf("failed to encode webhook for job %s: %v", job.ID, err)
+		return
+	}
+
+	msgID := "msg_" + generateID()
+	for attempt := 1; ; attempt++ {
+		err := h.webhook.send(ctx, msgID, body)
+		if err == nil {
+			return
+		}
+		if attempt == 3 {
+			log.Printf("failed to deliver webhook for job %s: %v", job.ID, err)
+			return
+		}
+		select {
+		case <-time.After(time.Duration(attempt) * 5 * time.Second):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (wh *webhook) send(ctx context.Context, msgID string, body []byte) error {
+	ts := time.Now().Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Webhook-Id", msgID)
+	req.Header.Set("Webhook-Timestamp", strconv.FormatInt(ts, 10))
+	if wh.secret != "" {
+		req.Header.Set("Webhook-Signature", signWebhook(wh.secret, msgID, ts, body))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// signWebhook returns the Webhook-Signature header for a delivery: an
+// HMAC-SHA256 of "id.timestamp.body". Secrets in the whsec_ format are
+// base64-decoded; other secrets are used as they are.
+func signWebhook(secret, msgID string, ts int64, body []byte) string {
+	key := []byte(secret)
+	if encoded, ok := strings.CutPrefix(secret, "whsec_"); ok {
+		if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			key = decoded
+		}
+	}
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s.%d.", msgID, ts)
+	mac.Write(body)
+	return "v1," + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func createJob(t *testing.T, handler *Handler, body string, header http.Header) types.Job {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var job types.Job
+	json.Unmarshal(w.Body.Bytes(), &job)
+	if loc := w.Header().Get("Location"); loc != "/v1/jobs/"+job.ID {
+		t.Errorf("Location = %q", loc)
+	}
+	return job
+}
+
+func waitJob(t *testing.T, handler *Handler, id string) types.Job {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		handler.HandleJob(w, httptest.NewRequest(http.MethodGet, "/v1/jobs/"+id, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var job types.Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.Status == "completed" || job.Status == "failed" {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for job, last state %+v", job)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJob_Background(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "Done.", FinishReason: "stop"},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	created := createJob(t, handler, `{"background":true,"messages":[{"role":"user","content":"Hi"}]}`, nil)
+	if created.Status != "queued" || !strings.HasPrefix(created.ID, "job_") {
+		t.Errorf("created job = %+v", created)
+	}
+
+	job := waitJob(t, handler, created.ID)
+	if job.Status != "completed" || job.StatusCode != http.StatusOK || job.CompletedAt == nil {
+		t.Fatalf("job = %+v", job)
+	}
+	var completion types.ChatCompletionResponse
+	if err := json.Unmarshal(job.Result, &completion); err != nil || completion.Choices[0].Message.Content.Text != "Done." {
+		t.Errorf("result = %s", job.Result)
+	}
+}
+
+func TestJob_PreferAsyncFailure(t *testing.T) {
+	mockClient := &mockPicoLMClient{err: errors.New("picolm timeout after 10m0s")}
+	handler := newStoreHandler(t, mockClient)
+
+	header := http.Header{"Prefer": {"wait=5, respond-async"}}
+	created := createJob(t, handler, `{"messages":[{"role":"user","content":"Hi"}]}`, header)
+
+	job := waitJob(t, handler, created.ID)
+	if job.Status != "failed" || job.StatusCode != http.StatusGatewayTimeout || job.Error == nil || !strings.Contains(job.Error.Message, "timeout") {
+		t.Errorf("job = %+v", job)
+	}
+}
+
+func TestJob_QueueFull(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	client := &chatFuncClient{
+		mockPicoLMClient: &mockPicoLMClient{},
+		chat: func(ctx context.Context, req *types.ChatCompletionRequest) (*picolm.ChatResult, error) {
+			if !picolm.IsLowPriority(ctx) {
+				t.Error("job was not low priority")
+			}
+			select {
+			case started <- struct{}{}:
+			default:
+			}
+			<-release
+			return &picolm.ChatResult{Content: "Done.", FinishReason: "stop"}, nil
+		},
+	}
+	handler := newStoreHandler(t, client)
+	body := `{"background":true,"messages":[{"role":"user","content":"Hi"}]}`
+
+	// One job runs and the rest fill the queue.
+	jobs := []types.Job{createJob(t, handler, body, nil)}
+	<-started
+	for i := 0; i < maxQueuedJobs; i++ {
+		jobs = append(jobs, createJob(t, handler, body, nil))
+	}
+
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("expected 429 with Retry-After when the job queue is full, got %d: %s", w.Code, w.Body.String())
+	}
+
+	close(release)
+	for _, job := range jobs {
+		if job := waitJob(t, handler, job.ID); job.Status != "completed" {
+			t.Errorf("job = %+v", job)
+		}
+	}
+}
+
+func TestJob_Resumed(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "Done.", FinishReason: "stop"},
+	}
+	handler := newStoreHandler(t, mockClient)
+	interrupted := storedJob{
+		Job: types.Job{ID: "job_interrupted", Object: "job", Status: "in_progress"},
+		Request: types.ChatCompletionRequest{
+			Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+		},
+	}
+	if err := handler.store.Put(jobsCollection, interrupted.Job.ID, interrupted); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler.Start(ctx)
+
+	if job := waitJob(t, handler, interrupted.Job.ID); job.Status != "completed" {
+		t.Errorf("job = %+v", job)
+	}
+}
+
+func TestJob_StreamRejected(t *testing.T) {
+	handler := newStoreHandler(t, &mockPicoLMClient{})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"background":true,"stream":true,"messages":[]}`))
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"stream"`) {
+		t.Errorf("expected 400 naming stream, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestJob_Webhook(t *testing.T) {
+	const secret = "whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw"
+
+	deliveries := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "Done.", FinishReason: "stop"},
+	}
+	handler := newStoreHandler(t, mockClient)
+	WithWebhook(server.URL, secret)(handler)
+
+	created := createJob(t, handler, `{"background":true,"messages":[{"role":"user","content":"Hi"}]}`, nil)
+
+	var r *http.Request
+	select {
+	case r = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not delivered")
+	}
+	body := <-bodies
+
+	ts, _ := strconv.ParseInt(r.Header.Get("Webhook-Timestamp"), 10, 64)
+	if got, want := r.Header.Get("Webhook-Signature"), signWebhook(secret, r.Header.Get("Webhook-Id"), ts, body); got != want {
+		t.Errorf("Webhook-Signature = %q, want %q", got, want)
+	}
+
+	var event struct {
+		Type string    `json:"type"`
+		Data types.Job `json:"data"`
+	}
+	json.Unmarshal(body, &event)
+	if event.Type != "job.completed" || event.Data.ID != created.ID {
+		t.Errorf("event = %s", body)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// The example from the Standard Webhooks specification.
+	got := signWebhook("whsec_MfKQ9r8GKYqrTwjUPD8ILPZIo2LaLaSw", "msg_p5jXN8AQM9LWM0D4loKWxJek", 1614265330, []byte(`{"test": 2432232314}`))
+	if want := "v1,g0hM9SsE+OTPJTGt/tmIKtSyZlE3uFJELVlNIOLJ1OE="; got != want {
+		t.Errorf("signWebhook() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/auth"
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func newKeyringHandler(t *testing.T, client picolm.Provider) *Handler {
+	t.Helper()
+	kr, err := auth.NewKeyring("", []config.APIKeyConfig{
+		{Name: "chat-only", Hash: auth.Hash("sk-chat"), Endpoints: []string{config.EndpointChat}},
+		{Name: "other-model", Hash: auth.Hash("sk-other"), Models: []string{"other"}},
+		{Name: "expired", Hash: auth.Hash("sk-expired"), ExpiresAt: time.Now().Add(-time.Minute)},
+		{Name: "admin", Hash: auth.Hash("sk-admin"), Endpoints: []string{config.EndpointAdmin}},
+	})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	return NewHandler(client, "", WithKeyring(kr))
+}
+
+func TestKeyring_ChatCompletions(t *testing.T) {
+	client := &mockPicoLMClient{response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}}
+	handler := newKeyringHandler(t, client)
+
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+		wantCode   string
+	}{
+		{name: "allowed", key: "sk-chat", wantStatus: http.StatusOK},
+		{name: "model not allowed", key: "sk-other", wantStatus: http.StatusNotFound, wantCode: "model_not_found"},
+		{name: "endpoint not allowed", key: "sk-admin", wantStatus: http.StatusForbidden, wantCode: "insufficient_permissions"},
+		{name: "expired", key: "sk-expired", wantStatus: http.StatusUnauthorized},
+		{name: "unknown", key: "sk-unknown", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+				strings.NewReader(`{"model":"picolm-local","messages":[{"role":"user","content":"Hi"}]}`))
+			req.Header.Set("Authorization", "Bearer "+tt.key)
+			w := httptest.NewRecorder()
+			handler.HandleChatCompletions(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			var resp types.ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("invalid error response %q: %v", w.Body.String(), err)
+			}
+			if resp.Error.Code != tt.wantCode {
+				t.Errorf("error code = %q, want %q", resp.Error.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestKeyring_ModelsFiltered(t *testing.T) {
+	handler := newKeyringHandler(t, &mockPicoLMClient{})
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+	req.Header.Set("Authorization", "Bearer sk-other")
+	w := httptest.NewRecorder()
+	handler.HandleModels(w, req)
+
+	var list types.ModelList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+	}
+	if len(list.Data) != 0 {
+		t.Errorf("models = %+v, want none for a key without access", list.Data)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/v1/models/picolm-local", nil)
+	req.Header.Set("Authorization", "Bearer sk-other")
+	w = httptest.NewRecorder()
+	handler.HandleModelInfo(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("model info status = %d, want 404", w.Code)
+	}
+}
+
+func TestKeyring_RequireAdmin(t *testing.T) {
+	handler := newKeyringHandler(t, &mockPicoLMClient{})
+	admin := handler.RequireAdmin(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if key := auth.FromContext(r.Context()); key == nil || key.Name != "admin" {
+			t.Errorf("key = %v, want admin", key)
+		}
+	}))
+
+	for key, want := range map[string]int{"sk-admin": http.StatusOK, "sk-chat": http.StatusForbidden} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+key)
+		w := httptest.NewRecorder()
+		admin.ServeHTTP(w, req)
+		if w.Code != want {
+			t.Errorf("%s: status = %d, want %d", key, w.Code, want)
+		}
+	}
+}
+
+func TestKeyring_StoredRecordsScoped(t *testing.T) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("store.Open() error = %v", err)
+	}
+	kr, err := auth.NewKeyring("", []config.APIKeyConfig{
+		{Name: "a", Hash: auth.Hash("sk-a")},
+		{Name: "b", Hash: auth.Hash("sk-b")},
+	})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	client := &mockPicoLMClient{response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}}
+	handler := NewHandler(client, "", WithStore(st), WithKeyring(kr))
+
+	send := func(h http.HandlerFunc, token, method, path, contentType string, body io.Reader) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	created := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		var obj struct{ ID string }
+		if w.Code != http.StatusOK && w.Code != http.StatusAccepted || json.Unmarshal(w.Body.Bytes(), &obj) != nil {
+			t.Fatalf("create: status %d: %s", w.Code, w.Body.String())
+		}
+		return obj.ID
+	}
+
+	completion := created(send(handler.HandleChatCompletions, "sk-a", http.MethodPost, "/v1/chat/completions", "",
+		strings.NewReader(`{"store":true,"messages":[{"role":"user","content":"Hi"}]}`)))
+	response := created(send(handler.HandleResponses, "sk-a", http.MethodPost, "/v1/responses", "",
+		strings.NewReader(`{"input":"Hi"}`)))
+	job := created(send(handler.HandleChatCompletions, "sk-a", http.MethodPost, "/v1/chat/completions", "",
+		strings.NewReader(`{"background":true,"messages":[{"role":"user","content":"Hi"}]}`)))
+
+	var upload bytes.Buffer
+	mw := multipart.NewWriter(&upload)
+	mw.WriteField("purpose", "batch")
+	fw, _ := mw.CreateFormFile("file", "requests.jsonl")
+	io.WriteString(fw, `{"custom_id":"1","method":"POST","url":"/v1/chat/completions","body":{"messages":[{"role":"user","content":"Hi"}]}}`+"\n")
+	mw.Close()
+	file := created(send(handler.HandleFiles, "sk-a", http.MethodPost, "/v1/files", mw.FormDataContentType(), &upload))
+	batch := created(send(handler.HandleBatches, "sk-a", http.MethodPost, "/v1/batches", "",
+		strings.NewReader(`{"input_file_id":"`+file+`","endpoint":"/v1/chat/completions","completion_window":"24h"}`)))
+
+	records := []struct {
+		handler http.HandlerFunc
+		method  string
+		path    string
+	}{
+		{handler.HandleChatCompletion, http.MethodGet, "/v1/chat/completions/" + completion},
+		{handler.HandleChatCompletion, http.MethodGet, "/v1/chat/completions/" + completion + "/messages"},
+		{handler.HandleChatCompletion, http.MethodDelete, "/v1/chat/completions/" + completion},
+		{handler.HandleResponse, http.MethodGet, "/v1/responses/" + response},
+		{handler.HandleResponse, http.MethodDelete, "/v1/responses/" + response},
+		{handler.HandleJob, http.MethodGet, "/v1/jobs/" + job},
+		{handler.HandleFile, http.MethodGet, "/v1/files/" + file},
+		{handler.HandleFile, http.MethodGet, "/v1/files/" + file + "/content"},
+		{handler.HandleFile, http.MethodDelete, "/v1/files/" + file},
+		{handler.HandleBatch, http.MethodGet, "/v1/batches/" + batch},
+		{handler.HandleBatch, http.MethodPost, "/v1/batches/" + batch + "/cancel"},
+	}
+	for _, rec := range records {
+		if w := send(rec.handler, "sk-b", rec.method, rec.path, "", nil); w.Code != http.StatusNotFound {
+			t.Errorf("%s %s with another key: status = %d, want 404", rec.method, rec.path, w.Code)
+		}
+	}
+
+	lists := []struct {
+		handler http.HandlerFunc
+		path    string
+	}{
+		{handler.HandleChatCompletions, "/v1/chat/completions"},
+		{handler.HandleFiles, "/v1/files"},
+		{handler.HandleBatches, "/v1/batches"},
+	}
+	for _, list := range lists {
+		for token, want := range map[string]int{"sk-a": 1, "sk-b": 0} {
+			w := send(list.handler, token, http.MethodGet, list.path, "", nil)
+			var page struct{ Data []json.RawMessage }
+			if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil || len(page.Data) != want {
+				t.Errorf("GET %s with %s: %s, want %d objects", list.path, token, w.Body.String(), want)
+			}
+		}
+	}
+
+	w := send(handler.HandleResponses, "sk-b", http.MethodPost, "/v1/responses", "",
+		strings.NewReader(`{"input":"Hi","previous_response_id":"`+response+`"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("previous_response_id of another key: status = %d, want 400", w.Code)
+	}
+	w = send(handler.HandleBatches, "sk-b", http.MethodPost, "/v1/batches", "",
+		strings.NewReader(`{"input_file_id":"`+file+`","endpoint":"/v1/chat/completions","completion_window":"24h"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("batch from a file of another key: status = %d, want 400", w.Code)
+	}
+
+	// Nothing was deleted or cancelled by the other key.
+	for _, rec := range records {
+		if rec.method != http.MethodGet {
+			continue
+		}
+		if w := send(rec.handler, "sk-a", rec.method, rec.path, "", nil); w.Code != http.StatusOK {
+			t.Errorf("%s %s with its key: status = %d, want 200", rec.method, rec.path, w.Code)
+		}
+	}
+
+	// Let the job finish before its store is removed.
+	waitStored(t, st, jobsCollection, job, func(sj storedJob) bool { return sj.Job.Status == "completed" })
+}
+
+// waitStored waits for the record id of collection to satisfy done.
+func waitStored[T any](t *testing.T, st *store.Store, collection, id string, done func(T) bool) T {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var v T
+		if err := st.Get(collection, id, &v); err == nil && done(v) {
+			return v
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s/%s, last state %+v", collection, id, v)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestKeyring_RevokedKeyWork(t *testing.T) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("store.Open() error = %v", err)
+	}
+	kr, err := auth.NewKeyring("", []config.APIKeyConfig{
+		{Name: "a", Hash: auth.Hash("sk-a")},
+		{Name: "expired", Hash: auth.Hash("sk-expired"), ExpiresAt: time.Now().Add(-time.Minute)},
+	})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	client := &mockPicoLMClient{response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}}
+
+	// Work queued by keys that were since removed from the config or expired.
+	request := types.ChatCompletionRequest{Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}}}
+	for _, key := range []string{"removed", "expired"} {
+		sj := storedJob{Job: types.Job{ID: "job_" + key, Object: "job", Status: "queued"}, Request: request, Key: key}
+		if err := st.Put(jobsCollection, sj.Job.ID, sj); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sb := storedBatch{
+		Batch: types.Batch{ID: "batch_removed", Object: "batch", Status: "validating", ExpiresAt: time.Now().Add(time.Hour).Unix()},
+		Key:   "removed",
+	}
+	if err := st.Put(batchesCollection, sb.Batch.ID, sb); err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewHandler(client, "", WithStore(st), WithKeyring(kr))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	handler.Start(ctx)
+
+	for _, key := range []string{"removed", "expired"} {
+		sj := waitStored(t, st, jobsCollection, "job_"+key, func(sj storedJob) bool { return sj.Job.Status == "failed" })
+		if sj.Job.StatusCode != http.StatusUnauthorized || sj.Job.Error == nil || sj.Job.Error.Code != "invalid_api_key" {
+			t.Errorf("job of %s key = %+v", key, sj.Job)
+		}
+	}
+	batch := waitStored(t, st, batchesCollection, sb.Batch.ID, func(sb storedBatch) bool { return sb.Batch.Status == "failed" })
+	if batch.Batch.Errors == nil || batch.Batch.Errors.Data[0].Code != "invalid_api_key" {
+		t.Errorf("batch errors = %+v", batch.Batch.Errors)
+	}
+	if calls := client.chatCalls.Load(); calls != 0 {
+		t.Errorf("%d requests of revoked keys ran", calls)
+	}
+}
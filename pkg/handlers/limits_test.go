@@ -0,0 +1,200 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/auth"
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/ratelimit"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func newLimitedHandler(t *testing.T, limits, userLimits config.Limits) (*Handler, *ratelimit.Limiter) {
+	t.Helper()
+	kr, err := auth.NewKeyring("", []config.APIKeyConfig{
+		{Name: "team-a", Hash: auth.Hash("sk-a"), Limits: limits},
+	})
+	if err != nil {
+		t.Fatalf("NewKeyring() error = %v", err)
+	}
+	limiter := ratelimit.New(nil, userLimits)
+	client := &mockPicoLMClient{response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}}
+	return NewHandler(client, "", WithKeyring(kr), WithLimiter(limiter)), limiter
+}
+
+func postLimited(handler http.HandlerFunc, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer sk-a")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func TestLimits_RequestsPerMinute(t *testing.T) {
+	handler, _ := newLimitedHandler(t, config.Limits{RequestsPerMinute: 1}, config.Limits{})
+	body := `{"messages":[{"role":"user","content":"Hi"}]}`
+
+	w := postLimited(handler.HandleChatCompletions, "/v1/chat/completions", body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("first request status = %d: %s", w.Code, w.Body.String())
+	}
+	if got := w.Header().Get("x-ratelimit-limit-requests"); got != "1" {
+		t.Errorf("x-ratelimit-limit-requests = %q, want 1", got)
+	}
+	if got := w.Header().Get("x-ratelimit-remaining-requests"); got != "0" {
+		t.Errorf("x-ratelimit-remaining-requests = %q, want 0", got)
+	}
+
+	w = postLimited(handler.HandleChatCompletions, "/v1/chat/completions", body)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("second request status = %d, want 429", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Retry-After = %q, want 60", got)
+	}
+	var resp types.ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid error response %q: %v", w.Body.String(), err)
+	}
+	if resp.Error.Code != "rate_limit_exceeded" || resp.Error.Type != "requests" {
+		t.Errorf("error = %+v, want a requests rate_limit_exceeded", resp.Error)
+	}
+}
+
+func TestLimits_InvalidRequestNotCounted(t *testing.T) {
+	handler, _ := newLimitedHandler(t, config.Limits{RequestsPerMinute: 1}, config.Limits{})
+
+	for _, tt := range []struct {
+		handler    http.HandlerFunc
+		path, body string
+	}{
+		{handler.HandleCompletions, "/v1/completions", `{"prompt":[]}`},
+		{handler.HandleCompletions, "/v1/completions", `{"prompt":"Hi","n":100}`},
+		{handler.HandleResponses, "/v1/responses", `{"input":[]}`},
+	} {
+		w := postLimited(tt.handler, tt.path, tt.body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("%s %s status = %d, want 400", tt.path, tt.body, w.Code)
+		}
+	}
+
+	w := postLimited(handler.HandleCompletions, "/v1/completions", `{"prompt":"Hi"}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("valid request status = %d, want 200 after rejected ones: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestLimits_UserQuota(t *testing.T) {
+	handler, limiter := newLimitedHandler(t, config.Limits{}, config.Limits{DailyTokens: 10})
+	key := &auth.Key{Name: "team-a"}
+	limiter.Charge(limiter.Subjects(key, "alice"), 10)
+
+	w := postLimited(handler.HandleChatCompletions, "/v1/chat/completions",
+		`{"user":"alice","messages":[{"role":"user","content":"Hi"}]}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	var resp types.ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Error.Code != "insufficient_quota" {
+		t.Errorf("error code = %q, want insufficient_quota", resp.Error.Code)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("expected a Retry-After header")
+	}
+
+	// Other users of the key are not affected.
+	w = postLimited(handler.HandleChatCompletions, "/v1/chat/completions",
+		`{"user":"bob","messages":[{"role":"user","content":"Hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Errorf("other user status = %d, want 200", w.Code)
+	}
+}
+
+func TestLimits_Messages(t *testing.T) {
+	handler, _ := newLimitedHandler(t, config.Limits{RequestsPerMinute: 1}, config.Limits{})
+	body := `{"max_tokens":16,"messages":[{"role":"user","content":"Hi"}]}`
+
+	postLimited(handler.HandleMessages, "/v1/messages", body)
+	w := postLimited(handler.HandleMessages, "/v1/messages", body)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %d, want 429", w.Code)
+	}
+	var resp types.AnthropicErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid error response %q: %v", w.Body.String(), err)
+	}
+	if resp.Error.Type != "rate_limit_error" {
+		t.Errorf("error type = %q, want rate_limit_error", resp.Error.Type)
+	}
+}
+
+// newLimitedBatchHandler returns a running handler with a store whose users
+// have userLimits, and the subjects of the user alice.
+func newLimitedBatchHandler(t *testing.T, userLimits config.Limits) (*Handler, *ratelimit.Limiter, []ratelimit.Subject) {
+	t.Helper()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("store.Open() error = %v", err)
+	}
+	limiter := ratelimit.New(nil, userLimits)
+	client := &mockPicoLMClient{response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"}}
+	handler := NewHandler(client, "", WithStore(st), WithLimiter(limiter))
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	handler.Start(ctx)
+	return handler, limiter, limiter.Subjects(nil, "alice")
+}
+
+func userBatchLine(customID string) string {
+	return `{"custom_id":"` + customID + `","method":"POST","url":"/v1/chat/completions","body":{"user":"alice","messages":[{"role":"user","content":"Hi"}]}}` + "\n"
+}
+
+func TestLimits_BatchWaitsForRateLimit(t *testing.T) {
+	handler, limiter, subjects := newLimitedBatchHandler(t, config.Limits{RequestsPerMinute: 240})
+	for i := 0; i < 240; i++ {
+		limiter.Allow(subjects)
+	}
+
+	// The bucket refills at 4 requests a second, so the two requests take
+	// at least half a second.
+	start := time.Now()
+	file := uploadBatchFile(t, handler, userBatchLine("req-1")+userBatchLine("req-2"))
+	created := createBatch(t, handler, file.ID)
+
+	batch := waitBatch(t, handler, created.ID, func(b types.Batch) bool { return b.Status == "completed" })
+	if batch.RequestCounts.Completed != 2 || batch.RequestCounts.Failed != 0 {
+		t.Errorf("rate limited requests should wait rather than fail: %+v", batch.RequestCounts)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("batch finished in %v, before the rate limit allowed its requests", elapsed)
+	}
+}
+
+func TestLimits_BatchQuotaExceeded(t *testing.T) {
+	handler, limiter, subjects := newLimitedBatchHandler(t, config.Limits{DailyTokens: 10})
+	limiter.Charge(subjects, 10)
+
+	file := uploadBatchFile(t, handler, userBatchLine("req-1")+userBatchLine("req-2"))
+	created := createBatch(t, handler, file.ID)
+
+	batch := waitBatch(t, handler, created.ID, func(b types.Batch) bool { return b.Status == "completed" })
+	if batch.RequestCounts.Completed != 0 || batch.RequestCounts.Failed != 2 {
+		t.Errorf("request counts = %+v, want every request failed", batch.RequestCounts)
+	}
+	for _, line := range fileLines(t, handler, batch.ErrorFileID) {
+		var resp types.ErrorResponse
+		json.Unmarshal(line.Response.Body, &resp)
+		if line.Response.StatusCode != http.StatusTooManyRequests || resp.Error.Code != "insufficient_quota" {
+			t.Errorf("%s: status %d, error %+v, want insufficient_quota", line.CustomID, line.Response.StatusCode, resp.Error)
+		}
+	}
+}
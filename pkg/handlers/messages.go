@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/metrics"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// stopReasons maps picolm finish reasons to Anthropic stop reasons.
+var stopReasons = map[string]string{
+	"stop":       "end_turn",
+	"length":     "max_tokens",
+	"tool_calls": "tool_use",
+}
+
+var anthropicErrorTypes = map[int]string{
+	http.StatusBadRequest:      "invalid_request_error",
+	http.StatusTooManyRequests: "rate_limit_error",
+	http.StatusGatewayTimeout:  "timeout_error",
+}
+
+// HandleMessages serves the Anthropic Messages API. Requests are translated
+// into chat completion requests and the results translated back.
+func (h *Handler) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.MessagesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeAnthropicError(w, "invalid request body", "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+
+	chatReq, err := toChatRequest(&req)
+	if err != nil {
+		h.writeAnthropicError(w, err.Error(), "invalid_request_error", http.StatusBadRequest)
+		return
+	}
+	if chatReq.Model == "" {
+		chatReq.Model = h.client.GetDefaultModel()
+	}
+	if !h.availableModel(r, chatReq.Model) {
+		h.writeAnthropicError(w, fmt.Sprintf("model: %s", chatReq.Model), "not_found_error", http.StatusNotFound)
+		return
+	}
+	metrics.SetModel(r.Context(), chatReq.Model)
+	if r, err = h.checkLimits(w, r, ""); err != nil {
+		h.writeMessagesError(w, err)
+		return
+	}
+
+	if req.Stream {
+		h.handleStreamingMessages(w, r, chatReq)
+		return
+	}
+
+	var mu sync.Mutex
+	result, err := h.client.Chat(h.observe(w, r, &mu), chatReq)
+	if err != nil {
+		log.Printf("picolm error: %v", err)
+		h.writeMessagesError(w, err)
+		return
+	}
+
+	content := []types.ContentBlock{}
+	if result.Content != "" {
+		content = append(content, types.ContentBlock{Type: "text", Text: result.Content})
+	}
+	for _, call := range result.ToolCalls {
+		content = append(content, types.ContentBlock{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: toolInput(call.Function.Arguments),
+		})
+	}
+
+	stopReason, stopSequence := stopReason(result.FinishReason, result.StopSequence)
+	response := types.MessagesResponse{
+		ID:           "msg_" + generateID(),
+		Type:         "message",
+		Role:         "assistant",
+		Model:        chatReq.Model,
+		Content:      content,
+		StopReason:   &stopReason,
+		StopSequence: stopSequence,
+		Usage: types.AnthropicUsage{
+			InputTokens:  result.Usage.PromptTokens,
+			OutputTokens: result.Usage.CompletionTokens,
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// handleStreamingMessages streams a reply as Anthropic server-sent events:
+// message_start, then content_block_start, content_block_delta and
+// content_block_stop for each text or tool_use block, then message_delta with
+// the stop reason and usage, and finally message_stop.
+func (h *Handler) handleStreamingMessages(w http.ResponseWriter, r *http.Request, req *types.ChatCompletionRequest) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeAnthropicError(w, "streaming not supported", "api_error", http.StatusInternalServerError)
+		return
+	}
+
+	msgID := "msg_" + generateID()
+
+	writeEvent := func(event string, data map[string]any) {
+		data["type"] = event
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	// message_start is deferred to the first chunk so that errors raised
+	// before generation starts are still reported with their HTTP status.
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		writeEvent("message_start", map[string]any{
+			"message": types.MessagesResponse{
+				ID:      msgID,
+				Type:    "message",
+				Role:    "assistant",
+				Model:   req.Model,
+				Content: []types.ContentBlock{},
+			},
+		})
+	}
+
+	index := -1
+	blockType := ""
+	openBlock := func(block map[string]any) {
+		if blockType != "" {
+			writeEvent("content_block_stop", map[string]any{"index": index})
+		}
+		index++
+		blockType, _ = block["type"].(string)
+		writeEvent("content_block_start", map[string]any{"index": index, "content_block": block})
+	}
+
+	var mu sync.Mutex
+	err := h.client.StreamChat(h.observe(w, r, &mu), req, func(chunk picolm.StreamChunk) error {
+		start()
+
+		if chunk.Content != "" {
+			if blockType != "text" {
+				openBlock(map[string]any{"type": "text", "text": ""})
+			}
+			writeEvent("content_block_delta", map[string]any{
+				"index": index,
+				"delta": map[string]any{"type": "text_delta", "text": chunk.Content},
+			})
+		}
+
+		for _, delta := range chunk.ToolCalls {
+			if delta.ID != "" {
+				openBlock(map[string]any{
+					"type":  "tool_use",
+					"id":    delta.ID,
+					"name":  delta.Function.Name,
+					"input": map[string]any{},
+				})
+			}
+			if delta.Function.Arguments != "" {
+				writeEvent("content_block_delta", map[string]any{
+					"index": index,
+					"delta": map[string]any{"type": "input_json_delta", "partial_json": delta.Function.Arguments},
+				})
+			}
+		}
+
+		if chunk.FinishReason != "" {
+			if blockType != "" {
+				writeEvent("content_block_stop", map[string]any{"index": index})
+				blockType = ""
+			}
+			usage := types.AnthropicUsage{}
+			if chunk.Usage != nil {
+				usage.InputTokens = chunk.Usage.PromptTokens
+				usage.OutputTokens = chunk.Usage.CompletionTokens
+			}
+			stopReason, stopSequence := stopReason(chunk.FinishReason, chunk.StopSequence)
+			writeEvent("message_delta", map[string]any{
+				"delta": map[string]any{"stop_reason": stopReason, "stop_sequence": stopSequence},
+				"usage": usage,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("picolm streaming error: %v", err)
+		if !started {
+			h.writeMessagesError(w, err)
+			return
+		}
+		writeEvent("error", map[string]any{
+			"error": types.AnthropicError{Type: "api_error", Message: err.Error()},
+		})
+		return
+	}
+
+	start()
+	writeEvent("message_stop", map[string]any{})
+}
+
+// toChatRequest translates an Anthropic Messages request into a chat
+// completion request. tool_use blocks become assistant tool calls and
+// tool_result blocks become tool messages.
+func toChatRequest(req *types.MessagesRequest) (*types.ChatCompletionRequest, error) {
+	chatReq := &types.ChatCompletionRequest{
+		Model:       req.Model,
+		MaxTokens:   req.MaxTokens,
+		Temperature: req.Temperature,
+		TopP:        req.TopP,
+		Stop:        req.StopSequences,
+	}
+
+	if len(req.System) > 0 {
+		system, err := blockText(req.System, "system")
+		if err != nil {
+			return nil, err
+		}
+		chatReq.Messages = append(chatReq.Messages, types.ChatMessage{
+			Role:    "system",
+			Content: types.TextContent(system),
+		})
+	}
+
+	for i, msg := range req.Messages {
+		param := fmt.Sprintf("messages.%d", i)
+
+		switch msg.Role {
+		case "user":
+			var texts []string
+			for j, block := range msg.Content {
+				switch block.Type {
+				case "text":
+					texts = append(texts, block.Text)
+				case "tool_result":
+					result, err := blockText(block.Content, fmt.Sprintf("%s.content.%d.content", param, j))
+					if err != nil {
+						return nil, err
+					}
+					if block.IsError {
+						result = "Error: " + result
+					}
+					chatReq.Messages = append(chatReq.Messages, types.ChatMessage{
+						Role:       "tool",
+						Content:    types.TextContent(result),
+						ToolCallID: block.ToolUseID,
+					})
+				default:
+					return nil, unsupportedBlock(block, fmt.Sprintf("%s.content.%d", param, j))
+				}
+			}
+			if len(texts) > 0 {
+				chatReq.Messages = append(chatReq.Messages, types.ChatMessage{
+					Role:    "user",
+					Content: types.TextContent(strings.Join(texts, "\n")),
+				})
+			}
+
+		case "assistant":
+			reply := types.ChatMessage{Role: "assistant"}
+			var texts []string
+			for j, block := range msg.Content {
+				switch block.Type {
+				case "text":
+					texts = append(texts, block.Text)
+				case "tool_use":
+					input := block.Input
+					if len(input) == 0 {
+						input = json.RawMessage("{}")
+					}
+					reply.ToolCalls = append(reply.ToolCalls, types.ToolCall{
+						ID:       block.ID,
+						Type:     "function",
+						Function: types.CallFunction{Name: block.Name, Arguments: string(input)},
+					})
+				default:
+					return nil, unsupportedBlock(block, fmt.Sprintf("%s.content.%d", param, j))
+				}
+			}
+			reply.Content = types.TextContent(strings.Join(texts, "\n"))
+			chatReq.Messages = append(chatReq.Messages, reply)
+
+		default:
+			return nil, fmt.Errorf("%s.role: unexpected role %q, must be \"user\" or \"assistant\"", param, msg.Role)
+		}
+	}
+
+	for _, tool := range req.Tools {
+		chatReq.Tools = append(chatReq.Tools, types.ToolDefinition{
+			Type: "function",
+			Function: types.FunctionDef{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.InputSchema,
+			},
+		})
+	}
+
+	if tc := req.ToolChoice; tc != nil {
+		switch tc.Type {
+		case "auto":
+			chatReq.ToolChoice = picolm.ToolChoiceAuto
+		case "any":
+			chatReq.ToolChoice = picolm.ToolChoiceRequired
+		case "none":
+			chatReq.ToolChoice = picolm.ToolChoiceNone
+		case "tool":
+			chatReq.ToolChoice = map[string]any{
+				"type":     picolm.ToolChoiceFunction,
+				"function": map[string]any{"name": tc.Name},
+			}
+		default:
+			return nil, fmt.Errorf("tool_choice.type: unexpected value %q", tc.Type)
+		}
+		if tc.DisableParallelToolUse {
+			parallel := false
+			chatReq.ParallelToolCalls = &parallel
+		}
+	}
+
+	return chatReq, nil
+}
+
+// blockText joins text blocks, rejecting any other block type.
+func blockText(blocks types.ContentBlocks, param string) (string, error) {
+	texts := make([]string, 0, len(blocks))
+	for i, block := range blocks {
+		if block.Type != "text" {
+			return "", unsupportedBlock(block, fmt.Sprintf("%s.%d", param, i))
+		}
+		texts = append(texts, block.Text)
+	}
+	return strings.Join(texts, "\n"), nil
+}
+
+func unsupportedBlock(block types.ContentBlock, param string) error {
+	return fmt.Errorf("%s: unsupported content block type %q", param, block.Type)
+}
+
+// stopReason returns the Anthropic stop reason of a reply and the stop
+// sequence it ended at, which is nil unless the reason is stop_sequence.
+func stopReason(finishReason, stopSequence string) (string, *string) {
+	if stopSequence != "" {
+		return "stop_sequence", &stopSequence
+	}
+	if reason, ok := stopReasons[finishReason]; ok {
+		return reason, nil
+	}
+	return "end_turn", nil
+}
+
+// toolInput returns tool call arguments as a JSON value, falling back to an
+// empty object when the model produced none.
+func toolInput(arguments string) json.RawMessage {
+	if !json.Valid([]byte(arguments)) {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(arguments)
+}
+
+// writeMessagesError reports a failed generation in the Anthropic error
+// format.
+func (h *Handler) writeMessagesError(w http.ResponseWriter, err error) {
+	status := inferenceStatus(w, err)
+	errType, ok := anthropicErrorTypes[status]
+	if !ok {
+		errType = "api_error"
+	}
+	h.writeAnthropicError(w, err.Error(), errType, status)
+}
+
+func (h *Handler) writeAnthropicError(w http.ResponseWriter, message, errType string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(types.AnthropicErrorResponse{
+		Type:  "error",
+		Error: types.AnthropicError{Type: errType, Message: message},
+	})
+}
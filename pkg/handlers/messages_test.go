@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestHandleMessages_Success(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content: "Let me check.",
+			ToolCalls: []types.ToolCall{{
+				ID:       "call_1",
+				Type:     "function",
+				Function: types.CallFunction{Name: "get_weather", Arguments: `{"city":"Nairobi"}`},
+			}},
+			FinishReason: "tool_calls",
+			Usage:        types.Usage{PromptTokens: 12, CompletionTokens: 7, TotalTokens: 19},
+		},
+	}
+	handler := NewHandler(mockClient, "test-api-key")
+
+	body := `{"model":"picolm-local","max_tokens":64,"messages":[{"role":"user","content":"Weather in Nairobi?"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+	req.Header.Set("x-api-key", "test-api-key")
+
+	w := httptest.NewRecorder()
+	handler.HandleMessages(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp types.MessagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.Type != "message" || resp.Role != "assistant" || !strings.HasPrefix(resp.ID, "msg_") {
+		t.Errorf("unexpected response envelope: %+v", resp)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "tool_use" {
+		t.Errorf("stop_reason = %v, want tool_use", resp.StopReason)
+	}
+	if len(resp.Content) != 2 {
+		t.Fatalf("expected 2 content blocks, got %+v", resp.Content)
+	}
+	if resp.Content[0].Type != "text" || resp.Content[0].Text != "Let me check." {
+		t.Errorf("text block = %+v", resp.Content[0])
+	}
+	use := resp.Content[1]
+	if use.Type != "tool_use" || use.ID != "call_1" || use.Name != "get_weather" || string(use.Input) != `{"city":"Nairobi"}` {
+		t.Errorf("tool_use block = %+v", use)
+	}
+	if resp.Usage.InputTokens != 12 || resp.Usage.OutputTokens != 7 {
+		t.Errorf("usage = %+v", resp.Usage)
+	}
+}
+
+func TestToChatRequest(t *testing.T) {
+	body := `{
+		"model": "picolm-local",
+		"max_tokens": 128,
+		"system": [{"type": "text", "text": "Be brief."}],
+		"stop_sequences": ["END"],
+		"messages": [
+			{"role": "user", "content": "Weather in Nairobi?"},
+			{"role": "assistant", "content": [
+				{"type": "text", "text": "Checking."},
+				{"type": "tool_use", "id": "toolu_1", "name": "get_weather", "input": {"city": "Nairobi"}}
+			]},
+			{"role": "user", "content": [
+				{"type": "tool_result", "tool_use_id": "toolu_1", "content": "22C"},
+				{"type": "text", "text": "Thanks"}
+			]}
+		],
+		"tools": [{"name": "get_weather", "input_schema": {"type": "object"}}],
+		"tool_choice": {"type": "any", "disable_parallel_tool_use": true}
+	}`
+
+	var req types.MessagesRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("failed to unmarshal request: %v", err)
+	}
+
+	got, err := toChatRequest(&req)
+	if err != nil {
+		t.Fatalf("toChatRequest() error = %v", err)
+	}
+
+	want := []types.ChatMessage{
+		{Role: "system", Content: types.TextContent("Be brief.")},
+		{Role: "user", Content: types.TextContent("Weather in Nairobi?")},
+		{Role: "assistant", Content: types.TextContent("Checking."), ToolCalls: []types.ToolCall{{
+			ID:       "toolu_1",
+			Type:     "function",
+			Function: types.CallFunction{Name: "get_weather", Arguments: `{"city": "Nairobi"}`},
+		}}},
+		{Role: "tool", Content: types.TextContent("22C"), ToolCallID: "toolu_1"},
+		{Role: "user", Content: types.TextContent("Thanks")},
+	}
+	if !reflect.DeepEqual(got.Messages, want) {
+		t.Errorf("messages = %+v, want %+v", got.Messages, want)
+	}
+	if got.MaxTokens != 128 || !reflect.DeepEqual([]string(got.Stop), []string{"END"}) {
+		t.Errorf("max_tokens = %d, stop = %v", got.MaxTokens, got.Stop)
+	}
+	if len(got.Tools) != 1 || got.Tools[0].Function.Name != "get_weather" || got.Tools[0].Function.Parameters["type"] != "object" {
+		t.Errorf("tools = %+v", got.Tools)
+	}
+	if got.ToolChoice != picolm.ToolChoiceRequired {
+		t.Errorf("tool_choice = %v, want %q", got.ToolChoice, picolm.ToolChoiceRequired)
+	}
+	if got.ParallelToolCalls == nil || *got.ParallelToolCalls {
+		t.Errorf("parallel_tool_calls = %v, want false", got.ParallelToolCalls)
+	}
+}
+
+func TestHandleMessages_InvalidRequest(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{name: "malformed body", body: `{"messages":`},
+		{name: "image block", body: `{"max_tokens":8,"messages":[{"role":"user","content":[{"type":"image","source":{}}]}]}`},
+		{name: "unknown role", body: `{"max_tokens":8,"messages":[{"role":"system","content":"Hi"}]}`},
+		{name: "unknown tool choice", body: `{"max_tokens":8,"messages":[{"role":"user","content":"Hi"}],"tool_choice":{"type":"maybe"}}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewHandler(&mockPicoLMClient{}, "")
+			req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(tt.body))
+
+			w := httptest.NewRecorder()
+			handler.HandleMessages(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d", w.Code)
+			}
+			var resp types.AnthropicErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("failed to unmarshal error: %v", err)
+			}
+			if resp.Type != "error" || resp.Error.Type != "invalid_request_error" {
+				t.Errorf("unexpected error response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestHandleMessages_QueueFull(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		err: &picolm.QueueFullError{Model: "picolm-local", Queued: 4, Capacity: 4, RetryAfter: 10 * time.Second},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"max_tokens":8,"messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler.HandleMessages(w, req)
+
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "10" {
+		t.Errorf("Retry-After = %q, want 10", w.Header().Get("Retry-After"))
+	}
+	if !strings.Contains(w.Body.String(), `"rate_limit_error"`) {
+		t.Errorf("unexpected body: %s", w.Body.String())
+	}
+}
+
+func TestHandleMessages_StopSequence(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response:     &picolm.ChatResult{Content: "Thought: search", FinishReason: "stop", StopSequence: "Observation:"},
+		streamTokens: []string{"Thought: search"},
+		streamStop:   "Observation:",
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"max_tokens":8,"stop_sequences":["Observation:"],"messages":[{"role":"user","content":"Hi"}]}`
+	w := httptest.NewRecorder()
+	handler.HandleMessages(w, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+
+	var resp types.MessagesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if resp.StopReason == nil || *resp.StopReason != "stop_sequence" || resp.StopSequence == nil || *resp.StopSequence != "Observation:" {
+		t.Errorf("stop_reason = %v, stop_sequence = %v, want stop_sequence Observation:", resp.StopReason, resp.StopSequence)
+	}
+
+	body = `{"max_tokens":8,"stream":true,"stop_sequences":["Observation:"],"messages":[{"role":"user","content":"Hi"}]}`
+	sw := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleMessages(sw, httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body)))
+
+	want := `"delta":{"stop_reason":"stop_sequence","stop_sequence":"Observation:"}`
+	if !strings.Contains(sw.Body().String(), want) {
+		t.Errorf("message_delta missing %s:\n%s", want, sw.Body().String())
+	}
+}
+
+func TestHandleMessages_Streaming(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Hello", " world"},
+		streamToolCalls: [][]types.ToolCallDelta{
+			{{Index: 0, ID: "call_1", Type: "function", Function: types.CallFunctionDelta{Name: "get_weather"}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `{"city":"Nairobi"}`}}},
+		},
+		streamFinish: "tool_calls",
+		streamUsage:  &types.Usage{PromptTokens: 5, CompletionTokens: 3, TotalTokens: 8},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"max_tokens":8,"stream":true,"messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/messages", strings.NewReader(body))
+
+	w := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleMessages(w, req)
+
+	if w.Code() != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code())
+	}
+
+	var events []string
+	var data []map[string]any
+	for _, frame := range strings.Split(strings.TrimSpace(w.Body().String()), "\n\n") {
+		lines := strings.SplitN(frame, "\n", 2)
+		if len(lines) != 2 {
+			t.Fatalf("malformed frame %q", frame)
+		}
+		event := strings.TrimPrefix(lines[0], "event: ")
+		var payload map[string]any
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &payload); err != nil {
+			t.Fatalf("failed to unmarshal %q: %v", lines[1], err)
+		}
+		if payload["type"] != event {
+			t.Errorf("event %q has type %v", event, payload["type"])
+		}
+		events = append(events, event)
+		data = append(data, payload)
+	}
+
+	want := []string{
+		"message_start",
+		"content_block_start", "content_block_delta", "content_block_delta", "content_block_stop",
+		"content_block_start", "content_block_delta", "content_block_stop",
+		"message_delta",
+		"message_stop",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+
+	toolStart := data[5]["content_block"].(map[string]any)
+	if data[5]["index"] != float64(1) || toolStart["type"] != "tool_use" || toolStart["name"] != "get_weather" {
+		t.Errorf("tool_use block start = %v", data[5])
+	}
+	if delta := data[6]["delta"].(map[string]any); delta["type"] != "input_json_delta" || delta["partial_json"] != `{"city":"Nairobi"}` {
+		t.Errorf("input_json_delta = %v", delta)
+	}
+
+	messageDelta := data[8]
+	if messageDelta["delta"].(map[string]any)["stop_reason"] != "tool_use" {
+		t.Errorf("message_delta = %v", messageDelta)
+	}
+	if usage := messageDelta["usage"].(map[string]any); usage["input_tokens"] != float64(5) || usage["output_tokens"] != float64(3) {
+		t.Errorf("usage = %v", usage)
+	}
+}
+
+func TestRequireAuth_XAPIKey(t *testing.T) {
+	handler := NewHandler(&mockPicoLMClient{}, "test-api-key")
+
+	tests := []struct {
+		name     string
+		apiKey   string
+		wantAuth bool
+	}{
+		{name: "correct key", apiKey: "test-api-key", wantAuth: true},
+		{name: "wrong key", apiKey: "wrong-key", wantAuth: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/messages", nil)
+			req.Header.Set("x-api-key", tt.apiKey)
+			w := httptest.NewRecorder()
+
+			if _, got := handler.requireAuth(w, req, config.EndpointChat); got != tt.wantAuth {
+				t.Errorf("requireAuth() = %v, want %v", got, tt.wantAuth)
+			}
+		})
+	}
+}
@@ -0,0 +1,594 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/metrics"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// ollamaVersion is the Ollama API version reported to clients that check it
+// before connecting.
+const ollamaVersion = "0.5.0"
+
+// HandleOllamaChat serves Ollama's /api/chat. Replies stream as
+// newline-delimited JSON unless the request sets stream to false.
+func (h *Handler) HandleOllamaChat(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.OllamaChatRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeOllamaError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	model, ok := h.ollamaModel(req.Model)
+	if !ok || !allowModel(r, model) {
+		h.writeOllamaError(w, fmt.Sprintf("model %q not found", req.Model), http.StatusNotFound)
+		return
+	}
+	metrics.SetModel(r.Context(), model)
+	r, err := h.checkLimits(w, r, "")
+	if err != nil {
+		h.writeOllamaError(w, err.Error(), inferenceStatus(w, err))
+		return
+	}
+
+	if len(req.Messages) == 0 {
+		h.writeOllamaJSON(w, types.OllamaChatResponse{
+			Model:      model,
+			CreatedAt:  time.Now().UTC(),
+			Message:    &types.OllamaMessage{Role: "assistant"},
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	chatReq := &types.ChatCompletionRequest{Model: model, Tools: req.Tools}
+	for _, msg := range req.Messages {
+		if len(msg.Images) > 0 {
+			h.writeOllamaError(w, "images are not supported", http.StatusBadRequest)
+			return
+		}
+		chatMsg := types.ChatMessage{
+			Role:    msg.Role,
+			Content: types.TextContent(msg.Content),
+			Name:    msg.ToolName,
+		}
+		for _, call := range msg.ToolCalls {
+			chatMsg.ToolCalls = append(chatMsg.ToolCalls, types.ToolCall{
+				Type:     "function",
+				Function: types.CallFunction{Name: call.Function.Name, Arguments: string(toolInput(string(call.Function.Arguments)))},
+			})
+		}
+		chatReq.Messages = append(chatReq.Messages, chatMsg)
+	}
+	applyOllamaOptions(chatReq, req.Options)
+
+	format, err := ollamaFormat(req.Format)
+	if err != nil {
+		h.writeOllamaError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chatReq.ResponseFormat = format
+
+	start := time.Now()
+	var mu sync.Mutex
+	ctx := h.observe(w, r, &mu)
+
+	if req.Stream != nil && !*req.Stream {
+		result, err := h.client.Chat(ctx, chatReq)
+		if err != nil {
+			log.Printf("picolm error: %v", err)
+			h.writeOllamaError(w, err.Error(), inferenceStatus(w, err))
+			return
+		}
+
+		h.writeOllamaJSON(w, types.OllamaChatResponse{
+			Model:     model,
+			CreatedAt: time.Now().UTC(),
+			Message: &types.OllamaMessage{
+				Role:      "assistant",
+				Content:   result.Content,
+				ToolCalls: ollamaToolCalls(result.ToolCalls),
+			},
+			Done:          true,
+			DoneReason:    doneReason(result.FinishReason),
+			OllamaMetrics: ollamaMetrics(start, result.Usage),
+		})
+		return
+	}
+
+	stream := h.ndjsonStream(w)
+	if stream == nil {
+		return
+	}
+
+	var calls []types.ToolCall
+	err = h.client.StreamChat(ctx, chatReq, func(chunk picolm.StreamChunk) error {
+		if chunk.Content != "" {
+			stream.write(types.OllamaChatResponse{
+				Model:     model,
+				CreatedAt: time.Now().UTC(),
+				Message:   &types.OllamaMessage{Role: "assistant", Content: chunk.Content},
+			})
+		}
+
+		// Ollama sends each tool call whole, so deltas are collected until
+		// the reply is complete.
+		for _, delta := range chunk.ToolCalls {
+			if delta.ID != "" {
+				calls = append(calls, types.ToolCall{ID: delta.ID, Type: delta.Type})
+				calls[len(calls)-1].Function.Name = delta.Function.Name
+			}
+			if delta.Index < len(calls) {
+				calls[delta.Index].Function.Arguments += delta.Function.Arguments
+			}
+		}
+
+		if chunk.FinishReason != "" {
+			if len(calls) > 0 {
+				stream.write(types.OllamaChatResponse{
+					Model:     model,
+					CreatedAt: time.Now().UTC(),
+					Message:   &types.OllamaMessage{Role: "assistant", ToolCalls: ollamaToolCalls(calls)},
+				})
+			}
+			final := types.OllamaChatResponse{
+				Model:      model,
+				CreatedAt:  time.Now().UTC(),
+				Message:    &types.OllamaMessage{Role: "assistant"},
+				Done:       true,
+				DoneReason: doneReason(chunk.FinishReason),
+			}
+			if chunk.Usage != nil {
+				final.OllamaMetrics = ollamaMetrics(start, *chunk.Usage)
+			}
+			stream.write(final)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("picolm streaming error: %v", err)
+		stream.fail(err)
+	}
+}
+
+// HandleOllamaGenerate serves Ollama's /api/generate. Prompts are rendered
+// with the model's chat template, except raw prompts and prompts with a
+// suffix, which are completed as they are.
+func (h *Handler) HandleOllamaGenerate(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.OllamaGenerateRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeOllamaError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	model, ok := h.ollamaModel(req.Model)
+	if !ok || !allowModel(r, model) {
+		h.writeOllamaError(w, fmt.Sprintf("model %q not found", req.Model), http.StatusNotFound)
+		return
+	}
+	metrics.SetModel(r.Context(), model)
+	r, err := h.checkLimits(w, r, "")
+	if err != nil {
+		h.writeOllamaError(w, err.Error(), inferenceStatus(w, err))
+		return
+	}
+
+	if len(req.Images) > 0 {
+		h.writeOllamaError(w, "images are not supported", http.StatusBadRequest)
+		return
+	}
+
+	format, err := ollamaFormat(req.Format)
+	if err != nil {
+		h.writeOllamaError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.Prompt == "" && req.Suffix == "" {
+		h.writeOllamaJSON(w, types.OllamaGenerateResponse{
+			Model:      model,
+			CreatedAt:  time.Now().UTC(),
+			Done:       true,
+			DoneReason: "load",
+		})
+		return
+	}
+
+	start := time.Now()
+	var mu sync.Mutex
+	ctx := h.observe(w, r, &mu)
+	streaming := req.Stream == nil || *req.Stream
+
+	var (
+		text         string
+		finishReason string
+		usage        types.Usage
+		stream       *ndjsonStream
+	)
+	if streaming {
+		if stream = h.ndjsonStream(w); stream == nil {
+			return
+		}
+	}
+	handler := func(chunk picolm.StreamChunk) error {
+		if chunk.Content != "" {
+			stream.write(types.OllamaGenerateResponse{
+				Model:     model,
+				CreatedAt: time.Now().UTC(),
+				Response:  chunk.Content,
+			})
+		}
+		if chunk.FinishReason != "" {
+			finishReason = chunk.FinishReason
+			if chunk.Usage != nil {
+				usage = *chunk.Usage
+			}
+		}
+		return nil
+	}
+
+	if req.Raw || req.Suffix != "" {
+		cmplReq := &types.CompletionRequest{Model: model, Suffix: req.Suffix}
+		if opts := req.Options; opts != nil {
+			cmplReq.Temperature = opts.Temperature
+			cmplReq.TopP = opts.TopP
+			cmplReq.MaxTokens = max(opts.NumPredict, 0)
+			cmplReq.Stop = opts.Stop
+		}
+
+		if streaming {
+			err = h.client.StreamComplete(ctx, cmplReq, req.Prompt, handler)
+		} else {
+			var result *picolm.CompletionResult
+			if result, err = h.client.Complete(ctx, cmplReq, req.Prompt); err == nil {
+				text, finishReason, usage = result.Text, result.FinishReason, result.Usage
+			}
+		}
+	} else {
+		chatReq := &types.ChatCompletionRequest{Model: model}
+		if req.System != "" {
+			chatReq.Messages = append(chatReq.Messages, types.ChatMessage{Role: "system", Content: types.TextContent(req.System)})
+		}
+		chatReq.Messages = append(chatReq.Messages, types.ChatMessage{Role: "user", Content: types.TextContent(req.Prompt)})
+		applyOllamaOptions(chatReq, req.Options)
+		chatReq.ResponseFormat = format
+
+		if streaming {
+			err = h.client.StreamChat(ctx, chatReq, handler)
+		} else {
+			var result *picolm.ChatResult
+			if result, err = h.client.Chat(ctx, chatReq); err == nil {
+				text, finishReason, usage = result.Content, result.FinishReason, result.Usage
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("picolm error: %v", err)
+		if streaming {
+			stream.fail(err)
+		} else {
+			h.writeOllamaError(w, err.Error(), inferenceStatus(w, err))
+		}
+		return
+	}
+
+	final := types.OllamaGenerateResponse{
+		Model:         model,
+		CreatedAt:     time.Now().UTC(),
+		Response:      text,
+		Done:          true,
+		DoneReason:    doneReason(finishReason),
+		OllamaMetrics: ollamaMetrics(start, usage),
+	}
+	if streaming {
+		stream.write(final)
+		return
+	}
+	h.writeOllamaJSON(w, final)
+}
+
+// HandleOllamaTags serves Ollama's /api/tags, listing the configured models.
+func (h *Handler) HandleOllamaTags(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointModels)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ids := h.client.GetModelIDs()
+	slices.Sort(ids)
+
+	models := make([]types.OllamaModel, 0, len(ids))
+	for _, id := range ids {
+		if !allowModel(r, id) {
+			continue
+		}
+		model, err := h.ollamaModelInfo(id)
+		if err != nil {
+			log.Printf("model unavailable for %s: %v", id, err)
+			continue
+		}
+		models = append(models, model)
+	}
+
+	h.writeOllamaJSON(w, types.OllamaModelList{Models: models})
+}
+
+// HandleOllamaShow serves Ollama's /api/show, describing a model from its
+// GGUF metadata.
+func (h *Handler) HandleOllamaShow(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointModels)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.OllamaShowRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeOllamaError(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if req.Model == "" {
+		req.Model = req.Name
+	}
+
+	id, ok := h.ollamaModel(req.Model)
+	if !ok || req.Model == "" || !allowModel(r, id) {
+		h.writeOllamaError(w, fmt.Sprintf("model %q not found", req.Model), http.StatusNotFound)
+		return
+	}
+	metrics.SetModel(r.Context(), id)
+
+	model, err := h.ollamaModelInfo(id)
+	if err != nil {
+		h.writeOllamaError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	response := types.OllamaShowResponse{
+		Modelfile:    fmt.Sprintf("FROM %s\n", id),
+		Details:      model.Details,
+		ModelInfo:    map[string]any{},
+		Capabilities: []string{"completion", "tools"},
+		ModifiedAt:   model.ModifiedAt,
+	}
+	if meta, err := h.client.GetModelMetadata(id); err == nil {
+		response.Template = meta.ChatTemplate
+		response.ModelInfo["general.architecture"] = meta.Architecture
+		response.ModelInfo["general.name"] = meta.Name
+		response.ModelInfo["general.parameter_count"] = meta.ParameterCount
+		if meta.ContextLength > 0 {
+			response.ModelInfo[meta.Architecture+".context_length"] = meta.ContextLength
+		}
+	} else {
+		log.Printf("model metadata unavailable for %s: %v", id, err)
+	}
+
+	h.writeOllamaJSON(w, response)
+}
+
+// HandleOllamaVersion serves Ollama's /api/version.
+func (h *Handler) HandleOllamaVersion(w http.ResponseWriter, r *http.Request) {
+	h.writeOllamaJSON(w, map[string]string{"version": ollamaVersion})
+}
+
+// ollamaModel resolves an Ollama model name. Ollama clients name models with
+// a tag, so a ":latest" suffix is ignored.
+func (h *Handler) ollamaModel(name string) (string, bool) {
+	if name == "" {
+		return h.client.GetDefaultModel(), true
+	}
+	ids := h.client.GetModelIDs()
+	if slices.Contains(ids, name) {
+		return name, true
+	}
+	if trimmed := strings.TrimSuffix(name, ":latest"); slices.Contains(ids, trimmed) {
+		return trimmed, true
+	}
+	return "", false
+}
+
+// ollamaModelInfo describes a model from its file and GGUF metadata. The
+// digest identifies the file by path, size and modification time rather than
+// hashing its contents.
+func (h *Handler) ollamaModelInfo(id string) (types.OllamaModel, error) {
+	path, _, err := h.client.GetModelInfo(id)
+	if err != nil {
+		return types.OllamaModel{}, err
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return types.OllamaModel{}, err
+	}
+
+	digest := sha256.Sum256([]byte(fmt.Sprintf("%s:%d:%d", path, st.Size(), st.ModTime().UnixNano())))
+	model := types.OllamaModel{
+		Name:       id,
+		Model:      id,
+		ModifiedAt: st.ModTime().UTC(),
+		Size:       st.Size(),
+		Digest:     fmt.Sprintf("%x", digest),
+		Details:    types.OllamaModelDetails{Format: "gguf", Families: []string{}},
+	}
+
+	if meta, err := h.client.GetModelMetadata(id); err == nil {
+		model.Details.Family = meta.Architecture
+		if meta.Architecture != "" {
+			model.Details.Families = []string{meta.Architecture}
+		}
+		model.Details.ParameterSize = parameterSize(meta.ParameterCount)
+		model.Details.QuantizationLevel = meta.Quantization
+	}
+
+	return model, nil
+}
+
+func applyOllamaOptions(req *types.ChatCompletionRequest, opts *types.OllamaOptions) {
+	if opts == nil {
+		return
+	}
+	req.Temperature = opts.Temperature
+	req.TopP = opts.TopP
+	// Negative num_predict means no limit, which picolm takes as the default.
+	req.MaxTokens = max(opts.NumPredict, 0)
+	req.Stop = opts.Stop
+}
+
+// ollamaFormat translates Ollama's format, either "json" or a JSON schema,
+// into a response format.
+func ollamaFormat(raw json.RawMessage) (*types.ResponseFormat, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) || bytes.Equal(raw, []byte(`""`)) {
+		return nil, nil
+	}
+
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		if name != "json" {
+			return nil, fmt.Errorf("invalid format %q: must be \"json\" or a JSON schema", name)
+		}
+		return &types.ResponseFormat{Type: picolm.FormatJSONObject}, nil
+	}
+
+	var schema map[string]any
+	if err := json.Unmarshal(raw, &schema); err != nil {
+		return nil, fmt.Errorf("invalid format: must be \"json\" or a JSON schema")
+	}
+	return &types.ResponseFormat{
+		Type:       picolm.FormatJSONSchema,
+		JSONSchema: &types.JSONSchemaFormat{Name: "response", Schema: schema},
+	}, nil
+}
+
+func ollamaToolCalls(calls []types.ToolCall) []types.OllamaToolCall {
+	if len(calls) == 0 {
+		return nil
+	}
+	out := make([]types.OllamaToolCall, len(calls))
+	for i, call := range calls {
+		out[i] = types.OllamaToolCall{Function: types.OllamaToolCallFunction{
+			Name:      call.Function.Name,
+			Arguments: toolInput(call.Function.Arguments),
+		}}
+	}
+	return out
+}
+
+func ollamaMetrics(start time.Time, usage types.Usage) types.OllamaMetrics {
+	elapsed := time.Since(start).Nanoseconds()
+	return types.OllamaMetrics{
+		TotalDuration:   elapsed,
+		PromptEvalCount: usage.PromptTokens,
+		EvalCount:       usage.CompletionTokens,
+		EvalDuration:    elapsed,
+	}
+}
+
+// doneReason maps a finish reason to Ollama's done_reason, which has no
+// separate value for tool calls.
+func doneReason(finishReason string) string {
+	if finishReason == "length" {
+		return "length"
+	}
+	return "stop"
+}
+
+// parameterSize formats a parameter count the way Ollama does, e.g. "1.1B".
+func parameterSize(n uint64) string {
+	switch {
+	case n == 0:
+		return ""
+	case n >= 1e9:
+		return fmt.Sprintf("%.1fB", float64(n)/1e9)
+	case n >= 1e6:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+// ndjsonStream writes newline-delimited JSON objects, flushing each one.
+type ndjsonStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	started bool
+}
+
+func (h *Handler) ndjsonStream(w http.ResponseWriter) *ndjsonStream {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		h.writeOllamaError(w, "streaming not supported", http.StatusInternalServerError)
+		return nil
+	}
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	return &ndjsonStream{w: w, flusher: flusher}
+}
+
+func (s *ndjsonStream) write(v any) {
+	s.started = true
+	json.NewEncoder(s.w).Encode(v)
+	s.flusher.Flush()
+}
+
+// fail reports an error with its HTTP status while nothing has been written,
+// and as a final error object after that.
+func (s *ndjsonStream) fail(err error) {
+	if !s.started {
+		status := inferenceStatus(s.w, err)
+		s.w.Header().Set("Content-Type", "application/json")
+		s.w.WriteHeader(status)
+	}
+	s.write(types.OllamaErrorResponse{Error: err.Error()})
+}
+
+func (h *Handler) writeOllamaJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (h *Handler) writeOllamaError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(types.OllamaErrorResponse{Error: message})
+}
@@ -0,0 +1,279 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestHandleOllamaChat_Streaming(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Hello", " world"},
+		streamToolCalls: [][]types.ToolCallDelta{
+			{{Index: 0, ID: "call_1", Type: "function", Function: types.CallFunctionDelta{Name: "get_weather"}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `{"city":`}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `"Nairobi"}`}}},
+		},
+		streamUsage: &types.Usage{PromptTokens: 5, CompletionTokens: 4, TotalTokens: 9},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"model":"picolm-local:latest","messages":[{"role":"user","content":"Hi"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body))
+
+	w := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleOllamaChat(w, req)
+
+	if w.Code() != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code(), w.Body().String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q, want application/x-ndjson", ct)
+	}
+
+	lines := strings.Split(strings.TrimSpace(w.Body().String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected 4 lines, got %d: %s", len(lines), w.Body().String())
+	}
+	responses := make([]types.OllamaChatResponse, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &responses[i]); err != nil {
+			t.Fatalf("line %d: %v", i, err)
+		}
+	}
+
+	if responses[0].Model != "picolm-local" || responses[0].Message.Content != "Hello" || responses[0].Done {
+		t.Errorf("first line = %+v", responses[0])
+	}
+	calls := responses[2].Message.ToolCalls
+	if len(calls) != 1 || calls[0].Function.Name != "get_weather" || string(calls[0].Function.Arguments) != `{"city":"Nairobi"}` {
+		t.Errorf("tool calls = %+v", calls)
+	}
+	final := responses[3]
+	if !final.Done || final.DoneReason != "stop" || final.PromptEvalCount != 5 || final.EvalCount != 4 {
+		t.Errorf("final line = %+v", final)
+	}
+}
+
+func TestHandleOllamaChat_NoStream(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content:      "Hi there",
+			FinishReason: "length",
+			Usage:        types.Usage{PromptTokens: 3, CompletionTokens: 2, TotalTokens: 5},
+		},
+	}
+	handler := NewHandler(mockClient, "")
+
+	body := `{"model":"picolm-local","stream":false,"messages":[{"role":"user","content":"Hi"}],"options":{"num_predict":2}}`
+	req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(body))
+
+	w := httptest.NewRecorder()
+	handler.HandleOllamaChat(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp types.OllamaChatResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	if !resp.Done || resp.DoneReason != "length" || resp.Message.Content != "Hi there" || resp.EvalCount != 2 {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+}
+
+func TestHandleOllamaChat_Errors(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{name: "unknown model", body: `{"model":"missing","messages":[{"role":"user","content":"Hi"}]}`, wantStatus: http.StatusNotFound},
+		{name: "images", body: `{"messages":[{"role":"user","content":"Hi","images":["aGk="]}]}`, wantStatus: http.StatusBadRequest},
+		{name: "bad format", body: `{"messages":[{"role":"user","content":"Hi"}],"format":"yaml"}`, wantStatus: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := NewHandler(&mockPicoLMClient{}, "")
+			req := httptest.NewRequest(http.MethodPost, "/api/chat", strings.NewReader(tt.body))
+
+			w := httptest.NewRecorder()
+			handler.HandleOllamaChat(w, req)
+
+			if w.Code != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, w.Code)
+			}
+			var resp types.OllamaErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error == "" {
+				t.Errorf("expected an Ollama error body, got %s", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleOllamaGenerate(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content:      "return a + b",
+			FinishReason: "stop",
+			Usage:        types.Usage{PromptTokens: 6, CompletionTokens: 4, TotalTokens: 10},
+		},
+		streamTokens: []string{"Nairobi", "."},
+	}
+	handler := NewHandler(mockClient, "")
+
+	t.Run("raw", func(t *testing.T) {
+		body := `{"model":"picolm-local","prompt":"func add(a, b int) int {","raw":true,"stream":false}`
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body))
+
+		w := httptest.NewRecorder()
+		handler.HandleOllamaGenerate(w, req)
+
+		var resp types.OllamaGenerateResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+		if !resp.Done || resp.Response != "return a + b" || resp.PromptEvalCount != 6 {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		body := `{"model":"picolm-local","system":"Be brief.","prompt":"Capital of Kenya?"}`
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(body))
+
+		w := &flusherRecorder{rec: httptest.NewRecorder()}
+		handler.HandleOllamaGenerate(w, req)
+
+		lines := strings.Split(strings.TrimSpace(w.Body().String()), "\n")
+		if len(lines) != 3 {
+			t.Fatalf("expected 3 lines, got %d: %s", len(lines), w.Body().String())
+		}
+		var first, final types.OllamaGenerateResponse
+		json.Unmarshal([]byte(lines[0]), &first)
+		json.Unmarshal([]byte(lines[2]), &final)
+		if first.Response != "Nairobi" || first.Done {
+			t.Errorf("first line = %+v", first)
+		}
+		if !final.Done || final.DoneReason != "stop" {
+			t.Errorf("final line = %+v", final)
+		}
+	})
+
+	t.Run("empty prompt loads the model", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/api/generate", strings.NewReader(`{"model":"picolm-local"}`))
+
+		w := httptest.NewRecorder()
+		handler.HandleOllamaGenerate(w, req)
+
+		var resp types.OllamaGenerateResponse
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if !resp.Done || resp.DoneReason != "load" {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+	})
+}
+
+func TestHandleOllamaTagsAndShow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "model.gguf")
+	if err := os.WriteFile(path, []byte("GGUF"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	mockClient := &mockPicoLMClient{
+		modelInfoPath: path,
+		modelMetadata: &types.ModelMetadata{
+			Architecture:   "llama",
+			Name:           "TinyLlama",
+			ParameterCount: 1_100_048_384,
+			Quantization:   "Q4_K_M",
+			ContextLength:  2048,
+			ChatTemplate:   "{{ messages }}",
+		},
+	}
+	handler := NewHandler(mockClient, "")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/tags", nil)
+	w := httptest.NewRecorder()
+	handler.HandleOllamaTags(w, req)
+
+	var list types.OllamaModelList
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil {
+		t.Fatalf("failed to unmarshal tags: %v", err)
+	}
+	if len(list.Models) != 1 {
+		t.Fatalf("expected 1 model, got %+v", list.Models)
+	}
+	model := list.Models[0]
+	if model.Name != "picolm-local" || model.Size != 4 || len(model.Digest) != 64 {
+		t.Errorf("unexpected model: %+v", model)
+	}
+	if model.Details.Family != "llama" || model.Details.ParameterSize != "1.1B" || model.Details.QuantizationLevel != "Q4_K_M" {
+		t.Errorf("unexpected details: %+v", model.Details)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/show", strings.NewReader(`{"name":"picolm-local:latest"}`))
+	w = httptest.NewRecorder()
+	handler.HandleOllamaShow(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var show types.OllamaShowResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &show); err != nil {
+		t.Fatalf("failed to unmarshal show: %v", err)
+	}
+	if show.Template != "{{ messages }}" || show.ModelInfo["llama.context_length"] != float64(2048) {
+		t.Errorf("unexpected show response: %+v", show)
+	}
+	if show.Modelfile != "FROM picolm-local\n" {
+		t.Errorf("Modelfile = %q, want the model ID without its path", show.Modelfile)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/show", strings.NewReader(`{"model":"missing"}`))
+	w = httptest.NewRecorder()
+	handler.HandleOllamaShow(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for unknown model, got %d", w.Code)
+	}
+}
+
+func TestOllamaFormat(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		wantType string
+		wantErr  bool
+	}{
+		{name: "omitted", format: ``},
+		{name: "json", format: `"json"`, wantType: picolm.FormatJSONObject},
+		{name: "schema", format: `{"type":"object"}`, wantType: picolm.FormatJSONSchema},
+		{name: "unknown", format: `"xml"`, wantErr: true},
+		{name: "number", format: `3`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ollamaFormat(json.RawMessage(tt.format))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ollamaFormat() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			gotType := ""
+			if got != nil {
+				gotType = got.Type
+			}
+			if gotType != tt.wantType {
+				t.Errorf("type = %q, want %q", gotType, tt.wantType)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// paginate returns the page of items, sorted oldest first, selected by the
+// after, limit and order query parameters.
+func paginate[T any](query url.Values, items []T, id func(T) string) (types.CursorList[T], error) {
+	limit := defaultPageSize
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return types.CursorList[T]{}, &picolm.InvalidRequestError{
+				Param:   "limit",
+				Message: fmt.Sprintf("limit must be between 1 and %d", maxPageSize),
+			}
+		}
+		limit = n
+	}
+
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		items = slices.Clone(items)
+		slices.Reverse(items)
+	default:
+		return types.CursorList[T]{}, &picolm.InvalidRequestError{
+			Param:   "order",
+			Message: `order must be "asc" or "desc"`,
+		}
+	}
+
+	if after := query.Get("after"); after != "" {
+		i := slices.IndexFunc(items, func(item T) bool { return id(item) == after })
+		if i < 0 {
+			return types.CursorList[T]{}, &picolm.InvalidRequestError{
+				Param:   "after",
+				Message: fmt.Sprintf("no object with id %q", after),
+			}
+		}
+		items = items[i+1:]
+	}
+
+	page := types.CursorList[T]{Object: "list", Data: items}
+	if len(items) > limit {
+		page.Data = items[:limit]
+		page.HasMore = true
+	}
+	if len(page.Data) > 0 {
+		page.FirstID = id(page.Data[0])
+		page.LastID = id(page.Data[len(page.Data)-1])
+	}
+	if page.Data == nil {
+		page.Data = []T{}
+	}
+	return page, nil
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+)
+
+func TestPaginate(t *testing.T) {
+	items := []string{"a", "b", "c", "d"}
+	id := func(s string) string { return s }
+
+	tests := []struct {
+		query   string
+		want    []string
+		hasMore bool
+	}{
+		{"", []string{"a", "b", "c", "d"}, false},
+		{"limit=2", []string{"a", "b"}, true},
+		{"limit=2&after=b", []string{"c", "d"}, false},
+		{"order=desc&limit=3", []string{"d", "c", "b"}, true},
+		{"order=desc&after=b", []string{"a"}, false},
+		{"after=d", []string{}, false},
+	}
+	for _, tt := range tests {
+		q, _ := url.ParseQuery(tt.query)
+		page, err := paginate(q, items, id)
+		if err != nil {
+			t.Errorf("paginate(%q) error = %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(page.Data, tt.want) || page.HasMore != tt.hasMore {
+			t.Errorf("paginate(%q) = %v, %v; want %v, %v", tt.query, page.Data, page.HasMore, tt.want, tt.hasMore)
+		}
+	}
+
+	if !reflect.DeepEqual(items, []string{"a", "b", "c", "d"}) {
+		t.Errorf("paginate modified its input: %v", items)
+	}
+
+	for _, query := range []string{"limit=0", "limit=101", "order=up", "after=z"} {
+		q, _ := url.ParseQuery(query)
+		var reqErr *picolm.InvalidRequestError
+		if _, err := paginate(q, items, id); !errors.As(err, &reqErr) {
+			t.Errorf("paginate(%q) error = %v, want an InvalidRequestError", query, err)
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+const responsesCollection = "responses"
+
+// storedResponse is a response together with the messages it added to its
+// conversation: the input of its request followed by its output. Earlier
+// turns are stored with the responses in the chain of previous_response_id,
+// so a long conversation is not copied into every turn. Instructions apply
+// to a single request and are not part of the conversation. Key names the
+// API key that created it.
+type storedResponse struct {
+	Response types.Response      `json:"response"`
+	Messages []types.ChatMessage `json:"messages"`
+	Key      string              `json:"key,omitempty"`
+}
+
+// HandleResponses serves the Responses API. Input items are translated into
+// chat messages, appended to the stored conversation of previous_response_id
+// when one is given.
+func (h *Handler) HandleResponses(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req types.ResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		h.writeDecodeError(w, err)
+		return
+	}
+
+	if req.Model == "" {
+		req.Model = h.client.GetDefaultModel()
+	}
+	if !h.requireModel(w, r, req.Model) {
+		return
+	}
+	if len(req.Input) == 0 {
+		h.writeErrorDetail(w, types.ErrorDetail{
+			Message: "input is required",
+			Type:    "invalid_request_error",
+			Param:   "input",
+		}, http.StatusBadRequest)
+		return
+	}
+
+	var conversation []types.ChatMessage
+	if req.PreviousResponseID != "" {
+		var err error
+		conversation, err = h.loadConversation(r, req.PreviousResponseID)
+		if err != nil {
+			h.writeErrorDetail(w, types.ErrorDetail{
+				Message: fmt.Sprintf("Previous response with id '%s' not found.", req.PreviousResponseID),
+				Type:    "invalid_request_error",
+				Param:   "previous_response_id",
+			}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	input, err := responseMessages(req.Input)
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+	conversation = append(conversation, input...)
+
+	chatReq, err := toResponseChatRequest(&req, conversation)
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+	if r, err = h.checkLimits(w, r, req.User); err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+
+	resp := newResponse(&req)
+
+	if req.Stream {
+		h.handleStreamingResponse(w, r, chatReq, resp, input)
+		return
+	}
+
+	var mu sync.Mutex
+	result, err := h.client.Chat(h.observe(w, r, &mu), chatReq)
+	if err != nil {
+		log.Printf("picolm error: %v", err)
+		h.writeInferenceError(w, err)
+		return
+	}
+
+	resp.Output = responseOutput(result.Content, result.ToolCalls)
+	finishResponse(resp, result.FinishReason, result.Usage)
+	h.saveResponse(keyName(r), resp, input)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleStreamingResponse streams a response as typed server-sent events:
+// response.created and response.in_progress, then for each output item
+// response.output_item.added, its text or function call argument deltas and
+// response.output_item.done, and finally response.completed or
+// response.incomplete.
+func (h *Handler) handleStreamingResponse(w http.ResponseWriter, r *http.Request, req *types.ChatCompletionRequest, resp *types.Response, input []types.ChatMessage) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("Transfer-Encoding", "chunked")
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/json")
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	seq := 0
+	writeEvent := func(event string, data map[string]any) {
+		data["type"] = event
+		data["sequence_number"] = seq
+		seq++
+		payload, _ := json.Marshal(data)
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+		flusher.Flush()
+	}
+
+	// response.created is deferred to the first chunk so that errors raised
+	// before generation starts are still reported with their HTTP status.
+	started := false
+	start := func() {
+		if started {
+			return
+		}
+		started = true
+		writeEvent("response.created", map[string]any{"response": resp})
+		writeEvent("response.in_progress", map[string]any{"response": resp})
+	}
+
+	open := -1
+	closeItem := func() {
+		if open < 0 {
+			return
+		}
+		item := &resp.Output[open]
+		item.Status = "completed"
+		switch item.Type {
+		case "message":
+			part := item.Content[0]
+			writeEvent("response.output_text.done", map[string]any{
+				"item_id": item.ID, "output_index": open, "content_index": 0, "text": part.Text,
+			})
+			writeEvent("response.content_part.done", map[string]any{
+				"item_id": item.ID, "output_index": open, "content_index": 0, "part": part,
+			})
+		case "function_call":
+			writeEvent("response.function_call_arguments.done", map[string]any{
+				"item_id": item.ID, "output_index": open, "arguments": item.Arguments,
+			})
+		}
+		writeEvent("response.output_item.done", map[string]any{"output_index": open, "item": *item})
+		open = -1
+	}
+
+	var mu sync.Mutex
+	err := h.client.StreamChat(h.observe(w, r, &mu), req, func(chunk picolm.StreamChunk) error {
+		start()
+
+		if chunk.Content != "" {
+			if open < 0 || resp.Output[open].Type != "message" {
+				closeItem()
+				item := types.ResponseItem{Type: "message", ID: "msg_" + generateID(), Status: "in_progress", Role: "assistant"}
+				resp.Output = append(resp.Output, item)
+				open = len(resp.Output) - 1
+				writeEvent("response.output_item.added", map[string]any{
+					"output_index": open,
+					"item": map[string]any{
+						"type": item.Type, "id": item.ID, "status": item.Status, "role": item.Role, "content": []any{},
+					},
+				})
+
+				part := outputText("")
+				resp.Output[open].Content = types.ResponseContent{part}
+				writeEvent("response.content_part.added", map[string]any{
+					"item_id": item.ID, "output_index": open, "content_index": 0, "part": part,
+				})
+			}
+
+			item := &resp.Output[open]
+			item.Content[0].Text += chunk.Content
+			writeEvent("response.output_text.delta", map[string]any{
+				"item_id": item.ID, "output_index": open, "content_index": 0, "delta": chunk.Content,
+			})
+		}
+
+		for _, delta := range chunk.ToolCalls {
+			if delta.ID != "" {
+				closeItem()
+				item := types.ResponseItem{
+					Type:   "function_call",
+					ID:     "fc_" + generateID(),
+					Status: "in_progress",
+					CallID: delta.ID,
+					Name:   delta.Function.Name,
+				}
+				resp.Output = append(resp.Output, item)
+				open = len(resp.Output) - 1
+				writeEvent("response.output_item.added", map[string]any{
+					"output_index": open,
+					"item": map[string]any{
+						"type": item.Type, "id": item.ID, "status": item.Status,
+						"call_id": item.CallID, "name": item.Name, "arguments": "",
+					},
+				})
+			}
+			if delta.Function.Arguments != "" && open >= 0 {
+				item := &resp.Output[open]
+				item.Arguments += delta.Function.Arguments
+				writeEvent("response.function_call_arguments.delta", map[string]any{
+					"item_id": item.ID, "output_index": open, "delta": delta.Function.Arguments,
+				})
+			}
+		}
+
+		if chunk.FinishReason != "" {
+			closeItem()
+			var usage types.Usage
+			if chunk.Usage != nil {
+				usage = *chunk.Usage
+			}
+			finishResponse(resp, chunk.FinishReason, usage)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("picolm streaming error: %v", err)
+		if !started && (h.writeQueueFull(w, err) || h.writeRequestError(w, err) || h.writeFormatError(w, err)) {
+			return
+		}
+		start()
+		resp.Status = "failed"
+		resp.Error = &types.ResponseError{Code: "server_error", Message: err.Error()}
+		writeEvent("response.failed", map[string]any{"response": resp})
+		return
+	}
+
+	start()
+	h.saveResponse(keyName(r), resp, input)
+
+	event := "response.completed"
+	if resp.Status == "incomplete" {
+		event = "response.incomplete"
+	}
+	writeEvent(event, map[string]any{"response": resp})
+}
+
+// HandleResponse serves GET and DELETE of a stored response.
+func (h *Handler) HandleResponse(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/v1/responses/")
+
+	switch r.Method {
+	case http.MethodGet:
+		stored, err := h.loadResponse(r, id)
+		if err != nil {
+			h.writeResponseNotFound(w, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stored.Response)
+
+	case http.MethodDelete:
+		_, err := h.loadResponse(r, id)
+		if err == nil {
+			err = h.store.Delete(responsesCollection, id)
+		}
+		if err != nil {
+			h.writeResponseNotFound(w, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.DeletedObject{ID: id, Object: "response", Deleted: true})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// loadResponse returns a stored response of the request's key. Those of
+// other keys are not found.
+func (h *Handler) loadResponse(r *http.Request, id string) (*storedResponse, error) {
+	if h.store == nil {
+		return nil, store.ErrNotFound
+	}
+	var stored storedResponse
+	if err := h.store.Get(responsesCollection, id, &stored); err != nil {
+		return nil, err
+	}
+	if !ownedBy(r, stored.Key) {
+		return nil, store.ErrNotFound
+	}
+	return &stored, nil
+}
+
+// loadConversation rebuilds the conversation that ends with the stored
+// response id by walking its chain of previous responses. The conversation
+// cannot be rebuilt once a response in the chain was deleted.
+func (h *Handler) loadConversation(r *http.Request, id string) ([]types.ChatMessage, error) {
+	var turns [][]types.ChatMessage
+	seen := map[string]bool{}
+	for id != "" && !seen[id] {
+		seen[id] = true
+		stored, err := h.loadResponse(r, id)
+		if err != nil {
+			return nil, err
+		}
+		turns = append(turns, stored.Messages)
+		id = stored.Response.PreviousResponseID
+	}
+
+	var conversation []types.ChatMessage
+	for i := len(turns) - 1; i >= 0; i-- {
+		conversation = append(conversation, turns[i]...)
+	}
+	return conversation, nil
+}
+
+// saveResponse persists a response of key with store enabled, together with
+// the input messages of its request. A failure to persist is logged rather
+// than failing a generation that already succeeded.
+func (h *Handler) saveResponse(key string, resp *types.Response, input []types.ChatMessage) {
+	if !resp.Store || h.store == nil {
+		return
+	}
+	stored := storedResponse{
+		Response: *resp,
+		Messages: append(slices.Clip(input), outputMessage(resp.Output)),
+		Key:      key,
+	}
+	if err := h.store.Put(responsesCollection, resp.ID, stored); err != nil {
+		log.Printf("failed to store response %s: %v", resp.ID, err)
+	}
+}
+
+func (h *Handler) writeResponseNotFound(w http.ResponseWriter, id string, err error) {
+	if !errors.Is(err, store.ErrNotFound) {
+		log.Printf("failed to load response %s: %v", id, err)
+		h.writeError(w, "failed to load response", "internal_error", http.StatusInternalServerError)
+		return
+	}
+	h.writeErrorDetail(w, types.ErrorDetail{
+		Message: fmt.Sprintf("Response with id '%s' not found.", id),
+		Type:    "invalid_request_error",
+	}, http.StatusNotFound)
+}
+
+// newResponse returns an in-progress response echoing the request's
+// settings.
+func newResponse(req *types.ResponseRequest) *types.Response {
+	resp := &types.Response{
+		ID:                 "resp_" + generateID(),
+		Object:             "response",
+		CreatedAt:          time.Now().Unix(),
+		Status:             "in_progress",
+		Model:              req.Model,
+		Output:             []types.ResponseItem{},
+		Instructions:       req.Instructions,
+		PreviousResponseID: req.PreviousResponseID,
+		MaxOutputTokens:    req.MaxOutputTokens,
+		Temperature:        req.Temperature,
+		TopP:               req.TopP,
+		Tools:              req.Tools,
+		ToolChoice:         req.ToolChoice,
+		ParallelToolCalls:  req.ParallelToolCalls == nil || *req.ParallelToolCalls,
+		Text:               req.Text,
+		Metadata:           req.Metadata,
+		Store:              req.Store == nil || *req.Store,
+	}
+	if resp.Tools == nil {
+		resp.Tools = []types.ResponseTool{}
+	}
+	if resp.ToolChoice == nil {
+		resp.ToolChoice = picolm.ToolChoiceAuto
+	}
+	if resp.Metadata == nil {
+		resp.Metadata = map[string]string{}
+	}
+	return resp
+}
+
+func finishResponse(resp *types.Response, finishReason string, usage types.Usage) {
+	resp.Status = "completed"
+	if finishReason == "length" {
+		resp.Status = "incomplete"
+		resp.IncompleteDetails = &types.IncompleteDetails{Reason: "max_output_tokens"}
+	}
+	resp.Usage = &types.ResponseUsage{
+		InputTokens:  usage.PromptTokens,
+		OutputTokens: usage.CompletionTokens,
+		TotalTokens:  usage.TotalTokens,
+	}
+}
+
+// responseMessages translates input items into chat messages. Function calls
+// are attached to the assistant message before them, and function call
+// outputs become tool messages.
+func responseMessages(items []types.ResponseItem) ([]types.ChatMessage, error) {
+	var messages []types.ChatMessage
+	for i, item := range items {
+		param := fmt.Sprintf("input[%d]", i)
+
+		switch item.Type {
+		case "", "message":
+			role := item.Role
+			switch role {
+			case "user", "assistant", "system":
+			case "developer":
+				role = "system"
+			default:
+				return nil, &picolm.InvalidRequestError{
+					Param:   param + ".role",
+					Message: fmt.Sprintf("unsupported role %q", item.Role),
+				}
+			}
+
+			texts := make([]string, 0, len(item.Content))
+			for j, part := range item.Content {
+				switch part.Type {
+				case "input_text", "output_text":
+					texts = append(texts, part.Text)
+				default:
+					return nil, &picolm.InvalidRequestError{
+						Param:   fmt.Sprintf("%s.content[%d]", param, j),
+						Message: fmt.Sprintf("unsupported content type %q: only text is supported", part.Type),
+					}
+				}
+			}
+			messages = append(messages, types.ChatMessage{
+				Role:    role,
+				Content: types.TextContent(strings.Join(texts, "\n")),
+			})
+
+		case "function_call":
+			call := types.ToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: types.CallFunction{Name: item.Name, Arguments: item.Arguments},
+			}
+			if n := len(messages); n > 0 && messages[n-1].Role == "assistant" {
+				messages[n-1].ToolCalls = append(messages[n-1].ToolCalls, call)
+			} else {
+				messages = append(messages, types.ChatMessage{Role: "assistant", ToolCalls: []types.ToolCall{call}})
+			}
+
+		case "function_call_output":
+			messages = append(messages, types.ChatMessage{
+				Role:       "tool",
+				Content:    types.TextContent(item.Output),
+				ToolCallID: item.CallID,
+			})
+
+		default:
+			return nil, &picolm.InvalidRequestError{
+				Param:   param + ".type",
+				Message: fmt.Sprintf("unsupported input item type %q", item.Type),
+			}
+		}
+	}
+	return messages, nil
+}
+
+// toResponseChatRequest builds the chat completion request for a Responses
+// API request and its conversation.
+func toResponseChatRequest(req *types.ResponseRequest, conversation []types.ChatMessage) (*types.ChatCompletionRequest, error) {
+	chatReq := &types.ChatCompletionRequest{
+		Model:             req.Model,
+		Temperature:       req.Temperature,
+		TopP:              req.TopP,
+		MaxTokens:         req.MaxOutputTokens,
+		ParallelToolCalls: req.ParallelToolCalls,
+		User:              req.User,
+	}
+
+	if req.Instructions != "" {
+		chatReq.Messages = append(chatReq.Messages, types.ChatMessage{
+			Role:    "system",
+			Content: types.TextContent(req.Instructions),
+		})
+	}
+	chatReq.Messages = append(chatReq.Messages, conversation...)
+
+	for i, tool := range req.Tools {
+		if tool.Type != "function" {
+			return nil, &picolm.InvalidRequestError{
+				Param:   fmt.Sprintf("tools[%d].type", i),
+				Message: fmt.Sprintf("unsupported tool type %q: only function tools are supported", tool.Type),
+			}
+		}
+		chatReq.Tools = append(chatReq.Tools, types.ToolDefinition{
+			Type: "function",
+			Function: types.FunctionDef{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
+	}
+
+	switch choice := req.ToolChoice.(type) {
+	case nil, string:
+		chatReq.ToolChoice = choice
+	case map[string]any:
+		name, _ := choice["name"].(string)
+		if choice["type"] != picolm.ToolChoiceFunction || name == "" {
+			return nil, &picolm.InvalidRequestError{
+				Param:   "tool_choice",
+				Message: "tool_choice must be \"auto\", \"none\", \"required\" or a function with a name",
+			}
+		}
+		chatReq.ToolChoice = map[string]any{
+			"type":     picolm.ToolChoiceFunction,
+			"function": map[string]any{"name": name},
+		}
+	default:
+		return nil, &picolm.InvalidRequestError{Param: "tool_choice", Message: "invalid tool_choice"}
+	}
+
+	if req.Text != nil && req.Text.Format != nil {
+		f := req.Text.Format
+		chatReq.ResponseFormat = &types.ResponseFormat{Type: f.Type}
+		if f.Type == picolm.FormatJSONSchema {
+			chatReq.ResponseFormat.JSONSchema = &types.JSONSchemaFormat{
+				Name:        f.Name,
+				Description: f.Description,
+				Schema:      f.Schema,
+				Strict:      f.Strict,
+			}
+		}
+	}
+
+	return chatReq, nil
+}
+
+// responseOutput returns the output items for a reply: a message for its
+// text, followed by a function call for each tool call.
+func responseOutput(content string, calls []types.ToolCall) []types.ResponseItem {
+	output := []types.ResponseItem{}
+	if content != "" {
+		output = append(output, types.ResponseItem{
+			Type:    "message",
+			ID:      "msg_" + generateID(),
+			Status:  "completed",
+			Role:    "assistant",
+			Content: types.ResponseContent{outputText(content)},
+		})
+	}
+	for _, call := range calls {
+		output = append(output, types.ResponseItem{
+			Type:      "function_call",
+			ID:        "fc_" + generateID(),
+			Status:    "completed",
+			CallID:    call.ID,
+			Name:      call.Function.Name,
+			Arguments: call.Function.Arguments,
+		})
+	}
+	return output
+}
+
+// outputMessage returns output items as the assistant message they add to
+// the conversation.
+func outputMessage(output []types.ResponseItem) types.ChatMessage {
+	msg := types.ChatMessage{Role: "assistant"}
+	var texts []string
+	for _, item := range output {
+		switch item.Type {
+		case "message":
+			for _, part := range item.Content {
+				texts = append(texts, part.Text)
+			}
+		case "function_call":
+			msg.ToolCalls = append(msg.ToolCalls, types.ToolCall{
+				ID:       item.CallID,
+				Type:     "function",
+				Function: types.CallFunction{Name: item.Name, Arguments: item.Arguments},
+			})
+		}
+	}
+	msg.Content = types.TextContent(strings.Join(texts, ""))
+	return msg
+}
+
+func outputText(text string) types.ResponseContentPart {
+	return types.ResponseContentPart{Type: "output_text", Text: text, Annotations: json.RawMessage("[]")}
+}
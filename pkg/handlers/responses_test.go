@@ -0,0 +1,270 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func newStoreHandler(t *testing.T, client picolm.Provider) *Handler {
+	t.Helper()
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("store.Open() error = %v", err)
+	}
+	return NewHandler(client, "", WithStore(st))
+}
+
+func postResponse(t *testing.T, handler *Handler, body string) (*httptest.ResponseRecorder, types.Response) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.HandleResponses(w, req)
+
+	var resp types.Response
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("failed to unmarshal response: %v", err)
+		}
+	}
+	return w, resp
+}
+
+func TestHandleResponses_PreviousResponse(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content:      "Nairobi.",
+			FinishReason: "stop",
+			Usage:        types.Usage{PromptTokens: 8, CompletionTokens: 2, TotalTokens: 10},
+		},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	w, first := postResponse(t, handler, `{"model":"picolm-local","instructions":"Be brief.","input":"Capital of Kenya?"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if first.Object != "response" || first.Status != "completed" || !strings.HasPrefix(first.ID, "resp_") || !first.Store {
+		t.Errorf("unexpected response envelope: %+v", first)
+	}
+	if len(first.Output) != 1 || first.Output[0].Type != "message" || first.Output[0].Content[0].Text != "Nairobi." {
+		t.Fatalf("unexpected output: %+v", first.Output)
+	}
+	if first.Usage == nil || first.Usage.InputTokens != 8 || first.Usage.OutputTokens != 2 {
+		t.Errorf("usage = %+v", first.Usage)
+	}
+
+	body := `{"model":"picolm-local","previous_response_id":"` + first.ID + `","input":[{"role":"user","content":"And of Uganda?"}]}`
+	w, second := postResponse(t, handler, body)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// The conversation is rebuilt from the stored response; its instructions
+	// are not carried over.
+	want := []types.ChatMessage{
+		{Role: "user", Content: types.TextContent("Capital of Kenya?")},
+		{Role: "assistant", Content: types.TextContent("Nairobi.")},
+		{Role: "user", Content: types.TextContent("And of Uganda?")},
+	}
+	if got := mockClient.lastRequest().Messages; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+
+	// Each response stores only the turn it added; a later turn walks the
+	// chain back to the first.
+	body = `{"model":"picolm-local","previous_response_id":"` + second.ID + `","input":"And of Tanzania?"}`
+	if w, _ := postResponse(t, handler, body); w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	want = append(want,
+		types.ChatMessage{Role: "assistant", Content: types.TextContent("Nairobi.")},
+		types.ChatMessage{Role: "user", Content: types.TextContent("And of Tanzania?")},
+	)
+	if got := mockClient.lastRequest().Messages; !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/responses/"+second.ID, nil)
+	if stored, err := handler.loadResponse(req, second.ID); err != nil || len(stored.Messages) != 2 {
+		t.Errorf("stored turn = %+v, %v, want its input and output only", stored, err)
+	}
+}
+
+func TestHandleResponse_GetAndDelete(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "Hi", FinishReason: "length"},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	_, created := postResponse(t, handler, `{"input":"Hello","max_output_tokens":1}`)
+	if created.Status != "incomplete" || created.IncompleteDetails == nil || created.IncompleteDetails.Reason != "max_output_tokens" {
+		t.Errorf("unexpected incomplete response: %+v", created)
+	}
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.HandleResponse(w, httptest.NewRequest(http.MethodGet, "/v1/responses/"+created.ID, nil))
+		return w
+	}
+
+	w := get()
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var fetched types.Response
+	json.Unmarshal(w.Body.Bytes(), &fetched)
+	if fetched.ID != created.ID || fetched.Output[0].Content[0].Text != "Hi" {
+		t.Errorf("fetched = %+v", fetched)
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleResponse(w, httptest.NewRequest(http.MethodDelete, "/v1/responses/"+created.ID, nil))
+	var deleted types.DeletedObject
+	json.Unmarshal(w.Body.Bytes(), &deleted)
+	if w.Code != http.StatusOK || !deleted.Deleted || deleted.ID != created.ID {
+		t.Errorf("delete = %d %s", w.Code, w.Body.String())
+	}
+
+	if w := get(); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestHandleResponses_NotStored(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "Hi", FinishReason: "stop"},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	_, created := postResponse(t, handler, `{"input":"Hello","store":false}`)
+
+	w := httptest.NewRecorder()
+	handler.HandleResponse(w, httptest.NewRequest(http.MethodGet, "/v1/responses/"+created.ID, nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 for unstored response, got %d", w.Code)
+	}
+
+	w, _ = postResponse(t, handler, `{"input":"Again","previous_response_id":"`+created.ID+`"}`)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"previous_response_id"`) {
+		t.Errorf("expected 400 for unknown previous response, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestHandleResponses_Streaming(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Let me ", "check."},
+		streamToolCalls: [][]types.ToolCallDelta{
+			{{Index: 0, ID: "call_1", Type: "function", Function: types.CallFunctionDelta{Name: "get_weather"}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `{"city":"Nairobi"}`}}},
+		},
+		streamFinish: "tool_calls",
+		streamUsage:  &types.Usage{PromptTokens: 5, CompletionTokens: 6, TotalTokens: 11},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	body := `{"input":"Weather?","stream":true,"tools":[{"type":"function","name":"get_weather","parameters":{"type":"object"}}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/responses", strings.NewReader(body))
+	w := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleResponses(w, req)
+
+	if w.Code() != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code(), w.Body().String())
+	}
+
+	var events []string
+	var final types.Response
+	for i, frame := range strings.Split(strings.TrimSpace(w.Body().String()), "\n\n") {
+		lines := strings.SplitN(frame, "\n", 2)
+		event := strings.TrimPrefix(lines[0], "event: ")
+		var payload struct {
+			Type     string         `json:"type"`
+			Sequence int            `json:"sequence_number"`
+			Response types.Response `json:"response"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &payload); err != nil {
+			t.Fatalf("failed to unmarshal %q: %v", lines[1], err)
+		}
+		if payload.Type != event || payload.Sequence != i {
+			t.Errorf("event %d %q has type %q and sequence %d", i, event, payload.Type, payload.Sequence)
+		}
+		events = append(events, event)
+		final = payload.Response
+	}
+
+	want := []string{
+		"response.created",
+		"response.in_progress",
+		"response.output_item.added",
+		"response.content_part.added",
+		"response.output_text.delta",
+		"response.output_text.delta",
+		"response.output_text.done",
+		"response.content_part.done",
+		"response.output_item.done",
+		"response.output_item.added",
+		"response.function_call_arguments.delta",
+		"response.function_call_arguments.done",
+		"response.output_item.done",
+		"response.completed",
+	}
+	if !reflect.DeepEqual(events, want) {
+		t.Fatalf("events = %v, want %v", events, want)
+	}
+
+	if final.Status != "completed" || len(final.Output) != 2 {
+		t.Fatalf("final response = %+v", final)
+	}
+	if final.Output[0].Content[0].Text != "Let me check." {
+		t.Errorf("message = %+v", final.Output[0])
+	}
+	call := final.Output[1]
+	if call.Type != "function_call" || call.CallID != "call_1" || call.Arguments != `{"city":"Nairobi"}` || call.Status != "completed" {
+		t.Errorf("function call = %+v", call)
+	}
+	if stored, err := handler.loadResponse(req, final.ID); err != nil || len(stored.Messages[1].ToolCalls) != 1 {
+		t.Errorf("stored response = %+v, %v", stored, err)
+	}
+}
+
+func TestResponseMessages(t *testing.T) {
+	input := `[
+		{"role": "developer", "content": "Be brief."},
+		{"type": "message", "role": "user", "content": [{"type": "input_text", "text": "Weather?"}]},
+		{"type": "function_call", "call_id": "call_1", "name": "get_weather", "arguments": "{}"},
+		{"type": "function_call_output", "call_id": "call_1", "output": "22C"}
+	]`
+	var items types.ResponseInput
+	if err := json.Unmarshal([]byte(input), &items); err != nil {
+		t.Fatalf("failed to unmarshal input: %v", err)
+	}
+
+	got, err := responseMessages(items)
+	if err != nil {
+		t.Fatalf("responseMessages() error = %v", err)
+	}
+	want := []types.ChatMessage{
+		{Role: "system", Content: types.TextContent("Be brief.")},
+		{Role: "user", Content: types.TextContent("Weather?")},
+		{Role: "assistant", ToolCalls: []types.ToolCall{{
+			ID:       "call_1",
+			Type:     "function",
+			Function: types.CallFunction{Name: "get_weather", Arguments: "{}"},
+		}}},
+		{Role: "tool", Content: types.TextContent("22C"), ToolCallID: "call_1"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+
+	image := types.ResponseInput{{Role: "user", Content: types.ResponseContent{{Type: "input_image"}}}}
+	if _, err := responseMessages(image); err == nil {
+		t.Error("expected an error for image input")
+	}
+}
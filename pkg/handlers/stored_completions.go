@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/store"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+const chatCompletionsCollection = "chat_completions"
+
+// storedCompletion is a chat completion kept with store enabled. Key names
+// the API key that created it.
+type storedCompletion struct {
+	Request  types.ChatCompletionRequest  `json:"request"`
+	Response types.ChatCompletionResponse `json:"response"`
+	StoredAt time.Time                    `json:"stored_at"`
+	Key      string                       `json:"key,omitempty"`
+}
+
+// saveCompletion persists a completion of key whose request has store
+// enabled. A failure to persist is logged rather than failing a generation
+// that already succeeded.
+func (h *Handler) saveCompletion(key string, req *types.ChatCompletionRequest, resp types.ChatCompletionResponse) {
+	if !req.Store || h.store == nil {
+		return
+	}
+	resp.Metadata = req.Metadata
+	stored := storedCompletion{Request: *req, Response: resp, StoredAt: time.Now(), Key: key}
+	if err := h.store.Put(chatCompletionsCollection, resp.ID, stored); err != nil {
+		log.Printf("failed to store chat completion %s: %v", resp.ID, err)
+		return
+	}
+	h.completions.add(stored.entry())
+}
+
+// completionEntry holds what listing filters and sorts stored completions
+// by, so a page is found without reading every record.
+type completionEntry struct {
+	ID       string
+	Created  int64
+	Model    string
+	Key      string
+	Metadata map[string]string
+}
+
+func (c *storedCompletion) entry() completionEntry {
+	return completionEntry{
+		ID:       c.Response.ID,
+		Created:  c.Response.Created,
+		Model:    c.Response.Model,
+		Key:      c.Key,
+		Metadata: c.Response.Metadata,
+	}
+}
+
+// compareEntries orders completions oldest first; IDs are random, so they
+// only break ties.
+func compareEntries(a, b completionEntry) int {
+	if c := cmp.Compare(a.Created, b.Created); c != 0 {
+		return c
+	}
+	return strings.Compare(a.ID, b.ID)
+}
+
+// completionIndex keeps the stored chat completions sorted by creation
+// time. It is read from the store on first use and then kept up to date as
+// completions are saved and deleted.
+type completionIndex struct {
+	mu      sync.Mutex
+	loaded  bool
+	entries []completionEntry
+}
+
+func (x *completionIndex) load(s *store.Store) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.loaded {
+		return nil
+	}
+
+	stored, err := store.List[storedCompletion](s, chatCompletionsCollection)
+	if err != nil {
+		return err
+	}
+	x.entries = make([]completionEntry, len(stored))
+	for i := range stored {
+		x.entries[i] = stored[i].entry()
+	}
+	slices.SortFunc(x.entries, compareEntries)
+	x.loaded = true
+	return nil
+}
+
+// add inserts or replaces e. Before the index is loaded there is nothing to
+// do: loading reads the record from the store.
+func (x *completionIndex) add(e completionEntry) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if !x.loaded {
+		return
+	}
+	i, found := slices.BinarySearchFunc(x.entries, e, compareEntries)
+	if found {
+		x.entries[i] = e
+		return
+	}
+	x.entries = slices.Insert(x.entries, i, e)
+}
+
+func (x *completionIndex) remove(id string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries = slices.DeleteFunc(x.entries, func(e completionEntry) bool { return e.ID == id })
+}
+
+// filter returns the entries, oldest first, for which keep returns true.
+func (x *completionIndex) filter(keep func(completionEntry) bool) []completionEntry {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	var entries []completionEntry
+	for _, e := range x.entries {
+		if keep(e) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// loadCompletion returns a stored completion of the request's key. Those of
+// other keys are not found.
+func (h *Handler) loadCompletion(r *http.Request, id string) (*storedCompletion, error) {
+	if h.store == nil {
+		return nil, store.ErrNotFound
+	}
+	var stored storedCompletion
+	if err := h.store.Get(chatCompletionsCollection, id, &stored); err != nil {
+		return nil, err
+	}
+	if !ownedBy(r, stored.Key) {
+		return nil, store.ErrNotFound
+	}
+	return &stored, nil
+}
+
+// listChatCompletions serves GET /v1/chat/completions for the request's key,
+// filtered by model and metadata[key]=value parameters. Filtering and
+// pagination use the index; only the records of the page are read.
+func (h *Handler) listChatCompletions(w http.ResponseWriter, r *http.Request) {
+	if h.store != nil {
+		if err := h.completions.load(h.store); err != nil {
+			log.Printf("failed to list chat completions: %v", err)
+			h.writeError(w, "failed to list chat completions", "internal_error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	query := r.URL.Query()
+	model := query.Get("model")
+	metadata := map[string]string{}
+	for key, values := range query {
+		if name, ok := strings.CutPrefix(key, "metadata["); ok && strings.HasSuffix(name, "]") {
+			metadata[strings.TrimSuffix(name, "]")] = values[0]
+		}
+	}
+
+	entries := h.completions.filter(func(e completionEntry) bool {
+		return ownedBy(r, e.Key) && (model == "" || e.Model == model) && matchesMetadata(e.Metadata, metadata)
+	})
+
+	index, err := paginate(query, entries, func(e completionEntry) string { return e.ID })
+	if err != nil {
+		h.writeInferenceError(w, err)
+		return
+	}
+
+	page := types.CursorList[types.ChatCompletionResponse]{
+		Object:  index.Object,
+		Data:    make([]types.ChatCompletionResponse, 0, len(index.Data)),
+		FirstID: index.FirstID,
+		LastID:  index.LastID,
+		HasMore: index.HasMore,
+	}
+	for _, e := range index.Data {
+		var stored storedCompletion
+		if err := h.store.Get(chatCompletionsCollection, e.ID, &stored); err != nil {
+			// Deleted since the index was read.
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			log.Printf("failed to list chat completions: %v", err)
+			h.writeError(w, "failed to list chat completions", "internal_error", http.StatusInternalServerError)
+			return
+		}
+		page.Data = append(page.Data, stored.Response)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func matchesMetadata(metadata, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
+
+// HandleChatCompletion serves a stored chat completion at
+// /v1/chat/completions/{id} and its request messages at
+// /v1/chat/completions/{id}/messages.
+func (h *Handler) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
+	r, ok := h.requireAuth(w, r, config.EndpointChat)
+	if !ok {
+		return
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/chat/completions/"), "/")
+
+	switch {
+	case sub == "messages" && r.Method == http.MethodGet:
+		stored, err := h.loadCompletion(r, id)
+		if err != nil {
+			h.writeCompletionNotFound(w, id, err)
+			return
+		}
+		messages := make([]types.ChatCompletionMessage, len(stored.Request.Messages))
+		for i, msg := range stored.Request.Messages {
+			messages[i] = types.ChatCompletionMessage{ID: fmt.Sprintf("%s-%d", id, i), ChatMessage: msg}
+		}
+		page, err := paginate(r.URL.Query(), messages, func(m types.ChatCompletionMessage) string { return m.ID })
+		if err != nil {
+			h.writeInferenceError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(page)
+
+	case sub != "":
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodGet:
+		stored, err := h.loadCompletion(r, id)
+		if err != nil {
+			h.writeCompletionNotFound(w, id, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stored.Response)
+
+	case r.Method == http.MethodDelete:
+		_, err := h.loadCompletion(r, id)
+		if err == nil {
+			err = h.store.Delete(chatCompletionsCollection, id)
+		}
+		if err != nil {
+			h.writeCompletionNotFound(w, id, err)
+			return
+		}
+		h.completions.remove(id)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(types.DeletedObject{ID: id, Object: "chat.completion.deleted", Deleted: true})
+
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *Handler) writeCompletionNotFound(w http.ResponseWriter, id string, err error) {
+	if !errors.Is(err, store.ErrNotFound) {
+		log.Printf("failed to load chat completion %s: %v", id, err)
+		h.writeError(w, "failed to load chat completion", "internal_error", http.StatusInternalServerError)
+		return
+	}
+	h.writeErrorDetail(w, types.ErrorDetail{
+		Message: fmt.Sprintf("Chat completion with id '%s' not found.", id),
+		Type:    "invalid_request_error",
+	}, http.StatusNotFound)
+}
+
+// streamedChoices assembles streamed chunks into the choices of a complete
+// response so that streamed completions can be stored.
+type streamedChoices struct {
+	content map[int]*strings.Builder
+	choices map[int]*types.Choice
+}
+
+func (s *streamedChoices) add(index int, chunk picolm.StreamChunk) {
+	if s.choices == nil {
+		s.content = map[int]*strings.Builder{}
+		s.choices = map[int]*types.Choice{}
+	}
+	choice, ok := s.choices[index]
+	if !ok {
+		choice = &types.Choice{Index: index, Message: types.ChatMessage{Role: "assistant"}}
+		s.choices[index] = choice
+		s.content[index] = &strings.Builder{}
+	}
+
+	s.content[index].WriteString(chunk.Content)
+	for _, delta := range chunk.ToolCalls {
+		calls := choice.Message.ToolCalls
+		for len(calls) <= delta.Index {
+			calls = append(calls, types.ToolCall{Type: "function"})
+		}
+		call := &calls[delta.Index]
+		if delta.ID != "" {
+			call.ID = delta.ID
+		}
+		if delta.Type != "" {
+			call.Type = delta.Type
+		}
+		call.Function.Name += delta.Function.Name
+		call.Function.Arguments += delta.Function.Arguments
+		choice.Message.ToolCalls = calls
+	}
+	if chunk.FinishReason != "" {
+		choice.FinishReason = chunk.FinishReason
+	}
+}
+
+func (s *streamedChoices) result(n int) []types.Choice {
+	choices := make([]types.Choice, n)
+	for i := range choices {
+		if choice, ok := s.choices[i]; ok {
+			choices[i] = *choice
+			choices[i].Message.Content = types.TextContent(s.content[i].String())
+		} else {
+			choices[i] = types.Choice{Index: i, Message: types.ChatMessage{Role: "assistant"}}
+		}
+	}
+	return choices
+}
@@ -0,0 +1,201 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/picolm"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func postChatCompletion(t *testing.T, handler *Handler, body string) types.ChatCompletionResponse {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	handler.HandleChatCompletions(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp types.ChatCompletionResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("failed to unmarshal response: %v", err)
+	}
+	return resp
+}
+
+func getCompletionPath(handler *Handler, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if path == "/v1/chat/completions" || strings.HasPrefix(path, "/v1/chat/completions?") {
+		handler.HandleChatCompletions(w, req)
+	} else {
+		handler.HandleChatCompletion(w, req)
+	}
+	return w
+}
+
+func TestStoredCompletion_GetMessagesDelete(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{
+			Content:      "Nairobi.",
+			FinishReason: "stop",
+			Usage:        types.Usage{PromptTokens: 8, CompletionTokens: 2, TotalTokens: 10},
+		},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	created := postChatCompletion(t, handler, `{
+		"store": true,
+		"metadata": {"team": "support"},
+		"messages": [
+			{"role": "system", "content": "Be brief."},
+			{"role": "user", "content": "Capital of Kenya?"}
+		]
+	}`)
+
+	w := getCompletionPath(handler, "/v1/chat/completions/"+created.ID)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var fetched types.ChatCompletionResponse
+	json.Unmarshal(w.Body.Bytes(), &fetched)
+	if fetched.ID != created.ID || fetched.Choices[0].Message.Content.Text != "Nairobi." || fetched.Usage.TotalTokens != 10 {
+		t.Errorf("fetched = %+v", fetched)
+	}
+	if fetched.Metadata["team"] != "support" {
+		t.Errorf("metadata = %v", fetched.Metadata)
+	}
+
+	w = getCompletionPath(handler, "/v1/chat/completions/"+created.ID+"/messages?limit=1")
+	var messages types.CursorList[types.ChatCompletionMessage]
+	json.Unmarshal(w.Body.Bytes(), &messages)
+	if w.Code != http.StatusOK || len(messages.Data) != 1 || !messages.HasMore {
+		t.Fatalf("messages = %d %s", w.Code, w.Body.String())
+	}
+	if messages.Data[0].Role != "system" || messages.Data[0].ID != created.ID+"-0" {
+		t.Errorf("first message = %+v", messages.Data[0])
+	}
+
+	w = getCompletionPath(handler, "/v1/chat/completions/"+created.ID+"/messages?after="+messages.LastID)
+	json.Unmarshal(w.Body.Bytes(), &messages)
+	if len(messages.Data) != 1 || messages.Data[0].Content.Text != "Capital of Kenya?" || messages.HasMore {
+		t.Errorf("second page = %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	handler.HandleChatCompletion(w, httptest.NewRequest(http.MethodDelete, "/v1/chat/completions/"+created.ID, nil))
+	var deleted types.DeletedObject
+	json.Unmarshal(w.Body.Bytes(), &deleted)
+	if w.Code != http.StatusOK || !deleted.Deleted || deleted.Object != "chat.completion.deleted" {
+		t.Errorf("delete = %d %s", w.Code, w.Body.String())
+	}
+
+	if w := getCompletionPath(handler, "/v1/chat/completions/"+created.ID); w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 after delete, got %d", w.Code)
+	}
+}
+
+func TestStoredCompletion_List(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		response: &picolm.ChatResult{Content: "ok", FinishReason: "stop"},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	// Completions without store are not kept.
+	postChatCompletion(t, handler, `{"messages":[{"role":"user","content":"a"}]}`)
+	first := postChatCompletion(t, handler, `{"store":true,"metadata":{"team":"support"},"messages":[{"role":"user","content":"b"}]}`)
+	postChatCompletion(t, handler, `{"store":true,"metadata":{"team":"sales"},"messages":[{"role":"user","content":"c"}]}`)
+
+	w := getCompletionPath(handler, "/v1/chat/completions")
+	var list types.CursorList[types.ChatCompletionResponse]
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if w.Code != http.StatusOK || list.Object != "list" || len(list.Data) != 2 {
+		t.Fatalf("list = %d %s", w.Code, w.Body.String())
+	}
+
+	w = getCompletionPath(handler, "/v1/chat/completions?metadata%5Bteam%5D=support")
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 || list.Data[0].ID != first.ID || list.FirstID != first.ID {
+		t.Errorf("filtered list = %s", w.Body.String())
+	}
+
+	w = getCompletionPath(handler, "/v1/chat/completions?limit=1")
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if len(list.Data) != 1 || !list.HasMore {
+		t.Errorf("paged list = %s", w.Body.String())
+	}
+
+	w = getCompletionPath(handler, "/v1/chat/completions?after=chatcmpl-unknown")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `"after"`) {
+		t.Errorf("expected 400 for unknown cursor, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// Completions saved and deleted after the first listing are reflected,
+	// and a handler reading the same store sees the same list.
+	last := postChatCompletion(t, handler, `{"store":true,"messages":[{"role":"user","content":"d"}]}`)
+	w = httptest.NewRecorder()
+	handler.HandleChatCompletion(w, httptest.NewRequest(http.MethodDelete, "/v1/chat/completions/"+first.ID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete = %d %s", w.Code, w.Body.String())
+	}
+	for _, h := range []*Handler{handler, NewHandler(mockClient, "", WithStore(handler.store))} {
+		w = getCompletionPath(h, "/v1/chat/completions")
+		list = types.CursorList[types.ChatCompletionResponse]{}
+		json.Unmarshal(w.Body.Bytes(), &list)
+		ids := []string{}
+		for _, c := range list.Data {
+			ids = append(ids, c.ID)
+		}
+		if len(ids) != 2 || slices.Contains(ids, first.ID) || !slices.Contains(ids, last.ID) {
+			t.Errorf("list after changes = %s", w.Body.String())
+		}
+	}
+}
+
+func TestStoredCompletion_Streaming(t *testing.T) {
+	mockClient := &mockPicoLMClient{
+		streamTokens: []string{"Let me ", "check."},
+		streamToolCalls: [][]types.ToolCallDelta{
+			{{Index: 0, ID: "call_1", Type: "function", Function: types.CallFunctionDelta{Name: "get_weather"}}},
+			{{Index: 0, Function: types.CallFunctionDelta{Arguments: `{"city":"Nairobi"}`}}},
+		},
+		streamFinish: "tool_calls",
+		streamUsage:  &types.Usage{PromptTokens: 5, CompletionTokens: 6, TotalTokens: 11},
+	}
+	handler := newStoreHandler(t, mockClient)
+
+	body := `{"stream":true,"store":true,"messages":[{"role":"user","content":"Weather?"}]}`
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+	w := &flusherRecorder{rec: httptest.NewRecorder()}
+	handler.HandleChatCompletions(w, req)
+	if w.Code() != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", w.Code(), w.Body().String())
+	}
+
+	list := getCompletionPath(handler, "/v1/chat/completions")
+	var completions types.CursorList[types.ChatCompletionResponse]
+	json.Unmarshal(list.Body.Bytes(), &completions)
+	if len(completions.Data) != 1 {
+		t.Fatalf("list = %s", list.Body.String())
+	}
+
+	stored := completions.Data[0]
+	if !strings.Contains(w.Body().String(), stored.ID) {
+		t.Errorf("stored ID %s does not match the streamed ID", stored.ID)
+	}
+	choice := stored.Choices[0]
+	if choice.Message.Content.Text != "Let me check." || choice.FinishReason != "tool_calls" {
+		t.Errorf("choice = %+v", choice)
+	}
+	if calls := choice.Message.ToolCalls; len(calls) != 1 || calls[0].ID != "call_1" || calls[0].Function.Arguments != `{"city":"Nairobi"}` {
+		t.Errorf("tool calls = %+v", calls)
+	}
+	if stored.Usage.TotalTokens != 11 {
+		t.Errorf("usage = %+v", stored.Usage)
+	}
+}
@@ -0,0 +1,414 @@
+// Package jsonschema validates decoded JSON values against the subset of JSON
+// Schema used to describe tool parameters and structured outputs.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// ValidationError lists every violation found in a value.
+type ValidationError struct {
+	Errors []FieldError
+}
+
+type FieldError struct {
+	// Path is a JSON pointer to the offending value, "" for the root.
+	Path    string
+	Message string
+}
+
+func (e FieldError) String() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, fe := range e.Errors {
+		msgs[i] = fe.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Validate checks value, as decoded by encoding/json, against schema. A nil
+// or empty schema accepts any value.
+func Validate(schema map[string]any, value any) error {
+	v := &validator{root: schema}
+	v.validate(schema, value, "")
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+// ValidateJSON decodes data and validates it against schema.
+func ValidateJSON(schema map[string]any, data []byte) error {
+	var value any
+	if err := json.Unmarshal(data, &value); err != nil {
+		return &ValidationError{Errors: []FieldError{{Message: "invalid JSON: " + err.Error()}}}
+	}
+	return Validate(schema, value)
+}
+
+type validator struct {
+	root   map[string]any
+	depth  int
+	errors []FieldError
+}
+
+func (v *validator) fail(path, format string, args ...any) {
+	v.errors = append(v.errors, FieldError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// check validates value against schema without recording errors, for the
+// combinators.
+func (v *validator) check(schema any, value any) bool {
+	sub := &validator{root: v.root, depth: v.depth}
+	sub.validateAny(schema, value, "")
+	return len(sub.errors) == 0
+}
+
+// resolve follows a local reference such as "#/$defs/address".
+func (v *validator) resolve(ref string) (map[string]any, bool) {
+	if ref == "#" {
+		return v.root, true
+	}
+	if !strings.HasPrefix(ref, "#/") {
+		return nil, false
+	}
+	var node any = v.root
+	for _, part := range strings.Split(ref[2:], "/") {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		m, ok := node.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		node = m[part]
+	}
+	schema, ok := node.(map[string]any)
+	return schema, ok
+}
+
+func (v *validator) validateAny(schema any, value any, path string) {
+	switch s := schema.(type) {
+	case bool:
+		if !s {
+			v.fail(path, "no value is allowed here")
+		}
+	case map[string]any:
+		v.validate(s, value, path)
+	}
+}
+
+func (v *validator) validate(schema map[string]any, value any, path string) {
+	if len(schema) == 0 {
+		return
+	}
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, found := v.resolve(ref)
+		if !found {
+			v.fail(path, "unresolvable schema reference %q", ref)
+			return
+		}
+		// Guard against reference cycles that never consume input.
+		if v.depth > 64 {
+			return
+		}
+		v.depth++
+		v.validate(target, value, path)
+		v.depth--
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		v.fail(path, "expected %s, got %s", describeType(t), typeName(value))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if equal(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "must be one of %s", compact(enum))
+		}
+	}
+	if c, ok := schema["const"]; ok && !equal(c, value) {
+		v.fail(path, "must be %s", compact(c))
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			v.validateAny(sub, value, path)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if v.check(sub, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(path, "does not match any of the allowed schemas")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		n := 0
+		for _, sub := range oneOf {
+			if v.check(sub, value) {
+				n++
+			}
+		}
+		if n != 1 {
+			v.fail(path, "must match exactly one of the allowed schemas, matched %d", n)
+		}
+	}
+	if not, ok := schema["not"]; ok && v.check(not, value) {
+		v.fail(path, "must not match the excluded schema")
+	}
+
+	switch val := value.(type) {
+	case map[string]any:
+		v.validateObject(schema, val, path)
+	case []any:
+		v.validateArray(schema, val, path)
+	case string:
+		v.validateString(schema, val, path)
+	case float64:
+		v.validateNumber(schema, val, path)
+	}
+}
+
+func (v *validator) validateObject(schema map[string]any, obj map[string]any, path string) {
+	props, _ := schema["properties"].(map[string]any)
+
+	for _, name := range stringList(schema["required"]) {
+		if _, ok := obj[name]; !ok {
+			v.fail(path, "missing required property %q", name)
+		}
+	}
+
+	for _, name := range sortedKeys(obj) {
+		child := path + "/" + escapePointer(name)
+		if sub, ok := props[name]; ok {
+			v.validateAny(sub, obj[name], child)
+			continue
+		}
+		if ap, ok := schema["additionalProperties"]; ok {
+			if allowed, isBool := ap.(bool); isBool && !allowed {
+				v.fail(path, "unexpected property %q", name)
+				continue
+			}
+			v.validateAny(ap, obj[name], child)
+		}
+	}
+
+	if n, ok := number(schema["minProperties"]); ok && float64(len(obj)) < n {
+		v.fail(path, "must have at least %v properties", n)
+	}
+	if n, ok := number(schema["maxProperties"]); ok && float64(len(obj)) > n {
+		v.fail(path, "must have at most %v properties", n)
+	}
+}
+
+func (v *validator) validateArray(schema map[string]any, arr []any, path string) {
+	start := 0
+	if prefix, ok := schema["prefixItems"].([]any); ok {
+		for i := 0; i < len(prefix) && i < len(arr); i++ {
+			v.validateAny(prefix[i], arr[i], fmt.Sprintf("%s/%d", path, i))
+		}
+		start = len(prefix)
+	}
+	if items, ok := schema["items"]; ok {
+		for i := start; i < len(arr); i++ {
+			v.validateAny(items, arr[i], fmt.Sprintf("%s/%d", path, i))
+		}
+	}
+
+	if n, ok := number(schema["minItems"]); ok && float64(len(arr)) < n {
+		v.fail(path, "must have at least %v items", n)
+	}
+	if n, ok := number(schema["maxItems"]); ok && float64(len(arr)) > n {
+		v.fail(path, "must have at most %v items", n)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := 0; i < len(arr); i++ {
+			for j := i + 1; j < len(arr); j++ {
+				if equal(arr[i], arr[j]) {
+					v.fail(path, "items %d and %d are equal", i, j)
+					return
+				}
+			}
+		}
+	}
+}
+
+func (v *validator) validateString(schema map[string]any, s, path string) {
+	length := float64(utf8.RuneCountInString(s))
+	if n, ok := number(schema["minLength"]); ok && length < n {
+		v.fail(path, "must be at least %v characters", n)
+	}
+	if n, ok := number(schema["maxLength"]); ok && length > n {
+		v.fail(path, "must be at most %v characters", n)
+	}
+	if pattern, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(pattern)
+		if err == nil && !re.MatchString(s) {
+			v.fail(path, "must match pattern %q", pattern)
+		}
+	}
+}
+
+func (v *validator) validateNumber(schema map[string]any, n float64, path string) {
+	if m, ok := number(schema["minimum"]); ok && n < m {
+		v.fail(path, "must be >= %v", m)
+	}
+	if m, ok := number(schema["maximum"]); ok && n > m {
+		v.fail(path, "must be <= %v", m)
+	}
+	if m, ok := number(schema["exclusiveMinimum"]); ok && n <= m {
+		v.fail(path, "must be > %v", m)
+	}
+	if m, ok := number(schema["exclusiveMaximum"]); ok && n >= m {
+		v.fail(path, "must be < %v", m)
+	}
+	if m, ok := number(schema["multipleOf"]); ok && m > 0 {
+		if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+			v.fail(path, "must be a multiple of %v", m)
+		}
+	}
+}
+
+func matchesType(t any, value any) bool {
+	switch t := t.(type) {
+	case string:
+		return isType(t, value)
+	case []any:
+		for _, name := range t {
+			if s, ok := name.(string); ok && isType(s, value) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func isType(name string, value any) bool {
+	switch name {
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "null":
+		return value == nil
+	}
+	return true
+}
+
+func typeName(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+func describeType(t any) string {
+	if list, ok := t.([]any); ok {
+		names := make([]string, 0, len(list))
+		for _, n := range list {
+			names = append(names, fmt.Sprint(n))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+func stringList(v any) []string {
+	switch v := v.(type) {
+	case []string:
+		return v
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, s := range v {
+			if s, ok := s.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	}
+	return nil
+}
+
+func number(v any) (float64, bool) {
+	n, ok := v.(float64)
+	return n, ok
+}
+
+func equal(a, b any) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func compact(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(data)
+}
+
+func escapePointer(s string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(s)
+}
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,93 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func mustSchema(t *testing.T, s string) map[string]any {
+	t.Helper()
+	var schema map[string]any
+	if err := json.Unmarshal([]byte(s), &schema); err != nil {
+		t.Fatalf("invalid schema: %v", err)
+	}
+	return schema
+}
+
+func TestValidateJSON(t *testing.T) {
+	schema := mustSchema(t, `{
+		"type": "object",
+		"properties": {
+			"city": {"type": "string", "minLength": 2},
+			"unit": {"enum": ["celsius", "fahrenheit"]},
+			"days": {"type": "integer", "minimum": 1, "maximum": 14},
+			"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 2},
+			"home": {"$ref": "#/$defs/place"}
+		},
+		"required": ["city"],
+		"additionalProperties": false,
+		"$defs": {
+			"place": {"type": "object", "required": ["lat", "lon"]}
+		}
+	}`)
+
+	tests := []struct {
+		name    string
+		value   string
+		wantErr string
+	}{
+		{name: "valid", value: `{"city": "Nairobi", "unit": "celsius", "days": 3, "tags": ["a"]}`},
+		{name: "missing required", value: `{"unit": "celsius"}`, wantErr: `missing required property "city"`},
+		{name: "wrong type", value: `{"city": 42}`, wantErr: "/city: expected string, got integer"},
+		{name: "not an integer", value: `{"city": "Nairobi", "days": 1.5}`, wantErr: "/days: expected integer, got number"},
+		{name: "enum", value: `{"city": "Nairobi", "unit": "kelvin"}`, wantErr: `/unit: must be one of ["celsius","fahrenheit"]`},
+		{name: "maximum", value: `{"city": "Nairobi", "days": 30}`, wantErr: "/days: must be <= 14"},
+		{name: "items", value: `{"city": "Nairobi", "tags": ["a", 1]}`, wantErr: "/tags/1: expected string"},
+		{name: "max items", value: `{"city": "Nairobi", "tags": ["a", "b", "c"]}`, wantErr: "/tags: must have at most 2 items"},
+		{name: "additional property", value: `{"city": "Nairobi", "country": "KE"}`, wantErr: `unexpected property "country"`},
+		{name: "reference", value: `{"city": "Nairobi", "home": {"lat": 1}}`, wantErr: `/home: missing required property "lon"`},
+		{name: "not JSON", value: `{"city": `, wantErr: "invalid JSON"},
+		{name: "not an object", value: `["Nairobi"]`, wantErr: "expected object, got array"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateJSON(schema, []byte(tt.value))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("ValidateJSON() error = %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ValidateJSON() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidate_Combinators(t *testing.T) {
+	schema := mustSchema(t, `{
+		"anyOf": [{"type": "string"}, {"type": "null"}],
+		"not": {"const": "forbidden"}
+	}`)
+
+	for value, valid := range map[string]bool{
+		`"ok"`:        true,
+		`null`:        true,
+		`1`:           false,
+		`"forbidden"`: false,
+	} {
+		err := ValidateJSON(schema, []byte(value))
+		if (err == nil) != valid {
+			t.Errorf("ValidateJSON(%s) error = %v, want valid = %v", value, err, valid)
+		}
+	}
+}
+
+func TestValidate_EmptySchema(t *testing.T) {
+	if err := Validate(nil, map[string]any{"anything": true}); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+package metrics
+
+var (
+	HTTPRequests = Default.NewCounterVec("picolm_http_requests_total",
+		"HTTP requests by route, status and model.", "path", "status", "model")
+	HTTPDuration = Default.NewHistogramVec("picolm_http_request_duration_seconds",
+		"HTTP request latency by route, status and model.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}, "path", "status", "model")
+	HTTPInFlight = Default.NewGaugeVec("picolm_http_requests_in_flight",
+		"HTTP requests currently being served, by route.", "path")
+
+	KeyRequests = Default.NewCounterVec("picolm_api_key_requests_total",
+		"HTTP requests by API key, route and status.", "key", "path", "status")
+	KeyTokens = Default.NewCounterVec("picolm_api_key_tokens_total",
+		"Tokens used by API key, by type: prompt or completion.", "key", "type")
+
+	TimeToFirstToken = Default.NewHistogramVec("picolm_time_to_first_token_seconds",
+		"Time from receiving a completion request to its first output, including queueing.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2, 5, 10, 30, 60}, "model")
+	TokensGenerated = Default.NewCounterVec("picolm_tokens_generated_total",
+		"Completion tokens generated.", "model")
+	PromptTokens = Default.NewCounterVec("picolm_prompt_tokens_total",
+		"Prompt tokens processed.", "model")
+	TokensPerSecond = Default.NewHistogramVec("picolm_tokens_per_second",
+		"Generation speed of completed picolm runs.",
+		[]float64{1, 2, 5, 10, 20, 50, 100, 200}, "model")
+	InferenceFailures = Default.NewCounterVec("picolm_inference_failures_total",
+		"Failed picolm runs by reason: spawn, timeout, cancelled, exit or queue_full.", "model", "reason")
+)
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+type requestKey struct{}
+
+type requestLabels struct {
+	model string
+	key   string
+
+	promptTokens     atomic.Int64
+	completionTokens atomic.Int64
+}
+
+// SetModel records the model a request was served with, for the model label
+// of the HTTP metrics. It is a no-op outside an instrumented handler.
+func SetModel(ctx context.Context, model string) {
+	if l, ok := ctx.Value(requestKey{}).(*requestLabels); ok {
+		l.model = model
+	}
+}
+
+// SetKey records the name of the API key a request was authenticated with,
+// attributing the request and its tokens to the key.
+func SetKey(ctx context.Context, key string) {
+	if l, ok := ctx.Value(requestKey{}).(*requestLabels); ok {
+		l.key = key
+	}
+}
+
+// AddUsage adds the tokens of a generation to the request's API key. Choices
+// generated concurrently may add to the same request.
+func AddUsage(ctx context.Context, promptTokens, completionTokens int) {
+	if l, ok := ctx.Value(requestKey{}).(*requestLabels); ok {
+		l.promptTokens.Add(int64(promptTokens))
+		l.completionTokens.Add(int64(completionTokens))
+	}
+}
+
+// Instrument records request count, latency and in-flight requests for a
+// route. route is used as the path label so that paths with IDs do not
+// create a series each.
+func Instrument(route string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		HTTPInFlight.Inc(route)
+		defer HTTPInFlight.Dec(route)
+
+		labels := &requestLabels{}
+		r = r.WithContext(context.WithValue(r.Context(), requestKey{}, labels))
+
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		if f, ok := w.(http.Flusher); ok {
+			sw.flusher = f
+		}
+
+		next.ServeHTTP(sw, r)
+
+		status := strconv.Itoa(sw.status)
+		HTTPRequests.Inc(route, status, labels.model)
+		HTTPDuration.Observe(time.Since(start).Seconds(), route, status, labels.model)
+		if labels.key != "" {
+			KeyRequests.Inc(labels.key, route, status)
+			KeyTokens.Add(float64(labels.promptTokens.Load()), labels.key, "prompt")
+			KeyTokens.Add(float64(labels.completionTokens.Load()), labels.key, "completion")
+		}
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	flusher     http.Flusher
+	status      int
+	wroteHeader bool
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if !sw.wroteHeader {
+		sw.status = code
+		sw.wroteHeader = true
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	sw.wroteHeader = true
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Flush() {
+	if sw.flusher != nil {
+		sw.flusher.Flush()
+	}
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInstrument(t *testing.T) {
+	handler := Instrument("/test/{id}", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetModel(r.Context(), "tinyllama")
+		if _, ok := w.(http.Flusher); !ok {
+			t.Error("instrumented writer should implement http.Flusher")
+		}
+		w.WriteHeader(http.StatusTeapot)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/42", nil))
+
+	var sb strings.Builder
+	Default.Write(&sb)
+	out := sb.String()
+
+	for _, want := range []string{
+		`picolm_http_requests_total{path="/test/{id}",status="418",model="tinyllama"} 1`,
+		`picolm_http_request_duration_seconds_count{path="/test/{id}",status="418",model="tinyllama"} 1`,
+		`picolm_http_requests_in_flight{path="/test/{id}"} 0`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+}
+
+func TestInstrument_Key(t *testing.T) {
+	handler := Instrument("/test/key", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		SetKey(r.Context(), "team-a")
+		AddUsage(r.Context(), 10, 4)
+		AddUsage(r.Context(), 10, 6)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/test/key", nil))
+
+	var sb strings.Builder
+	Default.Write(&sb)
+	out := sb.String()
+
+	for _, want := range []string{
+		`picolm_api_key_requests_total{key="team-a",path="/test/key",status="200"} 1`,
+		`picolm_api_key_tokens_total{key="team-a",type="prompt"} 20`,
+		`picolm_api_key_tokens_total{key="team-a",type="completion"} 10`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q", want)
+		}
+	}
+}
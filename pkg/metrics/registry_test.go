@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_Write(t *testing.T) {
+	r := NewRegistry()
+
+	requests := r.NewCounterVec("test_requests_total", "Requests.", "path")
+	requests.Inc("/a")
+	requests.Add(2, `/b"c`)
+
+	inFlight := r.NewGaugeVec("test_in_flight", "In flight.")
+	inFlight.Inc()
+	inFlight.Inc()
+	inFlight.Dec()
+
+	r.NewGaugeFunc("test_queue", "Queue.", func() float64 { return 3 })
+
+	latency := r.NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "model")
+	latency.Observe(0.05, "m")
+	latency.Observe(0.5, "m")
+	latency.Observe(5, "m")
+
+	var sb strings.Builder
+	if err := r.Write(&sb); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	out := sb.String()
+
+	for _, want := range []string{
+		"# HELP test_requests_total Requests.\n# TYPE test_requests_total counter\n",
+		`test_requests_total{path="/a"} 1` + "\n",
+		`test_requests_total{path="/b\"c"} 2` + "\n",
+		"# TYPE test_in_flight gauge\ntest_in_flight 1\n",
+		"test_queue 3\n",
+		`test_latency_seconds_bucket{model="m",le="0.1"} 1` + "\n",
+		`test_latency_seconds_bucket{model="m",le="1"} 2` + "\n",
+		`test_latency_seconds_bucket{model="m",le="+Inf"} 3` + "\n",
+		`test_latency_seconds_sum{model="m"} 5.55` + "\n",
+		`test_latency_seconds_count{model="m"} 3` + "\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("output missing %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRegistry_Handler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if w.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.Contains(w.Body.String(), "test_total 1\n") {
+		t.Errorf("body = %q", w.Body.String())
+	}
+}
@@ -1,37 +1,56 @@
 package picolm
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"os"
 	"os/exec"
+	"slices"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/gguf"
+	"github.com/wmik/picolm-server/pkg/metrics"
 	"github.com/wmik/picolm-server/pkg/types"
 )
 
 type Client struct {
 	config config.PicoLMConfig
-	mux    sync.Mutex
+	pool   *Pool
+	models modelCache
 }
 
 func NewClient(cfg config.PicoLMConfig) *Client {
-	return &Client{config: cfg}
+	limits := make(map[string]int)
+	for name, opts := range cfg.ModelOptions {
+		if opts.Slots > 0 {
+			limits[name] = opts.Slots
+		}
+	}
+	return &Client{
+		config: cfg,
+		pool:   NewPool(cfg.Workers, cfg.GetQueueSize(), limits),
+	}
 }
 
 type Provider interface {
 	Chat(ctx context.Context, req *types.ChatCompletionRequest) (*ChatResult, error)
 	StreamChat(ctx context.Context, req *types.ChatCompletionRequest, handler StreamHandler) error
+	Complete(ctx context.Context, req *types.CompletionRequest, prompt string) (*CompletionResult, error)
+	StreamComplete(ctx context.Context, req *types.CompletionRequest, prompt string, handler StreamHandler) error
 	GetDefaultModel() string
 	GetModelIDs() []string
 	GetModelInfo(modelName string) (string, int64, error)
+	GetModelMetadata(modelName string) (*types.ModelMetadata, error)
+	// CheckChoices rejects a number of choices the provider would refuse,
+	// so that handlers can do so before allocating anything for them.
+	CheckChoices(n int) error
+	// Available reports how many requests for a model could start now
+	// without queueing.
+	Available(modelName string) int
 	Validate() error
 }
 
@@ -41,350 +60,620 @@ type ChatResult struct {
 	Content      string
 	ToolCalls    []types.ToolCall
 	FinishReason string
+	// StopSequence is the stop sequence of the request the reply ended at,
+	// if any.
+	StopSequence string
 	Usage        types.Usage
 }
 
-func (c *Client) Chat(ctx context.Context, req *types.ChatCompletionRequest) (*ChatResult, error) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+// generation is a fully resolved picolm invocation.
+type generation struct {
+	model     string
+	template  *ChatTemplate
+	prompt    string
+	args      []string
+	maxTokens int
+	stops     []string
+	// requestStops are the stop sequences of the request, without those of
+	// the template.
+	requestStops []string
+	truncation   *Truncation
+	start        time.Time
+}
 
-	if c.config.Binary == "" {
-		return nil, fmt.Errorf("picolm binary not configured")
+func (c *Client) prepare(req *types.ChatCompletionRequest) (*generation, error) {
+	modelName, modelPath, err := c.resolveModel(req.Model)
+	if err != nil {
+		return nil, err
 	}
 
-	modelName := req.Model
-	if modelName == "" {
-		modelName, _ = c.config.GetDefaultModel()
+	if err := checkResponseFormat(req.ResponseFormat); err != nil {
+		return nil, err
+	}
+	if _, err := resolveToolChoice(req); err != nil {
+		return nil, err
+	}
+	if err := c.CheckChoices(req.N); err != nil {
+		return nil, err
 	}
 
-	modelPath, err := c.config.GetModelPath(modelName)
+	tmpl, err := c.chatTemplate(modelName)
 	if err != nil {
-		return nil, fmt.Errorf("model not configured: %s", modelName)
+		return nil, err
 	}
 
-	prompt := c.buildPrompt(req.Messages, req.Tools)
-
 	maxTokens := req.MaxTokens
 	if maxTokens == 0 {
 		maxTokens = c.config.MaxTokens
 	}
 
-	temperature := c.config.Temperature
-	if req.Temperature > 0 {
-		temperature = req.Temperature
+	prompt, truncation, err := c.fitContext(modelName, tmpl, req, maxTokens)
+	if err != nil {
+		return nil, err
 	}
 
-	topP := c.config.TopP
-	if req.TopP > 0 {
-		topP = req.TopP
+	args := c.buildArgs(modelName, modelPath, maxTokens, req.Temperature, req.TopP)
+	if len(offeredTools(req)) > 0 || structuredFormat(req) != nil {
+		args = append(args, "--json")
 	}
 
-	contextLength := c.config.ContextLength
+	return &generation{
+		model:        modelName,
+		template:     tmpl,
+		prompt:       prompt,
+		args:         args,
+		maxTokens:    maxTokens,
+		stops:        append(append([]string{}, tmpl.StopTokens...), req.Stop...),
+		requestStops: req.Stop,
+		truncation:   truncation,
+		start:        time.Now(),
+	}, nil
+}
 
-	args := []string{
-		modelPath,
-		"-n", fmt.Sprintf("%d", maxTokens),
-		"-j", fmt.Sprintf("%d", c.config.Threads),
-		"-t", fmt.Sprintf("%.1f", temperature),
-		"-k", fmt.Sprintf("%.1f", topP),
-		"-c", fmt.Sprintf("%d", contextLength),
+// resolveModel returns the name and path of the requested model, or of the
+// default model when none is requested.
+func (c *Client) resolveModel(requested string) (string, string, error) {
+	if c.config.Binary == "" {
+		return "", "", fmt.Errorf("picolm binary not configured")
 	}
 
-	if len(req.Tools) > 0 {
-		args = append(args, "--json")
+	modelName := requested
+	if modelName == "" {
+		modelName, _ = c.config.GetDefaultModel()
 	}
 
-	timeout := c.calculateTimeout(maxTokens)
-	inferenceCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
+	modelPath, err := c.config.GetModelPath(modelName)
+	if err != nil {
+		return "", "", fmt.Errorf("model not configured: %s", modelName)
+	}
+	return modelName, modelPath, nil
+}
 
-	cmd := exec.CommandContext(inferenceCtx, c.config.Binary, args...)
-	cmd.Stdin = bytes.NewReader([]byte(prompt))
+// CheckChoices rejects an n larger than max_choices. Zero means one choice.
+func (c *Client) CheckChoices(n int) error {
+	if n < 0 || n > max(c.config.MaxChoices, 1) {
+		return &InvalidRequestError{
+			Param:   "n",
+			Message: fmt.Sprintf("n must be between 1 and %d, got %d", max(c.config.MaxChoices, 1), n),
+		}
+	}
+	return nil
+}
 
-	var stdout, stderr bytes.Buffer
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
+// buildArgs returns the picolm command line for a model. Request sampling
+// parameters override the configured defaults when set.
+func (c *Client) buildArgs(modelName, modelPath string, maxTokens int, temperature, topP float64) []string {
+	if temperature <= 0 {
+		temperature = c.config.Temperature
+	}
+	if topP <= 0 {
+		topP = c.config.TopP
+	}
 
-	startTime := time.Now()
-	err = cmd.Run()
-	elapsed := time.Since(startTime)
+	return []string{
+		modelPath,
+		"-n", fmt.Sprintf("%d", maxTokens),
+		"-j", fmt.Sprintf("%d", c.config.Threads),
+		"-t", fmt.Sprintf("%.1f", temperature),
+		"-k", fmt.Sprintf("%.1f", topP),
+		"-c", fmt.Sprintf("%d", c.contextLength(modelName)),
+	}
+}
 
-	if inferenceCtx.Err() == context.DeadlineExceeded {
-		return nil, fmt.Errorf("picolm inference timed out after %v (max_tokens: %d)", timeout, maxTokens)
+func (c *Client) Chat(ctx context.Context, req *types.ChatCompletionRequest) (*ChatResult, error) {
+	g, err := c.prepare(req)
+	if err != nil {
+		return nil, err
 	}
+	observerFrom(ctx).truncated(g.truncation)
 
-	if inferenceCtx.Err() == context.Canceled {
-		return nil, fmt.Errorf("request cancelled (client disconnected or timeout)")
+	release, err := c.acquire(ctx, g.model)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
 
+	var out strings.Builder
+	res, err := c.run(ctx, g, func(text string) error {
+		out.WriteString(text)
+		return nil
+	})
 	if err != nil {
-		if stderr.Len() > 0 {
-			return nil, fmt.Errorf("picolm error: %s", stderr.String())
-		}
-		return nil, fmt.Errorf("picolm error: %w", err)
+		return nil, err
 	}
 
-	output := strings.TrimSpace(stdout.String())
-	if output == "" {
+	usage := c.usage(g, out.String())
+	c.observeGeneration(ctx, g, res, usage)
+	finishReason := c.finishReason(g, res, usage)
+
+	output := strings.TrimSpace(out.String())
+	if output == "" && structuredFormat(req) == nil {
 		return &ChatResult{
 			Content:      "",
-			FinishReason: "stop",
-			Usage:        types.Usage{},
+			FinishReason: finishReason,
+			StopSequence: g.stopSequence(res, finishReason),
+			Usage:        usage,
 		}, nil
 	}
 
-	toolCalls := c.extractToolCalls(output)
-	finishReason := "stop"
-	content := c.cleanResponse(output)
+	toolCalls, content, err := c.resolveOutput(ctx, req, g, output, finishReason, &usage)
+	if err != nil {
+		return nil, err
+	}
 
 	if len(toolCalls) > 0 {
 		finishReason = "tool_calls"
-		content = c.stripToolCalls(output)
-	}
-
-	approxTokens := len(output) / 4
-	usage := types.Usage{
-		PromptTokens:     len(prompt) / 4,
-		CompletionTokens: approxTokens,
-		TotalTokens:      (len(prompt) + len(output)) / 4,
 	}
 
-	_ = elapsed
-
 	return &ChatResult{
 		Content:      strings.TrimSpace(content),
 		ToolCalls:    toolCalls,
 		FinishReason: finishReason,
+		StopSequence: g.stopSequence(res, finishReason),
 		Usage:        usage,
 	}, nil
 }
 
-type StreamHandler func(content string, finishReason string) error
+// StreamChunk is one piece of a streamed completion: either content or tool
+// call deltas. The final chunk carries the finish reason, the stop sequence
+// of the request the reply ended at, if any, and token usage.
+type StreamChunk struct {
+	Content      string
+	ToolCalls    []types.ToolCallDelta
+	FinishReason string
+	StopSequence string
+	Usage        *types.Usage
+}
+
+type StreamHandler func(chunk StreamChunk) error
 
 func (c *Client) StreamChat(ctx context.Context, req *types.ChatCompletionRequest, handler StreamHandler) error {
-	c.mux.Lock()
-	defer c.mux.Unlock()
+	g, err := c.prepare(req)
+	if err != nil {
+		return err
+	}
+	observerFrom(ctx).truncated(g.truncation)
 
-	if c.config.Binary == "" {
-		return fmt.Errorf("picolm binary not configured")
+	release, err := c.acquire(ctx, g.model)
+	if err != nil {
+		return err
 	}
+	defer release()
 
-	modelName := req.Model
-	if modelName == "" {
-		modelName, _ = c.config.GetDefaultModel()
+	// Structured output and forced tool calls are validated, and possibly
+	// regenerated, before any of the output is sent.
+	choice, _ := resolveToolChoice(req)
+	hold := structuredFormat(req) != nil || choice.forced()
+
+	var tools *toolCallBuffer
+	if len(choice.tools(req.Tools)) > 0 {
+		tools = &toolCallBuffer{}
 	}
 
-	modelPath, err := c.config.GetModelPath(modelName)
+	var output strings.Builder
+	res, err := c.run(ctx, g, func(text string) error {
+		output.WriteString(text)
+		if hold {
+			return nil
+		}
+		if tools != nil {
+			if text = tools.Write(text); text == "" {
+				return nil
+			}
+		}
+		return handler(StreamChunk{Content: text})
+	})
 	if err != nil {
-		return fmt.Errorf("model not configured: %s", modelName)
+		return err
 	}
 
-	prompt := c.buildPrompt(req.Messages, req.Tools)
+	usage := c.usage(g, output.String())
+	c.observeGeneration(ctx, g, res, usage)
 
-	maxTokens := req.MaxTokens
-	if maxTokens == 0 {
-		maxTokens = c.config.MaxTokens
+	finishReason := c.finishReason(g, res, usage)
+
+	var calls []types.ToolCall
+	var content string
+
+	// Output that was not held has already been streamed as content, so a
+	// tool call embedded in it is left there rather than sent a second time.
+	if hold {
+		if calls, content, err = c.resolveOutput(ctx, req, g, strings.TrimSpace(output.String()), finishReason, &usage); err != nil {
+			return err
+		}
+	} else if tools != nil {
+		if held := strings.TrimSpace(tools.Held()); held != "" {
+			// Nothing has been streamed yet, so invalid calls can still be
+			// repaired before anything reaches the client.
+			if calls, content, err = c.resolveToolCalls(ctx, req, held, &usage); err != nil {
+				return err
+			}
+		}
 	}
 
-	temperature := c.config.Temperature
-	if req.Temperature > 0 {
-		temperature = req.Temperature
+	if len(calls) > 0 {
+		finishReason = "tool_calls"
+		if content != "" {
+			if err := handler(StreamChunk{Content: content}); err != nil {
+				return err
+			}
+		}
+		for _, delta := range toolCallDeltas(calls) {
+			if err := handler(StreamChunk{ToolCalls: delta}); err != nil {
+				return err
+			}
+		}
+	} else if content != "" {
+		if err := handler(StreamChunk{Content: content}); err != nil {
+			return err
+		}
 	}
 
-	topP := c.config.TopP
-	if req.TopP > 0 {
-		topP = req.TopP
+	return handler(StreamChunk{FinishReason: finishReason, StopSequence: g.stopSequence(res, finishReason), Usage: &usage})
+}
+
+// resolveOutput turns the output of a completed generation into tool calls
+// or content, repairing invalid tool calls and enforcing response_format.
+// Output cut short by max_tokens is returned without format validation.
+func (c *Client) resolveOutput(ctx context.Context, req *types.ChatCompletionRequest, g *generation, output, finishReason string, usage *types.Usage) ([]types.ToolCall, string, error) {
+	structured := structuredFormat(req) != nil
+	choice, _ := resolveToolChoice(req)
+
+	var calls []types.ToolCall
+	content := output
+	if len(choice.tools(req.Tools)) > 0 || (!structured && choice.Mode != ToolChoiceNone) {
+		var err error
+		if calls, content, err = c.resolveToolCalls(ctx, req, output, usage); err != nil {
+			return nil, "", err
+		}
+		if len(calls) > 0 {
+			return calls, content, nil
+		}
 	}
 
-	contextLength := c.config.ContextLength
+	content = c.cleanResponse(content, g.template.StopTokens)
+	if !structured || finishReason == "length" {
+		return nil, content, nil
+	}
 
-	args := []string{
-		modelPath,
-		"-n", fmt.Sprintf("%d", maxTokens),
-		"-j", fmt.Sprintf("%d", c.config.Threads),
-		"-t", fmt.Sprintf("%.1f", temperature),
-		"-k", fmt.Sprintf("%.1f", topP),
-		"-c", fmt.Sprintf("%d", contextLength),
+	content, err := c.resolveFormat(ctx, req, content, usage)
+	return nil, content, err
+}
+
+// finishReason tells a generation that ran out of tokens apart from one that
+// ended on its own or at a stop sequence. Output that was cut at a stop
+// sequence always finished with "stop"; otherwise picolm exited by itself,
+// which is either end-of-sequence or the max_tokens limit.
+func (c *Client) finishReason(g *generation, res *runResult, usage types.Usage) string {
+	if !res.Stopped && g.maxTokens > 0 && usage.CompletionTokens >= g.maxTokens {
+		return "length"
 	}
+	return "stop"
+}
 
-	if len(req.Tools) > 0 {
-		args = append(args, "--json")
+// stopSequence returns the stop sequence of the request a generation ended
+// at. Template stop tokens end a reply normally and are not reported.
+func (g *generation) stopSequence(res *runResult, finishReason string) string {
+	if finishReason != "stop" || res.Stop == "" || !slices.Contains(g.requestStops, res.Stop) {
+		return ""
+	}
+	return res.Stop
+}
+
+func (c *Client) observeGeneration(ctx context.Context, g *generation, res *runResult, usage types.Usage) {
+	metrics.AddUsage(ctx, usage.PromptTokens, usage.CompletionTokens)
+	observerFrom(ctx).used(usage)
+	metrics.PromptTokens.Add(float64(usage.PromptTokens), g.model)
+	metrics.TokensGenerated.Add(float64(usage.CompletionTokens), g.model)
+	if res.Duration > 0 && usage.CompletionTokens > 0 {
+		metrics.TokensPerSecond.Observe(float64(usage.CompletionTokens)/res.Duration.Seconds(), g.model)
 	}
+}
 
-	timeout := c.calculateTimeout(maxTokens)
+// runResult describes how a picolm process ended.
+type runResult struct {
+	// Stopped is set when output was cut at a stop sequence and the process
+	// was killed.
+	Stopped bool
+	// Stop is the stop sequence the output was cut at.
+	Stop string
+	// Duration is how long the process ran.
+	Duration time.Duration
+}
+
+// run spawns picolm for g and passes its output to emit as it is produced.
+// Template stop tokens and user stop sequences are never emitted: the process
+// is killed as soon as one is seen.
+func (c *Client) run(ctx context.Context, g *generation, emit func(text string) error) (*runResult, error) {
+	timeout := c.calculateTimeout(g.maxTokens)
 	inferenceCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	cmd := exec.CommandContext(inferenceCtx, c.config.Binary, args...)
-	cmd.Stdin = bytes.NewReader([]byte(prompt))
+	cmd := exec.CommandContext(inferenceCtx, c.config.Binary, g.args...)
+	cmd.Stdin = strings.NewReader(g.prompt)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	cmd.WaitDelay = 2 * time.Second
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
-		return fmt.Errorf("failed to create stdout pipe: %w", err)
+		return nil, fmt.Errorf("failed to create stdout pipe: %w", err)
 	}
-	defer stdout.Close()
 
-	stderr, err := cmd.StderrPipe()
-	if err != nil {
-		return fmt.Errorf("failed to create stderr pipe: %w", err)
+	if err := cmd.Start(); err != nil {
+		metrics.InferenceFailures.Inc(g.model, "spawn")
+		return nil, fmt.Errorf("failed to start picolm: %w", err)
 	}
-	defer stderr.Close()
+	started := time.Now()
 
-	var wg sync.WaitGroup
-	var stderrBuf strings.Builder
+	chunks := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
 
-	wg.Add(1)
 	go func() {
-		defer wg.Done()
-		scanner := bufio.NewScanner(stderr)
-		for scanner.Scan() {
-			stderrBuf.WriteString(scanner.Text())
-			stderrBuf.WriteString("\n")
+		defer close(chunks)
+		buf := make([]byte, 4096)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				select {
+				case chunks <- append([]byte(nil), buf[:n]...):
+				case <-done:
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
 		}
 	}()
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start picolm: %w", err)
+	interval := time.Duration(c.config.StreamFlushMs) * time.Millisecond
+	flushBytes := c.config.StreamFlushBytes
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
 	}
 
-	reader := bufio.NewReader(stdout)
-	var output strings.Builder
-	var tokenBuf strings.Builder
-	finishReason := "stop"
+	result := &runResult{}
+	decoder := newStreamDecoder(g.stops)
+	var emitErr error
+	first := true
+
+	flush := func() bool {
+		if decoder.Buffered() == 0 {
+			return true
+		}
+		if first {
+			metrics.TimeToFirstToken.Observe(time.Since(g.start).Seconds(), g.model)
+			first = false
+		}
+		emitErr = emit(decoder.Take())
+		return emitErr == nil
+	}
 
-outer:
+read:
 	for {
 		select {
 		case <-inferenceCtx.Done():
-			cmd.Process.Kill()
-			if inferenceCtx.Err() == context.DeadlineExceeded {
-				return fmt.Errorf("picolm inference timed out after %v (max_tokens: %d)", timeout, maxTokens)
+			break read
+		case b, ok := <-chunks:
+			if !ok {
+				decoder.Close()
+				flush()
+				break read
 			}
-			return fmt.Errorf("request cancelled (client disconnected or timeout)")
-		default:
-		}
-
-		b, readErr := reader.ReadByte()
-
-		if readErr != nil {
-			if readErr != io.EOF {
-				cmd.Process.Kill()
+			if decoder.Write(b) {
+				result.Stopped = true
+				flush()
+				break read
 			}
-
-			if rem := tokenBuf.String(); rem != "" && !containsSpecialToken(rem) {
-				output.WriteString(rem)
-				handler(rem, "") //nolint:errcheck
+			immediate := interval == 0 && flushBytes == 0
+			if (immediate || (flushBytes > 0 && decoder.Buffered() >= flushBytes)) && !flush() {
+				break read
+			}
+		case <-tick:
+			if !flush() {
+				break read
 			}
-			break outer
 		}
+	}
 
-		if b == ' ' || b == '\n' || b == '\t' {
-			token := tokenBuf.String()
-			tokenBuf.Reset()
+	result.Stop = decoder.Matched()
+	if result.Stopped || emitErr != nil {
+		cmd.Process.Kill()
+	}
 
-			if containsSpecialToken(token) {
-				break outer
-			}
+	waitErr := cmd.Wait()
+	result.Duration = time.Since(started)
 
-			output.WriteString(token)
+	if emitErr != nil {
+		return nil, emitErr
+	}
+	if result.Stopped {
+		return result, nil
+	}
 
-			if err := handler(token, ""); err != nil {
-				cmd.Process.Kill()
-				return err
-			}
+	if inferenceCtx.Err() == context.DeadlineExceeded {
+		metrics.InferenceFailures.Inc(g.model, "timeout")
+		return nil, fmt.Errorf("picolm inference timed out after %v (max_tokens: %d)", timeout, g.maxTokens)
+	}
+	if inferenceCtx.Err() == context.Canceled {
+		metrics.InferenceFailures.Inc(g.model, "cancelled")
+		return nil, fmt.Errorf("request cancelled (client disconnected or timeout)")
+	}
+
+	if waitErr != nil {
+		metrics.InferenceFailures.Inc(g.model, "exit")
+		if stderr.Len() > 0 {
+			return nil, fmt.Errorf("picolm error: %s", stderr.String())
 		}
+		return nil, fmt.Errorf("picolm error: %w", waitErr)
 	}
 
-	wg.Wait()
+	return result, nil
+}
 
-	if err := cmd.Wait(); err != nil {
-		if inferenceCtx.Err() == context.DeadlineExceeded {
-			return fmt.Errorf("picolm inference timed out after %v (max_tokens: %d)", timeout, maxTokens)
-		}
-		if inferenceCtx.Err() == context.Canceled {
-			return fmt.Errorf("request cancelled (client disconnected or timeout)")
+func (c *Client) acquire(ctx context.Context, model string) (func(), error) {
+	release, info, err := c.pool.Acquire(ctx, model)
+	if err != nil {
+		if ctx.Err() != nil {
+			metrics.InferenceFailures.Inc(model, "cancelled")
+			return nil, fmt.Errorf("request cancelled while queued (client disconnected or timeout)")
 		}
-		if stderrBuf.Len() > 0 {
-			return fmt.Errorf("picolm error: %s", stderrBuf.String())
+		metrics.InferenceFailures.Inc(model, "queue_full")
+		return nil, err
+	}
+	observerFrom(ctx).admitted(info)
+	return release, nil
+}
+
+const defaultSystemPrompt = "You are a helpful assistant."
+
+// chatTemplate returns the configured template for a model, falling back to
+// one detected from the GGUF chat template and then to the default.
+func (c *Client) chatTemplate(modelName string) (*ChatTemplate, error) {
+	if name := c.config.GetModelOptions(modelName).Template; name != "" {
+		return GetTemplate(name)
+	}
+	if f, err := c.modelFile(modelName); err == nil {
+		if name := DetectTemplate(f.ModelInfo().ChatTemplate); name != "" {
+			return GetTemplate(name)
 		}
-		return fmt.Errorf("picolm error: %w", err)
 	}
+	return GetTemplate(DefaultTemplate)
+}
+
+// systemInstructions returns the tool and response format instructions that
+// are appended to the system prompt for req.
+func (c *Client) systemInstructions(req *types.ChatCompletionRequest) []string {
+	var parts []string
 
-	outputStr := strings.TrimSpace(output.String())
-	if outputStr == "" {
-		return handler("", "stop")
+	choice, _ := resolveToolChoice(req)
+	if tools := choice.tools(req.Tools); len(tools) > 0 {
+		parts = append(parts, c.buildToolsPrompt(tools, choice, parallelToolCalls(req)))
 	}
 
-	toolCalls := c.extractToolCalls(outputStr)
-	if len(toolCalls) > 0 {
-		finishReason = "tool_calls"
+	if format := structuredFormat(req); format != nil {
+		parts = append(parts, buildFormatPrompt(format))
 	}
 
-	return handler("", finishReason)
+	return parts
 }
 
-const defaultSystemPrompt = "You are a helpful assistant."
-
-func (c *Client) buildPrompt(messages []types.ChatMessage, tools []types.ToolDefinition) string {
+func (c *Client) buildPrompt(tmpl *ChatTemplate, messages []types.ChatMessage, instructions []string) string {
 	var sb strings.Builder
 
 	var systemParts []string
 	for _, msg := range messages {
 		if msg.Role == "system" {
-			systemParts = append(systemParts, msg.Content)
+			systemParts = append(systemParts, msg.Content.String())
 		}
 	}
 
-	if len(tools) > 0 {
-		systemParts = append(systemParts, c.buildToolsPrompt(tools))
-	}
+	systemParts = append(systemParts, instructions...)
 
 	// Use default system prompt if none provided
-	if len(systemParts) == 0 {
+	if len(systemParts) == 0 && !tmpl.NoDefaultSystem {
 		systemParts = append(systemParts, defaultSystemPrompt)
 	}
 
-	// Write system prompt
-	sb.WriteString("<|system|>\n")
-	sb.WriteString(strings.Join(systemParts, "\n\n"))
-	sb.WriteString("</s>\n")
+	system := strings.Join(systemParts, "\n\n")
+
+	sb.WriteString(tmpl.Begin)
+
+	// Templates without a system role fold it into the first user turn
+	var pendingSystem string
+	if system != "" {
+		if tmpl.hasSystemRole() {
+			sb.WriteString(tmpl.System.wrap(system))
+		} else {
+			pendingSystem = fmt.Sprintf(tmpl.SystemInUser, system)
+		}
+	}
+
+	// Tool results name the function they answer, found through the
+	// assistant tool call with the same ID.
+	functions := make(map[string]string)
 
 	for _, msg := range messages {
 		switch msg.Role {
 		case "system":
 			// Already handled above
 		case "user":
-			sb.WriteString("<|user|>\n")
-			sb.WriteString(msg.Content)
-			sb.WriteString("</s>\n")
+			sb.WriteString(tmpl.User.wrap(pendingSystem + msg.Content.String()))
+			pendingSystem = ""
 		case "assistant":
-			sb.WriteString("<|assistant|>\n")
-			sb.WriteString(msg.Content)
-			sb.WriteString("</s>\n")
+			for _, call := range msg.ToolCalls {
+				functions[call.ID] = call.Function.Name
+			}
+			sb.WriteString(tmpl.Assistant.wrap(renderAssistant(msg)))
 		case "tool":
-			sb.WriteString("<|user|>\n")
-			sb.WriteString(fmt.Sprintf("[Tool Result for %s]: %s", msg.ToolCallID, msg.Content))
-			sb.WriteString("</s>\n")
+			name := functions[msg.ToolCallID]
+			if name == "" {
+				name = msg.Name
+			}
+			if tmpl.hasToolRole() {
+				sb.WriteString(tmpl.Tool.wrap(renderToolResult(name, msg)))
+				continue
+			}
+			sb.WriteString(tmpl.User.wrap(pendingSystem + toolResultLabel(name, msg.ToolCallID) + msg.Content.String()))
+			pendingSystem = ""
 		}
 	}
 
-	// No newline after assistant - matches working format
-	sb.WriteString("<|assistant|>")
+	if pendingSystem != "" {
+		sb.WriteString(tmpl.User.wrap(strings.TrimSpace(pendingSystem)))
+	}
 
-	// log.Printf("[DEBUG] buildPrompt: %q", sb.String())
+	sb.WriteString(tmpl.Generation)
 
 	return sb.String()
 }
 
-func (c *Client) buildToolsPrompt(tools []types.ToolDefinition) string {
+func (c *Client) buildToolsPrompt(tools []types.ToolDefinition, choice toolChoice, parallel bool) string {
 	var sb strings.Builder
 
 	sb.WriteString("## Available Tools\n\n")
-	sb.WriteString("When you need to use a tool, respond with ONLY a JSON object:\n\n")
+	switch choice.Mode {
+	case ToolChoiceRequired:
+		sb.WriteString("You MUST call at least one tool. Respond with ONLY a JSON object:\n\n")
+	case ToolChoiceFunction:
+		sb.WriteString(fmt.Sprintf("You MUST call the %s tool. Respond with ONLY a JSON object:\n\n", choice.Name))
+	default:
+		sb.WriteString("When you need to use a tool, respond with ONLY a JSON object:\n\n")
+	}
 	sb.WriteString("```json\n")
-	sb.WriteString(`{"tool_calls":[{"id":"call_xxx","type":"function","function":{"name":"tool_name","arguments":"{...}"}}]}`)
+	sb.WriteString(`{"tool_calls":[{"type":"function","function":{"name":"tool_name","arguments":"{...}"}}]}`)
 	sb.WriteString("\n```\n\n")
 	sb.WriteString("CRITICAL: The 'arguments' field MUST be a JSON-encoded STRING.\n\n")
+	if !parallel {
+		sb.WriteString("Call at most ONE tool per response.\n\n")
+	}
 	sb.WriteString("### Tool Definitions:\n\n")
 
 	for _, tool := range tools {
@@ -405,63 +694,69 @@ func (c *Client) buildToolsPrompt(tools []types.ToolDefinition) string {
 	return sb.String()
 }
 
-func (c *Client) extractToolCalls(text string) []types.ToolCall {
-	var result struct {
-		ToolCalls []struct {
-			ID       string `json:"id"`
-			Type     string `json:"type"`
-			Function struct {
-				Name      string `json:"name"`
-				Arguments string `json:"arguments"`
-			} `json:"function"`
-		} `json:"tool_calls"`
-	}
+// promptToolCall is a tool call in the shape the tools prompt teaches.
+type promptToolCall struct {
+	Type     string             `json:"type"`
+	Function types.CallFunction `json:"function"`
+}
 
-	if err := json.Unmarshal([]byte(text), &result); err != nil {
-		return nil
+// renderAssistant renders an assistant turn, serializing its tool calls as
+// the JSON object the model was asked to produce.
+func renderAssistant(msg types.ChatMessage) string {
+	content := msg.Content.String()
+	if len(msg.ToolCalls) == 0 {
+		return content
 	}
 
-	if len(result.ToolCalls) == 0 {
-		return nil
+	calls := make([]promptToolCall, len(msg.ToolCalls))
+	for i, call := range msg.ToolCalls {
+		calls[i] = promptToolCall{Type: "function", Function: call.Function}
 	}
+	data := marshalPrompt(struct {
+		ToolCalls []promptToolCall `json:"tool_calls"`
+	}{calls})
 
-	toolCalls := make([]types.ToolCall, len(result.ToolCalls))
-	for i, tc := range result.ToolCalls {
-		toolCalls[i] = types.ToolCall{
-			ID:   tc.ID,
-			Type: tc.Type,
-			Function: types.CallFunction{
-				Name:      tc.Function.Name,
-				Arguments: tc.Function.Arguments,
-			},
-		}
+	if content == "" {
+		return data
 	}
-
-	return toolCalls
+	return content + "\n" + data
 }
 
-func (c *Client) stripToolCalls(text string) string {
-	var result struct {
-		ToolCalls any    `json:"tool_calls"`
-		Content   string `json:"content"`
-	}
-
-	if err := json.Unmarshal([]byte(text), &result); err != nil {
-		return text
+// renderToolResult renders a tool result for templates with a native tool
+// role.
+func renderToolResult(name string, msg types.ChatMessage) string {
+	if name == "" {
+		return msg.Content.String()
 	}
+	return marshalPrompt(struct {
+		Name    string `json:"name"`
+		Content string `json:"content"`
+	}{name, msg.Content.String()})
+}
 
-	if result.Content != "" {
-		return result.Content
+// toolResultLabel introduces a tool result rendered as a user turn.
+func toolResultLabel(name, id string) string {
+	switch {
+	case name != "" && id != "":
+		return fmt.Sprintf("[Tool Result for %s (%s)]: ", name, id)
+	case name != "":
+		return fmt.Sprintf("[Tool Result for %s]: ", name)
 	}
-
-	return text
+	return fmt.Sprintf("[Tool Result for %s]: ", id)
 }
 
-func (c *Client) cleanResponse(output string) string {
-	specialTokens := []string{"<|user|>", "<|assistant|>", "</s>", "<|system|>", "<|end|>"}
+// marshalPrompt encodes v as compact JSON without HTML escaping.
+func marshalPrompt(v any) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(v)
+	return strings.TrimSpace(buf.String())
+}
 
+func (c *Client) cleanResponse(output string, stopTokens []string) string {
 	minIdx := len(output)
-	for _, token := range specialTokens {
+	for _, token := range stopTokens {
 		if idx := strings.Index(output, token); idx != -1 && idx < minIdx {
 			minIdx = idx
 		}
@@ -474,16 +769,6 @@ func (c *Client) cleanResponse(output string) string {
 	return strings.TrimSpace(output)
 }
 
-func containsSpecialToken(token string) bool {
-	specialTokens := []string{"<|user|>", "<|assistant|>", "</s>", "<|system|>", "<|end|>"}
-	for _, t := range specialTokens {
-		if strings.Contains(token, t) {
-			return true
-		}
-	}
-	return false
-}
-
 func (c *Client) Validate() error {
 	if c.config.Binary == "" {
 		return fmt.Errorf("binary path is required")
@@ -512,6 +797,17 @@ func (c *Client) Validate() error {
 		if info.IsDir() {
 			return fmt.Errorf("model path %q for %q is a directory", path, name)
 		}
+
+		if err := gguf.CheckFile(path); err != nil {
+			return fmt.Errorf("model %q at %q is not a GGUF file: %w", name, path, err)
+		}
+		if _, err := c.modelFile(name); err != nil {
+			return fmt.Errorf("model %q: %w", name, err)
+		}
+
+		if _, err := c.chatTemplate(name); err != nil {
+			return fmt.Errorf("model %q: %w", name, err)
+		}
 	}
 
 	return nil
@@ -535,6 +831,16 @@ func (c *Client) calculateTimeout(maxTokens int) time.Duration {
 	return estimatedTime
 }
 
+// Stats returns the number of running picolm processes and of requests
+// waiting for a worker.
+func (c *Client) Stats() (active, queued int) {
+	return c.pool.Stats()
+}
+
+func (c *Client) Available(modelName string) int {
+	return c.pool.Available(modelName)
+}
+
 func (c *Client) GetDefaultModel() string {
 	name, _ := c.config.GetDefaultModel()
 	return name
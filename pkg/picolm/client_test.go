@@ -2,9 +2,15 @@ package picolm
 
 import (
 	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/metrics"
 	"github.com/wmik/picolm-server/pkg/types"
 )
 
@@ -115,7 +121,7 @@ func TestClient_Chat_NoBinary(t *testing.T) {
 	req := &types.ChatCompletionRequest{
 		Model: "test",
 		Messages: []types.ChatMessage{
-			{Role: "user", Content: "Hello"},
+			{Role: "user", Content: types.TextContent("Hello")},
 		},
 	}
 
@@ -135,7 +141,7 @@ func TestClient_Chat_NoModel(t *testing.T) {
 	req := &types.ChatCompletionRequest{
 		Model: "nonexistent",
 		Messages: []types.ChatMessage{
-			{Role: "user", Content: "Hello"},
+			{Role: "user", Content: types.TextContent("Hello")},
 		},
 	}
 
@@ -155,11 +161,11 @@ func TestClient_StreamChat_NoBinary(t *testing.T) {
 	req := &types.ChatCompletionRequest{
 		Model: "test",
 		Messages: []types.ChatMessage{
-			{Role: "user", Content: "Hello"},
+			{Role: "user", Content: types.TextContent("Hello")},
 		},
 	}
 
-	err := c.StreamChat(context.Background(), req, func(content, finishReason string) error {
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
 		return nil
 	})
 	if err == nil {
@@ -177,14 +183,268 @@ func TestClient_StreamChat_NoModel(t *testing.T) {
 	req := &types.ChatCompletionRequest{
 		Model: "nonexistent",
 		Messages: []types.ChatMessage{
-			{Role: "user", Content: "Hello"},
+			{Role: "user", Content: types.TextContent("Hello")},
 		},
 	}
 
-	err := c.StreamChat(context.Background(), req, func(content, finishReason string) error {
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
 		return nil
 	})
 	if err == nil {
 		t.Error("expected error for nonexistent model")
 	}
 }
+
+// writeFakePicoLM writes a shell script standing in for the picolm binary.
+func writeFakePicoLM(t *testing.T, script string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "picolm")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\ncat >/dev/null\n"+script+"\n"), 0755); err != nil {
+		t.Fatalf("failed to write fake picolm: %v", err)
+	}
+	return path
+}
+
+func TestClient_Chat_StopSequence(t *testing.T) {
+	cfg := config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf 'Thought: search\nAction: lookup\nObservation: sunny\n'; exec sleep 10`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	}
+
+	c := NewClient(cfg)
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather?")}},
+		Stop:     []string{"Observation:"},
+	}
+
+	start := time.Now()
+	result, err := c.Chat(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+
+	if time.Since(start) > 5*time.Second {
+		t.Error("expected picolm to be killed when the stop sequence was hit")
+	}
+	if result.Content != "Thought: search\nAction: lookup" {
+		t.Errorf("Content = %q", result.Content)
+	}
+	if result.FinishReason != "stop" || result.StopSequence != "Observation:" {
+		t.Errorf("FinishReason = %q, StopSequence = %q, want stop at Observation:", result.FinishReason, result.StopSequence)
+	}
+}
+
+func TestClient_StreamChat_StopSequence(t *testing.T) {
+	cfg := config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf 'Action: lookup\nObservation: sunny\n'`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	}
+
+	c := NewClient(cfg)
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather?")}},
+		Stop:     []string{"Observation:"},
+	}
+
+	var sb strings.Builder
+	var finishReason, stopSequence string
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+		sb.WriteString(chunk.Content)
+		if chunk.FinishReason != "" {
+			finishReason, stopSequence = chunk.FinishReason, chunk.StopSequence
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChat() error = %v", err)
+	}
+
+	if strings.Contains(sb.String(), "Obs") {
+		t.Errorf("streamed output contains stop sequence: %q", sb.String())
+	}
+	if sb.String() != "Action: lookup\n" {
+		t.Errorf("streamed output = %q", sb.String())
+	}
+	if finishReason != "stop" || stopSequence != "Observation:" {
+		t.Errorf("finish reason = %q, stop sequence = %q, want stop at Observation:", finishReason, stopSequence)
+	}
+}
+
+// writeVocabModel writes a model whose vocabulary encodes "hello world" as
+// two tokens.
+func writeVocabModel(t *testing.T) string {
+	t.Helper()
+
+	return writeTestModel(t, t.TempDir(), map[string]any{
+		"general.architecture":            "llama",
+		"tokenizer.ggml.model":            "llama",
+		"tokenizer.ggml.tokens":           []string{"<unk>", "<s>", "▁hello", "▁world", "▁h", "▁he", "▁hel", "▁hell", "▁w", "▁wo", "▁wor", "▁worl", "▁", "h", "e", "l", "o", "w", "r", "d"},
+		"tokenizer.ggml.bos_token_id":     uint32(1),
+		"tokenizer.ggml.unknown_token_id": uint32(0),
+	})
+}
+
+func TestClient_Usage(t *testing.T) {
+	model := writeVocabModel(t)
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf 'hello world'`),
+		Models: map[string]string{"test": model},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+	}
+
+	var observed types.Usage
+	ctx := WithObserver(context.Background(), &Observer{
+		OnUsage: func(u types.Usage) { observed = u },
+	})
+	result, err := c.Chat(ctx, req)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if observed.PromptTokens != result.Usage.PromptTokens || observed.CompletionTokens != 2 {
+		t.Errorf("OnUsage got %+v, want %+v", observed, result.Usage)
+	}
+	if result.Usage.CompletionTokens != 2 {
+		t.Errorf("CompletionTokens = %d, want 2", result.Usage.CompletionTokens)
+	}
+	if result.Usage.PromptTokens == 0 || result.Usage.TotalTokens != result.Usage.PromptTokens+2 {
+		t.Errorf("Usage = %+v", result.Usage)
+	}
+
+	var usage *types.Usage
+	err = c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChat() error = %v", err)
+	}
+	if usage == nil || *usage != result.Usage {
+		t.Errorf("streamed usage = %+v, want %+v", usage, result.Usage)
+	}
+}
+
+func TestClient_FinishReason(t *testing.T) {
+	model := writeVocabModel(t)
+
+	tests := []struct {
+		name      string
+		maxTokens int
+		stop      []string
+		want      string
+	}{
+		{"max tokens reached", 2, nil, "length"},
+		{"natural end", 3, nil, "stop"},
+		{"stop sequence", 2, []string{"world"}, "stop"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(config.PicoLMConfig{
+				Binary: writeFakePicoLM(t, `printf 'hello world'`),
+				Models: map[string]string{"test": model},
+			})
+			req := &types.ChatCompletionRequest{
+				Model:     "test",
+				Messages:  []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+				MaxTokens: tt.maxTokens,
+				Stop:      tt.stop,
+			}
+
+			result, err := c.Chat(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Chat() error = %v", err)
+			}
+			if result.FinishReason != tt.want {
+				t.Errorf("Chat() FinishReason = %q, want %q", result.FinishReason, tt.want)
+			}
+
+			var finishReason string
+			err = c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+				if chunk.FinishReason != "" {
+					finishReason = chunk.FinishReason
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("StreamChat() error = %v", err)
+			}
+			if finishReason != tt.want {
+				t.Errorf("StreamChat() finish reason = %q, want %q", finishReason, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_Metrics(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf 'hello world'`),
+		Models: map[string]string{"metrics-test": writeVocabModel(t)},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:    "metrics-test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+	}
+	if _, err := c.Chat(context.Background(), req); err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+
+	c.config.Binary = filepath.Join(t.TempDir(), "missing")
+	if _, err := c.Chat(context.Background(), req); err == nil {
+		t.Fatal("expected error when picolm cannot be started")
+	}
+
+	var sb strings.Builder
+	metrics.Default.Write(&sb)
+	out := sb.String()
+
+	for _, want := range []string{
+		`picolm_tokens_generated_total{model="metrics-test"} 2`,
+		`picolm_time_to_first_token_seconds_count{model="metrics-test"} 1`,
+		`picolm_tokens_per_second_count{model="metrics-test"} 1`,
+		`picolm_inference_failures_total{model="metrics-test",reason="spawn"} 1`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics missing %q", want)
+		}
+	}
+}
+
+func TestClient_Chat_ChoiceLimit(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary:     writeFakePicoLM(t, `printf 'Hello'`),
+		Models:     map[string]string{"test": "/path/to/model.gguf"},
+		MaxChoices: 2,
+	})
+
+	for _, n := range []int{0, 1, 2} {
+		req := &types.ChatCompletionRequest{
+			Model:    "test",
+			Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+			N:        n,
+		}
+		if _, err := c.Chat(context.Background(), req); err != nil {
+			t.Errorf("Chat() with n=%d error = %v", n, err)
+		}
+	}
+
+	for _, n := range []int{-1, 3} {
+		req := &types.ChatCompletionRequest{
+			Model:    "test",
+			Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+			N:        n,
+		}
+		var rerr *InvalidRequestError
+		if _, err := c.Chat(context.Background(), req); !errors.As(err, &rerr) || rerr.Param != "n" {
+			t.Errorf("Chat() with n=%d error = %v, want invalid n", n, err)
+		}
+	}
+}
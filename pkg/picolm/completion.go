@@ -0,0 +1,181 @@
+package picolm
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// CompletionResult is the output of a text completion.
+type CompletionResult struct {
+	Text         string
+	FinishReason string
+	Usage        types.Usage
+}
+
+// fimFormat describes the fill-in-the-middle tokens of a model family. The
+// prompt is rendered as prefix, suffix, middle, and the model generates the
+// missing middle.
+type fimFormat struct {
+	Prefix string
+	Suffix string
+	Middle string
+	Stops  []string
+}
+
+var fimFormats = []fimFormat{
+	// Qwen2.5-Coder
+	{"<|fim_prefix|>", "<|fim_suffix|>", "<|fim_middle|>", []string{"<|endoftext|>", "<|fim_pad|>", "<|file_sep|>"}},
+	// StarCoder
+	{"<fim_prefix>", "<fim_suffix>", "<fim_middle>", []string{"<|endoftext|>", "<file_sep>"}},
+	// DeepSeek Coder
+	{"<｜fim▁begin｜>", "<｜fim▁hole｜>", "<｜fim▁end｜>", []string{"<｜end▁of▁sentence｜>"}},
+	// Code Llama
+	{"<PRE> ", " <SUF>", " <MID>", []string{"<EOT>"}},
+}
+
+// Complete generates a completion of a raw prompt, without a chat template.
+func (c *Client) Complete(ctx context.Context, req *types.CompletionRequest, prompt string) (*CompletionResult, error) {
+	g, err := c.prepareCompletion(req, prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := c.acquire(ctx, g.model)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	var out strings.Builder
+	res, err := c.run(ctx, g, func(text string) error {
+		out.WriteString(text)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	usage := c.usage(g, out.String())
+	c.observeGeneration(ctx, g, res, usage)
+
+	return &CompletionResult{
+		Text:         out.String(),
+		FinishReason: c.finishReason(g, res, usage),
+		Usage:        usage,
+	}, nil
+}
+
+// StreamComplete is the streaming form of Complete. The final chunk carries
+// the finish reason and token usage.
+func (c *Client) StreamComplete(ctx context.Context, req *types.CompletionRequest, prompt string, handler StreamHandler) error {
+	g, err := c.prepareCompletion(req, prompt)
+	if err != nil {
+		return err
+	}
+
+	release, err := c.acquire(ctx, g.model)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	var out strings.Builder
+	res, err := c.run(ctx, g, func(text string) error {
+		out.WriteString(text)
+		return handler(StreamChunk{Content: text})
+	})
+	if err != nil {
+		return err
+	}
+
+	usage := c.usage(g, out.String())
+	c.observeGeneration(ctx, g, res, usage)
+
+	return handler(StreamChunk{FinishReason: c.finishReason(g, res, usage), Usage: &usage})
+}
+
+func (c *Client) prepareCompletion(req *types.CompletionRequest, prompt string) (*generation, error) {
+	modelName, modelPath, err := c.resolveModel(req.Model)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.CheckChoices(req.N); err != nil {
+		return nil, err
+	}
+
+	stops := append([]string{}, req.Stop...)
+	if req.Suffix != "" {
+		f, ok := c.fimFormat(modelName)
+		if !ok {
+			return nil, &InvalidRequestError{
+				Param:   "suffix",
+				Message: fmt.Sprintf("model %s does not support suffix: its vocabulary has no fill-in-the-middle tokens", modelName),
+			}
+		}
+		prompt = f.Prefix + prompt + f.Suffix + req.Suffix + f.Middle
+		stops = append(stops, f.Stops...)
+	}
+
+	maxTokens := req.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = c.config.MaxTokens
+	}
+
+	// A raw prompt cannot be truncated, so it either fits or is rejected.
+	contextLength := c.contextLength(modelName)
+	reserved := 0
+	if reserveMaxTokens(c.config.GetModelOptions(modelName), req.ReserveMaxTokens) {
+		reserved = maxTokens
+	}
+	if tokens := c.countPrompt(modelName, prompt); tokens > contextLength-reserved {
+		return nil, &ContextLengthError{
+			Model:         modelName,
+			ContextLength: contextLength,
+			PromptTokens:  tokens,
+			Reserved:      reserved,
+		}
+	}
+
+	raw, err := GetTemplate("raw")
+	if err != nil {
+		return nil, err
+	}
+
+	return &generation{
+		model:     modelName,
+		template:  raw,
+		prompt:    prompt,
+		args:      c.buildArgs(modelName, modelPath, maxTokens, req.Temperature, req.TopP),
+		maxTokens: maxTokens,
+		stops:     stops,
+		start:     time.Now(),
+	}, nil
+}
+
+// fimFormat returns the fill-in-the-middle format whose tokens are all in the
+// model's vocabulary.
+func (c *Client) fimFormat(modelName string) (fimFormat, bool) {
+	tok := c.tokenizer(modelName)
+	if tok == nil {
+		return fimFormat{}, false
+	}
+	for _, f := range fimFormats {
+		if hasTokens(tok.TokenID, f.Prefix, f.Suffix, f.Middle) {
+			return f, true
+		}
+	}
+	return fimFormat{}, false
+}
+
+func hasTokens(lookup func(string) (int, bool), tokens ...string) bool {
+	for _, t := range tokens {
+		if _, ok := lookup(strings.TrimSpace(t)); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package picolm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestClient_Complete(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf '  return a + b\n}\n\nfunc main() {'; exec sleep 10`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.CompletionRequest{
+		Model: "test",
+		Stop:  []string{"\n\n"},
+	}
+
+	result, err := c.Complete(context.Background(), req, "func add(a, b int) int {\n")
+	if err != nil {
+		t.Fatalf("Complete() error = %v", err)
+	}
+	// Leading whitespace is significant in a completion and is kept.
+	if result.Text != "  return a + b\n}" {
+		t.Errorf("Text = %q", result.Text)
+	}
+	if result.FinishReason != "stop" || result.Usage.CompletionTokens == 0 {
+		t.Errorf("result = %+v", result)
+	}
+}
+
+func TestClient_StreamComplete(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf 'Once upon a time'`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+
+	var text strings.Builder
+	var last StreamChunk
+	err := c.StreamComplete(context.Background(), &types.CompletionRequest{Model: "test"}, "Tell me a story.", func(chunk StreamChunk) error {
+		text.WriteString(chunk.Content)
+		last = chunk
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamComplete() error = %v", err)
+	}
+	if text.String() != "Once upon a time" {
+		t.Errorf("streamed %q", text.String())
+	}
+	if last.FinishReason != "stop" || last.Usage == nil {
+		t.Errorf("final chunk = %+v", last)
+	}
+}
+
+func TestPrepareCompletion_Suffix(t *testing.T) {
+	fim := writeTestModel(t, t.TempDir(), map[string]any{
+		"general.architecture":  "qwen2",
+		"tokenizer.ggml.model":  "gpt2",
+		"tokenizer.ggml.tokens": []string{"a", "b", "<|fim_prefix|>", "<|fim_suffix|>", "<|fim_middle|>", "<|endoftext|>"},
+		"tokenizer.ggml.merges": []string{},
+	})
+	plain := writeVocabModel(t)
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: "/bin/picolm",
+		Models: map[string]string{"coder": fim, "chat": plain},
+	})
+
+	g, err := c.prepareCompletion(&types.CompletionRequest{Model: "coder", Suffix: "\n}"}, "func add(a, b int) int {\n")
+	if err != nil {
+		t.Fatalf("prepareCompletion() error = %v", err)
+	}
+	if want := "<|fim_prefix|>func add(a, b int) int {\n<|fim_suffix|>\n}<|fim_middle|>"; g.prompt != want {
+		t.Errorf("prompt = %q, want %q", g.prompt, want)
+	}
+	if !strings.Contains(strings.Join(g.stops, " "), "<|endoftext|>") {
+		t.Errorf("stops = %q, want FIM stop tokens", g.stops)
+	}
+
+	_, err = c.prepareCompletion(&types.CompletionRequest{Model: "chat", Suffix: "\n}"}, "func add(a, b int) int {\n")
+	var rerr *InvalidRequestError
+	if !errors.As(err, &rerr) || rerr.Param != "suffix" {
+		t.Errorf("prepareCompletion() error = %v, want invalid suffix", err)
+	}
+}
+
+func TestPrepareCompletion_ContextLength(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary:        "/bin/picolm",
+		Models:        map[string]string{"test": "/path/to/model.gguf"},
+		ContextLength: 16,
+	})
+
+	_, err := c.prepareCompletion(&types.CompletionRequest{Model: "test"}, strings.Repeat("word ", 100))
+	var cerr *ContextLengthError
+	if !errors.As(err, &cerr) || cerr.ContextLength != 16 {
+		t.Errorf("prepareCompletion() error = %v, want ContextLengthError", err)
+	}
+}
@@ -0,0 +1,32 @@
+package picolm
+
+import "fmt"
+
+// InvalidRequestError reports a request the server cannot process as sent.
+type InvalidRequestError struct {
+	Param   string
+	Message string
+}
+
+func (e *InvalidRequestError) Error() string {
+	return e.Message
+}
+
+// ContextLengthError is returned when a prompt does not fit the model's
+// context window and the truncation strategy could not make it fit.
+type ContextLengthError struct {
+	Model         string
+	ContextLength int
+	PromptTokens  int
+	// Reserved is the number of tokens held back for the completion.
+	Reserved int
+}
+
+func (e *ContextLengthError) Error() string {
+	if e.Reserved > 0 {
+		return fmt.Sprintf("This model's maximum context length is %d tokens. However, you requested %d tokens (%d in the messages, %d in the completion). Please reduce the length of the messages or completion.",
+			e.ContextLength, e.PromptTokens+e.Reserved, e.PromptTokens, e.Reserved)
+	}
+	return fmt.Sprintf("This model's maximum context length is %d tokens. However, your messages resulted in %d tokens. Please reduce the length of the messages.",
+		e.ContextLength, e.PromptTokens)
+}
@@ -0,0 +1,182 @@
+package picolm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/wmik/picolm-server/pkg/jsonschema"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// Response format types accepted in response_format.
+const (
+	FormatText       = "text"
+	FormatJSONObject = "json_object"
+	FormatJSONSchema = "json_schema"
+)
+
+// ResponseFormatError is returned when the model did not produce output
+// matching the requested response_format within the allowed retries.
+type ResponseFormatError struct {
+	Format   string
+	Attempts int
+	Err      error
+}
+
+func (e *ResponseFormatError) Error() string {
+	return fmt.Sprintf("model output did not match response_format %s after %d attempts: %v", e.Format, e.Attempts, e.Err)
+}
+
+func (e *ResponseFormatError) Unwrap() error {
+	return e.Err
+}
+
+// structuredFormat returns the requested JSON format, or nil when the reply
+// is plain text.
+func structuredFormat(req *types.ChatCompletionRequest) *types.ResponseFormat {
+	if f := req.ResponseFormat; f != nil && (f.Type == FormatJSONObject || f.Type == FormatJSONSchema) {
+		return f
+	}
+	return nil
+}
+
+func checkResponseFormat(f *types.ResponseFormat) error {
+	if f == nil {
+		return nil
+	}
+	switch f.Type {
+	case FormatText, FormatJSONObject:
+		return nil
+	case FormatJSONSchema:
+		if f.JSONSchema == nil {
+			return &InvalidRequestError{
+				Param:   "response_format.json_schema",
+				Message: "response_format of type json_schema requires a json_schema object",
+			}
+		}
+		return nil
+	}
+	return &InvalidRequestError{
+		Param:   "response_format.type",
+		Message: fmt.Sprintf("invalid response_format type %q: must be one of %s, %s or %s", f.Type, FormatText, FormatJSONObject, FormatJSONSchema),
+	}
+}
+
+func buildFormatPrompt(f *types.ResponseFormat) string {
+	var sb strings.Builder
+
+	sb.WriteString("## Response Format\n\n")
+	if f.Type == FormatJSONObject {
+		sb.WriteString("Respond with ONLY a valid JSON object. Do not add any other text.\n")
+		return sb.String()
+	}
+
+	sb.WriteString("Respond with ONLY a JSON object that matches the following JSON schema. Do not add any other text.\n\n")
+	if f.JSONSchema.Name != "" {
+		sb.WriteString(fmt.Sprintf("Name: %s\n", f.JSONSchema.Name))
+	}
+	if f.JSONSchema.Description != "" {
+		sb.WriteString(fmt.Sprintf("Description: %s\n", f.JSONSchema.Description))
+	}
+	schemaJSON, _ := json.Marshal(f.JSONSchema.Schema)
+	sb.WriteString(fmt.Sprintf("Schema:\n```json\n%s\n```\n", string(schemaJSON)))
+
+	return sb.String()
+}
+
+// parseStructured extracts the JSON value from output, which may be wrapped
+// in a code fence, and checks it against f.
+func parseStructured(output string, f *types.ResponseFormat) (string, error) {
+	text := strings.TrimSpace(output)
+	if strings.HasPrefix(text, "```") {
+		if m := fencedBlock.FindStringSubmatch(text); m != nil {
+			text = strings.TrimSpace(m[1])
+		}
+	}
+
+	var value any
+	if err := json.Unmarshal([]byte(text), &value); err != nil {
+		return "", fmt.Errorf("output is not valid JSON: %v", err)
+	}
+
+	if f.Type == FormatJSONObject {
+		if _, ok := value.(map[string]any); !ok {
+			return "", fmt.Errorf("output must be a JSON object")
+		}
+		return text, nil
+	}
+
+	if err := jsonschema.Validate(f.JSONSchema.Schema, value); err != nil {
+		return "", fmt.Errorf("output does not match the schema: %v", err)
+	}
+	return text, nil
+}
+
+// resolveFormat validates content against the request's response_format
+// and, while it fails, re-prompts the model with the errors up to
+// ResponseFormatRetries times. Tokens used by retries are added to usage.
+func (c *Client) resolveFormat(ctx context.Context, req *types.ChatCompletionRequest, content string, usage *types.Usage) (string, error) {
+	f := structuredFormat(req)
+
+	result, verr := parseStructured(content, f)
+	attempts := 1
+	for verr != nil && attempts <= c.config.GetResponseFormatRetries() {
+		output, err := c.regenerate(ctx, req, content, formatRepairPrompt(verr), usage)
+		if errors.As(err, new(*ContextLengthError)) {
+			// The conversation with the retry no longer fits.
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		attempts++
+		content = output
+		result, verr = parseStructured(content, f)
+	}
+
+	if verr != nil {
+		return "", &ResponseFormatError{Format: f.Type, Attempts: attempts, Err: verr}
+	}
+	return result, nil
+}
+
+// regenerate asks the model to try again after output, with feedback as the
+// next user message, and returns the new output. Tokens used are added to
+// usage.
+func (c *Client) regenerate(ctx context.Context, req *types.ChatCompletionRequest, output, feedback string, usage *types.Usage) (string, error) {
+	retry := *req
+	retry.Messages = append(append([]types.ChatMessage{}, req.Messages...),
+		types.ChatMessage{Role: "assistant", Content: types.TextContent(output)},
+		types.ChatMessage{Role: "user", Content: types.TextContent(feedback)},
+	)
+
+	g, err := c.prepare(&retry)
+	if err != nil {
+		return "", err
+	}
+
+	var out strings.Builder
+	res, err := c.run(ctx, g, func(text string) error {
+		out.WriteString(text)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	u := c.usage(g, out.String())
+	c.observeGeneration(ctx, g, res, u)
+	usage.PromptTokens += u.PromptTokens
+	usage.CompletionTokens += u.CompletionTokens
+	usage.TotalTokens += u.TotalTokens
+
+	return c.cleanResponse(out.String(), g.template.StopTokens), nil
+}
+
+func formatRepairPrompt(err error) string {
+	return fmt.Sprintf("Your previous response was invalid: %v\n\n"+
+		"Respond again with ONLY the corrected JSON, without any other text.", err)
+}
@@ -0,0 +1,210 @@
+package picolm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+var answerFormat = &types.ResponseFormat{
+	Type: FormatJSONSchema,
+	JSONSchema: &types.JSONSchemaFormat{
+		Name: "answer",
+		Schema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"city":  map[string]any{"type": "string"},
+				"temp":  map[string]any{"type": "number"},
+				"sunny": map[string]any{"type": "boolean"},
+			},
+			"required":             []any{"city", "temp"},
+			"additionalProperties": false,
+		},
+	},
+}
+
+func TestParseStructured(t *testing.T) {
+	jsonObject := &types.ResponseFormat{Type: FormatJSONObject}
+
+	tests := []struct {
+		name    string
+		output  string
+		format  *types.ResponseFormat
+		want    string
+		wantErr string
+	}{
+		{name: "json object", output: `{"a":1}`, format: jsonObject, want: `{"a":1}`},
+		{name: "fenced", output: "```json\n{\"a\":1}\n```", format: jsonObject, want: `{"a":1}`},
+		{name: "not JSON", output: `Sure, here it is: {"a":1}`, format: jsonObject, wantErr: "not valid JSON"},
+		{name: "array for json_object", output: `[1,2]`, format: jsonObject, wantErr: "must be a JSON object"},
+		{name: "matches schema", output: `{"city":"Nairobi","temp":24.5}`, format: answerFormat, want: `{"city":"Nairobi","temp":24.5}`},
+		{name: "missing property", output: `{"city":"Nairobi"}`, format: answerFormat, wantErr: `missing required property "temp"`},
+		{name: "wrong type", output: `{"city":"Nairobi","temp":"warm"}`, format: answerFormat, wantErr: "/temp: expected number"},
+		{name: "extra property", output: `{"city":"Nairobi","temp":24,"wind":3}`, format: answerFormat, wantErr: `unexpected property "wind"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseStructured(tt.output, tt.format)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseStructured() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseStructured() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parseStructured() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckResponseFormat(t *testing.T) {
+	tests := []struct {
+		format    *types.ResponseFormat
+		wantParam string
+	}{
+		{format: nil},
+		{format: &types.ResponseFormat{Type: FormatText}},
+		{format: &types.ResponseFormat{Type: FormatJSONObject}},
+		{format: answerFormat},
+		{format: &types.ResponseFormat{Type: FormatJSONSchema}, wantParam: "response_format.json_schema"},
+		{format: &types.ResponseFormat{Type: "xml"}, wantParam: "response_format.type"},
+	}
+
+	for _, tt := range tests {
+		err := checkResponseFormat(tt.format)
+		var rerr *InvalidRequestError
+		if tt.wantParam == "" {
+			if err != nil {
+				t.Errorf("checkResponseFormat(%+v) error = %v", tt.format, err)
+			}
+		} else if !errors.As(err, &rerr) || rerr.Param != tt.wantParam {
+			t.Errorf("checkResponseFormat(%+v) error = %v, want param %s", tt.format, err, tt.wantParam)
+		}
+	}
+}
+
+func TestBuildPrompt_ResponseFormat(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+	tmpl, _ := GetTemplate("chatml")
+	messages := []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather?")}}
+
+	req := &types.ChatCompletionRequest{Messages: messages, ResponseFormat: answerFormat}
+	prompt := c.buildPrompt(tmpl, messages, c.systemInstructions(req))
+	if !strings.Contains(prompt, "## Response Format") || !strings.Contains(prompt, `"required":["city","temp"]`) {
+		t.Errorf("schema instructions missing from prompt:\n%s", prompt)
+	}
+}
+
+func TestClient_Chat_ResponseFormat(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "attempted")
+	invalid := `{"city":"Nairobi"}`
+	valid := `{"city":"Nairobi","temp":24}`
+	// The fake only answers when JSON mode is enabled.
+	script := `case "$*" in *--json*) ;; *) exit 1 ;; esac
+if [ -f ` + marker + ` ]; then printf '%s' '` + valid + `'; else touch ` + marker + `; printf '%s' '` + invalid + `'; fi`
+
+	tests := []struct {
+		name    string
+		retries int
+		wantErr bool
+	}{
+		{name: "no retries", retries: 0, wantErr: true},
+		{name: "repaired", retries: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { os.Remove(marker) })
+
+			retries := tt.retries
+			c := NewClient(config.PicoLMConfig{
+				Binary:                writeFakePicoLM(t, script),
+				Models:                map[string]string{"test": "/path/to/model.gguf"},
+				ResponseFormatRetries: &retries,
+			})
+			req := &types.ChatCompletionRequest{
+				Model:          "test",
+				Messages:       []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+				ResponseFormat: answerFormat,
+			}
+
+			result, err := c.Chat(context.Background(), req)
+			if tt.wantErr {
+				var ferr *ResponseFormatError
+				if !errors.As(err, &ferr) || ferr.Attempts != 1 {
+					t.Fatalf("Chat() error = %v, want ResponseFormatError after 1 attempt", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Chat() error = %v", err)
+			}
+			if result.Content != valid {
+				t.Errorf("Content = %q, want %q", result.Content, valid)
+			}
+			if result.Usage.CompletionTokens <= c.countText("test", valid) {
+				t.Errorf("usage %+v does not include the retry", result.Usage)
+			}
+		})
+	}
+}
+
+func TestClient_StreamChat_ResponseFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		wantErr bool
+	}{
+		{name: "valid", output: "```json\n{\"city\":\"Nairobi\",\"temp\":24}\n```"},
+		{name: "invalid", output: `{"city":"Nairobi"}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(config.PicoLMConfig{
+				Binary: writeFakePicoLM(t, `printf '%s' '`+tt.output+`'`),
+				Models: map[string]string{"test": "/path/to/model.gguf"},
+			})
+			req := &types.ChatCompletionRequest{
+				Model:          "test",
+				Messages:       []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+				ResponseFormat: answerFormat,
+			}
+
+			var chunks []string
+			err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+				if chunk.Content != "" {
+					chunks = append(chunks, chunk.Content)
+				}
+				return nil
+			})
+
+			if tt.wantErr {
+				if !errors.As(err, new(*ResponseFormatError)) {
+					t.Fatalf("StreamChat() error = %v, want ResponseFormatError", err)
+				}
+				if len(chunks) != 0 {
+					t.Errorf("invalid output was streamed: %q", chunks)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("StreamChat() error = %v", err)
+			}
+			if len(chunks) != 1 || chunks[0] != `{"city":"Nairobi","temp":24}` {
+				t.Errorf("chunks = %q", chunks)
+			}
+		})
+	}
+}
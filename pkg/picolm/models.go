@@ -0,0 +1,143 @@
+package picolm
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/wmik/picolm-server/pkg/gguf"
+	"github.com/wmik/picolm-server/pkg/tokenizer"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+const defaultContextLength = 2048
+
+// modelCache holds parsed GGUF metadata and tokenizers per model so each
+// file is only read once.
+type modelCache struct {
+	mu         sync.Mutex
+	files      map[string]*gguf.File
+	tokenizers map[string]*tokenizer.Tokenizer
+}
+
+func (c *Client) modelFile(modelName string) (*gguf.File, error) {
+	path, err := c.config.GetModelPath(modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	c.models.mu.Lock()
+	defer c.models.mu.Unlock()
+
+	if f, ok := c.models.files[modelName]; ok {
+		return f, nil
+	}
+
+	f, err := gguf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.models.files == nil {
+		c.models.files = make(map[string]*gguf.File)
+	}
+	c.models.files[modelName] = f
+	return f, nil
+}
+
+// tokenizer returns the model's tokenizer, or nil when the vocabulary cannot
+// be loaded. Failures are cached so the file is not parsed again.
+func (c *Client) tokenizer(modelName string) *tokenizer.Tokenizer {
+	c.models.mu.Lock()
+	tok, ok := c.models.tokenizers[modelName]
+	c.models.mu.Unlock()
+	if ok {
+		return tok
+	}
+
+	if f, err := c.modelFile(modelName); err == nil {
+		tok, _ = tokenizer.FromGGUF(f)
+	}
+
+	c.models.mu.Lock()
+	defer c.models.mu.Unlock()
+	if c.models.tokenizers == nil {
+		c.models.tokenizers = make(map[string]*tokenizer.Tokenizer)
+	}
+	c.models.tokenizers[modelName] = tok
+	return tok
+}
+
+// countPrompt and countText count tokens with the model's tokenizer, falling
+// back to an estimate of four bytes per token.
+func (c *Client) countPrompt(modelName, prompt string) int {
+	if tok := c.tokenizer(modelName); tok != nil {
+		return tok.CountPrompt(prompt)
+	}
+	return len(prompt) / 4
+}
+
+func (c *Client) countText(modelName, text string) int {
+	if tok := c.tokenizer(modelName); tok != nil {
+		return tok.Count(text)
+	}
+	return len(text) / 4
+}
+
+func (c *Client) usage(g *generation, completion string) types.Usage {
+	u := types.Usage{
+		PromptTokens:     c.countPrompt(g.model, g.prompt),
+		CompletionTokens: c.countText(g.model, completion),
+	}
+	u.TotalTokens = u.PromptTokens + u.CompletionTokens
+	return u
+}
+
+// contextLength resolves the context window for a model: the per-model
+// override, then the global setting, then the model's native length.
+func (c *Client) contextLength(modelName string) int {
+	if n := c.config.GetModelOptions(modelName).ContextLength; n > 0 {
+		return n
+	}
+	if c.config.ContextLength > 0 {
+		return c.config.ContextLength
+	}
+	if f, err := c.modelFile(modelName); err == nil {
+		if n := f.ModelInfo().ContextLength; n > 0 {
+			return n
+		}
+	}
+	return defaultContextLength
+}
+
+func (c *Client) GetModelMetadata(modelName string) (*types.ModelMetadata, error) {
+	path, err := c.config.GetModelPath(modelName)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := c.modelFile(modelName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read model metadata: %w", err)
+	}
+
+	info := f.ModelInfo()
+	meta := &types.ModelMetadata{
+		Architecture:   info.Architecture,
+		Name:           info.Name,
+		ParameterCount: info.ParameterCount,
+		Quantization:   info.Quantization,
+		ContextLength:  info.ContextLength,
+		BOSToken:       info.BOSToken,
+		EOSToken:       info.EOSToken,
+		ChatTemplate:   info.ChatTemplate,
+	}
+
+	if tmpl, err := c.chatTemplate(modelName); err == nil {
+		meta.Template = tmpl.Name
+	}
+	if st, err := os.Stat(path); err == nil {
+		meta.FileSize = st.Size()
+	}
+
+	return meta, nil
+}
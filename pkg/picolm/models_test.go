@@ -0,0 +1,164 @@
+package picolm
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/gguf"
+)
+
+func writeTestModel(t *testing.T, dir string, metadata map[string]any) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "model.gguf")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create model file: %v", err)
+	}
+	defer f.Close()
+
+	if err := gguf.Write(f, &gguf.File{Metadata: metadata}); err != nil {
+		t.Fatalf("failed to write model file: %v", err)
+	}
+	return path
+}
+
+func writeTestBinary(t *testing.T, dir string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, "picolm")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("failed to write binary: %v", err)
+	}
+	return path
+}
+
+func TestClient_Validate_NotGGUF(t *testing.T) {
+	dir := t.TempDir()
+	model := filepath.Join(dir, "model.bin")
+	os.WriteFile(model, []byte("not a gguf file"), 0644)
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeTestBinary(t, dir),
+		Models: map[string]string{"test": model},
+	})
+
+	err := c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "not a GGUF file") {
+		t.Errorf("Validate() error = %v, want not a GGUF file", err)
+	}
+}
+
+func TestClient_Validate_GGUF(t *testing.T) {
+	dir := t.TempDir()
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeTestBinary(t, dir),
+		Models: map[string]string{"test": writeTestModel(t, dir, map[string]any{"general.architecture": "llama"})},
+	})
+
+	if err := c.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestClient_ContextLength(t *testing.T) {
+	model := writeTestModel(t, t.TempDir(), map[string]any{
+		"general.architecture": "llama",
+		"llama.context_length": uint32(8192),
+	})
+
+	tests := []struct {
+		name string
+		cfg  config.PicoLMConfig
+		want int
+	}{
+		{
+			name: "native",
+			cfg:  config.PicoLMConfig{Models: map[string]string{"m": model}},
+			want: 8192,
+		},
+		{
+			name: "global override",
+			cfg:  config.PicoLMConfig{Models: map[string]string{"m": model}, ContextLength: 1024},
+			want: 1024,
+		},
+		{
+			name: "model override",
+			cfg: config.PicoLMConfig{
+				Models:        map[string]string{"m": model},
+				ContextLength: 1024,
+				ModelOptions:  map[string]config.ModelOptions{"m": {ContextLength: 512}},
+			},
+			want: 512,
+		},
+		{
+			name: "unreadable model",
+			cfg:  config.PicoLMConfig{Models: map[string]string{"m": "/nonexistent.gguf"}},
+			want: defaultContextLength,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(tt.cfg)
+			if got := c.contextLength("m"); got != tt.want {
+				t.Errorf("contextLength() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_GetModelMetadata(t *testing.T) {
+	model := writeTestModel(t, t.TempDir(), map[string]any{
+		"general.architecture":        "qwen2",
+		"general.file_type":           uint32(7),
+		"qwen2.context_length":        uint32(32768),
+		"tokenizer.ggml.tokens":       []string{"<|endoftext|>", "<|im_start|>", "<|im_end|>"},
+		"tokenizer.ggml.eos_token_id": uint32(2),
+		"tokenizer.chat_template":     "{% for message in messages %}<|im_start|>{{ message.role }}{% endfor %}",
+	})
+
+	c := NewClient(config.PicoLMConfig{Models: map[string]string{"qwen": model}})
+
+	meta, err := c.GetModelMetadata("qwen")
+	if err != nil {
+		t.Fatalf("GetModelMetadata() error = %v", err)
+	}
+
+	if meta.Architecture != "qwen2" || meta.ContextLength != 32768 || meta.Quantization != "Q8_0" {
+		t.Errorf("unexpected metadata: %+v", meta)
+	}
+	if meta.EOSToken != "<|im_end|>" {
+		t.Errorf("EOSToken = %q, want <|im_end|>", meta.EOSToken)
+	}
+	if meta.Template != "chatml" {
+		t.Errorf("Template = %q, want chatml (detected)", meta.Template)
+	}
+	if meta.FileSize == 0 {
+		t.Error("expected non-zero file size")
+	}
+}
+
+func TestDetectTemplate(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "",
+		"<|im_start|>user":                 "chatml",
+		"<|start_header_id|>user":          "llama3",
+		"<start_of_turn>user":              "gemma",
+		"[INST] <<SYS>>":                   "llama2",
+		"[INST] {{ content }} [/INST]":     "mistral",
+		"<|user|>\n<|end|>\n<|assistant|>": "phi",
+		"<|user|>\n</s>\n<|assistant|>":    "zephyr",
+		"{{ unknown }}":                    "",
+	}
+
+	for jinja, want := range tests {
+		if got := DetectTemplate(jinja); got != want {
+			t.Errorf("DetectTemplate(%q) = %q, want %q", jinja, got, want)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package picolm
+
+import (
+	"context"
+
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// Observer receives notifications about a request before any output is
+// produced, so handlers can surface them as response headers. OnUsage is
+// called after each picolm run, including retries, with the tokens it used.
+type Observer struct {
+	OnAdmit    func(info QueueInfo)
+	OnTruncate func(t Truncation)
+	OnUsage    func(u types.Usage)
+}
+
+type observerKey struct{}
+
+func WithObserver(ctx context.Context, o *Observer) context.Context {
+	return context.WithValue(ctx, observerKey{}, o)
+}
+
+func observerFrom(ctx context.Context) *Observer {
+	if o, ok := ctx.Value(observerKey{}).(*Observer); ok {
+		return o
+	}
+	return &Observer{}
+}
+
+func (o *Observer) admitted(info QueueInfo) {
+	if o.OnAdmit != nil {
+		o.OnAdmit(info)
+	}
+}
+
+func (o *Observer) truncated(t *Truncation) {
+	if t != nil && o.OnTruncate != nil {
+		o.OnTruncate(*t)
+	}
+}
+
+func (o *Observer) used(u types.Usage) {
+	if o.OnUsage != nil {
+		o.OnUsage(u)
+	}
+}
@@ -0,0 +1,241 @@
+package picolm
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Pool admits inference requests into a fixed number of worker slots, with
+// optional per-model limits. Requests that cannot run immediately wait in a
+// bounded FIFO queue. Low-priority requests wait in a separate, unbounded
+// queue that is only served once the main queue has nothing that can run.
+type Pool struct {
+	mu        sync.Mutex
+	total     int
+	limits    map[string]int
+	queueSize int
+
+	active     int
+	perModel   map[string]int
+	queue      []*waiter
+	background []*waiter
+
+	avgService time.Duration
+}
+
+type waiter struct {
+	model    string
+	ready    chan struct{}
+	admitted bool
+}
+
+// QueueInfo describes how a request was admitted into the pool.
+type QueueInfo struct {
+	Position int
+	Wait     time.Duration
+}
+
+type QueueFullError struct {
+	Model      string
+	Queued     int
+	Capacity   int
+	RetryAfter time.Duration
+}
+
+func (e *QueueFullError) Error() string {
+	return fmt.Sprintf("server is busy: %d requests queued (capacity %d), retry after %v", e.Queued, e.Capacity, e.RetryAfter)
+}
+
+type priorityKey struct{}
+
+// WithLowPriority marks requests made with ctx as background work, such as
+// batches. They never fill the queue and yield to every waiting request.
+func WithLowPriority(ctx context.Context) context.Context {
+	return context.WithValue(ctx, priorityKey{}, true)
+}
+
+// IsLowPriority reports whether ctx was marked with WithLowPriority.
+func IsLowPriority(ctx context.Context) bool {
+	low, _ := ctx.Value(priorityKey{}).(bool)
+	return low
+}
+
+func NewPool(total, queueSize int, limits map[string]int) *Pool {
+	if total <= 0 {
+		total = 1
+	}
+	if queueSize < 0 {
+		queueSize = 0
+	}
+	return &Pool{
+		total:     total,
+		limits:    limits,
+		queueSize: queueSize,
+		perModel:  make(map[string]int),
+	}
+}
+
+// Acquire blocks until a slot for model is free, the queue is full or ctx is
+// done. The returned release func must be called once the slot is no longer
+// needed.
+func (p *Pool) Acquire(ctx context.Context, model string) (func(), QueueInfo, error) {
+	start := time.Now()
+
+	p.mu.Lock()
+	if p.canRun(model) {
+		p.admit(model)
+		p.mu.Unlock()
+		return p.releaser(model, time.Now()), QueueInfo{}, nil
+	}
+
+	low := IsLowPriority(ctx)
+	if !low && len(p.queue) >= p.queueSize {
+		err := &QueueFullError{
+			Model:      model,
+			Queued:     len(p.queue),
+			Capacity:   p.queueSize,
+			RetryAfter: p.retryAfter(),
+		}
+		p.mu.Unlock()
+		return nil, QueueInfo{}, err
+	}
+
+	w := &waiter{model: model, ready: make(chan struct{})}
+	if low {
+		p.background = append(p.background, w)
+	} else {
+		p.queue = append(p.queue, w)
+	}
+	position := len(p.queue) + len(p.background)
+	p.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		info := QueueInfo{Position: position, Wait: time.Since(start)}
+		return p.releaser(model, time.Now()), info, nil
+	case <-ctx.Done():
+		p.mu.Lock()
+		if w.admitted {
+			p.mu.Unlock()
+			p.release(model, 0)
+			return nil, QueueInfo{}, ctx.Err()
+		}
+		p.remove(w)
+		p.mu.Unlock()
+		return nil, QueueInfo{}, ctx.Err()
+	}
+}
+
+// Stats reports the number of running and queued requests.
+func (p *Pool) Stats() (active, queued int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.active, len(p.queue) + len(p.background)
+}
+
+// Available reports how many additional requests for model could start
+// without queueing.
+func (p *Pool) Available(model string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	free := p.total - p.active
+	if limit, ok := p.limits[model]; ok && limit > 0 {
+		if n := limit - p.perModel[model]; n < free {
+			free = n
+		}
+	}
+	if free < 0 {
+		return 0
+	}
+	return free
+}
+
+func (p *Pool) canRun(model string) bool {
+	if p.active >= p.total {
+		return false
+	}
+	if limit, ok := p.limits[model]; ok && limit > 0 && p.perModel[model] >= limit {
+		return false
+	}
+	return true
+}
+
+func (p *Pool) admit(model string) {
+	p.active++
+	p.perModel[model]++
+}
+
+func (p *Pool) releaser(model string, started time.Time) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			p.release(model, time.Since(started))
+		})
+	}
+}
+
+func (p *Pool) release(model string, held time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active--
+	p.perModel[model]--
+	if p.perModel[model] <= 0 {
+		delete(p.perModel, model)
+	}
+
+	if held > 0 {
+		if p.avgService == 0 {
+			p.avgService = held
+		} else {
+			p.avgService = (p.avgService*4 + held) / 5
+		}
+	}
+
+	p.dispatch()
+}
+
+// dispatch admits queued waiters in FIFO order, skipping those whose model is
+// at its per-model limit so they do not block other models. Low-priority
+// waiters are admitted only into slots the main queue leaves free.
+func (p *Pool) dispatch() {
+	p.queue = p.dispatchQueue(p.queue)
+	p.background = p.dispatchQueue(p.background)
+}
+
+func (p *Pool) dispatchQueue(queue []*waiter) []*waiter {
+	for i := 0; i < len(queue) && p.active < p.total; {
+		w := queue[i]
+		if !p.canRun(w.model) {
+			i++
+			continue
+		}
+		p.admit(w.model)
+		w.admitted = true
+		close(w.ready)
+		queue = append(queue[:i], queue[i+1:]...)
+	}
+	return queue
+}
+
+func (p *Pool) remove(w *waiter) {
+	p.queue = slices.DeleteFunc(p.queue, func(q *waiter) bool { return q == w })
+	p.background = slices.DeleteFunc(p.background, func(q *waiter) bool { return q == w })
+}
+
+func (p *Pool) retryAfter() time.Duration {
+	avg := p.avgService
+	if avg == 0 {
+		avg = 10 * time.Second
+	}
+	rounds := (len(p.queue) + p.total) / p.total
+	d := avg * time.Duration(rounds)
+	if d < time.Second {
+		d = time.Second
+	}
+	return d.Round(time.Second)
+}
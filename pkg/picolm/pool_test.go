@@ -0,0 +1,180 @@
+package picolm
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPool_AcquireImmediate(t *testing.T) {
+	p := NewPool(2, 4, nil)
+
+	release, info, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	defer release()
+
+	if info.Position != 0 {
+		t.Errorf("Position = %d, want 0", info.Position)
+	}
+
+	active, queued := p.Stats()
+	if active != 1 || queued != 0 {
+		t.Errorf("Stats() = (%d, %d), want (1, 0)", active, queued)
+	}
+}
+
+func TestPool_QueueFIFO(t *testing.T) {
+	p := NewPool(1, 4, nil)
+
+	release, _, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	order := make(chan int, 2)
+	for i := 1; i <= 2; i++ {
+		i := i
+		go func() {
+			rel, info, err := p.Acquire(context.Background(), "a")
+			if err != nil {
+				t.Errorf("Acquire() error = %v", err)
+				return
+			}
+			if info.Position != i {
+				t.Errorf("Position = %d, want %d", info.Position, i)
+			}
+			order <- i
+			rel()
+		}()
+		waitQueued(t, p, i)
+	}
+
+	release()
+
+	if first := <-order; first != 1 {
+		t.Errorf("first admitted = %d, want 1", first)
+	}
+	if second := <-order; second != 2 {
+		t.Errorf("second admitted = %d, want 2", second)
+	}
+}
+
+func TestPool_QueueFull(t *testing.T) {
+	p := NewPool(1, 0, nil)
+
+	release, _, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	defer release()
+
+	_, _, err = p.Acquire(context.Background(), "a")
+
+	var qerr *QueueFullError
+	if !errors.As(err, &qerr) {
+		t.Fatalf("Acquire() error = %v, want QueueFullError", err)
+	}
+	if qerr.RetryAfter < time.Second {
+		t.Errorf("RetryAfter = %v, want at least 1s", qerr.RetryAfter)
+	}
+}
+
+func TestPool_PerModelLimit(t *testing.T) {
+	p := NewPool(2, 4, map[string]int{"a": 1})
+
+	release, _, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	defer release()
+
+	if n := p.Available("a"); n != 0 {
+		t.Errorf("Available(a) = %d, want 0", n)
+	}
+	if n := p.Available("b"); n != 1 {
+		t.Errorf("Available(b) = %d, want 1", n)
+	}
+
+	releaseB, info, err := p.Acquire(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("Acquire(b) error = %v", err)
+	}
+	defer releaseB()
+
+	if info.Position != 0 {
+		t.Errorf("model b should not queue behind model a, got position %d", info.Position)
+	}
+}
+
+func TestPool_CancelWhileQueued(t *testing.T) {
+	p := NewPool(1, 4, nil)
+
+	release, _, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if _, _, err := p.Acquire(ctx, "a"); err == nil {
+		t.Fatal("expected error when context expires while queued")
+	}
+
+	if _, queued := p.Stats(); queued != 0 {
+		t.Errorf("queued = %d, want 0 after cancellation", queued)
+	}
+}
+
+func TestPool_LowPriority(t *testing.T) {
+	p := NewPool(1, 1, nil)
+
+	release, _, err := p.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	order := make(chan string, 3)
+	acquire := func(ctx context.Context, name string) {
+		rel, _, err := p.Acquire(ctx, "a")
+		if err != nil {
+			t.Errorf("Acquire(%s) error = %v", name, err)
+			return
+		}
+		order <- name
+		rel()
+	}
+
+	// Low-priority requests do not take up the queue, so the interactive
+	// request still fits.
+	go acquire(WithLowPriority(context.Background()), "low-1")
+	waitQueued(t, p, 1)
+	go acquire(WithLowPriority(context.Background()), "low-2")
+	waitQueued(t, p, 2)
+	go acquire(context.Background(), "interactive")
+	waitQueued(t, p, 3)
+
+	release()
+
+	for _, want := range []string{"interactive", "low-1", "low-2"} {
+		if got := <-order; got != want {
+			t.Errorf("admitted %s, want %s", got, want)
+		}
+	}
+}
+
+func waitQueued(t *testing.T, p *Pool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, queued := p.Stats(); queued >= n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d queued requests", n)
+}
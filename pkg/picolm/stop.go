@@ -0,0 +1,93 @@
+package picolm
+
+import "strings"
+
+// stopMatcher scans generated text for stop sequences. Text that might be the
+// start of a stop sequence is held back until it can be ruled out, so a
+// partial match is never emitted.
+type stopMatcher struct {
+	stops   []string
+	pending string
+	stopped bool
+	matched string
+}
+
+func newStopMatcher(stopLists ...[]string) *stopMatcher {
+	m := &stopMatcher{}
+	for _, list := range stopLists {
+		for _, s := range list {
+			if s != "" {
+				m.stops = append(m.stops, s)
+			}
+		}
+	}
+	return m
+}
+
+// Write adds text to the matcher and returns the part that is safe to emit.
+// hit reports that a stop sequence was found; emit then holds the text before
+// it and all further input is discarded.
+func (m *stopMatcher) Write(text string) (emit string, hit bool) {
+	if m.stopped {
+		return "", true
+	}
+
+	buf := m.pending + text
+
+	if idx, stop := m.index(buf); idx >= 0 {
+		m.pending = ""
+		m.stopped = true
+		m.matched = stop
+		return buf[:idx], true
+	}
+
+	hold := m.partialSuffix(buf)
+	m.pending = buf[len(buf)-hold:]
+	return buf[:len(buf)-hold], false
+}
+
+// Flush returns any text still held back once the output has ended.
+func (m *stopMatcher) Flush() string {
+	if m.stopped {
+		return ""
+	}
+	rem := m.pending
+	m.pending = ""
+	return rem
+}
+
+// Matched returns the stop sequence that was hit, or "" if none was.
+func (m *stopMatcher) Matched() string {
+	return m.matched
+}
+
+// index returns the position of the earliest stop sequence in s and the
+// sequence found there, or -1.
+func (m *stopMatcher) index(s string) (int, string) {
+	minIdx, matched := -1, ""
+	for _, stop := range m.stops {
+		if idx := strings.Index(s, stop); idx != -1 && (minIdx == -1 || idx < minIdx) {
+			minIdx, matched = idx, stop
+		}
+	}
+	return minIdx, matched
+}
+
+// partialSuffix returns the length of the longest suffix of s that is a
+// proper prefix of a stop sequence.
+func (m *stopMatcher) partialSuffix(s string) int {
+	longest := 0
+	for _, stop := range m.stops {
+		n := len(stop) - 1
+		if n > len(s) {
+			n = len(s)
+		}
+		for k := n; k > longest; k-- {
+			if strings.HasSuffix(s, stop[:k]) {
+				longest = k
+				break
+			}
+		}
+	}
+	return longest
+}
@@ -0,0 +1,93 @@
+package picolm
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStopMatcher(t *testing.T) {
+	tests := []struct {
+		name     string
+		stops    []string
+		chunks   []string
+		want     string
+		wantStop bool
+	}{
+		{
+			name:   "no stops",
+			chunks: []string{"Hello ", "world"},
+			want:   "Hello world",
+		},
+		{
+			name:     "stop within chunk",
+			stops:    []string{"Observation:"},
+			chunks:   []string{"Thought: look it up\nObservation: done"},
+			want:     "Thought: look it up\n",
+			wantStop: true,
+		},
+		{
+			name:     "stop across chunks",
+			stops:    []string{"Observation:"},
+			chunks:   []string{"Action: search\nObser", "vation: result"},
+			want:     "Action: search\n",
+			wantStop: true,
+		},
+		{
+			name:   "partial match released",
+			stops:  []string{"Observation:"},
+			chunks: []string{"Obser", "ved it"},
+			want:   "Observed it",
+		},
+		{
+			name:   "partial match at end of output",
+			stops:  []string{"</s>"},
+			chunks: []string{"done </"},
+			want:   "done </",
+		},
+		{
+			name:     "earliest stop wins",
+			stops:    []string{"END", "</s>"},
+			chunks:   []string{"a</s>b END"},
+			want:     "a",
+			wantStop: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newStopMatcher(tt.stops)
+			var sb strings.Builder
+			stopped := false
+			for _, chunk := range tt.chunks {
+				text, hit := m.Write(chunk)
+				if strings.Contains(text, "Obser") && !strings.Contains(tt.want, "Obser") {
+					t.Errorf("emitted partial stop sequence %q", text)
+				}
+				sb.WriteString(text)
+				if hit {
+					stopped = true
+					break
+				}
+			}
+			sb.WriteString(m.Flush())
+
+			if sb.String() != tt.want {
+				t.Errorf("output = %q, want %q", sb.String(), tt.want)
+			}
+			if stopped != tt.wantStop {
+				t.Errorf("stopped = %v, want %v", stopped, tt.wantStop)
+			}
+		})
+	}
+}
+
+func TestStopMatcher_HoldsBackPartialMatch(t *testing.T) {
+	m := newStopMatcher([]string{"Observation:"})
+
+	if text, _ := m.Write("Answer\nObs"); text != "Answer\n" {
+		t.Errorf("Write() = %q, want %q", text, "Answer\n")
+	}
+	if text, hit := m.Write("ervation:"); text != "" || !hit {
+		t.Errorf("Write() = (%q, %v), want (\"\", true)", text, hit)
+	}
+}
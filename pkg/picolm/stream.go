@@ -0,0 +1,77 @@
+package picolm
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// streamDecoder turns raw picolm output into text that is safe to forward.
+// It never splits a multibyte rune, holds back text that may be the start of
+// a stop sequence, and buffers output until the caller flushes it.
+type streamDecoder struct {
+	matcher *stopMatcher
+	partial []byte
+	pending strings.Builder
+}
+
+func newStreamDecoder(stops []string) *streamDecoder {
+	return &streamDecoder{matcher: newStopMatcher(stops)}
+}
+
+// Write decodes p and reports whether a stop sequence was hit. Once it has
+// been, further input is ignored.
+func (d *streamDecoder) Write(p []byte) bool {
+	buf := append(d.partial, p...)
+	n := completeRunes(buf)
+	d.partial = append([]byte(nil), buf[n:]...)
+
+	text, hit := d.matcher.Write(string(buf[:n]))
+	d.pending.WriteString(text)
+	return hit
+}
+
+// Close releases everything still held back once the output has ended.
+func (d *streamDecoder) Close() {
+	if len(d.partial) > 0 {
+		text, hit := d.matcher.Write(string(d.partial))
+		d.partial = nil
+		d.pending.WriteString(text)
+		if hit {
+			return
+		}
+	}
+	d.pending.WriteString(d.matcher.Flush())
+}
+
+// Matched returns the stop sequence that ended the output, if any.
+func (d *streamDecoder) Matched() string {
+	return d.matcher.Matched()
+}
+
+// Buffered returns the number of bytes ready to be taken.
+func (d *streamDecoder) Buffered() int {
+	return d.pending.Len()
+}
+
+// Take returns and clears the text ready to be forwarded.
+func (d *streamDecoder) Take() string {
+	text := d.pending.String()
+	d.pending.Reset()
+	return text
+}
+
+// completeRunes returns the length of the longest prefix of b that does not
+// end in an incomplete UTF-8 sequence. Invalid bytes are passed through.
+func completeRunes(b []byte) int {
+	// A rune is at most utf8.UTFMax bytes, so only the tail needs checking.
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if !utf8.FullRune(b[i:]) {
+			return i
+		}
+		break
+	}
+	return len(b)
+}
@@ -0,0 +1,131 @@
+package picolm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestStreamDecoder_SplitRune(t *testing.T) {
+	d := newStreamDecoder(nil)
+
+	euro := []byte("€") // 3 bytes
+	d.Write([]byte{'a', euro[0]})
+	if got := d.Take(); got != "a" {
+		t.Errorf("Take() = %q, want %q", got, "a")
+	}
+
+	d.Write(euro[1:])
+	if got := d.Take(); got != "€" {
+		t.Errorf("Take() = %q, want %q", got, "€")
+	}
+}
+
+func TestStreamDecoder_StopTokenAcrossChunks(t *testing.T) {
+	d := newStreamDecoder([]string{"<|im_end|>"})
+
+	if d.Write([]byte("Done.<|im_")) {
+		t.Fatal("unexpected stop on partial token")
+	}
+	if got := d.Take(); got != "Done." {
+		t.Errorf("Take() = %q, want %q", got, "Done.")
+	}
+	if !d.Write([]byte("end|>\nextra")) {
+		t.Fatal("expected stop token to be detected across chunks")
+	}
+	if got := d.Take(); got != "" {
+		t.Errorf("Take() = %q, want empty", got)
+	}
+}
+
+func TestStreamDecoder_CloseFlushesHeldText(t *testing.T) {
+	d := newStreamDecoder([]string{"</s>"})
+
+	d.Write([]byte("x </"))
+	d.Close()
+	if got := d.Take(); got != "x </" {
+		t.Errorf("Take() = %q, want %q", got, "x </")
+	}
+}
+
+func TestCompleteRunes(t *testing.T) {
+	emoji := []byte("😀")
+	tests := []struct {
+		in   []byte
+		want int
+	}{
+		{[]byte("abc"), 3},
+		{append([]byte("a"), emoji[:2]...), 1},
+		{append([]byte("a"), emoji...), 5},
+		{[]byte{0xff, 'a'}, 2},
+	}
+	for _, tt := range tests {
+		if got := completeRunes(tt.in); got != tt.want {
+			t.Errorf("completeRunes(%v) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestClient_StreamChat_PreservesWhitespace(t *testing.T) {
+	want := "```go\nfunc main() {\n\tfmt.Println(\"héllo 😀\")\n}\n```\n\n- item  one"
+	cfg := config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, "printf '%s' '"+want+"'"),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	}
+
+	c := NewClient(cfg)
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Code please")}},
+	}
+
+	var sb strings.Builder
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+		sb.WriteString(chunk.Content)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChat() error = %v", err)
+	}
+
+	if sb.String() != want {
+		t.Errorf("streamed output = %q, want %q", sb.String(), want)
+	}
+}
+
+func TestClient_StreamChat_FlushBytes(t *testing.T) {
+	cfg := config.PicoLMConfig{
+		Binary:           writeFakePicoLM(t, `for w in one two three four; do printf '%s ' "$w"; sleep 0.01; done`),
+		Models:           map[string]string{"test": "/path/to/model.gguf"},
+		StreamFlushBytes: 8,
+	}
+
+	c := NewClient(cfg)
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Count")}},
+	}
+
+	var chunks []string
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+		if chunk.Content != "" {
+			chunks = append(chunks, chunk.Content)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChat() error = %v", err)
+	}
+
+	if got := strings.Join(chunks, ""); got != "one two three four " {
+		t.Errorf("streamed output = %q", got)
+	}
+	for _, chunk := range chunks[:len(chunks)-1] {
+		if len(chunk) < 8 {
+			t.Errorf("chunk %q smaller than flush threshold", chunk)
+		}
+	}
+}
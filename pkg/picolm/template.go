@@ -0,0 +1,173 @@
+package picolm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// RoleFormat wraps the content of a single turn.
+type RoleFormat struct {
+	Prefix string
+	Suffix string
+}
+
+func (r RoleFormat) wrap(content string) string {
+	return r.Prefix + content + r.Suffix
+}
+
+// ChatTemplate describes how a model family expects a conversation to be
+// rendered, and which tokens mark the end of its reply.
+type ChatTemplate struct {
+	Name      string
+	Begin     string
+	System    RoleFormat
+	User      RoleFormat
+	Assistant RoleFormat
+
+	// Tool wraps tool results for families with a native tool role. Other
+	// families receive tool results as a user turn.
+	Tool RoleFormat
+
+	// SystemInUser is used by families without a system role: the system
+	// prompt is rendered with this format and prepended to the first user turn.
+	SystemInUser string
+
+	// Generation opens the assistant turn the model is asked to complete.
+	Generation string
+
+	// NoDefaultSystem disables the default system prompt when the request
+	// does not provide one.
+	NoDefaultSystem bool
+
+	StopTokens []string
+}
+
+const DefaultTemplate = "zephyr"
+
+var templates = map[string]*ChatTemplate{
+	"zephyr": {
+		Name:      "zephyr",
+		System:    RoleFormat{"<|system|>\n", "</s>\n"},
+		User:      RoleFormat{"<|user|>\n", "</s>\n"},
+		Assistant: RoleFormat{"<|assistant|>\n", "</s>\n"},
+		// No newline after assistant - matches working format
+		Generation: "<|assistant|>",
+		StopTokens: []string{"<|user|>", "<|assistant|>", "</s>", "<|system|>", "<|end|>"},
+	},
+	"chatml": {
+		Name:       "chatml",
+		System:     RoleFormat{"<|im_start|>system\n", "<|im_end|>\n"},
+		User:       RoleFormat{"<|im_start|>user\n", "<|im_end|>\n"},
+		Assistant:  RoleFormat{"<|im_start|>assistant\n", "<|im_end|>\n"},
+		Tool:       RoleFormat{"<|im_start|>tool\n", "<|im_end|>\n"},
+		Generation: "<|im_start|>assistant\n",
+		StopTokens: []string{"<|im_end|>", "<|im_start|>", "<|endoftext|>"},
+	},
+	"llama2": {
+		Name:         "llama2",
+		User:         RoleFormat{"<s>[INST] ", " [/INST]"},
+		Assistant:    RoleFormat{" ", " </s>"},
+		SystemInUser: "<<SYS>>\n%s\n<</SYS>>\n\n",
+		StopTokens:   []string{"</s>", "[INST]"},
+	},
+	"llama3": {
+		Name:       "llama3",
+		Begin:      "<|begin_of_text|>",
+		System:     RoleFormat{"<|start_header_id|>system<|end_header_id|>\n\n", "<|eot_id|>"},
+		User:       RoleFormat{"<|start_header_id|>user<|end_header_id|>\n\n", "<|eot_id|>"},
+		Assistant:  RoleFormat{"<|start_header_id|>assistant<|end_header_id|>\n\n", "<|eot_id|>"},
+		Tool:       RoleFormat{"<|start_header_id|>ipython<|end_header_id|>\n\n", "<|eot_id|>"},
+		Generation: "<|start_header_id|>assistant<|end_header_id|>\n\n",
+		StopTokens: []string{"<|eot_id|>", "<|end_of_text|>", "<|start_header_id|>"},
+	},
+	"mistral": {
+		Name:         "mistral",
+		Begin:        "<s>",
+		User:         RoleFormat{"[INST] ", " [/INST]"},
+		Assistant:    RoleFormat{"", "</s>"},
+		Tool:         RoleFormat{"[TOOL_RESULTS] ", "[/TOOL_RESULTS]"},
+		SystemInUser: "%s\n\n",
+		StopTokens:   []string{"</s>", "[INST]"},
+	},
+	"phi": {
+		Name:       "phi",
+		System:     RoleFormat{"<|system|>\n", "<|end|>\n"},
+		User:       RoleFormat{"<|user|>\n", "<|end|>\n"},
+		Assistant:  RoleFormat{"<|assistant|>\n", "<|end|>\n"},
+		Generation: "<|assistant|>\n",
+		StopTokens: []string{"<|end|>", "<|endoftext|>", "<|user|>", "<|assistant|>"},
+	},
+	"gemma": {
+		Name:         "gemma",
+		Begin:        "<bos>",
+		User:         RoleFormat{"<start_of_turn>user\n", "<end_of_turn>\n"},
+		Assistant:    RoleFormat{"<start_of_turn>model\n", "<end_of_turn>\n"},
+		SystemInUser: "%s\n\n",
+		Generation:   "<start_of_turn>model\n",
+		StopTokens:   []string{"<end_of_turn>", "<start_of_turn>", "<eos>"},
+	},
+	"raw": {
+		Name:            "raw",
+		System:          RoleFormat{"", "\n\n"},
+		User:            RoleFormat{"", "\n\n"},
+		Assistant:       RoleFormat{"", "\n\n"},
+		NoDefaultSystem: true,
+	},
+}
+
+func GetTemplate(name string) (*ChatTemplate, error) {
+	if name == "" {
+		name = DefaultTemplate
+	}
+	t, ok := templates[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown chat template %q (available: %s)", name, strings.Join(TemplateNames(), ", "))
+	}
+	return t, nil
+}
+
+func TemplateNames() []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DetectTemplate guesses the registry template matching a model's embedded
+// Jinja chat template. It returns "" when nothing matches.
+func DetectTemplate(jinja string) string {
+	switch {
+	case jinja == "":
+		return ""
+	case strings.Contains(jinja, "<|im_start|>"):
+		return "chatml"
+	case strings.Contains(jinja, "<|start_header_id|>"):
+		return "llama3"
+	case strings.Contains(jinja, "<start_of_turn>"):
+		return "gemma"
+	case strings.Contains(jinja, "<<SYS>>"):
+		return "llama2"
+	case strings.Contains(jinja, "[INST]"):
+		return "mistral"
+	case strings.Contains(jinja, "<|end|>") && strings.Contains(jinja, "<|assistant|>"):
+		return "phi"
+	case strings.Contains(jinja, "<|assistant|>"):
+		return "zephyr"
+	}
+	return ""
+}
+
+// hasSystemRole reports whether the template renders the system prompt as its
+// own turn.
+func (t *ChatTemplate) hasSystemRole() bool {
+	return t.SystemInUser == ""
+}
+
+// hasToolRole reports whether the template renders tool results as their own
+// turn.
+func (t *ChatTemplate) hasToolRole() bool {
+	return t.Tool.Prefix != ""
+}
@@ -0,0 +1,214 @@
+package picolm
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestGetTemplate(t *testing.T) {
+	for _, name := range []string{"", "zephyr", "chatml", "llama2", "llama3", "mistral", "phi", "gemma", "raw", "ChatML"} {
+		if _, err := GetTemplate(name); err != nil {
+			t.Errorf("GetTemplate(%q) error = %v", name, err)
+		}
+	}
+
+	if _, err := GetTemplate("unknown"); err == nil {
+		t.Error("expected error for unknown template")
+	}
+}
+
+func TestBuildPrompt_Templates(t *testing.T) {
+	messages := []types.ChatMessage{
+		{Role: "system", Content: types.TextContent("Be brief.")},
+		{Role: "user", Content: types.TextContent("Hi")},
+		{Role: "assistant", Content: types.TextContent("Hello")},
+		{Role: "user", Content: types.TextContent("Bye")},
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{
+			template: "zephyr",
+			want:     "<|system|>\nBe brief.</s>\n<|user|>\nHi</s>\n<|assistant|>\nHello</s>\n<|user|>\nBye</s>\n<|assistant|>",
+		},
+		{
+			template: "chatml",
+			want:     "<|im_start|>system\nBe brief.<|im_end|>\n<|im_start|>user\nHi<|im_end|>\n<|im_start|>assistant\nHello<|im_end|>\n<|im_start|>user\nBye<|im_end|>\n<|im_start|>assistant\n",
+		},
+		{
+			template: "llama2",
+			want:     "<s>[INST] <<SYS>>\nBe brief.\n<</SYS>>\n\nHi [/INST] Hello </s><s>[INST] Bye [/INST]",
+		},
+		{
+			template: "llama3",
+			want:     "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nHi<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\nHello<|eot_id|><|start_header_id|>user<|end_header_id|>\n\nBye<|eot_id|><|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+		{
+			template: "mistral",
+			want:     "<s>[INST] Be brief.\n\nHi [/INST]Hello</s>[INST] Bye [/INST]",
+		},
+		{
+			template: "gemma",
+			want:     "<bos><start_of_turn>user\nBe brief.\n\nHi<end_of_turn>\n<start_of_turn>model\nHello<end_of_turn>\n<start_of_turn>user\nBye<end_of_turn>\n<start_of_turn>model\n",
+		},
+		{
+			template: "raw",
+			want:     "Be brief.\n\nHi\n\nHello\n\nBye\n\n",
+		},
+	}
+
+	c := NewClient(config.PicoLMConfig{})
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, err := GetTemplate(tt.template)
+			if err != nil {
+				t.Fatalf("GetTemplate() error = %v", err)
+			}
+			got := c.buildPrompt(tmpl, messages, nil)
+			if got != tt.want {
+				t.Errorf("buildPrompt() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildPrompt_DefaultSystemPrompt(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+	messages := []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}}
+
+	zephyr, _ := GetTemplate("zephyr")
+	if got := c.buildPrompt(zephyr, messages, nil); got != "<|system|>\n"+defaultSystemPrompt+"</s>\n<|user|>\nHi</s>\n<|assistant|>" {
+		t.Errorf("unexpected zephyr prompt: %q", got)
+	}
+
+	raw, _ := GetTemplate("raw")
+	if got := c.buildPrompt(raw, messages, nil); got != "Hi\n\n" {
+		t.Errorf("raw template should not add a default system prompt, got %q", got)
+	}
+}
+
+func TestCleanResponse_TemplateStopTokens(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+
+	chatml, _ := GetTemplate("chatml")
+	if got := c.cleanResponse("Hello there<|im_end|>\n<|im_start|>user", chatml.StopTokens); got != "Hello there" {
+		t.Errorf("cleanResponse() = %q, want %q", got, "Hello there")
+	}
+
+	llama3, _ := GetTemplate("llama3")
+	if got := c.cleanResponse("Sure.<|eot_id|>", llama3.StopTokens); got != "Sure." {
+		t.Errorf("cleanResponse() = %q, want %q", got, "Sure.")
+	}
+}
+
+func TestClient_ChatTemplate(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Models: map[string]string{"a": "/a.gguf", "b": "/b.gguf"},
+		ModelOptions: map[string]config.ModelOptions{
+			"a": {Template: "llama3"},
+		},
+	})
+
+	if tmpl, _ := c.chatTemplate("a"); tmpl.Name != "llama3" {
+		t.Errorf("chatTemplate(a) = %q, want llama3", tmpl.Name)
+	}
+	if tmpl, _ := c.chatTemplate("b"); tmpl.Name != DefaultTemplate {
+		t.Errorf("chatTemplate(b) = %q, want %s", tmpl.Name, DefaultTemplate)
+	}
+}
+
+func TestBuildPrompt_ContentParts(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+	chatml, _ := GetTemplate("chatml")
+
+	messages := []types.ChatMessage{
+		{Role: "user", Content: types.MessageContent{Parts: []types.ContentPart{
+			{Type: "text", Text: "Summarise this:"},
+			{Type: "text", Text: "Go is fun."},
+		}}},
+	}
+
+	want := "<|im_start|>system\n" + defaultSystemPrompt + "<|im_end|>\n<|im_start|>user\nSummarise this:\nGo is fun.<|im_end|>\n<|im_start|>assistant\n"
+	if got := c.buildPrompt(chatml, messages, nil); got != want {
+		t.Errorf("buildPrompt() = %q, want %q", got, want)
+	}
+}
+
+func TestBuildPrompt_ToolHistory(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+	messages := []types.ChatMessage{
+		{Role: "system", Content: types.TextContent("Be brief.")},
+		{Role: "user", Content: types.TextContent("Weather in Nairobi?")},
+		{Role: "assistant", ToolCalls: []types.ToolCall{{
+			ID:       "call_1",
+			Type:     "function",
+			Function: types.CallFunction{Name: "get_weather", Arguments: `{"city":"Nairobi"}`},
+		}}},
+		{Role: "tool", ToolCallID: "call_1", Content: types.TextContent("24°C & sunny")},
+	}
+
+	tests := []struct {
+		template string
+		want     string
+	}{
+		{
+			template: "chatml",
+			want: "<|im_start|>system\nBe brief.<|im_end|>\n" +
+				"<|im_start|>user\nWeather in Nairobi?<|im_end|>\n" +
+				`<|im_start|>assistant` + "\n" + `{"tool_calls":[{"type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}<|im_end|>` + "\n" +
+				`<|im_start|>tool` + "\n" + `{"name":"get_weather","content":"24°C & sunny"}<|im_end|>` + "\n" +
+				"<|im_start|>assistant\n",
+		},
+		{
+			template: "zephyr",
+			want: "<|system|>\nBe brief.</s>\n" +
+				"<|user|>\nWeather in Nairobi?</s>\n" +
+				`<|assistant|>` + "\n" + `{"tool_calls":[{"type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}</s>` + "\n" +
+				"<|user|>\n[Tool Result for get_weather (call_1)]: 24°C & sunny</s>\n" +
+				"<|assistant|>",
+		},
+		{
+			template: "llama3",
+			want: "<|begin_of_text|><|start_header_id|>system<|end_header_id|>\n\nBe brief.<|eot_id|>" +
+				"<|start_header_id|>user<|end_header_id|>\n\nWeather in Nairobi?<|eot_id|>" +
+				`<|start_header_id|>assistant<|end_header_id|>` + "\n\n" + `{"tool_calls":[{"type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}<|eot_id|>` +
+				`<|start_header_id|>ipython<|end_header_id|>` + "\n\n" + `{"name":"get_weather","content":"24°C & sunny"}<|eot_id|>` +
+				"<|start_header_id|>assistant<|end_header_id|>\n\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			tmpl, _ := GetTemplate(tt.template)
+			if got := c.buildPrompt(tmpl, messages, nil); got != tt.want {
+				t.Errorf("buildPrompt() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildPrompt_ToolResultWithoutCall(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+	zephyr, _ := GetTemplate("zephyr")
+
+	messages := []types.ChatMessage{
+		{Role: "user", Content: types.TextContent("Hi")},
+		{Role: "assistant", Content: types.TextContent("Checking."), ToolCalls: []types.ToolCall{{
+			ID: "call_1", Type: "function", Function: types.CallFunction{Name: "get_time", Arguments: "{}"},
+		}}},
+		{Role: "tool", ToolCallID: "call_2", Content: types.TextContent("noon")},
+	}
+
+	got := c.buildPrompt(zephyr, messages, nil)
+	if !strings.Contains(got, "<|assistant|>\nChecking.\n{\"tool_calls\":[{\"type\":\"function\",\"function\":{\"name\":\"get_time\",\"arguments\":\"{}\"}}]}</s>") {
+		t.Errorf("assistant content and tool calls not rendered together:\n%q", got)
+	}
+	if !strings.Contains(got, "[Tool Result for call_2]: noon") {
+		t.Errorf("unmatched tool result should fall back to its ID:\n%q", got)
+	}
+}
@@ -0,0 +1,284 @@
+package picolm
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wmik/picolm-server/pkg/jsonschema"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// ToolCallError describes tool calls that do not match the tools offered in
+// the request. Its message is fed back to the model when re-prompting.
+type ToolCallError struct {
+	Problems []string
+}
+
+func (e *ToolCallError) Error() string {
+	return "invalid tool call: " + strings.Join(e.Problems, "; ")
+}
+
+// ToolChoiceError is returned when tool_choice requires a tool call and the
+// model did not produce a valid one within the allowed retries.
+type ToolChoiceError struct {
+	Mode     string
+	Attempts int
+	Err      error
+}
+
+func (e *ToolChoiceError) Error() string {
+	return fmt.Sprintf("model output did not satisfy tool_choice %s after %d attempts: %v", e.Mode, e.Attempts, e.Err)
+}
+
+func (e *ToolChoiceError) Unwrap() error {
+	return e.Err
+}
+
+type toolCallObject struct {
+	ToolCalls []rawToolCall `json:"tool_calls"`
+	Content   string        `json:"content"`
+}
+
+type rawToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	} `json:"function"`
+	// Some models put the function fields at the top level.
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+var fencedBlock = regexp.MustCompile("(?s)```[a-zA-Z]*[ \t]*\r?\n?(.*?)```")
+
+// parseToolCalls finds a tool call object in model output: the whole output,
+// a fenced code block, or a JSON object embedded in prose. It returns the
+// calls and any surrounding text. When tools are given, each call is checked
+// against them and a *ToolCallError describes any mismatch.
+func parseToolCalls(output string, tools []types.ToolDefinition) ([]types.ToolCall, string, error) {
+	obj, rest, ok := findToolCallObject(output)
+	if !ok {
+		return nil, output, nil
+	}
+
+	content := strings.TrimSpace(rest)
+	if obj.Content != "" {
+		content = obj.Content
+	}
+
+	calls := make([]types.ToolCall, 0, len(obj.ToolCalls))
+	var problems []string
+	seen := make(map[string]bool)
+
+	for i, raw := range obj.ToolCalls {
+		name, args := raw.Function.Name, raw.Function.Arguments
+		if name == "" {
+			name, args = raw.Name, raw.Arguments
+		}
+
+		arguments, err := normalizeArguments(args)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("tool call %d (%s): %v", i, name, err))
+		}
+
+		id := raw.ID
+		if id == "" || seen[id] {
+			id = newToolCallID()
+		}
+		seen[id] = true
+
+		calls = append(calls, types.ToolCall{
+			ID:   id,
+			Type: "function",
+			Function: types.CallFunction{
+				Name:      name,
+				Arguments: arguments,
+			},
+		})
+	}
+
+	if len(tools) > 0 {
+		problems = append(problems, checkToolCalls(calls, tools)...)
+	}
+	if len(problems) > 0 {
+		return calls, content, &ToolCallError{Problems: problems}
+	}
+	return calls, content, nil
+}
+
+// findToolCallObject returns the first candidate in text that decodes to an
+// object with a non-empty tool_calls list, together with the text around it.
+func findToolCallObject(text string) (toolCallObject, string, bool) {
+	try := func(candidate string) (toolCallObject, bool) {
+		var obj toolCallObject
+		if err := json.Unmarshal([]byte(candidate), &obj); err != nil || len(obj.ToolCalls) == 0 {
+			return obj, false
+		}
+		return obj, true
+	}
+
+	if obj, ok := try(strings.TrimSpace(text)); ok {
+		return obj, "", true
+	}
+
+	for _, m := range fencedBlock.FindAllStringSubmatchIndex(text, -1) {
+		if obj, ok := try(strings.TrimSpace(text[m[2]:m[3]])); ok {
+			return obj, text[:m[0]] + text[m[1]:], true
+		}
+	}
+
+	for i := 0; i < len(text); i++ {
+		if text[i] != '{' {
+			continue
+		}
+		dec := json.NewDecoder(strings.NewReader(text[i:]))
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			continue
+		}
+		if obj, ok := try(string(raw)); ok {
+			end := i + int(dec.InputOffset())
+			return obj, text[:i] + text[end:], true
+		}
+	}
+
+	return toolCallObject{}, "", false
+}
+
+// normalizeArguments returns arguments as a JSON-encoded string, accepting
+// both the string form and a plain object.
+func normalizeArguments(raw json.RawMessage) (string, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return "{}", nil
+	}
+
+	if raw[0] == '"' {
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+		return s, nil
+	}
+
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, raw); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// checkToolCalls validates each call's function name and arguments against
+// the tools offered in the request.
+func checkToolCalls(calls []types.ToolCall, tools []types.ToolDefinition) []string {
+	defs := make(map[string]types.FunctionDef)
+	var names []string
+	for _, tool := range tools {
+		if tool.Type == "function" {
+			defs[tool.Function.Name] = tool.Function
+			names = append(names, tool.Function.Name)
+		}
+	}
+
+	var problems []string
+	for i, call := range calls {
+		def, ok := defs[call.Function.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("tool call %d: unknown function %q, available functions are: %s",
+				i, call.Function.Name, strings.Join(names, ", ")))
+			continue
+		}
+
+		var args any
+		if err := json.Unmarshal([]byte(call.Function.Arguments), &args); err != nil {
+			problems = append(problems, fmt.Sprintf("tool call %d (%s): arguments are not valid JSON: %v", i, def.Name, err))
+			continue
+		}
+		if _, ok := args.(map[string]any); !ok {
+			problems = append(problems, fmt.Sprintf("tool call %d (%s): arguments must be a JSON object", i, def.Name))
+			continue
+		}
+		if err := jsonschema.Validate(def.Parameters, args); err != nil {
+			problems = append(problems, fmt.Sprintf("tool call %d (%s): arguments do not match the schema: %v", i, def.Name, err))
+		}
+	}
+	return problems
+}
+
+// resolveToolCalls parses tool calls from output and, while they fail
+// validation, re-prompts the model with the error up to ToolCallRetries
+// times. Tokens used by retries are added to usage. When no valid tool call
+// is produced the final output is returned as plain content, unless
+// tool_choice requires a call, which fails with a *ToolChoiceError.
+func (c *Client) resolveToolCalls(ctx context.Context, req *types.ChatCompletionRequest, output string, usage *types.Usage) ([]types.ToolCall, string, error) {
+	choice, _ := resolveToolChoice(req)
+	tools := choice.tools(req.Tools)
+
+	parse := func(output string) ([]types.ToolCall, string, error) {
+		calls, content, err := parseToolCalls(output, tools)
+		if err == nil && len(calls) == 0 && choice.forced() {
+			err = &ToolCallError{Problems: []string{"tool_choice requires a tool call but the response did not contain one"}}
+		}
+		return calls, content, err
+	}
+
+	// A forced tool call is always retried at least once.
+	retries := c.config.ToolCallRetries
+	if choice.forced() {
+		retries = max(retries, 1)
+	}
+
+	calls, content, verr := parse(output)
+	attempts := 1
+	for verr != nil && attempts <= retries {
+		retried, err := c.regenerate(ctx, req, output, repairPrompt(verr), usage)
+		if errors.As(err, new(*ContextLengthError)) {
+			break
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		attempts++
+		output = retried
+		calls, content, verr = parse(output)
+	}
+
+	if verr != nil && choice.forced() {
+		return nil, "", &ToolChoiceError{Mode: choice.Mode, Attempts: attempts, Err: verr}
+	}
+	if verr != nil {
+		return nil, output, nil
+	}
+	return limitToolCalls(req, calls), content, nil
+}
+
+// limitToolCalls keeps only the first call when req disables parallel tool
+// calls.
+func limitToolCalls(req *types.ChatCompletionRequest, calls []types.ToolCall) []types.ToolCall {
+	if len(calls) > 1 && !parallelToolCalls(req) {
+		return calls[:1]
+	}
+	return calls
+}
+
+func repairPrompt(err error) string {
+	return fmt.Sprintf("Your previous response contained an %v\n\n"+
+		"Respond again with ONLY a corrected JSON object of the form "+
+		`{"tool_calls":[{"type":"function","function":{"name":"tool_name","arguments":"{...}"}}]}`+
+		", using one of the available functions and arguments that match its parameters.", err)
+}
+
+func newToolCallID() string {
+	b := make([]byte, 12)
+	rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
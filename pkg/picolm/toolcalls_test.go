@@ -0,0 +1,179 @@
+package picolm
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+var weatherTool = types.ToolDefinition{
+	Type: "function",
+	Function: types.FunctionDef{
+		Name: "get_weather",
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"city": map[string]interface{}{"type": "string"},
+			},
+			"required": []interface{}{"city"},
+		},
+	},
+}
+
+func TestParseToolCalls(t *testing.T) {
+	tests := []struct {
+		name        string
+		output      string
+		wantArgs    string
+		wantContent string
+		wantErr     string
+	}{
+		{
+			name:     "strict JSON",
+			output:   `{"tool_calls":[{"id":"call_1","type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}`,
+			wantArgs: `{"city":"Nairobi"}`,
+		},
+		{
+			name:        "fenced code block",
+			output:      "Let me check.\n```json\n{\"tool_calls\":[{\"function\":{\"name\":\"get_weather\",\"arguments\":\"{\\\"city\\\":\\\"Nairobi\\\"}\"}}]}\n```",
+			wantArgs:    `{"city":"Nairobi"}`,
+			wantContent: "Let me check.",
+		},
+		{
+			name:        "mixed prose",
+			output:      `Sure! {"tool_calls":[{"function":{"name":"get_weather","arguments":{"city":"Nairobi"}}}]} Done.`,
+			wantArgs:    `{"city":"Nairobi"}`,
+			wantContent: "Sure!  Done.",
+		},
+		{
+			name:     "object arguments at top level",
+			output:   `{"tool_calls":[{"name":"get_weather","arguments":{ "city" : "Nairobi" }}]}`,
+			wantArgs: `{"city":"Nairobi"}`,
+		},
+		{
+			name:    "unknown function",
+			output:  `{"tool_calls":[{"function":{"name":"get_time","arguments":"{}"}}]}`,
+			wantErr: `unknown function "get_time"`,
+		},
+		{
+			name:    "schema violation",
+			output:  `{"tool_calls":[{"function":{"name":"get_weather","arguments":"{\"city\":42}"}}]}`,
+			wantErr: "/city: expected string",
+		},
+		{
+			name:    "arguments not JSON",
+			output:  `{"tool_calls":[{"function":{"name":"get_weather","arguments":"city=Nairobi"}}]}`,
+			wantErr: "arguments are not valid JSON",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls, content, err := parseToolCalls(tt.output, []types.ToolDefinition{weatherTool})
+			if tt.wantErr != "" {
+				var terr *ToolCallError
+				if !errors.As(err, &terr) || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseToolCalls() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseToolCalls() error = %v", err)
+			}
+			if len(calls) != 1 {
+				t.Fatalf("got %d tool calls, want 1", len(calls))
+			}
+			if calls[0].Function.Arguments != tt.wantArgs {
+				t.Errorf("Arguments = %q, want %q", calls[0].Function.Arguments, tt.wantArgs)
+			}
+			if content != tt.wantContent {
+				t.Errorf("content = %q, want %q", content, tt.wantContent)
+			}
+		})
+	}
+}
+
+func TestParseToolCalls_IDs(t *testing.T) {
+	output := `{"tool_calls":[{"function":{"name":"a"}},{"id":"x","function":{"name":"b"}},{"id":"x","function":{"name":"c"}}]}`
+
+	calls, _, err := parseToolCalls(output, nil)
+	if err != nil {
+		t.Fatalf("parseToolCalls() error = %v", err)
+	}
+
+	if !strings.HasPrefix(calls[0].ID, "call_") {
+		t.Errorf("missing ID not generated: %q", calls[0].ID)
+	}
+	if calls[1].ID != "x" {
+		t.Errorf("model ID not kept: %q", calls[1].ID)
+	}
+	if calls[2].ID == "x" {
+		t.Error("duplicate ID not replaced")
+	}
+	if calls[0].Function.Arguments != "{}" {
+		t.Errorf("missing arguments = %q, want {}", calls[0].Function.Arguments)
+	}
+}
+
+func TestParseToolCalls_NoToolCall(t *testing.T) {
+	calls, content, err := parseToolCalls("The weather is sunny.", []types.ToolDefinition{weatherTool})
+	if err != nil || calls != nil || content != "The weather is sunny." {
+		t.Errorf("parseToolCalls() = %v, %q, %v", calls, content, err)
+	}
+}
+
+func TestClient_Chat_ToolCallRepair(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "attempted")
+	invalid := `{"tool_calls":[{"function":{"name":"get_weather","arguments":"{\"town\":\"Nairobi\"}"}}]}`
+	valid := `{"tool_calls":[{"function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}`
+	script := `if [ -f ` + marker + ` ]; then printf '%s' '` + valid + `'; else touch ` + marker + `; printf '%s' '` + invalid + `'; fi`
+
+	tests := []struct {
+		name      string
+		retries   int
+		wantCalls int
+	}{
+		{name: "no retries", retries: 0, wantCalls: 0},
+		{name: "repaired", retries: 1, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Cleanup(func() { os.Remove(marker) })
+
+			c := NewClient(config.PicoLMConfig{
+				Binary:          writeFakePicoLM(t, script),
+				Models:          map[string]string{"test": "/path/to/model.gguf"},
+				ToolCallRetries: tt.retries,
+			})
+			req := &types.ChatCompletionRequest{
+				Model:    "test",
+				Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+				Tools:    []types.ToolDefinition{weatherTool},
+			}
+
+			result, err := c.Chat(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Chat() error = %v", err)
+			}
+			if len(result.ToolCalls) != tt.wantCalls {
+				t.Fatalf("got %d tool calls, want %d", len(result.ToolCalls), tt.wantCalls)
+			}
+			if tt.wantCalls == 0 {
+				if result.FinishReason != "stop" || !strings.Contains(result.Content, "town") {
+					t.Errorf("invalid tool call should be returned as content, got %q (%s)", result.Content, result.FinishReason)
+				}
+				return
+			}
+			if result.FinishReason != "tool_calls" || result.ToolCalls[0].Function.Arguments != `{"city":"Nairobi"}` {
+				t.Errorf("result = %+v", result)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package picolm
+
+import (
+	"fmt"
+
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// Tool choice modes accepted in tool_choice.
+const (
+	ToolChoiceAuto     = "auto"
+	ToolChoiceNone     = "none"
+	ToolChoiceRequired = "required"
+	ToolChoiceFunction = "function"
+)
+
+// toolChoice is the resolved tool_choice of a request.
+type toolChoice struct {
+	Mode string
+	// Name is the function the model must call when Mode is "function".
+	Name string
+}
+
+// resolveToolChoice parses the tool_choice of req, which is either one of
+// "none", "auto" and "required" or an object naming a function.
+func resolveToolChoice(req *types.ChatCompletionRequest) (toolChoice, error) {
+	choice := toolChoice{Mode: ToolChoiceAuto}
+
+	switch v := req.ToolChoice.(type) {
+	case nil:
+		return choice, nil
+	case string:
+		switch v {
+		case ToolChoiceAuto, ToolChoiceNone, ToolChoiceRequired:
+			choice.Mode = v
+		default:
+			return choice, &InvalidRequestError{
+				Param:   "tool_choice",
+				Message: fmt.Sprintf("invalid tool_choice %q: must be one of %s, %s, %s or a function", v, ToolChoiceNone, ToolChoiceAuto, ToolChoiceRequired),
+			}
+		}
+	case map[string]any:
+		fn, _ := v["function"].(map[string]any)
+		name, _ := fn["name"].(string)
+		if v["type"] != ToolChoiceFunction || name == "" {
+			return choice, &InvalidRequestError{
+				Param:   "tool_choice",
+				Message: `invalid tool_choice: expected {"type": "function", "function": {"name": "..."}}`,
+			}
+		}
+		choice = toolChoice{Mode: ToolChoiceFunction, Name: name}
+	default:
+		return choice, &InvalidRequestError{
+			Param:   "tool_choice",
+			Message: "invalid tool_choice: must be a string or an object",
+		}
+	}
+
+	if choice.Mode == ToolChoiceNone || choice.Mode == ToolChoiceAuto {
+		return choice, nil
+	}
+	if len(req.Tools) == 0 {
+		return choice, &InvalidRequestError{
+			Param:   "tool_choice",
+			Message: "tool_choice is only allowed when tools are specified",
+		}
+	}
+	if choice.Mode == ToolChoiceFunction && len(choice.tools(req.Tools)) == 0 {
+		return choice, &InvalidRequestError{
+			Param:   "tool_choice",
+			Message: fmt.Sprintf("tool_choice names function %q, which is not in tools", choice.Name),
+		}
+	}
+	return choice, nil
+}
+
+// tools returns the tools the model may call under this choice.
+func (tc toolChoice) tools(all []types.ToolDefinition) []types.ToolDefinition {
+	switch tc.Mode {
+	case ToolChoiceNone:
+		return nil
+	case ToolChoiceFunction:
+		for _, tool := range all {
+			if tool.Type == "function" && tool.Function.Name == tc.Name {
+				return []types.ToolDefinition{tool}
+			}
+		}
+		return nil
+	}
+	return all
+}
+
+// forced reports whether the model must answer with a tool call.
+func (tc toolChoice) forced() bool {
+	return tc.Mode == ToolChoiceRequired || tc.Mode == ToolChoiceFunction
+}
+
+// offeredTools returns the tools the model may call for req. The request's
+// tool_choice must already have been validated by prepare.
+func offeredTools(req *types.ChatCompletionRequest) []types.ToolDefinition {
+	choice, _ := resolveToolChoice(req)
+	return choice.tools(req.Tools)
+}
+
+// parallelToolCalls reports whether more than one tool call may be returned.
+func parallelToolCalls(req *types.ChatCompletionRequest) bool {
+	return req.ParallelToolCalls == nil || *req.ParallelToolCalls
+}
@@ -0,0 +1,223 @@
+package picolm
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+var timeTool = types.ToolDefinition{
+	Type:     "function",
+	Function: types.FunctionDef{Name: "get_time"},
+}
+
+func TestResolveToolChoice(t *testing.T) {
+	tools := []types.ToolDefinition{weatherTool, timeTool}
+	named := func(name string) map[string]any {
+		return map[string]any{"type": "function", "function": map[string]any{"name": name}}
+	}
+
+	tests := []struct {
+		name      string
+		choice    any
+		tools     []types.ToolDefinition
+		want      toolChoice
+		wantTools int
+		wantErr   string
+	}{
+		{name: "default", tools: tools, want: toolChoice{Mode: ToolChoiceAuto}, wantTools: 2},
+		{name: "auto", choice: "auto", tools: tools, want: toolChoice{Mode: ToolChoiceAuto}, wantTools: 2},
+		{name: "none", choice: "none", tools: tools, want: toolChoice{Mode: ToolChoiceNone}},
+		{name: "required", choice: "required", tools: tools, want: toolChoice{Mode: ToolChoiceRequired}, wantTools: 2},
+		{name: "named", choice: named("get_time"), tools: tools, want: toolChoice{Mode: ToolChoiceFunction, Name: "get_time"}, wantTools: 1},
+		{name: "required without tools", choice: "required", wantErr: "only allowed when tools are specified"},
+		{name: "unknown function", choice: named("get_date"), tools: tools, wantErr: `"get_date", which is not in tools`},
+		{name: "invalid string", choice: "any", tools: tools, wantErr: `invalid tool_choice "any"`},
+		{name: "invalid object", choice: map[string]any{"type": "function"}, tools: tools, wantErr: "invalid tool_choice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &types.ChatCompletionRequest{ToolChoice: tt.choice, Tools: tt.tools}
+			got, err := resolveToolChoice(req)
+			if tt.wantErr != "" {
+				var rerr *InvalidRequestError
+				if !errors.As(err, &rerr) || rerr.Param != "tool_choice" || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolveToolChoice() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveToolChoice() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveToolChoice() = %+v, want %+v", got, tt.want)
+			}
+			if n := len(got.tools(req.Tools)); n != tt.wantTools {
+				t.Errorf("tools() returned %d tools, want %d", n, tt.wantTools)
+			}
+		})
+	}
+}
+
+func TestSystemInstructions_ToolChoice(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{})
+	tools := []types.ToolDefinition{weatherTool, timeTool}
+	serial := false
+
+	tests := []struct {
+		name    string
+		req     types.ChatCompletionRequest
+		want    []string
+		notWant []string
+	}{
+		{name: "auto", req: types.ChatCompletionRequest{Tools: tools}, want: []string{"When you need to use a tool", "#### get_weather", "#### get_time"}},
+		{name: "none", req: types.ChatCompletionRequest{Tools: tools, ToolChoice: "none"}, notWant: []string{"Available Tools"}},
+		{name: "required", req: types.ChatCompletionRequest{Tools: tools, ToolChoice: "required"}, want: []string{"You MUST call at least one tool"}},
+		{
+			name: "named",
+			req: types.ChatCompletionRequest{Tools: tools, ToolChoice: map[string]any{
+				"type": "function", "function": map[string]any{"name": "get_time"},
+			}},
+			want:    []string{"You MUST call the get_time tool", "#### get_time"},
+			notWant: []string{"#### get_weather"},
+		},
+		{name: "serial", req: types.ChatCompletionRequest{Tools: tools, ParallelToolCalls: &serial}, want: []string{"at most ONE tool"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prompt := strings.Join(c.systemInstructions(&tt.req), "\n")
+			for _, s := range tt.want {
+				if !strings.Contains(prompt, s) {
+					t.Errorf("instructions missing %q:\n%s", s, prompt)
+				}
+			}
+			for _, s := range tt.notWant {
+				if strings.Contains(prompt, s) {
+					t.Errorf("instructions should not contain %q:\n%s", s, prompt)
+				}
+			}
+		})
+	}
+}
+
+func TestClient_Chat_ToolChoiceRequired(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "attempted")
+	call := `{"tool_calls":[{"function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}`
+	script := `if [ -f ` + marker + ` ]; then printf '%s' '` + call + `'; else touch ` + marker + `; printf 'It is sunny.'; fi`
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, script),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:      "test",
+		Messages:   []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+		Tools:      []types.ToolDefinition{weatherTool},
+		ToolChoice: "required",
+	}
+
+	result, err := c.Chat(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if result.FinishReason != "tool_calls" || len(result.ToolCalls) != 1 {
+		t.Errorf("prose answer was not re-prompted: %+v", result)
+	}
+}
+
+func TestClient_Chat_ToolChoiceRequiredFails(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary:          writeFakePicoLM(t, `printf 'It is sunny.'`),
+		Models:          map[string]string{"test": "/path/to/model.gguf"},
+		ToolCallRetries: 2,
+	})
+	req := &types.ChatCompletionRequest{
+		Model:      "test",
+		Messages:   []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+		Tools:      []types.ToolDefinition{weatherTool},
+		ToolChoice: "required",
+	}
+
+	result, err := c.Chat(context.Background(), req)
+	var terr *ToolChoiceError
+	if !errors.As(err, &terr) {
+		t.Fatalf("Chat() = %+v, %v, want a *ToolChoiceError", result, err)
+	}
+	if terr.Mode != ToolChoiceRequired || terr.Attempts != 3 {
+		t.Errorf("error = %+v, want 3 attempts at required", terr)
+	}
+}
+
+func TestClient_Chat_ToolChoiceNone(t *testing.T) {
+	call := `{"tool_calls":[{"function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}`
+	// JSON mode must be off when no tools are offered.
+	script := `case "$*" in *--json*) exit 1 ;; esac
+printf '%s' '` + call + `'`
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, script),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:      "test",
+		Messages:   []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+		Tools:      []types.ToolDefinition{weatherTool},
+		ToolChoice: "none",
+	}
+
+	result, err := c.Chat(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if result.FinishReason != "stop" || len(result.ToolCalls) != 0 || result.Content != call {
+		t.Errorf("tool_choice none returned %+v", result)
+	}
+}
+
+func TestClient_Chat_ParallelToolCallsDisabled(t *testing.T) {
+	calls := `{"tool_calls":[{"function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}},{"function":{"name":"get_weather","arguments":"{\"city\":\"Mombasa\"}"}}]}`
+
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf '%s' '`+calls+`'`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	serial := false
+	req := &types.ChatCompletionRequest{
+		Model:             "test",
+		Messages:          []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi and Mombasa?")}},
+		Tools:             []types.ToolDefinition{weatherTool},
+		ParallelToolCalls: &serial,
+	}
+
+	result, err := c.Chat(context.Background(), req)
+	if err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if len(result.ToolCalls) != 1 || !strings.Contains(result.ToolCalls[0].Function.Arguments, "Nairobi") {
+		t.Errorf("ToolCalls = %+v, want only the first call", result.ToolCalls)
+	}
+}
+
+func TestClient_Chat_InvalidToolChoice(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf 'unused'`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:      "test",
+		Messages:   []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+		ToolChoice: "required",
+	}
+
+	_, err := c.Chat(context.Background(), req)
+	if !errors.As(err, new(*InvalidRequestError)) {
+		t.Errorf("Chat() error = %v, want InvalidRequestError", err)
+	}
+}
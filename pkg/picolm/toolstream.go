@@ -0,0 +1,112 @@
+package picolm
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// toolCallPrefixes are the ways a tool call response can start, with
+// whitespace removed: a bare object or one in a fenced code block.
+var toolCallPrefixes = []string{
+	`{"tool_calls"`,
+	"```json" + `{"tool_calls"`,
+	"```" + `{"tool_calls"`,
+}
+
+// argumentsChunkSize is the size of the pieces tool call arguments are
+// streamed in.
+const argumentsChunkSize = 32
+
+type toolCallState int
+
+const (
+	toolCallUndecided toolCallState = iota
+	toolCallContent
+	toolCallHeld
+)
+
+// toolCallBuffer sits between picolm output and the stream handler when
+// tools are offered. Output that starts like a tool call object is held back
+// so it can be parsed and sent as tool_calls deltas instead of content.
+type toolCallBuffer struct {
+	state toolCallState
+	held  strings.Builder
+}
+
+// Write returns the part of text that can be streamed as content.
+func (b *toolCallBuffer) Write(text string) string {
+	switch b.state {
+	case toolCallContent:
+		return text
+	case toolCallHeld:
+		b.held.WriteString(text)
+		return ""
+	}
+
+	b.held.WriteString(text)
+	compact := strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, b.held.String())
+
+	undecided := false
+	for _, prefix := range toolCallPrefixes {
+		if strings.HasPrefix(compact, prefix) {
+			b.state = toolCallHeld
+			return ""
+		}
+		undecided = undecided || strings.HasPrefix(prefix, compact)
+	}
+	if undecided {
+		return ""
+	}
+
+	b.state = toolCallContent
+	return b.take()
+}
+
+// Held returns the output held back so far.
+func (b *toolCallBuffer) Held() string {
+	return b.take()
+}
+
+func (b *toolCallBuffer) take() string {
+	s := b.held.String()
+	b.held.Reset()
+	return s
+}
+
+// toolCallDeltas splits tool calls into streaming deltas: one announcing
+// each call's id and function name, followed by its arguments in pieces.
+func toolCallDeltas(calls []types.ToolCall) [][]types.ToolCallDelta {
+	var deltas [][]types.ToolCallDelta
+	for i, call := range calls {
+		deltas = append(deltas, []types.ToolCallDelta{{
+			Index: i,
+			ID:    call.ID,
+			Type:  call.Type,
+			Function: types.CallFunctionDelta{
+				Name: call.Function.Name,
+			},
+		}})
+
+		args := call.Function.Arguments
+		for len(args) > 0 {
+			n := min(argumentsChunkSize, len(args))
+			for n < len(args) && !utf8.RuneStart(args[n]) {
+				n++
+			}
+			deltas = append(deltas, []types.ToolCallDelta{{
+				Index:    i,
+				Function: types.CallFunctionDelta{Arguments: args[:n]},
+			}})
+			args = args[n:]
+		}
+	}
+	return deltas
+}
@@ -0,0 +1,188 @@
+package picolm
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func TestToolCallBuffer(t *testing.T) {
+	tests := []struct {
+		name        string
+		writes      []string
+		wantContent string
+		wantHeld    string
+	}{
+		{
+			name:     "tool call split across writes",
+			writes:   []string{"\n{ \"tool", `_calls":[{"id":"1"}]}`},
+			wantHeld: "\n{ \"tool_calls\":[{\"id\":\"1\"}]}",
+		},
+		{
+			name:     "fenced tool call",
+			writes:   []string{"``", "`json\n{\"tool_calls\":[]}\n```"},
+			wantHeld: "```json\n{\"tool_calls\":[]}\n```",
+		},
+		{
+			name:        "fenced code",
+			writes:      []string{"```go\nfmt.Println()\n```"},
+			wantContent: "```go\nfmt.Println()\n```",
+		},
+		{
+			name:        "plain content",
+			writes:      []string{"Hello", " world"},
+			wantContent: "Hello world",
+		},
+		{
+			name:        "other JSON",
+			writes:      []string{"{", `"answer": 42}`},
+			wantContent: `{"answer": 42}`,
+		},
+		{
+			name:     "undecided at end",
+			writes:   []string{"  {\"to"},
+			wantHeld: "  {\"to",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b toolCallBuffer
+			var content strings.Builder
+			for _, w := range tt.writes {
+				content.WriteString(b.Write(w))
+			}
+			if content.String() != tt.wantContent {
+				t.Errorf("content = %q, want %q", content.String(), tt.wantContent)
+			}
+			if held := b.Held(); held != tt.wantHeld {
+				t.Errorf("Held() = %q, want %q", held, tt.wantHeld)
+			}
+		})
+	}
+}
+
+func TestToolCallDeltas(t *testing.T) {
+	args := `{"city":"` + strings.Repeat("é", 20) + `"}`
+	calls := []types.ToolCall{
+		{ID: "call_1", Type: "function", Function: types.CallFunction{Name: "get_weather", Arguments: args}},
+		{ID: "call_2", Type: "function", Function: types.CallFunction{Name: "get_time", Arguments: "{}"}},
+	}
+
+	deltas := toolCallDeltas(calls)
+
+	first := deltas[0][0]
+	if first.Index != 0 || first.ID != "call_1" || first.Function.Name != "get_weather" || first.Function.Arguments != "" {
+		t.Errorf("first delta = %+v", first)
+	}
+
+	var rebuilt [2]strings.Builder
+	for _, d := range deltas {
+		for _, tc := range d {
+			if strings.ToValidUTF8(tc.Function.Arguments, "?") != tc.Function.Arguments {
+				t.Errorf("delta splits a UTF-8 sequence: %q", tc.Function.Arguments)
+			}
+			rebuilt[tc.Index].WriteString(tc.Function.Arguments)
+		}
+	}
+	if rebuilt[0].String() != args || rebuilt[1].String() != "{}" {
+		t.Errorf("rebuilt arguments = %q, %q", rebuilt[0].String(), rebuilt[1].String())
+	}
+	if len(deltas) < 4 {
+		t.Errorf("expected arguments to be streamed in several deltas, got %d deltas", len(deltas))
+	}
+}
+
+func TestClient_StreamChat_ToolCalls(t *testing.T) {
+	output := `{"tool_calls":[{"type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}`
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf '%s' '`+output+`'`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+		Tools: []types.ToolDefinition{{
+			Type:     "function",
+			Function: types.FunctionDef{Name: "get_weather"},
+		}},
+	}
+
+	var content strings.Builder
+	var deltas []types.ToolCallDelta
+	var finishReason string
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+		content.WriteString(chunk.Content)
+		deltas = append(deltas, chunk.ToolCalls...)
+		if chunk.FinishReason != "" {
+			finishReason = chunk.FinishReason
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChat() error = %v", err)
+	}
+
+	if content.Len() != 0 {
+		t.Errorf("tool call JSON streamed as content: %q", content.String())
+	}
+	if finishReason != "tool_calls" {
+		t.Errorf("finish reason = %q, want tool_calls", finishReason)
+	}
+	if len(deltas) == 0 || deltas[0].Function.Name != "get_weather" || !strings.HasPrefix(deltas[0].ID, "call_") {
+		t.Fatalf("first delta = %+v", deltas)
+	}
+
+	var args strings.Builder
+	for _, d := range deltas {
+		args.WriteString(d.Function.Arguments)
+	}
+	if args.String() != `{"city":"Nairobi"}` {
+		t.Errorf("arguments = %q", args.String())
+	}
+}
+
+func TestClient_StreamChat_ToolCallInContent(t *testing.T) {
+	output := `Sure! {"tool_calls":[{"type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Nairobi\"}"}}]}`
+	c := NewClient(config.PicoLMConfig{
+		Binary: writeFakePicoLM(t, `printf '%s' '`+output+`'`),
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:    "test",
+		Messages: []types.ChatMessage{{Role: "user", Content: types.TextContent("Weather in Nairobi?")}},
+		Tools: []types.ToolDefinition{{
+			Type:     "function",
+			Function: types.FunctionDef{Name: "get_weather"},
+		}},
+	}
+
+	var content strings.Builder
+	var deltas []types.ToolCallDelta
+	var finishReason string
+	err := c.StreamChat(context.Background(), req, func(chunk StreamChunk) error {
+		content.WriteString(chunk.Content)
+		deltas = append(deltas, chunk.ToolCalls...)
+		if chunk.FinishReason != "" {
+			finishReason = chunk.FinishReason
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("StreamChat() error = %v", err)
+	}
+
+	// The call was already streamed as content, so it is not sent again.
+	if !strings.Contains(content.String(), `"tool_calls"`) {
+		t.Errorf("content = %q, want the output as it was generated", content.String())
+	}
+	if len(deltas) != 0 {
+		t.Errorf("tool call sent again as deltas: %+v", deltas)
+	}
+	if finishReason != "stop" {
+		t.Errorf("finish reason = %q, want stop", finishReason)
+	}
+}
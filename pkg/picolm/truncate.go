@@ -0,0 +1,138 @@
+package picolm
+
+import (
+	"fmt"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+// Truncation describes how a conversation was shortened to fit the context
+// window.
+type Truncation struct {
+	Strategy        string
+	DroppedMessages int
+	PromptTokens    int
+}
+
+// reserveMaxTokens reports whether max_tokens is held back from the context
+// window, preferring the request's setting over the model's.
+func reserveMaxTokens(opts config.ModelOptions, override *bool) bool {
+	if override != nil {
+		return *override
+	}
+	return opts.ReserveMaxTokens
+}
+
+// fitContext renders the prompt for req and checks it against the model's
+// context window. When it does not fit, messages are dropped according to
+// the truncation strategy of the request or model; system messages and the
+// latest message are always kept.
+func (c *Client) fitContext(model string, tmpl *ChatTemplate, req *types.ChatCompletionRequest, maxTokens int) (string, *Truncation, error) {
+	opts := c.config.GetModelOptions(model)
+
+	strategy := opts.Truncation
+	if req.Truncation != "" {
+		strategy = req.Truncation
+	}
+	if !config.ValidTruncation(strategy) {
+		return "", nil, &InvalidRequestError{
+			Param:   "truncation",
+			Message: fmt.Sprintf("invalid truncation %q: must be one of %s, %s or %s", strategy, config.TruncationError, config.TruncationDropOldest, config.TruncationMiddleOut),
+		}
+	}
+
+	contextLength := c.contextLength(model)
+	reserved := 0
+	if reserveMaxTokens(opts, req.ReserveMaxTokens) {
+		reserved = maxTokens
+	}
+	budget := contextLength - reserved
+
+	instructions := c.systemInstructions(req)
+	prompt := c.buildPrompt(tmpl, req.Messages, instructions)
+	tokens := c.countPrompt(model, prompt)
+	if tokens <= budget {
+		return prompt, nil, nil
+	}
+
+	overflow := &ContextLengthError{
+		Model:         model,
+		ContextLength: contextLength,
+		PromptTokens:  tokens,
+		Reserved:      reserved,
+	}
+
+	var drop func([]types.ChatMessage) []types.ChatMessage
+	switch strategy {
+	case config.TruncationDropOldest:
+		drop = dropOldest
+	case config.TruncationMiddleOut:
+		drop = dropMiddle
+	default:
+		return "", nil, overflow
+	}
+
+	messages := req.Messages
+	for {
+		if messages = drop(messages); messages == nil {
+			return "", nil, overflow
+		}
+
+		prompt = c.buildPrompt(tmpl, messages, instructions)
+		tokens = c.countPrompt(model, prompt)
+		if tokens <= budget {
+			return prompt, &Truncation{
+				Strategy:        strategy,
+				DroppedMessages: len(req.Messages) - len(messages),
+				PromptTokens:    tokens,
+			}, nil
+		}
+	}
+}
+
+// conversation returns the indices of the non-system messages.
+func conversation(messages []types.ChatMessage) []int {
+	var idx []int
+	for i, msg := range messages {
+		if msg.Role != "system" {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+func removeMessage(messages []types.ChatMessage, i int) []types.ChatMessage {
+	out := make([]types.ChatMessage, 0, len(messages)-1)
+	out = append(out, messages[:i]...)
+	return append(out, messages[i+1:]...)
+}
+
+// dropOldest removes the oldest turn, along with any tool results that
+// would be left without the assistant message that requested them. It
+// returns nil when only the latest message is left.
+func dropOldest(messages []types.ChatMessage) []types.ChatMessage {
+	idx := conversation(messages)
+	if len(idx) <= 1 {
+		return nil
+	}
+
+	messages = removeMessage(messages, idx[0])
+	for {
+		idx = conversation(messages)
+		if len(idx) <= 1 || messages[idx[0]].Role != "tool" {
+			return messages
+		}
+		messages = removeMessage(messages, idx[0])
+	}
+}
+
+// dropMiddle removes the turn in the middle of the conversation, keeping the
+// first and latest turns. It returns nil when nothing is left to remove.
+func dropMiddle(messages []types.ChatMessage) []types.ChatMessage {
+	idx := conversation(messages)
+	if len(idx) <= 2 {
+		return nil
+	}
+	return removeMessage(messages, idx[1+(len(idx)-2)/2])
+}
@@ -0,0 +1,190 @@
+package picolm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/types"
+)
+
+func roles(messages []types.ChatMessage) string {
+	var r []string
+	for _, msg := range messages {
+		r = append(r, msg.Role+":"+msg.Content.String())
+	}
+	return strings.Join(r, " ")
+}
+
+func history(turns ...string) []types.ChatMessage {
+	var messages []types.ChatMessage
+	for _, turn := range turns {
+		role, content, _ := strings.Cut(turn, ":")
+		messages = append(messages, types.ChatMessage{Role: role, Content: types.TextContent(content)})
+	}
+	return messages
+}
+
+func TestDropOldest(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []types.ChatMessage
+		want     string
+	}{
+		{
+			name:     "keeps system messages",
+			messages: history("system:s", "user:a", "assistant:b", "user:c"),
+			want:     "system:s assistant:b user:c",
+		},
+		{
+			name:     "drops orphaned tool results",
+			messages: history("assistant:call", "tool:result", "tool:result2", "user:c"),
+			want:     "user:c",
+		},
+		{
+			name:     "only latest left",
+			messages: history("system:s", "user:c"),
+			want:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roles(dropOldest(tt.messages)); got != tt.want {
+				t.Errorf("dropOldest() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropMiddle(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []types.ChatMessage
+		want     string
+	}{
+		{
+			name:     "removes middle turn",
+			messages: history("system:s", "user:a", "assistant:b", "user:c", "assistant:d", "user:e"),
+			want:     "system:s user:a assistant:b assistant:d user:e",
+		},
+		{
+			name:     "keeps first and latest",
+			messages: history("user:a", "user:e"),
+			want:     "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := roles(dropMiddle(tt.messages)); got != tt.want {
+				t.Errorf("dropMiddle() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClient_FitContext(t *testing.T) {
+	long := strings.Repeat("lorem ipsum ", 40)
+	messages := []types.ChatMessage{
+		{Role: "system", Content: types.TextContent("Be brief.")},
+		{Role: "user", Content: types.TextContent(long)},
+		{Role: "assistant", Content: types.TextContent("Noted.")},
+		{Role: "user", Content: types.TextContent("Summarize.")},
+	}
+
+	reserve, noReserve := true, false
+	tests := []struct {
+		name        string
+		opts        config.ModelOptions
+		truncation  string
+		reserve     *bool
+		wantDropped int
+		wantErr     bool
+	}{
+		{name: "error by default", wantErr: true},
+		{name: "model strategy", opts: config.ModelOptions{Truncation: config.TruncationDropOldest}, wantDropped: 1},
+		{name: "request overrides model", opts: config.ModelOptions{Truncation: config.TruncationDropOldest}, truncation: config.TruncationError, wantErr: true},
+		{name: "reserve max tokens", opts: config.ModelOptions{Truncation: config.TruncationDropOldest, ReserveMaxTokens: true}, wantErr: true},
+		{name: "request reserves max tokens", opts: config.ModelOptions{Truncation: config.TruncationDropOldest}, reserve: &reserve, wantErr: true},
+		{name: "request does not reserve", opts: config.ModelOptions{Truncation: config.TruncationDropOldest, ReserveMaxTokens: true}, reserve: &noReserve, wantDropped: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(config.PicoLMConfig{
+				Binary:        "/usr/bin/picolm",
+				Models:        map[string]string{"test": "/path/to/model.gguf"},
+				ContextLength: 60,
+				MaxTokens:     50,
+				ModelOptions:  map[string]config.ModelOptions{"test": tt.opts},
+			})
+			req := &types.ChatCompletionRequest{Model: "test", Messages: messages, Truncation: tt.truncation, ReserveMaxTokens: tt.reserve}
+
+			g, err := c.prepare(req)
+			if tt.wantErr {
+				var cerr *ContextLengthError
+				if !errors.As(err, &cerr) {
+					t.Fatalf("prepare() error = %v, want ContextLengthError", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("prepare() error = %v", err)
+			}
+			if g.truncation == nil || g.truncation.DroppedMessages != tt.wantDropped {
+				t.Fatalf("truncation = %+v, want %d dropped messages", g.truncation, tt.wantDropped)
+			}
+			if strings.Contains(g.prompt, "lorem") || !strings.Contains(g.prompt, "Be brief.") {
+				t.Errorf("prompt should keep the system message and drop the oldest turn: %q", g.prompt)
+			}
+		})
+	}
+}
+
+func TestClient_FitContext_InvalidStrategy(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary: "/usr/bin/picolm",
+		Models: map[string]string{"test": "/path/to/model.gguf"},
+	})
+	req := &types.ChatCompletionRequest{
+		Model:      "test",
+		Messages:   []types.ChatMessage{{Role: "user", Content: types.TextContent("Hi")}},
+		Truncation: "newest_first",
+	}
+
+	_, err := c.prepare(req)
+	var rerr *InvalidRequestError
+	if !errors.As(err, &rerr) || rerr.Param != "truncation" {
+		t.Errorf("prepare() error = %v, want InvalidRequestError for truncation", err)
+	}
+}
+
+func TestClient_Chat_ReportsTruncation(t *testing.T) {
+	c := NewClient(config.PicoLMConfig{
+		Binary:        writeFakePicoLM(t, `printf 'ok'`),
+		Models:        map[string]string{"test": "/path/to/model.gguf"},
+		ContextLength: 60,
+	})
+	req := &types.ChatCompletionRequest{
+		Model: "test",
+		Messages: []types.ChatMessage{
+			{Role: "user", Content: types.TextContent(strings.Repeat("lorem ipsum ", 40))},
+			{Role: "user", Content: types.TextContent("Summarize.")},
+		},
+		Truncation: config.TruncationDropOldest,
+	}
+
+	var got *Truncation
+	ctx := WithObserver(context.Background(), &Observer{
+		OnTruncate: func(t Truncation) { got = &t },
+	})
+	if _, err := c.Chat(ctx, req); err != nil {
+		t.Fatalf("Chat() error = %v", err)
+	}
+	if got == nil || got.Strategy != config.TruncationDropOldest || got.DroppedMessages != 1 {
+		t.Errorf("OnTruncate = %+v, want drop_oldest with 1 dropped message", got)
+	}
+}
@@ -0,0 +1,431 @@
+// Package ratelimit enforces per API key and per user request rates, token
+// rates and token quotas.
+package ratelimit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/auth"
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/store"
+)
+
+const countersCollection = "ratelimits"
+
+// pruneInterval is how often counters are checked for ones that can be
+// forgotten.
+const pruneInterval = time.Minute
+
+// Error is returned for a request rejected by a limit. Code is
+// rate_limit_exceeded for the per-minute limits, which recover on their own,
+// and insufficient_quota for the daily and monthly quotas.
+type Error struct {
+	Type       string
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Subject is something limits apply to: an API key, or a user of one.
+type Subject struct {
+	ID     string
+	Limits config.Limits
+}
+
+// counter is the persisted state of a subject. Requests and Tokens are the
+// levels of its token buckets; Tokens goes negative when a request uses more
+// than was left, holding back the next requests until it refills. Full is
+// when both buckets will have refilled.
+type counter struct {
+	Subject     string    `json:"subject"`
+	Requests    float64   `json:"requests"`
+	Tokens      float64   `json:"tokens"`
+	Updated     time.Time `json:"updated"`
+	Full        time.Time `json:"full"`
+	Day         string    `json:"day"`
+	DayTokens   int       `json:"day_tokens"`
+	Month       string    `json:"month"`
+	MonthTokens int       `json:"month_tokens"`
+}
+
+// Limiter tracks the counters of subjects, persisting them in a store so
+// that they survive restarts. Without a store they are kept in memory.
+//
+// Counters that are no different from a new one are forgotten, so that
+// subjects seen once, such as rotating user values, do not accumulate.
+// Changes are saved in batches outside mu, with saveMu keeping a record
+// from being overwritten by an older state.
+type Limiter struct {
+	store *store.Store
+	user  config.Limits
+	now   func() time.Time
+
+	mu       sync.Mutex
+	counters map[string]*counter
+	// dirty holds the subjects whose counters changed or were forgotten
+	// since they were last saved.
+	dirty  map[string]bool
+	pruned time.Time
+
+	saveMu sync.Mutex
+}
+
+// New returns a limiter keeping its counters in st. userLimits apply to each
+// user of every key.
+func New(st *store.Store, userLimits config.Limits) *Limiter {
+	l := &Limiter{
+		store:    st,
+		user:     userLimits,
+		now:      time.Now,
+		counters: make(map[string]*counter),
+		dirty:    make(map[string]bool),
+	}
+	l.load()
+	return l
+}
+
+// load reads the counters kept in the store, deleting those that can be
+// forgotten.
+func (l *Limiter) load() {
+	if l.store == nil {
+		return
+	}
+	counters, err := store.List[counter](l.store, countersCollection)
+	if err != nil {
+		log.Printf("failed to load rate limits: %v", err)
+	}
+	now := l.now()
+	for i := range counters {
+		c := &counters[i]
+		if c.idle(now) {
+			l.dirty[c.Subject] = true
+			continue
+		}
+		l.counters[c.Subject] = c
+	}
+	l.save()
+}
+
+// Subjects returns the subjects with limits a request of key on behalf of
+// user counts against. key is nil for servers without authentication.
+func (l *Limiter) Subjects(key *auth.Key, user string) []Subject {
+	if l == nil {
+		return nil
+	}
+	var subjects []Subject
+	var name string
+	if key != nil {
+		name = key.Name
+		if key.Limits != (config.Limits{}) {
+			subjects = append(subjects, Subject{ID: "key:" + name, Limits: key.Limits})
+		}
+	}
+	if user != "" && l.user != (config.Limits{}) {
+		subjects = append(subjects, Subject{ID: "user:" + name + ":" + user, Limits: l.user})
+	}
+	return subjects
+}
+
+// Allow admits a request if none of its subjects is over a limit, taking one
+// request from each. The returned status describes the most limited subject
+// either way.
+func (l *Limiter) Allow(subjects []Subject) (Status, error) {
+	l.mu.Lock()
+	now := l.now()
+	l.prune(now)
+	counters := make([]*counter, len(subjects))
+	var err error
+	for i, s := range subjects {
+		counters[i] = l.counter(s, now)
+		if err == nil {
+			err = counters[i].check(s, now)
+		}
+	}
+	if err == nil {
+		for i, s := range subjects {
+			if s.Limits.RequestsPerMinute > 0 {
+				counters[i].Requests--
+			}
+			l.changed(s, counters[i])
+		}
+	}
+	st := status(subjects, counters)
+	l.mu.Unlock()
+
+	l.save()
+	return st, err
+}
+
+// Charge counts tokens a request used against its subjects.
+func (l *Limiter) Charge(subjects []Subject, tokens int) {
+	if tokens <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := l.now()
+	l.prune(now)
+	for _, s := range subjects {
+		c := l.counter(s, now)
+		if s.Limits.TokensPerMinute > 0 {
+			c.Tokens -= float64(tokens)
+		}
+		c.DayTokens += tokens
+		c.MonthTokens += tokens
+		l.changed(s, c)
+	}
+	l.mu.Unlock()
+
+	l.save()
+}
+
+// counter returns the counter of a subject, refilled up to now.
+func (l *Limiter) counter(s Subject, now time.Time) *counter {
+	c, ok := l.counters[s.ID]
+	if !ok {
+		c = &counter{Subject: s.ID}
+		l.counters[s.ID] = c
+	}
+	c.refill(s.Limits, now)
+	return c
+}
+
+// changed records that the counter of s was updated.
+func (l *Limiter) changed(s Subject, c *counter) {
+	c.Full = c.Updated
+	if rpm := s.Limits.RequestsPerMinute; rpm > 0 {
+		c.Full = c.Updated.Add(untilLevel(c.Requests, float64(rpm), rpm))
+	}
+	if tpm := s.Limits.TokensPerMinute; tpm > 0 {
+		if full := c.Updated.Add(untilLevel(c.Tokens, float64(tpm), tpm)); full.After(c.Full) {
+			c.Full = full
+		}
+	}
+	if l.store != nil {
+		l.dirty[s.ID] = true
+	}
+}
+
+// prune forgets the counters that are no different from a new one, at most
+// once per pruneInterval.
+func (l *Limiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < pruneInterval {
+		return
+	}
+	l.pruned = now
+	for id, c := range l.counters {
+		if c.idle(now) {
+			delete(l.counters, id)
+			if l.store != nil {
+				l.dirty[id] = true
+			}
+		}
+	}
+}
+
+// save writes the changed counters to the store and deletes the records of
+// forgotten ones. The changes are taken under mu but written outside it, so
+// that requests are not held up by the store.
+func (l *Limiter) save() {
+	if l.store == nil {
+		return
+	}
+	l.saveMu.Lock()
+	defer l.saveMu.Unlock()
+
+	l.mu.Lock()
+	changes := make(map[string]*counter, len(l.dirty))
+	for id := range l.dirty {
+		if c, ok := l.counters[id]; ok {
+			saved := *c
+			changes[id] = &saved
+		} else {
+			changes[id] = nil
+		}
+	}
+	clear(l.dirty)
+	l.mu.Unlock()
+
+	for id, c := range changes {
+		var err error
+		if c == nil {
+			if err = l.store.Delete(countersCollection, counterID(id)); errors.Is(err, store.ErrNotFound) {
+				err = nil
+			}
+		} else {
+			err = l.store.Put(countersCollection, counterID(id), c)
+		}
+		if err != nil {
+			log.Printf("failed to store rate limits of %s: %v", id, err)
+		}
+	}
+}
+
+// counterID names the record of a subject. User names can be anything, so
+// they are hashed into a valid record ID.
+func counterID(subject string) string {
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (c *counter) refill(limits config.Limits, now time.Time) {
+	rpm, tpm := float64(limits.RequestsPerMinute), float64(limits.TokensPerMinute)
+	if c.Updated.IsZero() {
+		c.Requests, c.Tokens = rpm, tpm
+	} else if elapsed := now.Sub(c.Updated).Minutes(); elapsed > 0 {
+		c.Requests = math.Min(rpm, c.Requests+elapsed*rpm)
+		c.Tokens = math.Min(tpm, c.Tokens+elapsed*tpm)
+	}
+	c.Updated = now
+
+	utc := now.UTC()
+	if day := utc.Format("2006-01-02"); c.Day != day {
+		c.Day, c.DayTokens = day, 0
+	}
+	if month := utc.Format("2006-01"); c.Month != month {
+		c.Month, c.MonthTokens = month, 0
+	}
+}
+
+// idle reports whether the counter is no different from a new one: both
+// buckets are full and nothing was used this month.
+func (c *counter) idle(now time.Time) bool {
+	return !now.Before(c.Full) && (c.MonthTokens == 0 || c.Month != now.UTC().Format("2006-01"))
+}
+
+func (c *counter) check(s Subject, now time.Time) error {
+	utc := now.UTC()
+	switch {
+	case s.Limits.MonthlyTokens > 0 && c.MonthTokens >= s.Limits.MonthlyTokens:
+		next := time.Date(utc.Year(), utc.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		return quotaError(s, "monthly", s.Limits.MonthlyTokens, next.Sub(utc))
+	case s.Limits.DailyTokens > 0 && c.DayTokens >= s.Limits.DailyTokens:
+		next := time.Date(utc.Year(), utc.Month(), utc.Day()+1, 0, 0, 0, 0, time.UTC)
+		return quotaError(s, "daily", s.Limits.DailyTokens, next.Sub(utc))
+	case s.Limits.RequestsPerMinute > 0 && c.Requests < 1:
+		return rateError(s, "requests", "RPM", s.Limits.RequestsPerMinute, c.Requests)
+	case s.Limits.TokensPerMinute > 0 && c.Tokens <= 0:
+		return rateError(s, "tokens", "TPM", s.Limits.TokensPerMinute, c.Tokens)
+	}
+	return nil
+}
+
+func quotaError(s Subject, period string, quota int, retry time.Duration) *Error {
+	return &Error{
+		Type:       "insufficient_quota",
+		Code:       "insufficient_quota",
+		Message:    fmt.Sprintf("You exceeded the %s token quota of %s: Limit %d.", period, s.ID, quota),
+		RetryAfter: retry,
+	}
+}
+
+// rateError reports a bucket at level, which refills at limit per minute.
+func rateError(s Subject, kind, abbrev string, limit int, level float64) *Error {
+	retry := untilLevel(level, 1, limit)
+	return &Error{
+		Type:       kind,
+		Code:       "rate_limit_exceeded",
+		Message:    fmt.Sprintf("Rate limit reached for %s on %s per min (%s): Limit %d. Please try again in %s.", s.ID, kind, abbrev, limit, retry),
+		RetryAfter: retry,
+	}
+}
+
+// untilLevel returns how long a bucket at level takes to refill to target.
+func untilLevel(level, target float64, perMinute int) time.Duration {
+	if level >= target {
+		return 0
+	}
+	d := time.Duration((target - level) / float64(perMinute) * float64(time.Minute))
+	return d.Round(time.Millisecond)
+}
+
+// Bucket describes one per-minute limit for the x-ratelimit-* headers.
+type Bucket struct {
+	Limit     int
+	Remaining int
+	// Reset is how long the bucket takes to refill completely.
+	Reset time.Duration
+}
+
+// Status holds the most limited request and token buckets of a request's
+// subjects. Either is nil when no subject limits it.
+type Status struct {
+	Requests *Bucket
+	Tokens   *Bucket
+}
+
+func status(subjects []Subject, counters []*counter) Status {
+	var st Status
+	for i, s := range subjects {
+		c := counters[i]
+		if limit := s.Limits.RequestsPerMinute; limit > 0 {
+			st.Requests = lowest(st.Requests, bucket(limit, c.Requests))
+		}
+		if limit := s.Limits.TokensPerMinute; limit > 0 {
+			st.Tokens = lowest(st.Tokens, bucket(limit, c.Tokens))
+		}
+	}
+	return st
+}
+
+func bucket(limit int, level float64) *Bucket {
+	return &Bucket{
+		Limit:     limit,
+		Remaining: max(int(math.Floor(level)), 0),
+		Reset:     untilLevel(level, float64(limit), limit),
+	}
+}
+
+func lowest(a, b *Bucket) *Bucket {
+	if a == nil || b.Remaining < a.Remaining {
+		return b
+	}
+	return a
+}
+
+// SetHeaders sets the x-ratelimit-* headers OpenAI sends.
+func (st Status) SetHeaders(h http.Header) {
+	if b := st.Requests; b != nil {
+		h.Set("X-Ratelimit-Limit-Requests", strconv.Itoa(b.Limit))
+		h.Set("X-Ratelimit-Remaining-Requests", strconv.Itoa(b.Remaining))
+		h.Set("X-Ratelimit-Reset-Requests", b.Reset.String())
+	}
+	if b := st.Tokens; b != nil {
+		h.Set("X-Ratelimit-Limit-Tokens", strconv.Itoa(b.Limit))
+		h.Set("X-Ratelimit-Remaining-Tokens", strconv.Itoa(b.Remaining))
+		h.Set("X-Ratelimit-Reset-Tokens", b.Reset.String())
+	}
+}
+
+// RetryAfterSeconds returns the Retry-After header value for e, in whole
+// seconds.
+func (e *Error) RetryAfterSeconds() string {
+	return strconv.Itoa(max(int(math.Ceil(e.RetryAfter.Seconds())), 1))
+}
+
+type contextKey struct{}
+
+// WithSubjects returns ctx carrying the subjects the tokens used by a request
+// are charged to.
+func WithSubjects(ctx context.Context, subjects []Subject) context.Context {
+	return context.WithValue(ctx, contextKey{}, subjects)
+}
+
+// SubjectsFrom returns the subjects of a request.
+func SubjectsFrom(ctx context.Context) []Subject {
+	subjects, _ := ctx.Value(contextKey{}).([]Subject)
+	return subjects
+}
@@ -0,0 +1,235 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/wmik/picolm-server/pkg/auth"
+	"github.com/wmik/picolm-server/pkg/config"
+	"github.com/wmik/picolm-server/pkg/store"
+)
+
+// newTestLimiter returns a limiter on st whose clock reads now, loading its
+// counters as of then.
+func newTestLimiter(t *testing.T, st *store.Store, now *time.Time) *Limiter {
+	t.Helper()
+	l := New(nil, config.Limits{})
+	l.store = st
+	l.now = func() time.Time { return *now }
+	l.load()
+	return l
+}
+
+func TestLimiter_RequestsPerMinute(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(t, nil, &now)
+	subjects := []Subject{{ID: "key:a", Limits: config.Limits{RequestsPerMinute: 2}}}
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.Allow(subjects); err != nil {
+			t.Fatalf("request %d: unexpected error %v", i, err)
+		}
+	}
+
+	status, err := l.Allow(subjects)
+	var lerr *Error
+	if !errors.As(err, &lerr) || lerr.Code != "rate_limit_exceeded" || lerr.Type != "requests" {
+		t.Fatalf("Allow() error = %v, want a requests rate limit", err)
+	}
+	if lerr.RetryAfter != 30*time.Second {
+		t.Errorf("RetryAfter = %v, want 30s", lerr.RetryAfter)
+	}
+	if status.Requests == nil || status.Requests.Remaining != 0 || status.Requests.Reset != time.Minute {
+		t.Errorf("Requests = %+v, want 0 remaining resetting in 1m", status.Requests)
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, err := l.Allow(subjects); err != nil {
+		t.Errorf("Allow() after refill error = %v", err)
+	}
+}
+
+func TestLimiter_TokensPerMinute(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(t, nil, &now)
+	subjects := []Subject{{ID: "key:a", Limits: config.Limits{TokensPerMinute: 100}}}
+
+	if _, err := l.Allow(subjects); err != nil {
+		t.Fatalf("Allow() error = %v", err)
+	}
+	// A request may take the bucket below zero; the next waits for it.
+	l.Charge(subjects, 150)
+
+	_, err := l.Allow(subjects)
+	var lerr *Error
+	if !errors.As(err, &lerr) || lerr.Type != "tokens" {
+		t.Fatalf("Allow() error = %v, want a tokens rate limit", err)
+	}
+	if want := 30600 * time.Millisecond; lerr.RetryAfter != want {
+		t.Errorf("RetryAfter = %v, want %v", lerr.RetryAfter, want)
+	}
+
+	now = now.Add(31 * time.Second)
+	status, err := l.Allow(subjects)
+	if err != nil {
+		t.Fatalf("Allow() after refill error = %v", err)
+	}
+	if status.Tokens == nil || status.Tokens.Limit != 100 || status.Tokens.Remaining != 1 {
+		t.Errorf("Tokens = %+v, want 1 of 100 remaining", status.Tokens)
+	}
+}
+
+func TestLimiter_Quotas(t *testing.T) {
+	now := time.Date(2026, 10, 31, 23, 0, 0, 0, time.UTC)
+	l := newTestLimiter(t, nil, &now)
+	subjects := []Subject{{ID: "key:a", Limits: config.Limits{DailyTokens: 100, MonthlyTokens: 1000}}}
+
+	l.Charge(subjects, 100)
+	_, err := l.Allow(subjects)
+	var lerr *Error
+	if !errors.As(err, &lerr) || lerr.Code != "insufficient_quota" {
+		t.Fatalf("Allow() error = %v, want insufficient_quota", err)
+	}
+	if lerr.RetryAfter != time.Hour {
+		t.Errorf("RetryAfter = %v, want the hour until midnight", lerr.RetryAfter)
+	}
+
+	now = now.Add(time.Hour)
+	if _, err := l.Allow(subjects); err != nil {
+		t.Fatalf("Allow() on the next day error = %v", err)
+	}
+
+	l.Charge(subjects, 1000)
+	now = now.Add(24 * time.Hour)
+	if _, err := l.Allow(subjects); !errors.As(err, &lerr) || lerr.Code != "insufficient_quota" {
+		t.Fatalf("Allow() error = %v, want the monthly quota exceeded", err)
+	}
+}
+
+func TestLimiter_AllOrNothing(t *testing.T) {
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(t, nil, &now)
+	key := Subject{ID: "key:a", Limits: config.Limits{RequestsPerMinute: 10}}
+	user := Subject{ID: "user:a:alice", Limits: config.Limits{RequestsPerMinute: 1}}
+
+	if _, err := l.Allow([]Subject{key, user}); err != nil {
+		t.Fatalf("Allow() error = %v", err)
+	}
+	status, err := l.Allow([]Subject{key, user})
+	if err == nil {
+		t.Fatal("expected the user limit to reject the request")
+	}
+	if status.Requests.Limit != 1 {
+		t.Errorf("status should describe the most limited subject, got %+v", status.Requests)
+	}
+
+	// The rejected request did not count against the key.
+	status, _ = l.Allow([]Subject{key})
+	if status.Requests.Remaining != 8 {
+		t.Errorf("key remaining = %d, want 8", status.Requests.Remaining)
+	}
+}
+
+func TestLimiter_Persists(t *testing.T) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	subjects := []Subject{{ID: "user:a:alice@example.com", Limits: config.Limits{DailyTokens: 100}}}
+
+	newTestLimiter(t, st, &now).Charge(subjects, 100)
+
+	_, err = newTestLimiter(t, st, &now).Allow(subjects)
+	var lerr *Error
+	if !errors.As(err, &lerr) || lerr.Code != "insufficient_quota" {
+		t.Fatalf("Allow() after restart error = %v, want insufficient_quota", err)
+	}
+}
+
+func TestLimiter_Prune(t *testing.T) {
+	st, err := store.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	l := newTestLimiter(t, st, &now)
+	rate := Subject{ID: "user:a:alice", Limits: config.Limits{RequestsPerMinute: 60}}
+	quota := Subject{ID: "user:a:bob", Limits: config.Limits{DailyTokens: 100}}
+
+	l.Allow([]Subject{rate})
+	l.Charge([]Subject{quota}, 10)
+	if records, _ := store.List[counter](st, countersCollection); len(records) != 2 {
+		t.Fatalf("stored %d counters, want 2", len(records))
+	}
+
+	// Once its bucket has refilled, alice's counter is no different from a
+	// new one; bob's still holds this month's usage.
+	now = now.Add(2 * time.Minute)
+	l.Allow(nil)
+	if _, ok := l.counters[rate.ID]; ok || len(l.counters) != 1 {
+		t.Errorf("counters = %v, want only %s", l.counters, quota.ID)
+	}
+	if records, _ := store.List[counter](st, countersCollection); len(records) != 1 || records[0].Subject != quota.ID {
+		t.Errorf("stored counters = %+v, want only %s", records, quota.ID)
+	}
+
+	// A restart in the next month forgets bob's counter as well.
+	now = time.Date(2026, 11, 1, 0, 0, 0, 0, time.UTC)
+	newTestLimiter(t, st, &now)
+	if records, _ := store.List[counter](st, countersCollection); len(records) != 0 {
+		t.Errorf("stored counters = %+v, want none", records)
+	}
+}
+
+func TestLimiter_Subjects(t *testing.T) {
+	l := New(nil, config.Limits{TokensPerMinute: 10})
+	key := &auth.Key{Name: "a", Limits: config.Limits{RequestsPerMinute: 5}}
+
+	subjects := l.Subjects(key, "alice")
+	if len(subjects) != 2 || subjects[0].ID != "key:a" || subjects[1].ID != "user:a:alice" {
+		t.Errorf("Subjects() = %+v", subjects)
+	}
+	if subjects := l.Subjects(&auth.Key{Name: "b"}, ""); len(subjects) != 0 {
+		t.Errorf("Subjects() without limits = %+v, want none", subjects)
+	}
+
+	var none *Limiter
+	if subjects := none.Subjects(key, "alice"); subjects != nil {
+		t.Errorf("nil limiter Subjects() = %+v, want nil", subjects)
+	}
+}
+
+func TestStatus_SetHeaders(t *testing.T) {
+	h := http.Header{}
+	Status{
+		Requests: &Bucket{Limit: 60, Remaining: 59, Reset: time.Second},
+		Tokens:   &Bucket{Limit: 1000, Remaining: 0, Reset: 6 * time.Minute},
+	}.SetHeaders(h)
+
+	for name, want := range map[string]string{
+		"x-ratelimit-limit-requests":     "60",
+		"x-ratelimit-remaining-requests": "59",
+		"x-ratelimit-reset-requests":     "1s",
+		"x-ratelimit-limit-tokens":       "1000",
+		"x-ratelimit-remaining-tokens":   "0",
+		"x-ratelimit-reset-tokens":       "6m0s",
+	} {
+		if got := h.Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	subjects := []Subject{{ID: "key:a"}}
+	if got := SubjectsFrom(WithSubjects(context.Background(), subjects)); len(got) != 1 {
+		t.Errorf("SubjectsFrom() = %+v", got)
+	}
+	if got := SubjectsFrom(context.Background()); got != nil {
+		t.Errorf("SubjectsFrom(empty) = %+v, want nil", got)
+	}
+}
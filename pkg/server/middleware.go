@@ -16,6 +16,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/wmik/picolm-server/pkg/auth"
 	"github.com/wmik/picolm-server/pkg/config"
 )
 
@@ -59,7 +60,7 @@ func (m *loggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 	requestID := generateRequestID()
 
-	r = r.WithContext(withRequestID(r.Context(), requestID))
+	r = r.WithContext(auth.Track(withRequestID(r.Context(), requestID)))
 
 	var flusher http.Flusher
 	if f, ok := w.(http.Flusher); ok {
@@ -85,6 +86,9 @@ func (m *loggingMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		RequestID:  requestID,
 		ClientIP:   getClientIP(r),
 	}
+	if key := auth.FromContext(r.Context()); key != nil {
+		entry.APIKey = key.Name
+	}
 
 	m.log(entry)
 }
@@ -112,6 +116,9 @@ func (m *loggingMiddleware) log(entry LogEntry) {
 			entry.RequestID,
 			entry.ClientIP,
 		)
+		if entry.APIKey != "" {
+			output += " key=" + entry.APIKey
+		}
 	}
 
 	switch m.config.Output {
@@ -181,6 +188,7 @@ type LogEntry struct {
 	DurationMs int64  `json:"duration_ms"`
 	RequestID  string `json:"request_id"`
 	ClientIP   string `json:"client_ip"`
+	APIKey     string `json:"api_key,omitempty"`
 }
 
 type contextKey string
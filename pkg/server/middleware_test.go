@@ -4,8 +4,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/wmik/picolm-server/pkg/auth"
 	"github.com/wmik/picolm-server/pkg/config"
 )
 
@@ -181,3 +184,29 @@ func TestGetRequestID_NotSet(t *testing.T) {
 		t.Errorf("GetRequestID() = %q, want empty string", id)
 	}
 }
+
+func TestLoggingMiddleware_APIKey(t *testing.T) {
+	cfg := config.LoggingConfig{
+		Level:    "info",
+		Format:   "json",
+		Output:   "file",
+		FilePath: filepath.Join(t.TempDir(), "server.log"),
+	}
+
+	handler := NewLoggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth.WithKey(r.Context(), &auth.Key{Name: "team-a"})
+	}), cfg)
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v1/models", nil))
+
+	data, err := os.ReadFile(cfg.FilePath)
+	if err != nil {
+		t.Fatalf("failed to read log file: %v", err)
+	}
+	var entry LogEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		t.Fatalf("invalid log entry %q: %v", data, err)
+	}
+	if entry.APIKey != "team-a" {
+		t.Errorf("APIKey = %q, want team-a", entry.APIKey)
+	}
+}
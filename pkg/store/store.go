@@ -0,0 +1,263 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrNotFound is returned when a record does not exist.
+var ErrNotFound = errors.New("record not found")
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Store persists records as JSON files under a directory, one subdirectory
+// per collection. Writes go to a temporary file that is renamed into place,
+// so a record is never left half-written. Blobs hold raw data, such as
+// uploaded files, next to the records.
+type Store struct {
+	dir string
+	mu  sync.RWMutex
+}
+
+// Open returns a store rooted at dir, creating the directory if needed.
+func Open(dir string) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the directory the store is rooted at.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+func (s *Store) path(collection, id string) (string, error) {
+	if !validID.MatchString(collection) || !validID.MatchString(id) {
+		return "", fmt.Errorf("invalid record key %s/%s", collection, id)
+	}
+	return filepath.Join(s.dir, collection, id+".json"), nil
+}
+
+func (s *Store) blobPath(collection, id string) (string, error) {
+	if !validID.MatchString(collection) || !validID.MatchString(id) {
+		return "", fmt.Errorf("invalid blob key %s/%s", collection, id)
+	}
+	return filepath.Join(s.dir, collection, id+".blob"), nil
+}
+
+// Put writes a record, replacing any existing record with the same ID.
+func (s *Store) Put(collection, id string, v any) error {
+	path, err := s.path(collection, id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Get reads a record into v.
+func (s *Store) Get(collection, id string, v any) error {
+	path, err := s.path(collection, id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	s.mu.RLock()
+	data, err := os.ReadFile(path)
+	s.mu.RUnlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Delete removes a record.
+func (s *Store) Delete(collection, id string) error {
+	path, err := s.path(collection, id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// IDs returns the IDs of all records in a collection, sorted.
+func (s *Store) IDs(collection string) ([]string, error) {
+	if !validID.MatchString(collection) {
+		return nil, fmt.Errorf("invalid collection %q", collection)
+	}
+
+	s.mu.RLock()
+	entries, err := os.ReadDir(filepath.Join(s.dir, collection))
+	s.mu.RUnlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		ids = append(ids, strings.TrimSuffix(name, ".json"))
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// List reads every record in a collection. Records removed while listing
+// are skipped.
+func List[T any](s *Store, collection string) ([]T, error) {
+	ids, err := s.IDs(collection)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]T, 0, len(ids))
+	for _, id := range ids {
+		var v T
+		if err := s.Get(collection, id, &v); err != nil {
+			if errors.Is(err, ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		records = append(records, v)
+	}
+	return records, nil
+}
+
+// PutBlob writes the data read from r as a blob, replacing any existing blob
+// with the same ID, and returns its size. The data is copied without
+// holding the store's lock, so large uploads do not block other requests.
+func (s *Store) PutBlob(collection, id string, r io.Reader) (int64, error) {
+	path, err := s.blobPath(collection, id)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return n, os.Rename(tmp.Name(), path)
+}
+
+// AppendBlob appends data to a blob, creating it if needed.
+func (s *Store) AppendBlob(collection, id string, data []byte) error {
+	path, err := s.blobPath(collection, id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// OpenBlob opens a blob for reading. The caller must close it.
+func (s *Store) OpenBlob(collection, id string) (*os.File, error) {
+	path, err := s.blobPath(collection, id)
+	if err != nil {
+		return nil, ErrNotFound
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	return f, err
+}
+
+// DeleteBlob removes a blob.
+func (s *Store) DeleteBlob(collection, id string) error {
+	path, err := s.blobPath(collection, id)
+	if err != nil {
+		return ErrNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err = os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type record struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+func TestStore_PutGetDelete(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if err := s.Put("items", "a", record{Name: "first", Count: 1}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	var got record
+	if err := s.Get("items", "a", &got); err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	if got != (record{Name: "first", Count: 1}) {
+		t.Errorf("Get() = %+v", got)
+	}
+
+	if err := s.Put("items", "a", record{Name: "first", Count: 2}); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := s.Get("items", "a", &got); err != nil || got.Count != 2 {
+		t.Errorf("Get() after overwrite = %+v, %v", got, err)
+	}
+
+	if err := s.Delete("items", "a"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := s.Get("items", "a", &got); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() after delete error = %v, want ErrNotFound", err)
+	}
+	if err := s.Delete("items", "a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete() of missing record error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStore_List(t *testing.T) {
+	dir := t.TempDir()
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if got, err := List[record](s, "items"); err != nil || len(got) != 0 {
+		t.Fatalf("List() of empty collection = %v, %v", got, err)
+	}
+
+	for _, id := range []string{"b", "a", "c"} {
+		if err := s.Put("items", id, record{Name: id}); err != nil {
+			t.Fatalf("Put() error = %v", err)
+		}
+	}
+	// Leftover temporary files are ignored.
+	os.WriteFile(filepath.Join(dir, "items", ".tmp-123"), []byte("{"), 0o644)
+
+	ids, err := s.IDs("items")
+	if err != nil || !reflect.DeepEqual(ids, []string{"a", "b", "c"}) {
+		t.Errorf("IDs() = %v, %v", ids, err)
+	}
+
+	got, err := List[record](s, "items")
+	if err != nil {
+		t.Fatalf("List() error = %v", err)
+	}
+	if len(got) != 3 || got[0].Name != "a" || got[2].Name != "c" {
+		t.Errorf("List() = %+v", got)
+	}
+
+	// Records outlive the store that wrote them.
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	var r record
+	if err := reopened.Get("items", "b", &r); err != nil || r.Name != "b" {
+		t.Errorf("Get() after reopen = %+v, %v", r, err)
+	}
+}
+
+func TestStore_InvalidKeys(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if err := s.Put("items", "../escape", record{}); err == nil {
+		t.Error("Put() with a path in the ID should fail")
+	}
+	var r record
+	if err := s.Get("items", "../escape", &r); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get() with a path in the ID error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestStore_Blobs(t *testing.T) {
+	s, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	n, err := s.PutBlob("files", "f1", strings.NewReader("line 1\n"))
+	if err != nil || n != 7 {
+		t.Fatalf("PutBlob() = %d, %v", n, err)
+	}
+	if err := s.AppendBlob("files", "f1", []byte("line 2\n")); err != nil {
+		t.Fatalf("AppendBlob() error = %v", err)
+	}
+
+	f, err := s.OpenBlob("files", "f1")
+	if err != nil {
+		t.Fatalf("OpenBlob() error = %v", err)
+	}
+	data, _ := io.ReadAll(f)
+	f.Close()
+	if string(data) != "line 1\nline 2\n" {
+		t.Errorf("blob = %q", data)
+	}
+
+	// Blobs are not records.
+	if ids, _ := s.IDs("files"); len(ids) != 0 {
+		t.Errorf("IDs() = %v, want none", ids)
+	}
+
+	if err := s.DeleteBlob("files", "f1"); err != nil {
+		t.Fatalf("DeleteBlob() error = %v", err)
+	}
+	if _, err := s.OpenBlob("files", "f1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("OpenBlob() after delete error = %v, want ErrNotFound", err)
+	}
+}
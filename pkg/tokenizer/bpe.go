@@ -0,0 +1,274 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// byteEncoder maps each byte to the printable rune GPT-2 style vocabularies
+// use to represent it.
+var byteEncoder = func() [256]string {
+	var enc [256]string
+	n := 0
+	for b := 0; b < 256; b++ {
+		printable := (b >= '!' && b <= '~') || (b >= 0xA1 && b <= 0xAC) || (b >= 0xAE && b <= 0xFF)
+		if printable {
+			enc[b] = string(rune(b))
+		} else {
+			enc[b] = string(rune(256 + n))
+			n++
+		}
+	}
+	return enc
+}()
+
+// encodeBPE implements byte-level BPE: text is split by the model's
+// pre-tokenizer, each piece is mapped to byte runes and the adjacent pair
+// with the lowest merge rank is merged until no merge applies. Candidate
+// pairs are kept in a priority queue, as in encodeSPM, so long pieces are
+// not rescanned after every merge.
+func (t *Tokenizer) encodeBPE(text string, out []int) []int {
+	type symbol struct {
+		text       string
+		prev, next int
+	}
+
+	var symbols []symbol
+	queue := &mergeQueue{}
+	tryAdd := func(left, right int) {
+		if left < 0 || right < 0 {
+			return
+		}
+		rank, ok := t.ranks[symbols[left].text+" "+symbols[right].text]
+		if !ok {
+			return
+		}
+		heap.Push(queue, merge{left: left, right: right, rank: rank, size: len(symbols[left].text) + len(symbols[right].text)})
+	}
+
+	for _, piece := range t.pretokenize(text) {
+		symbols = symbols[:0]
+		for i := 0; i < len(piece); i++ {
+			symbols = append(symbols, symbol{text: byteEncoder[piece[i]], prev: i - 1, next: i + 1})
+		}
+		symbols[len(symbols)-1].next = -1
+
+		*queue = (*queue)[:0]
+		for i := 1; i < len(symbols); i++ {
+			tryAdd(i-1, i)
+		}
+
+		for queue.Len() > 0 {
+			m := heap.Pop(queue).(merge)
+			left, right := &symbols[m.left], &symbols[m.right]
+
+			// Skip pairs invalidated by an earlier merge.
+			if left.text == "" || right.text == "" || len(left.text)+len(right.text) != m.size {
+				continue
+			}
+
+			left.text += right.text
+			right.text = ""
+			left.next = right.next
+			if right.next >= 0 {
+				symbols[right.next].prev = m.left
+			}
+
+			tryAdd(left.prev, m.left)
+			tryAdd(m.left, left.next)
+		}
+
+		for i := 0; i >= 0; i = symbols[i].next {
+			if id, ok := t.ids[symbols[i].text]; ok {
+				out = append(out, id)
+			} else if t.unkID >= 0 {
+				out = append(out, t.unkID)
+			}
+		}
+	}
+	return out
+}
+
+type merge struct {
+	left, right int
+	rank        int
+	size        int
+}
+
+// mergeQueue orders candidate merges by rank, then by position.
+type mergeQueue []merge
+
+func (q mergeQueue) Len() int { return len(q) }
+func (q mergeQueue) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank < q[j].rank
+	}
+	return q[i].left < q[j].left
+}
+func (q mergeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *mergeQueue) Push(x any)   { *q = append(*q, x.(merge)) }
+func (q *mergeQueue) Pop() any {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
+
+// pretokenize splits text the way the model's pre-tokenizer regex does.
+func (t *Tokenizer) pretokenize(text string) []string {
+	switch t.pre {
+	case "llama-bpe", "llama3", "smaug-bpe", "dbrx":
+		return splitLlama3(text, 3)
+	case "qwen2", "deepseek-llm", "stablelm2":
+		return splitLlama3(text, 1)
+	}
+	return splitGPT2(text)
+}
+
+func isLetter(r rune) bool { return unicode.IsLetter(r) }
+func isNumber(r rune) bool { return unicode.IsNumber(r) }
+func isSpace(r rune) bool  { return unicode.IsSpace(r) }
+
+func isOther(r rune) bool {
+	return !isSpace(r) && !isLetter(r) && !isNumber(r)
+}
+
+// contraction returns the length of an English contraction at the start of
+// s ('s, 't, 're, 've, 'm, 'll, 'd).
+func contraction(s string, foldCase bool) int {
+	if len(s) < 2 || s[0] != '\'' {
+		return 0
+	}
+	rest := s[1:]
+	if foldCase {
+		rest = strings.ToLower(rest[:min(2, len(rest))])
+	}
+	for _, c := range []string{"re", "ve", "ll", "s", "t", "m", "d"} {
+		if strings.HasPrefix(rest, c) {
+			return 1 + len(c)
+		}
+	}
+	return 0
+}
+
+// scanWhile returns the length of the run at the start of s whose runes
+// satisfy fn, limited to max runes when max > 0.
+func scanWhile(s string, fn func(rune) bool, max int) int {
+	n, count := 0, 0
+	for n < len(s) && (max <= 0 || count < max) {
+		r, size := utf8.DecodeRuneInString(s[n:])
+		if !fn(r) {
+			break
+		}
+		n += size
+		count++
+	}
+	return n
+}
+
+// whitespace implements `\s+(?!\S)|\s+`: a run of whitespace, leaving the
+// last character for the next piece when it is followed by non-whitespace.
+func whitespace(s string) int {
+	n := scanWhile(s, isSpace, 0)
+	if n == len(s) {
+		return n
+	}
+	_, lastSize := utf8.DecodeLastRuneInString(s[:n])
+	if n > lastSize {
+		return n - lastSize
+	}
+	return n
+}
+
+// splitGPT2 implements
+// 's|'t|'re|'ve|'m|'ll|'d| ?\p{L}+| ?\p{N}+| ?[^\s\p{L}\p{N}]+|\s+(?!\S)|\s+
+func splitGPT2(text string) []string {
+	var pieces []string
+	for i := 0; i < len(text); {
+		s := text[i:]
+		n := contraction(s, false)
+
+		if n == 0 {
+			off := 0
+			if s[0] == ' ' {
+				off = 1
+			}
+			for _, fn := range []func(rune) bool{isLetter, isNumber, isOther} {
+				if m := scanWhile(s[off:], fn, 0); m > 0 {
+					n = off + m
+					break
+				}
+			}
+		}
+		if n == 0 {
+			n = whitespace(s)
+		}
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(s)
+		}
+
+		pieces = append(pieces, s[:n])
+		i += n
+	}
+	return pieces
+}
+
+// splitLlama3 implements the Llama 3 pre-tokenizer:
+// (?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}|
+// ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+(?!\S)|\s+
+// maxDigits is 3 for Llama 3 and 1 for Qwen 2.
+func splitLlama3(text string, maxDigits int) []string {
+	isNewline := func(r rune) bool { return r == '\r' || r == '\n' }
+
+	var pieces []string
+	for i := 0; i < len(text); {
+		s := text[i:]
+		n := contraction(s, true)
+
+		if n == 0 {
+			r, size := utf8.DecodeRuneInString(s)
+			off := 0
+			if !isNewline(r) && !isLetter(r) && !isNumber(r) {
+				off = size
+			}
+			if m := scanWhile(s[off:], isLetter, 0); m > 0 {
+				n = off + m
+			} else if m := scanWhile(s, isLetter, 0); m > 0 {
+				n = m
+			}
+		}
+		if n == 0 {
+			n = scanWhile(s, isNumber, maxDigits)
+		}
+		if n == 0 {
+			off := 0
+			if s[0] == ' ' {
+				off = 1
+			}
+			if m := scanWhile(s[off:], isOther, 0); m > 0 {
+				n = off + m
+				n += scanWhile(s[n:], isNewline, 0)
+			}
+		}
+		if n == 0 {
+			// \s*[\r\n]+ : whitespace ending in the last newline of the run.
+			ws := scanWhile(s, isSpace, 0)
+			if last := strings.LastIndexAny(s[:ws], "\r\n"); last >= 0 {
+				n = last + 1
+			}
+		}
+		if n == 0 {
+			n = whitespace(s)
+		}
+		if n == 0 {
+			_, n = utf8.DecodeRuneInString(s)
+		}
+
+		pieces = append(pieces, s[:n])
+		i += n
+	}
+	return pieces
+}
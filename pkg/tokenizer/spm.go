@@ -0,0 +1,121 @@
+package tokenizer
+
+import (
+	"container/heap"
+	"strings"
+	"unicode/utf8"
+)
+
+// encodeSPM implements SentencePiece BPE as done by llama.cpp: the text is
+// split into characters, and the adjacent pair whose concatenation has the
+// highest score in the vocabulary is merged until no pair is left.
+// Characters missing from the vocabulary fall back to byte tokens.
+func (t *Tokenizer) encodeSPM(text string, out []int) []int {
+	text = strings.ReplaceAll(text, " ", "▁")
+	if text == "" {
+		return out
+	}
+
+	type symbol struct {
+		text       string
+		prev, next int
+	}
+
+	var symbols []symbol
+	for i := 0; i < len(text); {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		symbols = append(symbols, symbol{
+			text: text[i : i+size],
+			prev: len(symbols) - 1,
+			next: len(symbols) + 1,
+		})
+		i += size
+	}
+	symbols[len(symbols)-1].next = -1
+
+	queue := &bigramQueue{}
+	tryAdd := func(left, right int) {
+		if left < 0 || right < 0 {
+			return
+		}
+		merged := symbols[left].text + symbols[right].text
+		id, ok := t.ids[merged]
+		if !ok {
+			return
+		}
+		var score float32
+		if t.scores != nil {
+			score = t.scores[id]
+		}
+		heap.Push(queue, bigram{left: left, right: right, score: score, size: len(merged)})
+	}
+
+	for i := 1; i < len(symbols); i++ {
+		tryAdd(i-1, i)
+	}
+
+	for queue.Len() > 0 {
+		bg := heap.Pop(queue).(bigram)
+		left, right := &symbols[bg.left], &symbols[bg.right]
+
+		// Skip pairs invalidated by an earlier merge.
+		if left.text == "" || right.text == "" || len(left.text)+len(right.text) != bg.size {
+			continue
+		}
+
+		left.text += right.text
+		right.text = ""
+		left.next = right.next
+		if right.next >= 0 {
+			symbols[right.next].prev = bg.left
+		}
+
+		tryAdd(left.prev, bg.left)
+		tryAdd(bg.left, left.next)
+	}
+
+	for i := 0; i >= 0; i = symbols[i].next {
+		out = t.appendPiece(symbols[i].text, out)
+	}
+	return out
+}
+
+func (t *Tokenizer) appendPiece(piece string, out []int) []int {
+	if id, ok := t.ids[piece]; ok {
+		return append(out, id)
+	}
+	for i := 0; i < len(piece); i++ {
+		if id := t.byteIDs[piece[i]]; id >= 0 {
+			out = append(out, id)
+		} else if t.unkID >= 0 {
+			out = append(out, t.unkID)
+		}
+	}
+	return out
+}
+
+type bigram struct {
+	left, right int
+	score       float32
+	size        int
+}
+
+// bigramQueue orders candidate merges by score, then by position.
+type bigramQueue []bigram
+
+func (q bigramQueue) Len() int { return len(q) }
+func (q bigramQueue) Less(i, j int) bool {
+	if q[i].score != q[j].score {
+		return q[i].score > q[j].score
+	}
+	return q[i].left < q[j].left
+}
+func (q bigramQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *bigramQueue) Push(x any)   { *q = append(*q, x.(bigram)) }
+func (q *bigramQueue) Pop() any {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	*q = old[:n-1]
+	return x
+}
@@ -0,0 +1,222 @@
+package tokenizer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/wmik/picolm-server/pkg/gguf"
+)
+
+// Token types as stored in tokenizer.ggml.token_type.
+const (
+	typeNormal      = 1
+	typeUnknown     = 2
+	typeControl     = 3
+	typeUserDefined = 4
+	typeUnused      = 5
+	typeByte        = 6
+)
+
+const (
+	modelSPM = "llama"
+	modelBPE = "gpt2"
+)
+
+// Tokenizer reproduces the tokenization of a GGUF model from the vocabulary
+// embedded in the file. SentencePiece ("llama") and byte-level BPE ("gpt2")
+// vocabularies are supported.
+type Tokenizer struct {
+	model  string
+	pre    string
+	tokens []string
+	ids    map[string]int
+	scores []float32
+	types  []int32
+	ranks  map[string]int
+
+	special      []string
+	specialFirst [256]bool
+
+	addBOS      bool
+	spacePrefix bool
+	bosID       int
+	unkID       int
+	byteIDs     [256]int
+}
+
+func FromGGUF(f *gguf.File) (*Tokenizer, error) {
+	model, _ := f.String("tokenizer.ggml.model")
+	if model != modelSPM && model != modelBPE {
+		return nil, fmt.Errorf("unsupported tokenizer model %q", model)
+	}
+
+	tokens, ok := f.Strings("tokenizer.ggml.tokens")
+	if !ok || len(tokens) == 0 {
+		return nil, fmt.Errorf("model has no tokenizer vocabulary")
+	}
+
+	t := &Tokenizer{
+		model:       model,
+		tokens:      tokens,
+		ids:         make(map[string]int, len(tokens)),
+		bosID:       -1,
+		unkID:       -1,
+		addBOS:      model == modelSPM,
+		spacePrefix: model == modelSPM,
+	}
+	t.pre, _ = f.String("tokenizer.ggml.pre")
+
+	for i, tok := range tokens {
+		if _, dup := t.ids[tok]; !dup {
+			t.ids[tok] = i
+		}
+	}
+
+	if scores, ok := f.Metadata["tokenizer.ggml.scores"].([]float32); ok && len(scores) == len(tokens) {
+		t.scores = scores
+	}
+	if types, ok := f.Metadata["tokenizer.ggml.token_type"].([]int32); ok && len(types) == len(tokens) {
+		t.types = types
+	}
+
+	if merges, ok := f.Strings("tokenizer.ggml.merges"); ok {
+		t.ranks = make(map[string]int, len(merges))
+		for i, m := range merges {
+			t.ranks[m] = i
+		}
+	}
+	if model == modelBPE && t.ranks == nil {
+		return nil, fmt.Errorf("BPE tokenizer has no merges")
+	}
+
+	if id, ok := f.Uint("tokenizer.ggml.bos_token_id"); ok && int(id) < len(tokens) {
+		t.bosID = int(id)
+	}
+	if id, ok := f.Uint("tokenizer.ggml.unknown_token_id"); ok && int(id) < len(tokens) {
+		t.unkID = int(id)
+	}
+	if v, ok := f.Metadata["tokenizer.ggml.add_bos_token"].(bool); ok {
+		t.addBOS = v
+	}
+	if v, ok := f.Metadata["tokenizer.ggml.add_space_prefix"].(bool); ok {
+		t.spacePrefix = v
+	}
+
+	for b := 0; b < 256; b++ {
+		t.byteIDs[b] = -1
+		if id, ok := t.ids[fmt.Sprintf("<0x%02X>", b)]; ok {
+			t.byteIDs[b] = id
+		}
+	}
+
+	for i, tok := range tokens {
+		if tok == "" || t.types == nil {
+			continue
+		}
+		if typ := t.types[i]; typ == typeControl || typ == typeUserDefined {
+			t.special = append(t.special, tok)
+			t.specialFirst[tok[0]] = true
+		}
+	}
+	// Longest first so that overlapping special tokens match greedily.
+	sort.SliceStable(t.special, func(i, j int) bool {
+		return len(t.special[i]) > len(t.special[j])
+	})
+
+	return t, nil
+}
+
+// Encode tokenizes text. Special tokens written literally in text (such as
+// chat template markers) are mapped to their IDs. A BOS token is prepended
+// when the model requests one and the text does not already start with it.
+func (t *Tokenizer) Encode(text string, addSpecial bool) []int {
+	var out []int
+	if addSpecial && t.addBOS && t.bosID >= 0 && !strings.HasPrefix(text, t.tokens[t.bosID]) {
+		out = append(out, t.bosID)
+	}
+
+	prevSpecial := true
+	for _, frag := range t.splitSpecial(text) {
+		if frag.special {
+			out = append(out, t.ids[frag.text])
+			prevSpecial = true
+			continue
+		}
+
+		switch t.model {
+		case modelSPM:
+			raw := frag.text
+			if t.spacePrefix && prevSpecial {
+				raw = " " + raw
+			}
+			out = t.encodeSPM(raw, out)
+		case modelBPE:
+			out = t.encodeBPE(frag.text, out)
+		}
+		prevSpecial = false
+	}
+
+	return out
+}
+
+// Count returns the number of tokens in text without adding BOS.
+func (t *Tokenizer) Count(text string) int {
+	return len(t.Encode(text, false))
+}
+
+// CountPrompt returns the number of tokens the model sees for a full prompt,
+// including BOS when the model adds one.
+func (t *Tokenizer) CountPrompt(text string) int {
+	return len(t.Encode(text, true))
+}
+
+// TokenID returns the ID of a token string.
+func (t *Tokenizer) TokenID(token string) (int, bool) {
+	id, ok := t.ids[token]
+	return id, ok
+}
+
+// Token returns the string of a token ID.
+func (t *Tokenizer) Token(id int) string {
+	if id < 0 || id >= len(t.tokens) {
+		return ""
+	}
+	return t.tokens[id]
+}
+
+type fragment struct {
+	text    string
+	special bool
+}
+
+// splitSpecial separates special tokens written in text from the surrounding
+// raw text.
+func (t *Tokenizer) splitSpecial(text string) []fragment {
+	if len(t.special) == 0 {
+		return []fragment{{text: text}}
+	}
+
+	var frags []fragment
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if !t.specialFirst[text[i]] {
+			continue
+		}
+		for _, sp := range t.special {
+			if strings.HasPrefix(text[i:], sp) {
+				if i > start {
+					frags = append(frags, fragment{text: text[start:i]})
+				}
+				frags = append(frags, fragment{text: sp, special: true})
+				i += len(sp) - 1
+				start = i + 1
+				break
+			}
+		}
+	}
+	if start < len(text) {
+		frags = append(frags, fragment{text: text[start:]})
+	}
+	return frags
+}
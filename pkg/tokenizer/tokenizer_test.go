@@ -0,0 +1,180 @@
+package tokenizer
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wmik/picolm-server/pkg/gguf"
+)
+
+func spmTokenizer(t *testing.T) *Tokenizer {
+	t.Helper()
+
+	tokens := []string{
+		"<unk>", "<s>", "</s>", "<0x0A>",
+		"▁", "h", "e", "l", "o", "w", "r", "d",
+		"▁h", "▁he", "▁hel", "▁hell", "▁hello",
+		"▁w", "▁wo", "▁wor", "▁worl", "▁world",
+	}
+	types := make([]int32, len(tokens))
+	scores := make([]float32, len(tokens))
+	for i := range tokens {
+		types[i] = typeNormal
+		scores[i] = float32(-i)
+	}
+	types[0] = typeUnknown
+	types[1], types[2] = typeControl, typeControl
+	types[3] = typeByte
+
+	tok, err := FromGGUF(&gguf.File{Metadata: map[string]any{
+		"tokenizer.ggml.model":            "llama",
+		"tokenizer.ggml.tokens":           tokens,
+		"tokenizer.ggml.scores":           scores,
+		"tokenizer.ggml.token_type":       types,
+		"tokenizer.ggml.bos_token_id":     uint32(1),
+		"tokenizer.ggml.unknown_token_id": uint32(0),
+	}})
+	if err != nil {
+		t.Fatalf("FromGGUF() error = %v", err)
+	}
+	return tok
+}
+
+func bpeTokenizer(t *testing.T) *Tokenizer {
+	t.Helper()
+
+	tokens := []string{
+		"<|begin_of_text|>",
+		"h", "e", "l", "o", "Ġ", "w", "r", "d",
+		"he", "ll", "hell", "hello", "Ġw", "or", "Ġwor", "ld", "Ġworld",
+	}
+	types := make([]int32, len(tokens))
+	for i := range types {
+		types[i] = typeNormal
+	}
+	types[0] = typeControl
+
+	tok, err := FromGGUF(&gguf.File{Metadata: map[string]any{
+		"tokenizer.ggml.model":         "gpt2",
+		"tokenizer.ggml.pre":           "llama-bpe",
+		"tokenizer.ggml.tokens":        tokens,
+		"tokenizer.ggml.token_type":    types,
+		"tokenizer.ggml.merges":        []string{"h e", "l l", "he ll", "hell o", "Ġ w", "o r", "Ġw or", "l d", "Ġwor ld"},
+		"tokenizer.ggml.bos_token_id":  uint32(0),
+		"tokenizer.ggml.add_bos_token": true,
+	}})
+	if err != nil {
+		t.Fatalf("FromGGUF() error = %v", err)
+	}
+	return tok
+}
+
+func TestEncode_SPM(t *testing.T) {
+	tok := spmTokenizer(t)
+
+	tests := []struct {
+		name       string
+		text       string
+		addSpecial bool
+		want       []int
+	}{
+		{"words", "hello world", false, []int{16, 21}},
+		{"bos", "hello", true, []int{1, 16}},
+		{"bos not duplicated", "<s>hello", true, []int{1, 16}},
+		{"special token", "hello</s>", false, []int{16, 2}},
+		{"byte fallback", "hello\n", false, []int{16, 3}},
+		{"unknown", "hello!", false, []int{16, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tok.Encode(tt.text, tt.addSpecial); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Encode(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncode_BPE(t *testing.T) {
+	tok := bpeTokenizer(t)
+
+	if got, want := tok.Encode("hello world", true), []int{0, 12, 17}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Encode() = %v, want %v", got, want)
+	}
+	if got := tok.CountPrompt("<|begin_of_text|>hello"); got != 2 {
+		t.Errorf("CountPrompt() = %d, want 2", got)
+	}
+	if got := tok.Count("hello world"); got != 2 {
+		t.Errorf("Count() = %d, want 2", got)
+	}
+
+	// Merges apply by rank, leftmost first among equal ranks.
+	if got, want := tok.Encode("hellllo", false), []int{11, 10, 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Encode(hellllo) = %v, want %v", got, want)
+	}
+	if got, want := tok.Encode("lllll", false), []int{10, 10, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Encode(lllll) = %v, want %v", got, want)
+	}
+
+	// A single long piece is merged without rescanning it after every merge.
+	if got := tok.Count(strings.Repeat("l", 1<<16)); got != 1<<15 {
+		t.Errorf("Count(long piece) = %d, want %d", got, 1<<15)
+	}
+}
+
+func TestFromGGUF_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]any
+	}{
+		{"no tokenizer", map[string]any{}},
+		{"unsupported model", map[string]any{"tokenizer.ggml.model": "bert", "tokenizer.ggml.tokens": []string{"a"}}},
+		{"no vocabulary", map[string]any{"tokenizer.ggml.model": "llama"}},
+		{"bpe without merges", map[string]any{"tokenizer.ggml.model": "gpt2", "tokenizer.ggml.tokens": []string{"a"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := FromGGUF(&gguf.File{Metadata: tt.metadata}); err == nil {
+				t.Error("FromGGUF() expected error")
+			}
+		})
+	}
+}
+
+func TestPretokenize(t *testing.T) {
+	tests := []struct {
+		name  string
+		split func(string) []string
+		text  string
+		want  []string
+	}{
+		{
+			name:  "gpt2",
+			split: splitGPT2,
+			text:  "Hello world  123!! I'm",
+			want:  []string{"Hello", " world", " ", " 123", "!!", " I", "'m"},
+		},
+		{
+			name:  "llama3",
+			split: func(s string) []string { return splitLlama3(s, 3) },
+			text:  "Hello world 12345\n\nI'M",
+			want:  []string{"Hello", " world", " ", "123", "45", "\n\n", "I", "'M"},
+		},
+		{
+			name:  "qwen2",
+			split: func(s string) []string { return splitLlama3(s, 1) },
+			text:  "x42",
+			want:  []string{"x", "4", "2"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.split(tt.text); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("split(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
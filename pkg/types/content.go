@@ -0,0 +1,95 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+type ContentPart struct {
+	Type       string          `json:"type"`
+	Text       string          `json:"text,omitempty"`
+	ImageURL   json.RawMessage `json:"image_url,omitempty"`
+	InputAudio json.RawMessage `json:"input_audio,omitempty"`
+	File       json.RawMessage `json:"file,omitempty"`
+}
+
+// MessageContent is the content of a chat message. Clients may send it either
+// as a plain string or as an array of content parts; it is written back in
+// the form it was received.
+type MessageContent struct {
+	Text  string
+	Parts []ContentPart
+}
+
+func TextContent(text string) MessageContent {
+	return MessageContent{Text: text}
+}
+
+// String returns the text of the content, concatenating text parts.
+func (c MessageContent) String() string {
+	if c.Parts == nil {
+		return c.Text
+	}
+	texts := make([]string, 0, len(c.Parts))
+	for _, p := range c.Parts {
+		if p.Type == "text" {
+			texts = append(texts, p.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
+
+func (c MessageContent) MarshalJSON() ([]byte, error) {
+	if c.Parts != nil {
+		return json.Marshal(c.Parts)
+	}
+	return json.Marshal(c.Text)
+}
+
+func (c *MessageContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*c = MessageContent{}
+		return nil
+	case len(data) > 0 && data[0] == '"':
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*c = MessageContent{Text: text}
+		return nil
+	}
+
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+	for i, p := range parts {
+		if p.Type != "text" {
+			return &UnsupportedContentError{Type: p.Type, Index: i}
+		}
+	}
+	if parts == nil {
+		parts = []ContentPart{}
+	}
+	*c = MessageContent{Parts: parts}
+	return nil
+}
+
+// UnsupportedContentError is returned when a message contains a content part
+// the server cannot process.
+type UnsupportedContentError struct {
+	Type  string
+	Index int
+}
+
+func (e *UnsupportedContentError) Error() string {
+	if e.Type == "" {
+		return fmt.Sprintf("content part %d is missing a type", e.Index)
+	}
+	return fmt.Sprintf("unsupported content part type %q at index %d: only \"text\" parts are supported", e.Type, e.Index)
+}
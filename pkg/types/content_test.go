@@ -0,0 +1,104 @@
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestMessageContent_UnmarshalString(t *testing.T) {
+	var msg ChatMessage
+	if err := json.Unmarshal([]byte(`{"role":"user","content":"Hello"}`), &msg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if msg.Content.String() != "Hello" {
+		t.Errorf("Content = %q, want %q", msg.Content.String(), "Hello")
+	}
+}
+
+func TestMessageContent_UnmarshalParts(t *testing.T) {
+	var msg ChatMessage
+	data := `{"role":"user","content":[{"type":"text","text":"Hello"},{"type":"text","text":"world"}]}`
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(msg.Content.Parts) != 2 {
+		t.Fatalf("Parts = %d, want 2", len(msg.Content.Parts))
+	}
+	if msg.Content.String() != "Hello\nworld" {
+		t.Errorf("String() = %q, want %q", msg.Content.String(), "Hello\nworld")
+	}
+}
+
+func TestMessageContent_UnmarshalNull(t *testing.T) {
+	var msg ChatMessage
+	if err := json.Unmarshal([]byte(`{"role":"assistant","content":null}`), &msg); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if msg.Content.String() != "" {
+		t.Errorf("Content = %q, want empty", msg.Content.String())
+	}
+}
+
+func TestMessageContent_UnsupportedPart(t *testing.T) {
+	tests := []struct {
+		data     string
+		wantType string
+	}{
+		{`[{"type":"image_url","image_url":{"url":"https://example.com/a.png"}}]`, "image_url"},
+		{`[{"type":"text","text":"hi"},{"type":"input_audio","input_audio":{"data":"...","format":"wav"}}]`, "input_audio"},
+		{`[{"type":"file","file":{"file_id":"file-1"}}]`, "file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.wantType, func(t *testing.T) {
+			var c MessageContent
+			err := json.Unmarshal([]byte(tt.data), &c)
+
+			var cerr *UnsupportedContentError
+			if !errors.As(err, &cerr) {
+				t.Fatalf("Unmarshal() error = %v, want UnsupportedContentError", err)
+			}
+			if cerr.Type != tt.wantType {
+				t.Errorf("Type = %q, want %q", cerr.Type, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestMessageContent_RoundTrip(t *testing.T) {
+	for _, data := range []string{
+		`"Hello"`,
+		`[{"type":"text","text":"Hello"}]`,
+		`""`,
+	} {
+		var c MessageContent
+		if err := json.Unmarshal([]byte(data), &c); err != nil {
+			t.Fatalf("Unmarshal(%s) error = %v", data, err)
+		}
+		out, err := json.Marshal(c)
+		if err != nil {
+			t.Fatalf("Marshal() error = %v", err)
+		}
+		if string(out) != data {
+			t.Errorf("round trip of %s = %s", data, out)
+		}
+	}
+}
+
+func TestStopSequences_Unmarshal(t *testing.T) {
+	var req ChatCompletionRequest
+	if err := json.Unmarshal([]byte(`{"stop":"END"}`), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(req.Stop) != 1 || req.Stop[0] != "END" {
+		t.Errorf("Stop = %v, want [END]", req.Stop)
+	}
+
+	if err := json.Unmarshal([]byte(`{"stop":["a","b"]}`), &req); err != nil {
+		t.Fatalf("Unmarshal() error = %v", err)
+	}
+	if len(req.Stop) != 2 {
+		t.Errorf("Stop = %v, want [a b]", req.Stop)
+	}
+}
@@ -0,0 +1,18 @@
+package types
+
+import "encoding/json"
+
+// Job is a chat completion run in the background. Status moves from queued
+// to in_progress and then to completed or failed. StatusCode and either
+// Result or Error are set once the job has finished.
+type Job struct {
+	ID          string          `json:"id"`
+	Object      string          `json:"object"`
+	Status      string          `json:"status"`
+	CreatedAt   int64           `json:"created_at"`
+	StartedAt   *int64          `json:"started_at"`
+	CompletedAt *int64          `json:"completed_at"`
+	StatusCode  int             `json:"status_code,omitempty"`
+	Result      json.RawMessage `json:"result,omitempty"`
+	Error       *ErrorDetail    `json:"error,omitempty"`
+}
@@ -0,0 +1,126 @@
+package types
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// OllamaChatRequest is an Ollama /api/chat request. Stream defaults to true
+// when it is omitted.
+type OllamaChatRequest struct {
+	Model    string           `json:"model"`
+	Messages []OllamaMessage  `json:"messages"`
+	Tools    []ToolDefinition `json:"tools,omitempty"`
+	Format   json.RawMessage  `json:"format,omitempty"`
+	Options  *OllamaOptions   `json:"options,omitempty"`
+	Stream   *bool            `json:"stream,omitempty"`
+}
+
+// OllamaGenerateRequest is an Ollama /api/generate request. Raw prompts and
+// prompts with a suffix are completed without a chat template.
+type OllamaGenerateRequest struct {
+	Model   string          `json:"model"`
+	Prompt  string          `json:"prompt"`
+	Suffix  string          `json:"suffix,omitempty"`
+	System  string          `json:"system,omitempty"`
+	Format  json.RawMessage `json:"format,omitempty"`
+	Options *OllamaOptions  `json:"options,omitempty"`
+	Stream  *bool           `json:"stream,omitempty"`
+	Raw     bool            `json:"raw,omitempty"`
+	Images  []string        `json:"images,omitempty"`
+}
+
+// OllamaOptions holds the model options picolm supports. Other Ollama
+// options are accepted and ignored.
+type OllamaOptions struct {
+	Temperature float64  `json:"temperature,omitempty"`
+	TopP        float64  `json:"top_p,omitempty"`
+	NumPredict  int      `json:"num_predict,omitempty"`
+	Stop        []string `json:"stop,omitempty"`
+}
+
+type OllamaMessage struct {
+	Role      string           `json:"role"`
+	Content   string           `json:"content"`
+	Images    []string         `json:"images,omitempty"`
+	ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+	ToolName  string           `json:"tool_name,omitempty"`
+}
+
+type OllamaToolCall struct {
+	Function OllamaToolCallFunction `json:"function"`
+}
+
+type OllamaToolCallFunction struct {
+	Name      string          `json:"name"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type OllamaChatResponse struct {
+	Model      string         `json:"model"`
+	CreatedAt  time.Time      `json:"created_at"`
+	Message    *OllamaMessage `json:"message,omitempty"`
+	Done       bool           `json:"done"`
+	DoneReason string         `json:"done_reason,omitempty"`
+	OllamaMetrics
+}
+
+type OllamaGenerateResponse struct {
+	Model      string    `json:"model"`
+	CreatedAt  time.Time `json:"created_at"`
+	Response   string    `json:"response"`
+	Done       bool      `json:"done"`
+	DoneReason string    `json:"done_reason,omitempty"`
+	OllamaMetrics
+}
+
+// OllamaMetrics reports token counts and durations, in nanoseconds, on the
+// final response.
+type OllamaMetrics struct {
+	TotalDuration   int64 `json:"total_duration,omitempty"`
+	PromptEvalCount int   `json:"prompt_eval_count,omitempty"`
+	EvalCount       int   `json:"eval_count,omitempty"`
+	EvalDuration    int64 `json:"eval_duration,omitempty"`
+}
+
+type OllamaModelList struct {
+	Models []OllamaModel `json:"models"`
+}
+
+type OllamaModel struct {
+	Name       string             `json:"name"`
+	Model      string             `json:"model"`
+	ModifiedAt time.Time          `json:"modified_at"`
+	Size       int64              `json:"size"`
+	Digest     string             `json:"digest"`
+	Details    OllamaModelDetails `json:"details"`
+}
+
+type OllamaModelDetails struct {
+	ParentModel       string   `json:"parent_model"`
+	Format            string   `json:"format"`
+	Family            string   `json:"family"`
+	Families          []string `json:"families"`
+	ParameterSize     string   `json:"parameter_size"`
+	QuantizationLevel string   `json:"quantization_level"`
+}
+
+// OllamaShowRequest names a model by model, or by name as older clients do.
+type OllamaShowRequest struct {
+	Model string `json:"model"`
+	Name  string `json:"name"`
+}
+
+type OllamaShowResponse struct {
+	Modelfile    string             `json:"modelfile"`
+	Parameters   string             `json:"parameters"`
+	Template     string             `json:"template"`
+	Details      OllamaModelDetails `json:"details"`
+	ModelInfo    map[string]any     `json:"model_info"`
+	Capabilities []string           `json:"capabilities"`
+	ModifiedAt   time.Time          `json:"modified_at"`
+}
+
+type OllamaErrorResponse struct {
+	Error string `json:"error"`
+}
@@ -1,25 +1,88 @@
 package types
 
+import (
+	"encoding/json"
+	"fmt"
+)
+
 type ChatCompletionRequest struct {
-	Model       string           `json:"model"`
-	Messages    []ChatMessage    `json:"messages"`
-	Temperature float64          `json:"temperature,omitempty"`
-	TopP        float64          `json:"top_p,omitempty"`
-	MaxTokens   int              `json:"max_tokens,omitempty"`
-	N           int              `json:"n,omitempty"`
-	Stream      bool             `json:"stream,omitempty"`
-	Stop        []string         `json:"stop,omitempty"`
-	Tools       []ToolDefinition `json:"tools,omitempty"`
-	ToolChoice  any              `json:"tool_choice,omitempty"`
-	User        string           `json:"user,omitempty"`
+	Model         string           `json:"model"`
+	Messages      []ChatMessage    `json:"messages"`
+	Temperature   float64          `json:"temperature,omitempty"`
+	TopP          float64          `json:"top_p,omitempty"`
+	MaxTokens     int              `json:"max_tokens,omitempty"`
+	N             int              `json:"n,omitempty"`
+	Stream        bool             `json:"stream,omitempty"`
+	StreamOptions *StreamOptions   `json:"stream_options,omitempty"`
+	Stop          StopSequences    `json:"stop,omitempty"`
+	Tools         []ToolDefinition `json:"tools,omitempty"`
+	ToolChoice    any              `json:"tool_choice,omitempty"`
+	User          string           `json:"user,omitempty"`
+	Truncation    string           `json:"truncation,omitempty"`
+
+	// ReserveMaxTokens overrides the model's reserve_max_tokens option for
+	// this request.
+	ReserveMaxTokens *bool `json:"reserve_max_tokens,omitempty"`
+
+	ParallelToolCalls *bool           `json:"parallel_tool_calls,omitempty"`
+	ResponseFormat    *ResponseFormat `json:"response_format,omitempty"`
+
+	// Store keeps the request and its response for later retrieval, tagged
+	// with Metadata.
+	Store    bool              `json:"store,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Background runs the request as a job and responds with 202 at once.
+	Background bool `json:"background,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage,omitempty"`
+}
+
+// ResponseFormat constrains the assistant's reply to plain text, any JSON
+// object, or JSON matching a schema.
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+	Strict     bool              `json:"strict,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name        string         `json:"name,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      bool           `json:"strict,omitempty"`
+}
+
+// StopSequences accepts either a single string or an array of strings.
+type StopSequences []string
+
+func (s *StopSequences) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*s = nil
+		} else {
+			*s = StopSequences{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
 }
 
 type ChatMessage struct {
-	Role       string     `json:"role"`
-	Content    string     `json:"content"`
-	Name       string     `json:"name,omitempty"`
-	ToolCallID string     `json:"tool_call_id,omitempty"`
-	ToolCalls  []ToolCall `json:"tool_calls,omitempty"`
+	Role       string         `json:"role"`
+	Content    MessageContent `json:"content"`
+	Name       string         `json:"name,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+	ToolCalls  []ToolCall     `json:"tool_calls,omitempty"`
 }
 
 type ToolDefinition struct {
@@ -44,13 +107,35 @@ type CallFunction struct {
 	Arguments string `json:"arguments"`
 }
 
+// ToolCallDelta is a fragment of a tool call in a streamed response. The
+// first delta of a call carries its ID, type and function name; later deltas
+// append to its arguments.
+type ToolCallDelta struct {
+	Index    int               `json:"index"`
+	ID       string            `json:"id,omitempty"`
+	Type     string            `json:"type,omitempty"`
+	Function CallFunctionDelta `json:"function"`
+}
+
+type CallFunctionDelta struct {
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments"`
+}
+
 type ChatCompletionResponse struct {
-	ID      string   `json:"id"`
-	Object  string   `json:"object"`
-	Created int64    `json:"created"`
-	Model   string   `json:"model"`
-	Choices []Choice `json:"choices"`
-	Usage   Usage    `json:"usage"`
+	ID       string            `json:"id"`
+	Object   string            `json:"object"`
+	Created  int64             `json:"created"`
+	Model    string            `json:"model"`
+	Choices  []Choice          `json:"choices"`
+	Usage    Usage             `json:"usage"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// ChatCompletionMessage is a message of a stored chat completion's request.
+type ChatCompletionMessage struct {
+	ID string `json:"id"`
+	ChatMessage
 }
 
 type Choice struct {
@@ -66,13 +151,27 @@ type Usage struct {
 }
 
 type Model struct {
-	ID          string `json:"id"`
-	Object      string `json:"object"`
-	Created     int    `json:"created"`
-	OwnedBy     string `json:"owned_by"`
-	Permission  []any  `json:"permission"`
-	Root        string `json:"root"`
-	ParentModel string `json:"parent_model,omitempty"`
+	ID          string         `json:"id"`
+	Object      string         `json:"object"`
+	Created     int            `json:"created"`
+	OwnedBy     string         `json:"owned_by"`
+	Permission  []any          `json:"permission"`
+	Root        string         `json:"root"`
+	ParentModel string         `json:"parent_model,omitempty"`
+	Metadata    *ModelMetadata `json:"metadata,omitempty"`
+}
+
+type ModelMetadata struct {
+	Architecture   string `json:"architecture,omitempty"`
+	Name           string `json:"name,omitempty"`
+	ParameterCount uint64 `json:"parameter_count,omitempty"`
+	Quantization   string `json:"quantization,omitempty"`
+	ContextLength  int    `json:"context_length,omitempty"`
+	BOSToken       string `json:"bos_token,omitempty"`
+	EOSToken       string `json:"eos_token,omitempty"`
+	ChatTemplate   string `json:"chat_template,omitempty"`
+	Template       string `json:"template,omitempty"`
+	FileSize       int64  `json:"file_size,omitempty"`
 }
 
 type ModelList struct {
@@ -80,6 +179,23 @@ type ModelList struct {
 	Data   []Model `json:"data"`
 }
 
+// CursorList is a page of stored objects. The next page starts after
+// LastID.
+type CursorList[T any] struct {
+	Object  string `json:"object"`
+	Data    []T    `json:"data"`
+	FirstID string `json:"first_id"`
+	LastID  string `json:"last_id"`
+	HasMore bool   `json:"has_more"`
+}
+
+// DeletedObject confirms that a stored object was deleted.
+type DeletedObject struct {
+	ID      string `json:"id"`
+	Object  string `json:"object"`
+	Deleted bool   `json:"deleted"`
+}
+
 type ErrorResponse struct {
 	Error ErrorDetail `json:"error"`
 }
@@ -87,5 +203,60 @@ type ErrorResponse struct {
 type ErrorDetail struct {
 	Message string `json:"message"`
 	Type    string `json:"type"`
+	Param   string `json:"param,omitempty"`
 	Code    string `json:"code,omitempty"`
 }
+
+// CompletionRequest is a legacy text completion request.
+type CompletionRequest struct {
+	Model         string           `json:"model"`
+	Prompt        CompletionPrompt `json:"prompt"`
+	Suffix        string           `json:"suffix,omitempty"`
+	MaxTokens     int              `json:"max_tokens,omitempty"`
+	Temperature   float64          `json:"temperature,omitempty"`
+	TopP          float64          `json:"top_p,omitempty"`
+	N             int              `json:"n,omitempty"`
+	Stream        bool             `json:"stream,omitempty"`
+	StreamOptions *StreamOptions   `json:"stream_options,omitempty"`
+	Echo          bool             `json:"echo,omitempty"`
+	Stop          StopSequences    `json:"stop,omitempty"`
+	User          string           `json:"user,omitempty"`
+
+	// ReserveMaxTokens overrides the model's reserve_max_tokens option for
+	// this request.
+	ReserveMaxTokens *bool `json:"reserve_max_tokens,omitempty"`
+}
+
+// CompletionPrompt accepts either a single string or an array of strings.
+type CompletionPrompt []string
+
+func (p *CompletionPrompt) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*p = CompletionPrompt{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("prompt must be a string or an array of strings")
+	}
+	*p = list
+	return nil
+}
+
+type CompletionResponse struct {
+	ID      string             `json:"id"`
+	Object  string             `json:"object"`
+	Created int64              `json:"created"`
+	Model   string             `json:"model"`
+	Choices []CompletionChoice `json:"choices"`
+	Usage   *Usage             `json:"usage,omitempty"`
+}
+
+type CompletionChoice struct {
+	Text         string  `json:"text"`
+	Index        int     `json:"index"`
+	Logprobs     any     `json:"logprobs"`
+	FinishReason *string `json:"finish_reason"`
+}
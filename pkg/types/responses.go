@@ -0,0 +1,158 @@
+package types
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// ResponseRequest is an OpenAI Responses API request. Store defaults to true
+// when it is omitted.
+type ResponseRequest struct {
+	Model              string            `json:"model"`
+	Input              ResponseInput     `json:"input"`
+	Instructions       string            `json:"instructions,omitempty"`
+	PreviousResponseID string            `json:"previous_response_id,omitempty"`
+	MaxOutputTokens    int               `json:"max_output_tokens,omitempty"`
+	Temperature        float64           `json:"temperature,omitempty"`
+	TopP               float64           `json:"top_p,omitempty"`
+	Stream             bool              `json:"stream,omitempty"`
+	Store              *bool             `json:"store,omitempty"`
+	Tools              []ResponseTool    `json:"tools,omitempty"`
+	ToolChoice         any               `json:"tool_choice,omitempty"`
+	ParallelToolCalls  *bool             `json:"parallel_tool_calls,omitempty"`
+	Text               *ResponseText     `json:"text,omitempty"`
+	Metadata           map[string]string `json:"metadata,omitempty"`
+	User               string            `json:"user,omitempty"`
+}
+
+// ResponseInput accepts either a plain string, read as a single user
+// message, or an array of input items.
+type ResponseInput []ResponseItem
+
+func (in *ResponseInput) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*in = ResponseInput{{
+			Type:    "message",
+			Role:    "user",
+			Content: ResponseContent{{Type: "input_text", Text: text}},
+		}}
+		return nil
+	}
+
+	var items []ResponseItem
+	if err := json.Unmarshal(data, &items); err != nil {
+		return fmt.Errorf("input must be a string or an array of items: %w", err)
+	}
+	*in = items
+	return nil
+}
+
+// ResponseItem is an input or output item. Only the fields of its type are
+// set: messages have a role and content, function calls a call ID, name and
+// arguments, and function call outputs a call ID and output.
+type ResponseItem struct {
+	Type   string `json:"type,omitempty"`
+	ID     string `json:"id,omitempty"`
+	Status string `json:"status,omitempty"`
+
+	Role    string          `json:"role,omitempty"`
+	Content ResponseContent `json:"content,omitempty"`
+
+	CallID    string `json:"call_id,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Arguments string `json:"arguments,omitempty"`
+	Output    string `json:"output,omitempty"`
+}
+
+// ResponseContent accepts either a plain string, read as a single
+// input_text part, or an array of content parts.
+type ResponseContent []ResponseContentPart
+
+func (c *ResponseContent) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var text string
+		if err := json.Unmarshal(data, &text); err != nil {
+			return err
+		}
+		*c = ResponseContent{{Type: "input_text", Text: text}}
+		return nil
+	}
+
+	var parts []ResponseContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+	*c = parts
+	return nil
+}
+
+type ResponseContentPart struct {
+	Type        string          `json:"type"`
+	Text        string          `json:"text"`
+	Annotations json.RawMessage `json:"annotations,omitempty"`
+}
+
+type ResponseTool struct {
+	Type        string         `json:"type"`
+	Name        string         `json:"name"`
+	Description string         `json:"description,omitempty"`
+	Parameters  map[string]any `json:"parameters,omitempty"`
+	Strict      *bool          `json:"strict,omitempty"`
+}
+
+type ResponseText struct {
+	Format *ResponseTextFormat `json:"format,omitempty"`
+}
+
+type ResponseTextFormat struct {
+	Type        string         `json:"type"`
+	Name        string         `json:"name,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Schema      map[string]any `json:"schema,omitempty"`
+	Strict      bool           `json:"strict,omitempty"`
+}
+
+type Response struct {
+	ID                 string             `json:"id"`
+	Object             string             `json:"object"`
+	CreatedAt          int64              `json:"created_at"`
+	Status             string             `json:"status"`
+	Model              string             `json:"model"`
+	Output             []ResponseItem     `json:"output"`
+	Usage              *ResponseUsage     `json:"usage"`
+	Error              *ResponseError     `json:"error"`
+	IncompleteDetails  *IncompleteDetails `json:"incomplete_details"`
+	Instructions       string             `json:"instructions,omitempty"`
+	PreviousResponseID string             `json:"previous_response_id,omitempty"`
+	MaxOutputTokens    int                `json:"max_output_tokens,omitempty"`
+	Temperature        float64            `json:"temperature,omitempty"`
+	TopP               float64            `json:"top_p,omitempty"`
+	Tools              []ResponseTool     `json:"tools"`
+	ToolChoice         any                `json:"tool_choice"`
+	ParallelToolCalls  bool               `json:"parallel_tool_calls"`
+	Text               *ResponseText      `json:"text,omitempty"`
+	Metadata           map[string]string  `json:"metadata"`
+	Store              bool               `json:"store"`
+}
+
+type ResponseUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+	TotalTokens  int `json:"total_tokens"`
+}
+
+type ResponseError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type IncompleteDetails struct {
+	Reason string `json:"reason"`
+}